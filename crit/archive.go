@@ -0,0 +1,291 @@
+package crit
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readerAtCloser is a file which supports random access
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Helper to open a file of fsys for random access. Files
+// which implement io.ReaderAt, such as the files of os.DirFS,
+// fstest.MapFS or NewTarFS(), are used directly. Other files,
+// such as members of a zip archive, are read sequentially and
+// reopened whenever an earlier offset is requested.
+func openReaderAt(fsys fs.FS, name string) (readerAtCloser, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if ra, ok := f.(readerAtCloser); ok {
+		return ra, nil
+	}
+	return &sequentialReaderAt{fsys: fsys, name: name, f: f}, nil
+}
+
+// sequentialReaderAt implements io.ReaderAt
+// for files which can only be read in order
+type sequentialReaderAt struct {
+	fsys   fs.FS
+	name   string
+	mutex  sync.Mutex
+	f      fs.File
+	offset int64
+}
+
+func (r *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if seeker, ok := r.f.(io.Seeker); ok {
+		if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.offset = off
+	} else if off < r.offset {
+		f, err := r.fsys.Open(r.name)
+		if err != nil {
+			return 0, err
+		}
+		r.f.Close()
+		r.f = f
+		r.offset = 0
+	}
+
+	if off > r.offset {
+		n, err := io.CopyN(io.Discard, r.f, off-r.offset)
+		r.offset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(r.f, p)
+	r.offset += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *sequentialReaderAt) Close() error {
+	return r.f.Close()
+}
+
+// tarFS is a read-only file system for a tar archive
+type tarFS struct {
+	r       io.ReaderAt
+	entries map[string]*tarEntry
+}
+
+// tarEntry is a regular file or a directory of a tar archive
+type tarEntry struct {
+	info fs.FileInfo
+	// Position of the file contents in the archive
+	offset int64
+	// Entries of a directory, sorted by name
+	children []fs.DirEntry
+}
+
+// NewTarFS returns a read-only file system for the uncompressed
+// tar archive in r, which is size bytes long. Only the headers
+// are read when the archive is opened, the contents of the files
+// are read from r on demand. This allows to open checkpoints
+// stored as archives with OpenCheckpointFS() without extracting
+// them. Links and special files of the archive are ignored.
+func NewTarFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	tfs := &tarFS{
+		r:       r,
+		entries: map[string]*tarEntry{".": {info: tarDirInfo(".")}},
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("error reading tar archive: %w", err)
+		}
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if !fs.ValidPath(name) {
+			continue
+		}
+
+		info := hdr.FileInfo()
+		switch {
+		case info.IsDir():
+			if entry, ok := tfs.entries[name]; ok && entry.info.IsDir() {
+				entry.info = info
+				continue
+			}
+			tfs.entries[name] = &tarEntry{info: info}
+		case info.Mode().IsRegular() && name != ".":
+			if hdr.Typeflag == tar.TypeGNUSparse {
+				return nil, fmt.Errorf("sparse file %s in tar archive is not supported", hdr.Name)
+			}
+			// The tar reader does not read ahead,
+			// so the contents start at its position
+			offset, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			if offset+info.Size() > size {
+				return nil, fmt.Errorf("file %s in tar archive is truncated", hdr.Name)
+			}
+			tfs.entries[name] = &tarEntry{info: info, offset: offset}
+		default:
+			continue
+		}
+
+		// Create the parents of the entry if they
+		// are not part of the archive themselves
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			if _, ok := tfs.entries[dir]; ok {
+				break
+			}
+			tfs.entries[dir] = &tarEntry{info: tarDirInfo(dir)}
+		}
+	}
+
+	for name, entry := range tfs.entries {
+		if name == "." {
+			continue
+		}
+		parent := tfs.entries[path.Dir(name)]
+		if !parent.info.IsDir() {
+			return nil, fmt.Errorf("parent of %s in tar archive is not a directory", name)
+		}
+		parent.children = append(parent.children, fs.FileInfoToDirEntry(renamedInfo{entry.info, path.Base(name)}))
+	}
+	for _, entry := range tfs.entries {
+		sort.Slice(entry.children, func(i, j int) bool {
+			return entry.children[i].Name() < entry.children[j].Name()
+		})
+	}
+
+	return tfs, nil
+}
+
+// Open opens the named file or directory of the archive
+func (tfs *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := tfs.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	info := renamedInfo{entry.info, path.Base(name)}
+	if info.IsDir() {
+		return &tarDir{info: info, children: entry.children}, nil
+	}
+	return &tarFile{
+		SectionReader: io.NewSectionReader(tfs.r, entry.offset, info.Size()),
+		info:          info,
+	}, nil
+}
+
+// tarFile is an open regular file of a tar archive
+type tarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+// tarDir is an open directory of a tar archive
+type tarDir struct {
+	info     fs.FileInfo
+	children []fs.DirEntry
+	offset   int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) Close() error {
+	return nil
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	children := d.children[d.offset:]
+	if n > 0 {
+		if len(children) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(children) {
+			children = children[:n]
+		}
+	}
+	d.offset += len(children)
+	return children, nil
+}
+
+// renamedInfo overrides the name of a file, as the names
+// in tar headers may differ from the cleaned path
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i renamedInfo) Name() string {
+	return i.name
+}
+
+// tarDirInfo describes a directory which is not part of
+// a tar archive but contains some of its entries
+type tarDirInfo string
+
+func (i tarDirInfo) Name() string {
+	return path.Base(string(i))
+}
+
+func (i tarDirInfo) Size() int64 {
+	return 0
+}
+
+func (i tarDirInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0o555
+}
+
+func (i tarDirInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i tarDirInfo) IsDir() bool {
+	return true
+}
+
+func (i tarDirInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,159 @@
+package crit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeTestMemory is a helper to add the memory of process 1 to
+// a checkpoint, with two pages mapped at 0x1000 and one at 0x5000
+func writeTestMemory(t *testing.T, dir string) []byte {
+	t.Helper()
+	writeTestImg(t, dir, "pagemap-1.img", "PAGEMAP",
+		&pagemap.PagemapHead{PagesId: proto.Uint32(1)},
+		&pagemap.PagemapEntry{Vaddr: proto.Uint64(0x1000), NrPages: proto.Uint32(2)},
+		&pagemap.PagemapEntry{Vaddr: proto.Uint64(0x5000), NrPages: proto.Uint32(1)},
+	)
+	pages := make([]byte, 3*0x1000)
+	for i := range pages {
+		pages[i] = byte(i / 0x1000)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pages-1.img"), pages, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return pages
+}
+
+// Helper to archive the files of dir under prefix
+func archiveTestDir(t *testing.T, dir, prefix string, zipped bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	zw := zip.NewWriter(&buf)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := prefix + entry.Name()
+		if zipped {
+			w, err := zw.Create(name)
+			if err == nil {
+				_, err = w.Write(data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))})
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if zipped {
+		err = zw.Close()
+	} else {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Helper to check the explore and memory functionality
+// of a checkpoint created by writeTestFds and writeTestMemory
+func checkTestCheckpoint(t *testing.T, c *Checkpoint, pages []byte) {
+	t.Helper()
+	fds, err := c.ExploreFds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 1 || fds[0].Files[0].Path != "/a" {
+		t.Errorf("unexpected fds %+v", fds)
+	}
+
+	mr, err := c.MemoryReader(1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read backwards to check random access
+	for _, addr := range []uint64{0x5000, 0x1800} {
+		buf, err := mr.GetMemPages(addr, addr+0x1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := pages[0x2000:0x3000]
+		if addr == 0x1800 {
+			want = pages[0x800:0x1800]
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("unexpected memory at 0x%x", addr)
+		}
+	}
+}
+
+func TestTarFS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFds(t, dir, "/a")
+	pages := writeTestMemory(t, dir)
+
+	archive := archiveTestDir(t, dir, "./checkpoint/", false)
+	fsys, err := NewTarFS(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "checkpoint/files.img", "checkpoint/pages-1.img"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(fsys, "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenCheckpointFS(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestCheckpoint(t, c, pages)
+
+	if _, err := NewTarFS(bytes.NewReader(archive), int64(len(archive))-4096); err == nil {
+		t.Error("expected error for truncated archive")
+	}
+}
+
+func TestZipCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFds(t, dir, "/a")
+	pages := writeTestMemory(t, dir)
+
+	archive := archiveTestDir(t, dir, "", true)
+	fsys, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenCheckpointFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestCheckpoint(t, c, pages)
+}
@@ -0,0 +1,484 @@
+package crit
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+)
+
+// Default maximum number of frames of a backtrace
+const defaultMaxFrames = 256
+
+// STT_GNU_IFUNC, which debug/elf only defines since Go 1.23
+const sttGNUIFunc elf.SymType = 10
+
+// BacktraceOptions are the options used to unwind the stacks of threads
+type BacktraceOptions struct {
+	// Directory in which the files mapped by the processes
+	// are looked up. The root directory is used by default.
+	Sysroot string
+	// Page size of the checkpoint, where 0
+	// uses the page size of the host
+	PageSize int
+	// Maximum number of frames of a thread,
+	// where 0 selects a default of 256 frames
+	MaxFrames int
+}
+
+// Backtrace is the call stack of a single thread
+type Backtrace struct {
+	PID    uint32        `json:"pid"`
+	TID    uint32        `json:"tid"`
+	Comm   string        `json:"comm"`
+	Frames []*StackFrame `json:"frames"`
+	// Reason why the stack could not be unwound completely
+	Error string `json:"error,omitempty"`
+}
+
+// StackFrame is a frame of a call stack. Function is
+// empty if the address could not be symbolized, and
+// Object is the file mapped at the address, if any.
+type StackFrame struct {
+	PC       uint64 `json:"pc"`
+	Function string `json:"function,omitempty"`
+	Offset   uint64 `json:"offset,omitempty"`
+	Object   string `json:"object,omitempty"`
+}
+
+// unwindRegs maps the names of the registers of an
+// architecture to their DWARF numbers, where sp and
+// fp are the numbers of the stack and frame pointer
+type unwindRegs struct {
+	dwarf  map[string]uint64
+	sp, fp uint64
+}
+
+var unwindArchs = map[string]*unwindRegs{
+	"x86_64": {
+		dwarf: map[string]uint64{
+			"ax": 0, "dx": 1, "cx": 2, "bx": 3, "si": 4, "di": 5, "bp": 6, "sp": 7,
+			"r8": 8, "r9": 9, "r10": 10, "r11": 11, "r12": 12, "r13": 13, "r14": 14, "r15": 15,
+			"ip": 16,
+		},
+		sp: 7,
+		fp: 6,
+	},
+	"aarch64": {dwarf: aarch64DwarfRegs(), sp: 31, fp: 29},
+}
+
+// Helper to get the DWARF numbers of the registers of aarch64
+func aarch64DwarfRegs() map[string]uint64 {
+	regs := map[string]uint64{"sp": 31}
+	for i := uint64(0); i <= 30; i++ {
+		regs[fmt.Sprintf("x%d", i)] = i
+	}
+	return regs
+}
+
+// btMapping is a memory mapping used to symbolize addresses
+type btMapping struct {
+	start, end, pgoff uint64
+	name              string
+	module            *elfModule
+}
+
+// elfModule holds the symbols and the call frame
+// information of an ELF file mapped by a process
+type elfModule struct {
+	// Reason why the file cannot be used
+	err     error
+	order   binary.ByteOrder
+	ptrSize int
+	loads   []*elf.ProgHeader
+	// Functions sorted by address
+	symbols []elf.Symbol
+	eh      *ehFrame
+}
+
+// Backtraces unwinds the stacks of all threads from their registers
+// and memory, using the call frame information of .eh_frame where
+// available and frame pointers otherwise. Addresses are symbolized
+// with the ELF files mapped by the processes, which are read from
+// the sysroot of the options and must match the build-IDs recorded
+// in the checkpoint. Only x86_64 and aarch64 checkpoints can be
+// unwound, while the stacks of other architectures only contain the
+// current instruction. Dead tasks have no stack.
+func (c *Checkpoint) Backtraces(opts BacktraceOptions) ([]*Backtrace, error) {
+	if opts.Sysroot == "" {
+		opts.Sysroot = "/"
+	}
+	if opts.MaxFrames <= 0 {
+		opts.MaxFrames = defaultMaxFrames
+	}
+	threads, err := c.ExploreThreads()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		backtraces []*Backtrace
+		mr         *MemoryReader
+		mappings   []*btMapping
+		pid        uint32
+	)
+	defer func() {
+		if mr != nil {
+			mr.Close()
+		}
+	}()
+	modules := make(map[string]*elfModule)
+	for _, thread := range threads {
+		if thread.Registers == nil {
+			continue
+		}
+		// Threads of a process are listed together
+		if mr == nil || thread.PID != pid {
+			if mr != nil {
+				mr.Close()
+			}
+			pid = thread.PID
+			if mr, err = c.MemoryReader(pid, opts.PageSize); err != nil {
+				return nil, err
+			}
+			mmEntry, err := c.MM(pid)
+			if err != nil {
+				return nil, err
+			}
+			if mappings, err = c.btMappings(mmEntry, opts.Sysroot, modules); err != nil {
+				return nil, err
+			}
+		}
+
+		bt := &Backtrace{PID: thread.PID, TID: thread.TID, Comm: thread.Comm}
+		bt.Frames, err = unwind(thread.Registers, mr, mappings, opts.MaxFrames)
+		if err != nil {
+			bt.Error = err.Error()
+		}
+		backtraces = append(backtraces, bt)
+	}
+	return backtraces, nil
+}
+
+// String formats the backtrace like gdb
+func (bt *Backtrace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Thread %d (process %d) %q:\n", bt.TID, bt.PID, bt.Comm)
+	for i, frame := range bt.Frames {
+		function := "??"
+		if frame.Function != "" {
+			function = frame.Function
+			if frame.Offset != 0 {
+				function += fmt.Sprintf("+0x%x", frame.Offset)
+			}
+		}
+		fmt.Fprintf(&b, "#%-2d 0x%016x in %s ()", i, frame.PC, function)
+		if frame.Object != "" {
+			fmt.Fprintf(&b, " from %s", frame.Object)
+		}
+		b.WriteByte('\n')
+	}
+	if bt.Error != "" {
+		fmt.Fprintf(&b, "Backtrace stopped: %s\n", bt.Error)
+	}
+	return b.String()
+}
+
+// Helper to get the memory mappings of a process, where the
+// ELF files of file mappings are loaded from sysroot and cached
+// in modules. Files which cannot be loaded are not symbolized.
+func (c *Checkpoint) btMappings(mmEntry *mm.MmEntry, sysroot string, modules map[string]*elfModule) ([]*btMapping, error) {
+	mappings := make([]*btMapping, 0, len(mmEntry.GetVmas()))
+	for _, vma := range mmEntry.GetVmas() {
+		mapping := &btMapping{start: vma.GetStart(), end: vma.GetEnd(), pgoff: vma.GetPgoff()}
+		switch status := vma.GetStatus(); {
+		case status&vmaVdso != 0:
+			mapping.name = "[vdso]"
+		case status&(vmaFilePrivate|vmaFileShared) != 0 && status&vmaMemfd == 0:
+			file, err := c.file(uint32(vma.GetShmid()))
+			if err != nil {
+				return nil, err
+			}
+			if mapping.name, err = c.filePath(uint32(vma.GetShmid()), fdinfo.FdTypes_REG); err != nil {
+				return nil, err
+			}
+			buildID := file.GetReg().GetBuildId()
+			key := fmt.Sprintf("%s:%v", mapping.name, buildID)
+			if _, ok := modules[key]; !ok {
+				modules[key] = loadElfModule(filepath.Join(sysroot, mapping.name), buildID)
+			}
+			mapping.module = modules[key]
+		}
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].start < mappings[j].start
+	})
+	return mappings, nil
+}
+
+// Helper to load the symbols and the call frame information
+// of an ELF file, which must have the given build ID if any
+func loadElfModule(name string, buildID []uint32) *elfModule {
+	m := &elfModule{}
+	f, err := elf.Open(name)
+	if err != nil {
+		m.err = err
+		return m
+	}
+	defer f.Close()
+
+	if len(buildID) > 0 {
+		if id, err := elfBuildID(f); err == nil && !equalBuildID(buildID, id) {
+			m.err = fmt.Errorf("build-ID of %s does not match the checkpoint", name)
+			return m
+		}
+	}
+	m.order = f.ByteOrder
+	m.ptrSize = 8
+	if f.Class == elf.ELFCLASS32 {
+		m.ptrSize = 4
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			m.loads = append(m.loads, &prog.ProgHeader)
+		}
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		m.err = err
+		return m
+	}
+	dynamic, err := f.DynamicSymbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		m.err = err
+		return m
+	}
+	for _, sym := range append(symbols, dynamic...) {
+		typ := elf.ST_TYPE(sym.Info)
+		if (typ == elf.STT_FUNC || typ == sttGNUIFunc) && sym.Section != elf.SHN_UNDEF && sym.Value != 0 {
+			m.symbols = append(m.symbols, sym)
+		}
+	}
+	sort.SliceStable(m.symbols, func(i, j int) bool {
+		return m.symbols[i].Value < m.symbols[j].Value
+	})
+
+	// Without call frame information, frame pointers are used
+	m.eh, _ = parseEhFrame(f)
+	return m
+}
+
+// Helper to get the address in the ELF file of
+// an address of the process in the given mapping
+func (m *elfModule) elfAddr(mapping *btMapping, addr uint64) uint64 {
+	off := mapping.pgoff + addr - mapping.start
+	for _, load := range m.loads {
+		if load.Off <= off && off < load.Off+load.Filesz {
+			return load.Vaddr + off - load.Off
+		}
+	}
+	if len(m.loads) > 0 {
+		return m.loads[0].Vaddr + off - m.loads[0].Off
+	}
+	return off
+}
+
+// Helper to get the function containing an address of the ELF file
+func (m *elfModule) symbol(addr uint64) *elf.Symbol {
+	i := sort.Search(len(m.symbols), func(i int) bool { return m.symbols[i].Value > addr }) - 1
+	if i < 0 {
+		return nil
+	}
+	sym := &m.symbols[i]
+	if sym.Size != 0 && addr >= sym.Value+sym.Size {
+		return nil
+	}
+	return sym
+}
+
+// Helper to find the mapping containing addr
+func findBtMapping(mappings []*btMapping, addr uint64) *btMapping {
+	i := sort.Search(len(mappings), func(i int) bool { return mappings[i].end > addr })
+	if i < len(mappings) && mappings[i].start <= addr {
+		return mappings[i]
+	}
+	return nil
+}
+
+// Helper to read a pointer from the memory of the process
+func readPointer(mr *MemoryReader, addr uint64) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := mr.ReadAt(buf, int64(addr)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// Helper to unwind the stack of a thread. The frames which
+// have been unwound are returned with the error which stopped
+// unwinding, if the outermost frame has not been reached.
+func unwind(regs Registers, mr *MemoryReader, mappings []*btMapping, maxFrames int) ([]*StackFrame, error) {
+	pc := regs.InstructionPointer()
+	arch, ok := unwindArchs[regs.Arch()]
+	if !ok {
+		return []*StackFrame{symbolize(mappings, pc, pc)}, fmt.Errorf("unwinding %s stacks is not supported", regs.Arch())
+	}
+	state := make(map[uint64]uint64)
+	for _, name := range regs.Names() {
+		if n, ok := arch.dwarf[name]; ok {
+			state[n], _ = regs.Register(name)
+		}
+	}
+
+	var frames []*StackFrame
+	// Addresses of the frames with the current stack pointer,
+	// as leaf functions of aarch64 do not change it
+	seen := make(map[uint64]bool)
+	for {
+		// The return address of outer frames is after the call
+		lookup := pc
+		if len(frames) > 0 {
+			lookup--
+		}
+		frames = append(frames, symbolize(mappings, pc, lookup))
+		if len(frames) == maxFrames {
+			return frames, fmt.Errorf("more than %d frames", maxFrames)
+		}
+
+		next, nextPC, err := unwindCFI(state, mr, arch, findBtMapping(mappings, lookup), lookup)
+		if err != nil || next == nil {
+			next, nextPC, err = unwindFramePointer(state, mr, arch)
+		}
+		if err != nil {
+			return frames, err
+		}
+		if nextPC == 0 {
+			// Outermost frame
+			return frames, nil
+		}
+		switch sp := next[arch.sp]; {
+		case sp < state[arch.sp]:
+			return frames, fmt.Errorf("stack pointer 0x%x decreases", sp)
+		case sp > state[arch.sp]:
+			seen = make(map[uint64]bool)
+		}
+		seen[pc] = true
+		if seen[nextPC] {
+			return frames, fmt.Errorf("frame at 0x%x repeats with stack pointer 0x%x", nextPC, next[arch.sp])
+		}
+		state, pc = next, nextPC
+	}
+}
+
+// Helper to symbolize the address pc, where lookup is the
+// address used to find the function containing pc
+func symbolize(mappings []*btMapping, pc, lookup uint64) *StackFrame {
+	frame := &StackFrame{PC: pc}
+	mapping := findBtMapping(mappings, lookup)
+	if mapping == nil {
+		return frame
+	}
+	frame.Object = mapping.name
+	if m := mapping.module; m != nil && m.err == nil {
+		if sym := m.symbol(m.elfAddr(mapping, lookup)); sym != nil {
+			frame.Function = sym.Name
+			frame.Offset = m.elfAddr(mapping, pc) - sym.Value
+		}
+	}
+	return frame
+}
+
+// Helper to unwind a frame with the call frame information
+// of the ELF file mapped at pc. The registers of the caller
+// are nil if there is no call frame information for pc.
+func unwindCFI(state map[uint64]uint64, mr *MemoryReader, arch *unwindRegs, mapping *btMapping, pc uint64) (map[uint64]uint64, uint64, error) {
+	if mapping == nil || mapping.module == nil || mapping.module.eh == nil {
+		return nil, 0, nil
+	}
+	m := mapping.module
+	addr := m.elfAddr(mapping, pc)
+	fde := m.eh.find(addr)
+	if fde == nil {
+		return nil, 0, nil
+	}
+	row, err := fde.row(addr, m.order, m.ptrSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if row.cfaExpr {
+		return nil, 0, errors.New("CFA expressions are not supported")
+	}
+	base, ok := state[row.cfaReg]
+	if !ok {
+		return nil, 0, fmt.Errorf("register %d of the CFA is unknown", row.cfaReg)
+	}
+	cfa := base + uint64(row.cfaOffset)
+
+	next := make(map[uint64]uint64, len(state))
+	for reg, value := range state {
+		next[reg] = value
+	}
+	for reg, rule := range row.regs {
+		switch rule.kind {
+		case ruleOffset:
+			value, err := readPointer(mr, cfa+uint64(rule.offset))
+			if err != nil {
+				return nil, 0, err
+			}
+			next[reg] = value
+		case ruleValOffset:
+			next[reg] = cfa + uint64(rule.offset)
+		case ruleRegister:
+			if value, ok := state[rule.reg]; ok {
+				next[reg] = value
+			} else {
+				delete(next, reg)
+			}
+		case ruleUndefined, ruleExpression:
+			delete(next, reg)
+		}
+	}
+	// The CFA is the stack pointer of the caller
+	next[arch.sp] = cfa
+	// An undefined return address marks the outermost frame
+	ra := next[fde.cie.raReg]
+	if row.raSigned {
+		// The signature is stored in the bits above the
+		// 48-bit virtual addresses of user space
+		ra &= 1<<48 - 1
+	}
+	return next, ra, nil
+}
+
+// Helper to unwind a frame with the frame pointer, which
+// points to the saved frame pointer and return address
+func unwindFramePointer(state map[uint64]uint64, mr *MemoryReader, arch *unwindRegs) (map[uint64]uint64, uint64, error) {
+	fp := state[arch.fp]
+	if fp == 0 {
+		return nil, 0, nil
+	}
+	savedFP, err := readPointer(mr, fp)
+	if err != nil {
+		return nil, 0, err
+	}
+	ra, err := readPointer(mr, fp+8)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next := make(map[uint64]uint64, len(state))
+	for reg, value := range state {
+		next[reg] = value
+	}
+	next[arch.fp] = savedFP
+	next[arch.sp] = fp + 16
+	return next, ra, nil
+}
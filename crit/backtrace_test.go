@@ -0,0 +1,293 @@
+package crit
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	core_aarch64 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-aarch64"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"google.golang.org/protobuf/proto"
+)
+
+// Address of the .eh_frame section of writeTestELF
+const testEhFrameAddr = 0x403000
+
+type testSymbol struct {
+	name        string
+	value, size uint64
+}
+
+// writeTestELF is a helper to write an x86_64 executable loaded at
+// 0x400000 with the given functions and build-ID, where the function
+// at 0x402200 has call frame information and all others do not
+func writeTestELF(t *testing.T, name string, buildID []byte, symbols ...testSymbol) {
+	t.Helper()
+	le := binary.LittleEndian
+
+	// The CIE defines the CFA as rsp+8 and the return address at CFA-8,
+	// and the FDE changes the CFA to rsp+32 after the first 4 bytes
+	ehFrame := []byte{
+		20, 0, 0, 0, 0, 0, 0, 0, 1, 'z', 'R', 0, 1, 0x78, 16, 1, 0x1b,
+		0x0c, 7, 8, 0x90, 1, 0, 0,
+		16, 0, 0, 0, 28, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0x44, 0x0e, 32,
+		0, 0, 0, 0,
+	}
+	pcBegin := int32(0x402200 - (testEhFrameAddr + 32))
+	le.PutUint32(ehFrame[32:], uint32(pcBegin))
+
+	note := make([]byte, 16, 16+align4(len(buildID)))
+	le.PutUint32(note, 4)
+	le.PutUint32(note[4:], uint32(len(buildID)))
+	le.PutUint32(note[8:], 3)
+	copy(note[12:], "GNU\x00")
+	note = append(note, buildID...)
+	note = append(note, make([]byte, align4(len(buildID))-len(buildID))...)
+
+	strtab := []byte{0}
+	var symtab bytes.Buffer
+	if err := binary.Write(&symtab, le, elf.Sym64{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sym := range symbols {
+		if err := binary.Write(&symtab, le, elf.Sym64{
+			Name:  uint32(len(strtab)),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			Shndx: 2,
+			Value: sym.value,
+			Size:  sym.size,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		strtab = append(strtab, sym.name+"\x00"...)
+	}
+	shstrtab := []byte("\x00.note.gnu.build-id\x00.eh_frame\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	// Sections follow the header and the program headers
+	contents := [][]byte{note, ehFrame, symtab.Bytes(), strtab, shstrtab}
+	offsets := make([]uint64, len(contents))
+	off := uint64(64 + 2*56)
+	for i, data := range contents {
+		offsets[i] = off
+		off += uint64(len(data))
+	}
+	shoff := (off + 7) &^ 7
+
+	var b bytes.Buffer
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     64,
+		Shoff:     shoff,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     2,
+		Shentsize: 64,
+		Shnum:     6,
+		Shstrndx:  5,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	progs := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Vaddr: 0x400000, Filesz: 0x4000, Memsz: 0x4000},
+		{Type: uint32(elf.PT_NOTE), Flags: uint32(elf.PF_R), Off: offsets[0], Filesz: uint64(len(note))},
+	}
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_NOTE), Off: offsets[0], Size: uint64(len(note)), Addralign: 4},
+		{Name: 20, Type: uint32(elf.SHT_PROGBITS), Addr: testEhFrameAddr, Off: offsets[1], Size: uint64(len(ehFrame)), Addralign: 8},
+		{Name: 30, Type: uint32(elf.SHT_SYMTAB), Off: offsets[2], Size: uint64(symtab.Len()), Link: 4, Info: 1, Entsize: 24},
+		{Name: 38, Type: uint32(elf.SHT_STRTAB), Off: offsets[3], Size: uint64(len(strtab))},
+		{Name: 46, Type: uint32(elf.SHT_STRTAB), Off: offsets[4], Size: uint64(len(shstrtab))},
+	}
+	for _, v := range []any{header, progs} {
+		if err := binary.Write(&b, le, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, data := range contents {
+		b.Write(data)
+	}
+	b.Write(make([]byte, shoff-off))
+	if err := binary.Write(&b, le, sections); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, b.Bytes(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBacktraces(t *testing.T) {
+	dir, sysroot := t.TempDir(), t.TempDir()
+	writeTestProcess(t, dir)
+	buildID := []byte{0xde, 0xad, 0xbe, 0xef}
+	writeTestELF(t, filepath.Join(sysroot, "bin/test"), buildID,
+		testSymbol{"main", 0x402000, 0x200},
+		testSymbol{"worker", 0x402200, 0x100},
+		testSymbol{"_start", 0x402300, 0x100},
+	)
+	exe := testRegFile(1, "/bin/test", 0, 0o100755)
+	exe.Reg.BuildId = []uint32{0xde, 0xad, 0xbe, 0xef}
+	writeTestImg(t, dir, "files.img", "FILES", exe,
+		testRegFile(2, "/", 0, 0o40755),
+		testRegFile(3, "/lib/libc.so.6", 0, 0o100755),
+	)
+
+	// Thread 1 is in worker(), which has call frame information
+	// and was called by main(), which was called by _start(), which
+	// both use frame pointers. Thread 3 is in main(). The executable
+	// is mapped at 0x7000 with an offset of 0x2000.
+	for tid, regs := range map[uint32][3]uint64{1: {0x7250, 0x1400, 0x1800}, 3: {0x7150, 0x1700, 0x1800}} {
+		core := testCore(regs[0], 0, 1000)
+		core.ThreadInfo.Gpregs.Sp = proto.Uint64(regs[1])
+		core.ThreadInfo.Gpregs.Bp = proto.Uint64(regs[2])
+		writeTestImg(t, dir, fmt.Sprintf("core-%d.img", tid), "CORE", core)
+	}
+	mw, err := NewMemoryWriter(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, value := range map[int64]uint64{0x1418: 0x7110, 0x1808: 0x7310} {
+		if _, err := mw.WriteAt(uint64Bytes([]uint64{value}), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backtraces, err := newCheckpoint(dir).Backtraces(BacktraceOptions{Sysroot: sysroot, PageSize: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]string{
+		1: {"worker+0x50", "main+0x110", "_start+0x10"},
+		3: {"main+0x150", "_start+0x10"},
+	}
+	if len(backtraces) != 2 {
+		t.Fatalf("unexpected backtraces %+v", backtraces)
+	}
+	for _, bt := range backtraces {
+		var functions []string
+		for _, frame := range bt.Frames {
+			functions = append(functions, fmt.Sprintf("%s+0x%x", frame.Function, frame.Offset))
+			if frame.Object != "/bin/test" {
+				t.Errorf("unexpected object %q", frame.Object)
+			}
+		}
+		if bt.Error != "" || strings.Join(functions, ",") != strings.Join(want[bt.TID], ",") {
+			t.Errorf("unexpected backtrace of thread %d:\n%s", bt.TID, bt)
+		}
+	}
+	if s := backtraces[0].String(); !strings.Contains(s, "#1  0x0000000000007110 in main+0x110 () from /bin/test\n") {
+		t.Errorf("unexpected backtrace:\n%s", s)
+	}
+
+	// Files with another build-ID are not used
+	exe.Reg.BuildId = []uint32{1, 2, 3, 4}
+	writeTestImg(t, dir, "files.img", "FILES", exe,
+		testRegFile(2, "/", 0, 0o40755),
+		testRegFile(3, "/lib/libc.so.6", 0, 0o100755),
+	)
+	backtraces, err = newCheckpoint(dir).Backtraces(BacktraceOptions{Sysroot: sysroot, PageSize: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := backtraces[0].Frames; len(frames) == 0 || frames[0].Function != "" {
+		t.Errorf("unexpected frames %+v", frames)
+	}
+}
+
+func TestUnwindLeafFrame(t *testing.T) {
+	// The leaf function at 0x401000 keeps the return address in x30
+	// and does not change the stack pointer, which is the CFA
+	cie := &ehCIE{codeAlign: 4, dataAlign: -8, raReg: 30, initial: []byte{dwCfaDefCfa, 31, 0}}
+	module := &elfModule{
+		order:   binary.LittleEndian,
+		ptrSize: 8,
+		loads:   []*elf.ProgHeader{{Vaddr: 0x400000, Filesz: 0x3000}},
+		symbols: []elf.Symbol{{Name: "leaf", Value: 0x401000, Size: 0x100}, {Name: "main", Value: 0x402000, Size: 0x100}},
+		eh:      &ehFrame{fdes: []*ehFDE{{cie: cie, start: 0x401000, end: 0x401100}}},
+	}
+	mappings := []*btMapping{{start: 0x400000, end: 0x403000, name: "/bin/test", module: module}}
+
+	for _, test := range []struct {
+		lr     uint64
+		frames int
+		err    bool
+	}{
+		// main() is the outermost frame, as it has no frame pointer
+		{lr: 0x402010, frames: 2},
+		// The leaf function returns to itself with the same stack pointer
+		{lr: 0x401010, frames: 1, err: true},
+	} {
+		core := &criu_core.CoreEntry{
+			Mtype: criu_core.CoreEntry_AARCH64.Enum(),
+			TiAarch64: &core_aarch64.ThreadInfoAarch64{
+				Gpregs: &core_aarch64.UserAarch64RegsEntry{
+					Regs: make([]uint64, 31),
+					Sp:   proto.Uint64(0x7ff0),
+					Pc:   proto.Uint64(0x401010),
+				},
+			},
+		}
+		core.TiAarch64.Gpregs.Regs[30] = test.lr
+		fillRequired(core.ProtoReflect())
+		regs, err := ThreadRegisters(core)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames, err := unwind(regs, nil, mappings, defaultMaxFrames)
+		if len(frames) != test.frames || (err != nil) != test.err {
+			t.Errorf("unexpected frames %+v with return address 0x%x: %v", frames, test.lr, err)
+		}
+		if len(frames) == 2 && (frames[0].Function != "leaf" || frames[1].Function != "main") {
+			t.Errorf("unexpected frames %+v %+v", frames[0], frames[1])
+		}
+	}
+}
+
+func TestEhFrameMalformed(t *testing.T) {
+	le := binary.LittleEndian
+	// The largest value of an unsigned LEB128 number
+	maxUleb := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	// CIE whose augmentation data is longer than the CIE
+	cie := append([]byte{0, 0, 0, 0, 1, 'z', 'R', 0, 1, 0x78, 16}, maxUleb...)
+	cie = append(cie, 0x1b)
+	data := append(le.AppendUint32(nil, uint32(len(cie))), cie...)
+	if _, err := parseCIE(&ehReader{data: data, order: le, ptrSize: 8}, 0); err == nil {
+		t.Error("expected error for the augmentation length")
+	}
+
+	// Expressions which are longer than the instructions
+	for _, instructions := range [][]byte{
+		append([]byte{dwCfaDefCfaExpression}, maxUleb...),
+		append([]byte{dwCfaExpression, 16}, maxUleb...),
+		{dwCfaDefCfa, 7},
+	} {
+		fde := &ehFDE{cie: &ehCIE{codeAlign: 1, dataAlign: -8}, instructions: instructions}
+		if _, err := fde.row(0, le, 8); err == nil {
+			t.Errorf("expected error for instructions %x", instructions)
+		}
+	}
+
+	// The signing of the return address is toggled
+	fde := &ehFDE{cie: &ehCIE{codeAlign: 1, dataAlign: -8}, instructions: []byte{dwCfaGNUWindowSave}}
+	if row, err := fde.row(0, le, 8); err != nil || !row.raSigned {
+		t.Errorf("return address is not signed: %v", err)
+	}
+}
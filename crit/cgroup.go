@@ -0,0 +1,191 @@
+package crit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cgroup"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Mount point of the cgroup hierarchies on the current host
+var hostCgroupPath = "/sys/fs/cgroup"
+
+// CgroupRemap contains the restore options required
+// to move the cgroups of a checkpoint to a new root.
+type CgroupRemap struct {
+	Mode        rpc.CriuCgMode      `json:"mode"`
+	Roots       []*rpc.CgroupRoot   `json:"roots"`
+	Controllers []*CgroupController `json:"controllers"`
+	Warnings    []string            `json:"warnings,omitempty"`
+}
+
+// CgroupController represents a single cgroup hierarchy
+// of a checkpoint and the root it is remapped to.
+type CgroupController struct {
+	Names      []string `json:"names"`
+	Version    int      `json:"version"`
+	DumpedRoot string   `json:"dumped_root"`
+	NewRoot    string   `json:"new_root,omitempty"`
+}
+
+// Apply sets the cgroup management mode and
+// cgroup roots of the given restore options.
+func (r *CgroupRemap) Apply(opts *rpc.CriuOpts) {
+	opts.ManageCgroups = proto.Bool(true)
+	opts.ManageCgroupsMode = r.Mode.Enum()
+	opts.CgRoot = append(opts.CgRoot, r.Roots...)
+}
+
+// RemapCgroups analyzes the cgroup image in the checkpoint
+// directory and returns the cgroup roots needed to restore
+// every controller under targetRoot. The cgroup management
+// mode is soft, so targetRoot may be created in advance, but
+// any properties recorded for the dumped root itself are then
+// not restored. Such properties, as well as properties of
+// controllers which are not available on the current host,
+// are reported as warnings.
+func RemapCgroups(dir, targetRoot string) (*CgroupRemap, error) {
+	cgroupImg, err := getImg(filepath.Join(dir, "cgroup.img"), &cgroup.CgroupEntry{})
+	if err != nil {
+		return nil, err
+	}
+	if len(cgroupImg.Entries) == 0 {
+		return nil, errors.New("no entries in cgroup image")
+	}
+	cgroupEntry := cgroupImg.Entries[0].Message.(*cgroup.CgroupEntry)
+
+	hostControllers, hostVersion := getHostCgroups()
+
+	remap := &CgroupRemap{Mode: rpc.CriuCgMode_SOFT}
+	warn := func(format string, a ...any) {
+		remap.Warnings = append(remap.Warnings, fmt.Sprintf(format, a...))
+	}
+
+	for _, ctrl := range cgroupEntry.GetControllers() {
+		names := ctrl.GetCnames()
+		if len(names) == 0 {
+			continue
+		}
+		controller := &CgroupController{
+			Names:   names,
+			Version: getCgroupVersion(ctrl),
+		}
+		remap.Controllers = append(remap.Controllers, controller)
+		ctrlName := strings.Join(names, ",")
+
+		dirs := ctrl.GetDirs()
+		if len(dirs) == 0 {
+			// Nothing was dumped for this controller, as
+			// all tasks were in the root of the hierarchy
+			controller.DumpedRoot = "/"
+		} else if len(dirs) > 1 {
+			warn("controller %s has %d top-level directories and cannot be remapped", ctrlName, len(dirs))
+			continue
+		} else {
+			controller.DumpedRoot = dirs[0].GetDirName()
+		}
+		controller.NewRoot = targetRoot
+		remap.Roots = append(remap.Roots, &rpc.CgroupRoot{
+			Ctrl: proto.String(names[0]),
+			Path: proto.String(targetRoot),
+		})
+
+		// Hybrid hosts mount the cgroup v2 hierarchy in "unified"
+		hybrid := controller.Version == 2 && hostControllers["unified"]
+		if controller.Version != hostVersion && !hybrid {
+			warn("controller %s uses cgroup v%d, but the host uses cgroup v%d; its properties cannot be applied",
+				ctrlName, controller.Version, hostVersion)
+			continue
+		}
+		if controller.Version == 1 {
+			for _, name := range names {
+				if !hostControllers[name] {
+					warn("controller %s is not available on the host; its properties cannot be applied", name)
+				}
+			}
+		}
+
+		for _, dir := range dirs {
+			walkCgroupDirs(dir, dir.GetDirName(), func(path string, prop *cgroup.CgroupPropEntry) {
+				// The dumped root is replaced with targetRoot, which
+				// already exists and is therefore left untouched
+				if path == controller.DumpedRoot {
+					warn("property %s of %s is not applied to the existing root %s",
+						prop.GetName(), path, targetRoot)
+					return
+				}
+				if controller.Version == 2 {
+					name, _, _ := strings.Cut(prop.GetName(), ".")
+					if name != "cgroup" && !hostControllers[name] {
+						warn("property %s of %s cannot be applied: controller %s is not available on the host",
+							prop.GetName(), path, name)
+					}
+				}
+			})
+		}
+	}
+
+	return remap, nil
+}
+
+// Helper to call fn for every property in a tree of cgroup directories
+func walkCgroupDirs(
+	dir *cgroup.CgroupDirEntry,
+	path string,
+	fn func(string, *cgroup.CgroupPropEntry),
+) {
+	for _, prop := range dir.GetProperties() {
+		fn(path, prop)
+	}
+	for _, child := range dir.GetChildren() {
+		walkCgroupDirs(child, filepath.Join(path, child.GetDirName()), fn)
+	}
+}
+
+// Helper to identify the cgroup version of a controller.
+// CRIU stores the cgroup v2 hierarchy as "unified".
+func getCgroupVersion(ctrl *cgroup.CgControllerEntry) int {
+	for _, name := range ctrl.GetCnames() {
+		if name == "unified" || name == "" {
+			return 2
+		}
+	}
+	if ctrl.GetIsThreaded() {
+		return 2
+	}
+	return 1
+}
+
+// Helper to get the controllers available on the current
+// host and the cgroup version used by the host
+func getHostCgroups() (map[string]bool, int) {
+	controllers := make(map[string]bool)
+
+	data, err := os.ReadFile(filepath.Join(hostCgroupPath, "cgroup.controllers"))
+	if err == nil {
+		for _, name := range strings.Fields(string(data)) {
+			controllers[name] = true
+		}
+		return controllers, 2
+	}
+
+	// On cgroup v1, every hierarchy is mounted in its own directory
+	entries, err := os.ReadDir(hostCgroupPath)
+	if err != nil {
+		return controllers, 1
+	}
+	for _, entry := range entries {
+		for _, name := range strings.Split(entry.Name(), ",") {
+			controllers[name] = true
+		}
+		if entry.Name() != "unified" {
+			controllers["name="+entry.Name()] = true
+		}
+	}
+	return controllers, 1
+}
@@ -0,0 +1,92 @@
+package crit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cgroup"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func testCgroupProp(name, value string) *cgroup.CgroupPropEntry {
+	return &cgroup.CgroupPropEntry{
+		Name:  proto.String(name),
+		Value: proto.String(value),
+	}
+}
+
+func TestRemapCgroups(t *testing.T) {
+	hostDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(hostDir, "cgroup.controllers"), []byte("cpu memory pids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { hostCgroupPath = path }(hostCgroupPath)
+	hostCgroupPath = hostDir
+
+	dir := t.TempDir()
+	writeTestImg(t, dir, "cgroup.img", "CGROUP", &cgroup.CgroupEntry{
+		Controllers: []*cgroup.CgControllerEntry{
+			{
+				Cnames: []string{"unified"},
+				Dirs: []*cgroup.CgroupDirEntry{
+					{
+						DirName:    proto.String("/system.slice/app.service"),
+						Properties: []*cgroup.CgroupPropEntry{testCgroupProp("memory.max", "max")},
+						Children: []*cgroup.CgroupDirEntry{
+							{
+								DirName: proto.String("worker"),
+								Properties: []*cgroup.CgroupPropEntry{
+									testCgroupProp("cpu.weight", "100"),
+									testCgroupProp("hugetlb.2MB.max", "0"),
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				Cnames: []string{"cpu", "cpuacct"},
+				Dirs: []*cgroup.CgroupDirEntry{
+					{DirName: proto.String("/app")},
+				},
+			},
+		},
+	})
+
+	remap, err := RemapCgroups(dir, "/kubepods.slice/pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remap.Mode != rpc.CriuCgMode_SOFT {
+		t.Errorf("want mode SOFT, got %s", remap.Mode)
+	}
+	if len(remap.Controllers) != 2 {
+		t.Fatalf("want 2 controllers, got %d", len(remap.Controllers))
+	}
+	if c := remap.Controllers[0]; c.Version != 2 || c.DumpedRoot != "/system.slice/app.service" {
+		t.Errorf("unexpected controller %+v", c)
+	}
+	if c := remap.Controllers[1]; c.Version != 1 || c.DumpedRoot != "/app" {
+		t.Errorf("unexpected controller %+v", c)
+	}
+	for i, ctrl := range []string{"unified", "cpu"} {
+		root := remap.Roots[i]
+		if root.GetCtrl() != ctrl || root.GetPath() != "/kubepods.slice/pod1" {
+			t.Errorf("unexpected cgroup root %v", root)
+		}
+	}
+
+	// memory.max of the root, hugetlb.2MB.max and the cgroup v1 controller
+	if len(remap.Warnings) != 3 {
+		t.Errorf("want 3 warnings, got %q", remap.Warnings)
+	}
+
+	opts := &rpc.CriuOpts{}
+	remap.Apply(opts)
+	if opts.GetManageCgroupsMode() != rpc.CriuCgMode_SOFT || len(opts.GetCgRoot()) != 2 {
+		t.Errorf("unexpected restore options %v", opts)
+	}
+}
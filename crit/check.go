@@ -0,0 +1,304 @@
+package crit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	ghost_file "github.com/checkpoint-restore/go-criu/v7/crit/images/ghost-file"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+)
+
+// States of a task which has no memory, files or namespaces
+const (
+	taskDead   = 2
+	taskHelper = 4
+)
+
+// Patterns of files in a checkpoint which are not protobuf images
+var rawImgPatterns = []string{
+	"pages-*.img",
+	"tmpfs-*.tar.gz.img",
+	"tmpfs-dev-*.tar.gz.img",
+	"iptables-*.img",
+	"ip6tables-*.img",
+	"nftables-*.img",
+	"ifaddr-*.img",
+	"route-*.img",
+	"route6-*.img",
+	"rule-*.img",
+}
+
+// CheckReport contains the problems found by CheckConsistency
+type CheckReport struct {
+	Problems []*Problem `json:"problems"`
+}
+
+// Errors returns the problems which make the checkpoint unusable
+func (r *CheckReport) Errors() []*Problem {
+	var problems []*Problem
+	for _, problem := range r.Problems {
+		if problem.Severity == SeverityError {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func (r *CheckReport) add(severity Severity, check, format string, a ...any) {
+	r.Problems = append(r.Problems, &Problem{
+		Severity: severity,
+		Check:    check,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// CheckConsistency verifies that the images of a checkpoint
+// are complete and consistent with each other, without the
+// need to restore it. It checks the magic and the entries of
+// every image, the size of the memory pages, the references
+// from fdinfo to files.img, the images of every task, the
+// parent checkpoint of incremental dumps and the chunks of
+// ghost files. A pageSize of 0 uses the page size of the host.
+// An error is only returned if the checkpoint cannot be listed;
+// all problems of the images are part of the report.
+func CheckConsistency(c *Checkpoint, pageSize int) (*CheckReport, error) {
+	if pageSize <= 0 {
+		pageSize = sysPageSize
+	}
+	report := &CheckReport{Problems: make([]*Problem, 0)}
+
+	names, err := fs.Glob(c.fsys, "*.img")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	// Images which cannot be decoded are only reported
+	// once, and skipped by the following checks
+	broken := make(map[string]bool)
+	for _, name := range names {
+		if isRawImg(name) {
+			continue
+		}
+		if !c.checkImg(report, name) {
+			broken[name] = true
+		}
+	}
+
+	c.checkTasks(report, broken)
+	c.checkFdinfo(report, names, broken)
+	c.checkPagemaps(report, names, broken, pageSize)
+
+	return report, nil
+}
+
+// Helper to check whether a file is not a protobuf image
+func isRawImg(name string) bool {
+	for _, pattern := range rawImgPatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper to read all entries of an image without their payloads.
+// Ghost files are checked here, as the chunks are only available
+// while reading the image. It returns false if the image cannot
+// be decoded.
+func (c *Checkpoint) checkImg(report *CheckReport, name string) bool {
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		report.add(SeverityError, "image", "%s: %v", name, err)
+		return false
+	}
+	magic, err := readMagic(f)
+	f.Close()
+	if err != nil {
+		report.add(SeverityError, "magic", "%s: %v", name, err)
+		return false
+	}
+	entryType, err := GetEntryType(magic)
+	if err != nil {
+		report.add(SeverityWarning, "magic", "%s: %v", name, err)
+		return false
+	}
+
+	// The image reader reads the magic again
+	f, err = c.fsys.Open(name)
+	if err != nil {
+		report.add(SeverityError, "image", "%s: %v", name, err)
+		return false
+	}
+	defer f.Close()
+	ir, err := NewImageReader(f, entryType, true)
+	if err != nil {
+		report.add(SeverityError, "image", "%v", withImageName(err, name))
+		return false
+	}
+	ir.SetLimits(c.decodeLimits())
+
+	var ghost *ghost_file.GhostFileEntry
+	for {
+		entry, err := ir.Next()
+		if err == nil {
+			_, err = ir.ReadExtra()
+		}
+		switch {
+		case errors.Is(err, io.EOF):
+			return true
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			report.add(SeverityError, "truncated", "%v", withImageName(err, name))
+			return false
+		case err != nil:
+			report.add(SeverityError, "entry", "%v", withImageName(err, name))
+			return false
+		}
+
+		switch e := entry.Message.(type) {
+		case *ghost_file.GhostFileEntry:
+			ghost = e
+		case *ghost_file.GhostChunkEntry:
+			if ghost.Size != nil && e.GetOff()+e.GetLen() > ghost.GetSize() {
+				report.add(SeverityError, "ghost", "%s: chunk at 0x%x with length 0x%x exceeds file size 0x%x",
+					name, e.GetOff(), e.GetLen(), ghost.GetSize())
+			}
+		}
+	}
+}
+
+// Helper to check that every task has the images needed to restore it
+func (c *Checkpoint) checkTasks(report *CheckReport, broken map[string]bool) {
+	if broken["pstree.img"] {
+		return
+	}
+	psTree, err := c.Pstree()
+	if err != nil {
+		report.add(SeverityError, "pstree", "%v", err)
+		return
+	}
+
+	for _, process := range psTree {
+		pID := process.GetPid()
+		core := c.checkCore(report, pID, broken)
+		for _, tID := range process.GetThreads() {
+			if tID != pID {
+				c.checkCore(report, tID, broken)
+			}
+		}
+
+		// Dead tasks and helpers have no resources of their own
+		if state := core.GetTc().GetTaskState(); state == taskDead || state == taskHelper {
+			continue
+		}
+		for _, prefix := range []string{"mm", "fs", "ids"} {
+			name := fmt.Sprintf("%s-%d.img", prefix, pID)
+			if _, err := fs.Stat(c.fsys, name); err != nil {
+				report.add(SeverityError, "task", "process %d: %v", pID, err)
+			}
+		}
+	}
+}
+
+// Helper to check that the core image of a task exists.
+// It returns nil if the image cannot be decoded.
+func (c *Checkpoint) checkCore(report *CheckReport, tID uint32, broken map[string]bool) *criu_core.CoreEntry {
+	name := fmt.Sprintf("core-%d.img", tID)
+	if _, err := fs.Stat(c.fsys, name); err != nil {
+		report.add(SeverityError, "task", "thread %d: %v", tID, err)
+		return nil
+	}
+	if broken[name] {
+		return nil
+	}
+	core, err := c.Core(tID)
+	if err != nil {
+		return nil
+	}
+	return core
+}
+
+// Helper to check that all file descriptors refer to files.img
+func (c *Checkpoint) checkFdinfo(report *CheckReport, names []string, broken map[string]bool) {
+	var fdinfoNames []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "fdinfo-") && !broken[name] {
+			fdinfoNames = append(fdinfoNames, name)
+		}
+	}
+	if len(fdinfoNames) == 0 || broken["files.img"] {
+		return
+	}
+	files, err := c.Files()
+	if err != nil {
+		report.add(SeverityError, "fdinfo", "%v", err)
+		return
+	}
+
+	for _, name := range fdinfoNames {
+		img, err := c.image(name, &fdinfo.FdinfoEntry{})
+		if err != nil {
+			continue
+		}
+		for _, entry := range img.Entries {
+			fd := entry.Message.(*fdinfo.FdinfoEntry)
+			if _, ok := files[fd.GetId()]; !ok {
+				report.add(SeverityError, "fdinfo", "%s: fd %d refers to missing file 0x%x",
+					name, fd.GetFd(), fd.GetId())
+			}
+		}
+	}
+}
+
+// Helper to check the memory pages referenced by all pagemaps
+func (c *Checkpoint) checkPagemaps(report *CheckReport, names []string, broken map[string]bool, pageSize int) {
+	for _, name := range names {
+		if !strings.HasPrefix(name, "pagemap-") || broken[name] {
+			continue
+		}
+		img, err := c.image(name, nil)
+		if err != nil || len(img.Entries) == 0 {
+			continue
+		}
+		head, ok := img.Entries[0].Message.(*pagemap.PagemapHead)
+		if !ok {
+			continue
+		}
+
+		var present int64
+		inParent := false
+		for _, entry := range img.Entries[1:] {
+			pagemapEntry := entry.Message.(*pagemap.PagemapEntry)
+			flags := pagemapFlags(pagemapEntry)
+			if flags&pagemapPresent != 0 {
+				present += int64(pagemapEntry.GetNrPages())
+			}
+			if flags&pagemapParent != 0 {
+				inParent = true
+			}
+		}
+
+		pagesName := fmt.Sprintf("pages-%d.img", head.GetPagesId())
+		info, err := fs.Stat(c.fsys, pagesName)
+		switch {
+		case err != nil && present > 0:
+			report.add(SeverityError, "pages", "%s: %v", name, err)
+		case err == nil && info.Size() != present*int64(pageSize):
+			report.add(SeverityError, "pages", "%s: %d pages of 0x%x bytes expected, %s has %d bytes",
+				name, present, pageSize, pagesName, info.Size())
+		}
+
+		if inParent {
+			if info, err := fs.Stat(c.fsys, "parent"); err != nil || !info.IsDir() {
+				report.add(SeverityError, "parent", "%s: pages are stored in the parent checkpoint, which is missing",
+					name)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package crit
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	ghost_file "github.com/checkpoint-restore/go-criu/v7/crit/images/ghost-file"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Helper to write a ghost file with a single chunk of
+// the given length at offset 0 of a file with size
+func writeTestGhostFile(t *testing.T, dir string, size, length uint64) {
+	t.Helper()
+	ghost := &ghost_file.GhostFileEntry{Chunks: proto.Bool(true), Size: proto.Uint64(size)}
+	fillRequired(ghost.ProtoReflect())
+	img := &CriuImage{Magic: "GHOST_FILE", Entries: []*CriuEntry{
+		{Message: ghost},
+		{
+			Message: &ghost_file.GhostChunkEntry{Len: proto.Uint64(length), Off: proto.Uint64(0)},
+			Extra:   base64.StdEncoding.EncodeToString(make([]byte, length)),
+		},
+	}}
+
+	f, err := os.Create(filepath.Join(dir, "ghost-file-1.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := encodeImg(img, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFds(t, dir, "/a")
+	writeTestMemory(t, dir)
+	writeTestImg(t, dir, "core-1.img", "CORE", testCore(0x1000, 0, 0))
+	writeTestImg(t, dir, "mm-1.img", "MM", testMm(0x1000, 0x2000, 0x5000))
+	writeTestGhostFile(t, dir, 0x10, 0x10)
+
+	report, err := CheckConsistency(newCheckpoint(dir), 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+
+	// Break the checkpoint in every way that is checked
+	writeTestGhostFile(t, dir, 0x8, 0x10)
+	writeTestImg(t, dir, "fdinfo-1.img", "FDINFO",
+		testFdInfo(1, 0, fdinfo.FdTypes_REG),
+		testFdInfo(9, 1, fdinfo.FdTypes_REG),
+	)
+	writeTestImg(t, dir, "pagemap-1.img", "PAGEMAP",
+		&pagemap.PagemapHead{PagesId: proto.Uint32(1)},
+		&pagemap.PagemapEntry{Vaddr: proto.Uint64(0x1000), NrPages: proto.Uint32(2)},
+		&pagemap.PagemapEntry{Vaddr: proto.Uint64(0x5000), NrPages: proto.Uint32(1), InParent: proto.Bool(true)},
+	)
+	if err := os.Remove(filepath.Join(dir, "mm-1.img")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "fs-1.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fs-1.img"), data[:len(data)-4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bogus.img"), []byte{1, 2, 3, 4}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = CheckConsistency(newCheckpoint(dir), 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"magic":     "bogus.img",
+		"truncated": "fs-1.img",
+		"fdinfo":    "fdinfo-1.img",
+		"ghost":     "ghost-file-1.img",
+		"task":      "mm-1.img",
+		"pages":     "pages-1.img",
+		"parent":    "pagemap-1.img",
+	}
+	for _, problem := range report.Problems {
+		if problem.Severity != SeverityError {
+			t.Errorf("unexpected severity %+v", problem)
+		}
+		if name, ok := want[problem.Check]; !ok || !strings.Contains(problem.Message, name) {
+			t.Errorf("unexpected problem %+v", problem)
+		}
+		delete(want, problem.Check)
+	}
+	for check := range want {
+		t.Errorf("missing problem of check %s", check)
+	}
+	if len(report.Errors()) != len(report.Problems) {
+		t.Errorf("unexpected errors %+v", report.Errors())
+	}
+}
@@ -0,0 +1,343 @@
+package crit
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fs"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mnt"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	"google.golang.org/protobuf/proto"
+)
+
+// Checkpoint provides access to the images of a checkpoint
+// directory or of any other file system, such as an archive
+// or an in-memory file system. Images are decoded when they are first requested
+// and cached for the lifetime of the Checkpoint, which may be
+// used by multiple goroutines concurrently. The returned entries
+// are shared between all callers and must not be modified.
+// New instances should be created with OpenCheckpoint()
+// or OpenCheckpointFS().
+type Checkpoint struct {
+	dir    string
+	fsys   iofs.FS
+	limits DecodeLimits
+
+	mutex  sync.Mutex
+	images map[string]*cachedImg
+
+	filesOnce sync.Once
+	files     map[uint32]*fdinfo.FileEntry
+	filesErr  error
+
+	parentOnce sync.Once
+	parent     *Checkpoint
+	parentErr  error
+}
+
+// cachedImg holds the result of decoding a single image
+type cachedImg struct {
+	once sync.Once
+	img  *CriuImage
+	err  error
+}
+
+// OpenCheckpoint creates a Checkpoint for the given directory
+func OpenCheckpoint(dir string) (*Checkpoint, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return newCheckpoint(dir), nil
+}
+
+// OpenCheckpointFS creates a Checkpoint for the images in the
+// root directory of fsys. Pages are read with io.ReaderAt if the
+// files of fsys implement it, and sequentially otherwise.
+func OpenCheckpointFS(fsys iofs.FS) (*Checkpoint, error) {
+	info, err := iofs.Stat(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("root of %T is not a directory", fsys)
+	}
+
+	return newCheckpointFS(fsys), nil
+}
+
+func newCheckpoint(dir string) *Checkpoint {
+	c := newCheckpointFS(os.DirFS(dir))
+	c.dir = dir
+	return c
+}
+
+func newCheckpointFS(fsys iofs.FS) *Checkpoint {
+	return &Checkpoint{
+		fsys:   fsys,
+		limits: DefaultDecodeLimits,
+		images: make(map[string]*cachedImg),
+	}
+}
+
+// SetDecodeLimits sets the limits used to decode the images of
+// the checkpoint, which is useful for checkpoints from untrusted
+// sources. Images which have already been decoded are not affected.
+func (c *Checkpoint) SetDecodeLimits(limits DecodeLimits) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.limits = limits
+}
+
+// Helper to get the limits used to decode images
+func (c *Checkpoint) decodeLimits() DecodeLimits {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.limits
+}
+
+// Dir returns the path of the checkpoint directory.
+// It is empty if the Checkpoint was created with
+// OpenCheckpointFS().
+func (c *Checkpoint) Dir() string {
+	return c.dir
+}
+
+// FS returns the file system holding the images of the checkpoint
+func (c *Checkpoint) FS() iofs.FS {
+	return c.fsys
+}
+
+// Parent returns the parent checkpoint of an incremental
+// checkpoint, which is linked by the parent symlink in its
+// directory. Pages of the checkpoint may be stored in any
+// checkpoint of the chain of parents.
+func (c *Checkpoint) Parent() (*Checkpoint, error) {
+	c.parentOnce.Do(func() {
+		info, err := iofs.Stat(c.fsys, "parent")
+		if err != nil {
+			c.parentErr = fmt.Errorf("error opening parent checkpoint: %w", err)
+			return
+		}
+		if !info.IsDir() {
+			c.parentErr = errors.New("parent of the checkpoint is not a directory")
+			return
+		}
+
+		if c.dir != "" {
+			c.parent = newCheckpoint(filepath.Join(c.dir, "parent"))
+		} else {
+			sub, err := iofs.Sub(c.fsys, "parent")
+			if err != nil {
+				c.parentErr = err
+				return
+			}
+			c.parent = newCheckpointFS(sub)
+		}
+		c.parent.SetDecodeLimits(c.decodeLimits())
+	})
+	return c.parent, c.parentErr
+}
+
+// Helper to decode an image of the checkpoint only once.
+// Concurrent callers requesting the same image wait for
+// the first one to decode it.
+func (c *Checkpoint) image(name string, entryType proto.Message) (*CriuImage, error) {
+	c.mutex.Lock()
+	cached, ok := c.images[name]
+	if !ok {
+		cached = &cachedImg{}
+		c.images[name] = cached
+	}
+	c.mutex.Unlock()
+
+	cached.once.Do(func() {
+		f, err := c.fsys.Open(name)
+		if err != nil {
+			cached.err = fmt.Errorf("error opening binary file: %w", err)
+			return
+		}
+		defer f.Close()
+
+		img, err := decodeImg(f, entryType, false, c.decodeLimits())
+		cached.img, cached.err = img, withImageName(err, name)
+	})
+	return cached.img, cached.err
+}
+
+// Helper to drop an image from the cache
+// after it has been written to the checkpoint
+func (c *Checkpoint) forget(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.images, name)
+}
+
+// Helper to get the only entry of an image
+func (c *Checkpoint) entry(name string, entryType proto.Message) (proto.Message, error) {
+	img, err := c.image(name, entryType)
+	if err != nil {
+		return nil, err
+	}
+	if len(img.Entries) == 0 {
+		return nil, fmt.Errorf("no entries in %s", name)
+	}
+	return img.Entries[0].Message, nil
+}
+
+// Pstree returns the processes of the checkpoint
+func (c *Checkpoint) Pstree() ([]*pstree.PstreeEntry, error) {
+	img, err := c.image("pstree.img", &pstree.PstreeEntry{})
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]*pstree.PstreeEntry, 0, len(img.Entries))
+	for _, entry := range img.Entries {
+		processes = append(processes, entry.Message.(*pstree.PstreeEntry))
+	}
+	return processes, nil
+}
+
+// Core returns the state of the process with the given PID
+func (c *Checkpoint) Core(pID uint32) (*criu_core.CoreEntry, error) {
+	entry, err := c.entry(fmt.Sprintf("core-%d.img", pID), &criu_core.CoreEntry{})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*criu_core.CoreEntry), nil
+}
+
+// Ids returns the IDs of the kernel objects used
+// by the process with the given PID
+func (c *Checkpoint) Ids(pID uint32) (*criu_core.TaskKobjIdsEntry, error) {
+	entry, err := c.entry(fmt.Sprintf("ids-%d.img", pID), &criu_core.TaskKobjIdsEntry{})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*criu_core.TaskKobjIdsEntry), nil
+}
+
+// MM returns the memory mappings of the process with the given PID
+func (c *Checkpoint) MM(pID uint32) (*mm.MmEntry, error) {
+	entry, err := c.entry(fmt.Sprintf("mm-%d.img", pID), &mm.MmEntry{})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*mm.MmEntry), nil
+}
+
+// Fs returns the root and working directory
+// of the process with the given PID
+func (c *Checkpoint) Fs(pID uint32) (*fs.FsEntry, error) {
+	entry, err := c.entry(fmt.Sprintf("fs-%d.img", pID), &fs.FsEntry{})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*fs.FsEntry), nil
+}
+
+// Pagemap returns the pagemap head and the pagemap
+// entries of the process with the given PID
+func (c *Checkpoint) Pagemap(pID uint32) (*pagemap.PagemapHead, []*pagemap.PagemapEntry, error) {
+	return c.pagemap(fmt.Sprintf("pagemap-%d.img", pID))
+}
+
+// ShmemPagemap returns the pagemap head and the pagemap entries
+// of the shared memory object with the given ID. The addresses
+// of the entries are offsets in the shared memory object.
+func (c *Checkpoint) ShmemPagemap(shmid uint64) (*pagemap.PagemapHead, []*pagemap.PagemapEntry, error) {
+	return c.pagemap(fmt.Sprintf("pagemap-shmem-%d.img", shmid))
+}
+
+// Helper to get the head and the entries of a pagemap image
+func (c *Checkpoint) pagemap(name string) (*pagemap.PagemapHead, []*pagemap.PagemapEntry, error) {
+	img, err := c.image(name, &pagemap.PagemapHead{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(img.Entries) == 0 {
+		return nil, nil, fmt.Errorf("no entries in %s", name)
+	}
+
+	pagemapEntries := make([]*pagemap.PagemapEntry, 0, len(img.Entries)-1)
+	for _, entry := range img.Entries[1:] {
+		pagemapEntries = append(pagemapEntries, entry.Message.(*pagemap.PagemapEntry))
+	}
+	return img.Entries[0].Message.(*pagemap.PagemapHead), pagemapEntries, nil
+}
+
+// Fdinfo returns the file descriptors of the file table with the given ID
+func (c *Checkpoint) Fdinfo(filesID uint32) ([]*fdinfo.FdinfoEntry, error) {
+	img, err := c.image(fmt.Sprintf("fdinfo-%d.img", filesID), &fdinfo.FdinfoEntry{})
+	if err != nil {
+		return nil, err
+	}
+
+	fdInfos := make([]*fdinfo.FdinfoEntry, 0, len(img.Entries))
+	for _, entry := range img.Entries {
+		fdInfos = append(fdInfos, entry.Message.(*fdinfo.FdinfoEntry))
+	}
+	return fdInfos, nil
+}
+
+// Helper to get the file descriptors opened by a process
+func (c *Checkpoint) processFdinfo(pID uint32) ([]*fdinfo.FdinfoEntry, error) {
+	ids, err := c.Ids(pID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Fdinfo(ids.GetFilesId())
+}
+
+// Files returns the entries of files.img indexed by ID
+func (c *Checkpoint) Files() (map[uint32]*fdinfo.FileEntry, error) {
+	c.filesOnce.Do(func() {
+		img, err := c.image("files.img", &fdinfo.FileEntry{})
+		if err != nil {
+			c.filesErr = err
+			return
+		}
+		c.files = make(map[uint32]*fdinfo.FileEntry, len(img.Entries))
+		for _, entry := range img.Entries {
+			file := entry.Message.(*fdinfo.FileEntry)
+			c.files[file.GetId()] = file
+		}
+	})
+	return c.files, c.filesErr
+}
+
+// Helper to fetch a file if it exists in files.img
+func (c *Checkpoint) file(fID uint32) (*fdinfo.FileEntry, error) {
+	files, err := c.Files()
+	if err != nil {
+		return nil, err
+	}
+	return files[fID], nil
+}
+
+// Mountpoints returns the mounts of the mount namespace with the given ID
+func (c *Checkpoint) Mountpoints(id uint32) ([]*mnt.MntEntry, error) {
+	img, err := c.image(fmt.Sprintf("mountpoints-%d.img", id), &mnt.MntEntry{})
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]*mnt.MntEntry, 0, len(img.Entries))
+	for _, entry := range img.Entries {
+		mounts = append(mounts, entry.Message.(*mnt.MntEntry))
+	}
+	return mounts, nil
+}
@@ -0,0 +1,109 @@
+package crit
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fs"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeTestFds is a helper to create a checkpoint with a
+// single process which has the given file open as fd 0
+func writeTestFds(t *testing.T, dir, name string) {
+	t.Helper()
+	writeTestPsTree(t, dir, 1)
+	writeTestImg(t, dir, "fdinfo-1.img", "FDINFO", testFdInfo(1, 0, fdinfo.FdTypes_REG))
+	writeTestImg(t, dir, "files.img", "FILES",
+		testRegFile(1, name, 0, 0o100644),
+		testRegFile(2, "/", 0, 0o40755),
+	)
+	writeTestImg(t, dir, "fs-1.img", "FS", &fs.FsEntry{
+		CwdId:  proto.Uint32(2),
+		RootId: proto.Uint32(2),
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	writeTestFds(t, dirA, "/a")
+	writeTestFds(t, dirB, "/b")
+
+	for dir, want := range map[string]string{dirA: "/a", dirB: "/b"} {
+		c, err := OpenCheckpoint(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds, err := c.ExploreFds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fds) != 1 || len(fds[0].Files) != 3 {
+			t.Fatalf("unexpected fds %+v", fds)
+		}
+		if path := fds[0].Files[0].Path; path != want {
+			t.Errorf("want: %s, got: %s", want, path)
+		}
+	}
+
+	c, err := OpenCheckpoint(dirA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.ExploreFds(); err != nil {
+				t.Error(err)
+			}
+			if _, err := c.Files(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := c.Core(1); err == nil {
+		t.Error("expected error for missing core image")
+	}
+	if _, err := OpenCheckpoint(dirA + "/files.img"); err == nil {
+		t.Error("expected error for regular file")
+	}
+}
+
+func TestOpenCheckpointFS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFds(t, dir, "/a")
+	pages := writeTestMemory(t, dir)
+
+	mapFS := fstest.MapFS{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapFS[entry.Name()] = &fstest.MapFile{Data: data}
+	}
+
+	c, err := OpenCheckpointFS(mapFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir() != "" {
+		t.Errorf("unexpected directory %s", c.Dir())
+	}
+	checkTestCheckpoint(t, c, pages)
+	if _, err := c.DumpStats(); err == nil {
+		t.Error("expected error for missing stats image")
+	}
+}
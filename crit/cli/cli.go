@@ -1,14 +1,24 @@
 package cli
 
 import (
+	"archive/zip"
+	"bufio"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/checkpoint-restore/go-criu/v7/crit"
 	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -21,6 +31,18 @@ var (
 	inputDirPath   string
 	pretty         bool
 	noPayload      bool
+	split          bool
+	pageSize       int
+	// Memory search options
+	pid         uint32
+	useRegexp   bool
+	hexPattern  bool
+	contextSize int
+	maxMatchLen int
+	minLength   int
+	encoding    string
+	listenAddr  string
+	sysroot     string
 )
 
 // The `crit` command
@@ -38,7 +60,9 @@ var decodeCmd = &cobra.Command{
 	Use:   "decode",
 	Short: "Convert binary image to JSON",
 	Long: `Convert the input binary image to JSON and write it to a file.
-If no output file is provided, the JSON is printed to stdout.`,
+If no output file is provided, the JSON is printed to stdout.
+The entries are streamed as JSON Lines, with the magic of the
+image on the first line, unless the output is pretty-printed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			inputFile *os.File
@@ -60,17 +84,28 @@ If no output file is provided, the JSON is printed to stdout.`,
 		if err != nil {
 			log.Fatal(fmt.Errorf("error getting protobuf binding: %w", err))
 		}
+
+		if !pretty {
+			outputFile := os.Stdout
+			if outputFilePath != "" {
+				outputFile, err = os.Create(outputFilePath)
+				if err != nil {
+					log.Fatal(fmt.Errorf("error opening destination file: %w", err))
+				}
+				defer outputFile.Close()
+			}
+			if err := decodeJSONLines(inputFile, outputFile, entryType); err != nil {
+				log.Fatal(fmt.Errorf("error decoding image: %w", err))
+			}
+			return
+		}
+
 		img, err := c.Decode(entryType)
 		if err != nil {
 			log.Fatal(fmt.Errorf("error decoding image: %w", err))
 		}
 
-		var jsonData []byte
-		if pretty {
-			jsonData, err = json.MarshalIndent(img, "", "    ")
-		} else {
-			jsonData, err = json.Marshal(img)
-		}
+		jsonData, err := json.MarshalIndent(img, "", "    ")
 		if err != nil {
 			log.Fatal(fmt.Errorf("error processing data into JSON: %w", err))
 		}
@@ -97,7 +132,8 @@ If no output file is provided, the JSON is printed to stdout.`,
 var encodeCmd = &cobra.Command{
 	Use:   "encode",
 	Short: "Convert JSON to binary image file",
-	Long:  "Convert the input JSON to a CRIU image file.",
+	Long: `Convert the input JSON to a CRIU image file.
+Both a single JSON document and JSON Lines are accepted.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			inputFile, outputFile *os.File
@@ -128,6 +164,16 @@ var encodeCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal(fmt.Errorf("error getting protobuf binding: %w", err))
 		}
+		jsonLines, err := isJSONLines(inputFile)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error parsing JSON: %w", err))
+		}
+		if jsonLines {
+			if err := encodeJSONLines(inputFile, outputFile, entryType); err != nil {
+				log.Fatal(fmt.Errorf("error writing to file: %w", err))
+			}
+			return
+		}
 		// Convert JSON to Go struct
 		img, err := c.Parse(entryType)
 		if err != nil {
@@ -140,6 +186,97 @@ var encodeCmd = &cobra.Command{
 	},
 }
 
+// The `crit decode-dir` command
+var decodeDirCmd = &cobra.Command{
+	Use:   "decode-dir DIR",
+	Short: "Convert all images of a checkpoint directory to JSON",
+	Long: `Convert every image of the checkpoint directory into a single
+JSON document. Files which are not protobuf images, such as memory
+pages, are embedded base64 encoded. If no output file is provided,
+the JSON is printed to stdout. With --split, the output is a
+directory with one JSON file per image, and all other files are
+copied as they are.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fsys := os.DirFS(args[0])
+		criuDir, err := crit.DecodeDir(fsys, !split)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error decoding directory: %w", err))
+		}
+
+		if split {
+			if outputFilePath == "" {
+				log.Fatal(errors.New("an output directory is required with --split"))
+			}
+			if err := crit.WriteDirJSON(criuDir, outputFilePath, fsys); err != nil {
+				log.Fatal(fmt.Errorf("error writing JSON files: %w", err))
+			}
+			return
+		}
+
+		var jsonData []byte
+		if pretty {
+			jsonData, err = json.MarshalIndent(criuDir, "", "    ")
+		} else {
+			jsonData, err = json.Marshal(criuDir)
+		}
+		if err != nil {
+			log.Fatal(fmt.Errorf("error processing data into JSON: %w", err))
+		}
+		// If no output file, print to stdout
+		if outputFilePath == "" {
+			fmt.Println(string(jsonData))
+			return
+		}
+		if err := os.WriteFile(outputFilePath, append(jsonData, '\n'), 0o644); err != nil {
+			log.Fatal(fmt.Errorf("error writing JSON data: %w", err))
+		}
+	},
+}
+
+// The `crit encode-dir` command
+var encodeDirCmd = &cobra.Command{
+	Use:   "encode-dir DIR",
+	Short: "Convert JSON to a checkpoint directory",
+	Long: `Rebuild the checkpoint directory from the JSON document created
+by decode-dir, or from a directory created by decode-dir --split.
+Files referenced by path are resolved relative to the input.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			criuDir *crit.CriuDir
+			fsys    fs.FS
+			err     error
+		)
+		switch {
+		case split:
+			if inputFilePath == "" {
+				log.Fatal(errors.New("an input directory is required with --split"))
+			}
+			fsys = os.DirFS(inputFilePath)
+			criuDir, err = crit.ReadDirJSON(fsys)
+		case inputFilePath == "":
+			fsys = os.DirFS(".")
+			criuDir = &crit.CriuDir{}
+			err = json.NewDecoder(os.Stdin).Decode(criuDir)
+		default:
+			fsys = os.DirFS(filepath.Dir(inputFilePath))
+			var jsonData []byte
+			if jsonData, err = os.ReadFile(inputFilePath); err == nil {
+				criuDir = &crit.CriuDir{}
+				err = json.Unmarshal(jsonData, criuDir)
+			}
+		}
+		if err != nil {
+			log.Fatal(fmt.Errorf("error parsing JSON: %w", err))
+		}
+
+		if err := crit.EncodeDir(criuDir, args[0], fsys); err != nil {
+			log.Fatal(fmt.Errorf("error writing directory: %w", err))
+		}
+	},
+}
+
 // The `crit show` command
 var showCmd = &cobra.Command{
 	Use:   "show INPATH",
@@ -220,11 +357,14 @@ var infoCmd = &cobra.Command{
 
 // The `crit x` command
 var xCmd = &cobra.Command{
-	Use:   "x DIR {ps|fd|mem|rss|sk}",
+	Use:   "x DIR {ps|fd|mem|rss|sk|threads|bt|goroutines}",
 	Short: "Explore the image directory",
-	Long:  "Explore the image directory with one of (ps, fd, mem, rss, sk) options",
+	Long: "Explore the image directory with one of (ps, fd, mem, rss, sk, threads, bt, goroutines) options. " +
+		"DIR may also be an uncompressed tar or zip archive of the images. " +
+		"The bt option prints the backtraces of all threads, symbolized with the files of --sysroot. " +
+		"The goroutines option prints the goroutines of Go programs like the Go runtime on SIGQUIT.",
 	// Exactly two arguments are required:
-	// * Path of the input directory
+	// * Path of the input directory or archive
 	// * Explore type
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -234,24 +374,48 @@ var xCmd = &cobra.Command{
 		// about the data itself, as long as we can
 		// marshal it into JSON and display it.
 		var xData any
-		var err error
 
-		c = crit.New(nil, nil,
-			inputDirPath, pretty, noPayload)
+		checkpoint, err := openCheckpoint(inputDirPath)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
 		// Switch the explore type and call the handler.
 		switch args[1] {
 		case "ps":
-			xData, err = c.ExplorePs()
+			xData, err = checkpoint.ExplorePs()
 		case "fd", "fds":
-			xData, err = c.ExploreFds()
+			xData, err = checkpoint.ExploreFds()
 		case "mem", "mems":
-			xData, err = c.ExploreMems()
+			xData, err = checkpoint.ExploreMems()
 		case "rss":
-			xData, err = c.ExploreRss()
+			xData, err = checkpoint.ExploreRss()
 		case "sk":
-			xData, err = c.ExploreSk()
+			xData, err = checkpoint.ExploreSk()
+		case "threads":
+			xData, err = checkpoint.ExploreThreads()
+		case "bt":
+			var backtraces []*crit.Backtrace
+			backtraces, err = checkpoint.Backtraces(crit.BacktraceOptions{Sysroot: sysroot, PageSize: pageSize})
+			if err != nil {
+				break
+			}
+			// Backtraces are printed like gdb does
+			for _, bt := range backtraces {
+				fmt.Println(bt)
+			}
+			return
+		case "goroutines":
+			var processes []*crit.GoProcess
+			processes, err = checkpoint.Goroutines(crit.BacktraceOptions{Sysroot: sysroot, PageSize: pageSize})
+			if err != nil {
+				break
+			}
+			for _, process := range processes {
+				fmt.Println(process)
+			}
+			return
 		default:
-			err = errors.New("invalid explore type (supported: {ps|fd|mem|rss|sk})")
+			err = errors.New("invalid explore type (supported: {ps|fd|mem|rss|sk|threads|bt|goroutines})")
 		}
 		if err != nil {
 			log.Fatal(fmt.Errorf("error exploring directory: %w", err))
@@ -265,6 +429,451 @@ var xCmd = &cobra.Command{
 	},
 }
 
+// The `crit diff` command
+var diffCmd = &cobra.Command{
+	Use:   "diff DIR1 DIR2",
+	Short: "Compare the objects of two checkpoints",
+	Long: `Compare two checkpoints, such as a pre-dump and the following dump,
+and list the processes, threads, memory mappings, files, sockets,
+mounts, cgroups and credentials which were added, removed or changed.
+The checkpoints may also be uncompressed tar or zip archives.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		a, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+		b, err := openCheckpoint(args[1])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		diff, err := crit.Diff(a, b)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error comparing checkpoints: %w", err))
+		}
+
+		jsonData, err := json.MarshalIndent(diff, "", "    ")
+		if err != nil {
+			log.Fatal(fmt.Errorf("error processing data into JSON: %w", err))
+		}
+		fmt.Println(string(jsonData))
+	},
+}
+
+// The `crit check` command
+var checkCmd = &cobra.Command{
+	Use:   "check DIR",
+	Short: "Check the consistency of a checkpoint",
+	Long: `Check that the images of a checkpoint are complete and consistent
+with each other. This includes the magic and entries of every image,
+the size of the memory pages, the files referenced by fdinfo images,
+the images of every task, the parent of incremental checkpoints and
+the chunks of ghost files. The problems found are printed as JSON.
+The checkpoint may also be an uncompressed tar or zip archive.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		report, err := crit.CheckConsistency(checkpoint, pageSize)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error checking checkpoint: %w", err))
+		}
+
+		jsonData, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			log.Fatal(fmt.Errorf("error processing data into JSON: %w", err))
+		}
+		fmt.Println(string(jsonData))
+		if len(report.Errors()) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// The `crit search` command
+var searchCmd = &cobra.Command{
+	Use:   "search DIR PATTERN",
+	Short: "Search for a pattern in the memory of a checkpoint",
+	Long: `Search for a pattern in the memory of all processes of a checkpoint,
+or of a single process with --pid. The pattern is matched on the raw
+bytes of memory, and may be given as hex with --hex or as a regular
+expression with --regexp. Every match is printed as JSON with the
+memory mapping containing it. The checkpoint may also be an
+uncompressed tar or zip archive.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		var pattern crit.MemoryPattern
+		switch {
+		case useRegexp && hexPattern:
+			log.Fatal(errors.New("--regexp and --hex cannot be used together"))
+		case useRegexp:
+			re, err := regexp.Compile(args[1])
+			if err != nil {
+				log.Fatal(fmt.Errorf("error parsing pattern: %w", err))
+			}
+			pattern = crit.RegexpPattern(re, maxMatchLen)
+		case hexPattern:
+			b, err := hex.DecodeString(strings.ReplaceAll(args[1], " ", ""))
+			if err != nil {
+				log.Fatal(fmt.Errorf("error parsing pattern: %w", err))
+			}
+			pattern = crit.BytePattern(b)
+		default:
+			pattern = crit.BytePattern([]byte(args[1]))
+		}
+
+		opts := crit.SearchOptions{Context: contextSize}
+		var matches []crit.MemoryMatch
+		if pid != 0 {
+			mr, err := checkpoint.MemoryReader(pid, pageSize)
+			if err != nil {
+				log.Fatal(fmt.Errorf("error reading memory: %w", err))
+			}
+			defer mr.Close()
+			matches, err = mr.Search(pattern, opts)
+		} else {
+			matches, err = checkpoint.SearchMemory(pattern, pageSize, opts)
+		}
+		if err != nil {
+			log.Fatal(fmt.Errorf("error searching memory: %w", err))
+		}
+
+		jsonData, err := json.MarshalIndent(matches, "", "    ")
+		if err != nil {
+			log.Fatal(fmt.Errorf("error processing data into JSON: %w", err))
+		}
+		fmt.Println(string(jsonData))
+	},
+}
+
+// The `crit strings` command
+var stringsCmd = &cobra.Command{
+	Use:   "strings DIR",
+	Short: "Extract the strings from the memory of a checkpoint",
+	Long: `Extract the strings of printable characters from the memory of all
+processes of a checkpoint, or of a single process with --pid, like
+strings(1). The strings are printed as JSON with the memory mapping
+containing them. The checkpoint may also be an uncompressed tar or
+zip archive.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		opts := crit.StringsOptions{
+			MinLength: minLength,
+			Encoding:  crit.StringEncoding(encoding),
+		}
+		var strs []crit.MemoryString
+		if pid != 0 {
+			mr, err := checkpoint.MemoryReader(pid, pageSize)
+			if err != nil {
+				log.Fatal(fmt.Errorf("error reading memory: %w", err))
+			}
+			defer mr.Close()
+			strs, err = mr.Strings(opts)
+		} else {
+			strs, err = checkpoint.MemoryStrings(pageSize, opts)
+		}
+		if err != nil {
+			log.Fatal(fmt.Errorf("error extracting strings: %w", err))
+		}
+
+		jsonData, err := json.MarshalIndent(strs, "", "    ")
+		if err != nil {
+			log.Fatal(fmt.Errorf("error processing data into JSON: %w", err))
+		}
+		fmt.Println(string(jsonData))
+	},
+}
+
+// The `crit core-dump` command
+var coreDumpCmd = &cobra.Command{
+	Use:   "core-dump DIR",
+	Short: "Convert a process of a checkpoint into an ELF core file",
+	Long: `Write an ELF core file of the process selected with --pid, which can
+be analyzed with gdb, readelf and other tools for core files without
+restoring the checkpoint. The core file is written to core.PID unless
+an output file is given. Only x86_64 checkpoints are supported. The
+checkpoint may also be an uncompressed tar or zip archive.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if pid == 0 {
+			log.Fatal(errors.New("a process is required with --pid"))
+		}
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		if outputFilePath == "" {
+			outputFilePath = fmt.Sprintf("core.%d", pid)
+		}
+		outputFile, err := os.Create(outputFilePath)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening destination file: %w", err))
+		}
+		defer outputFile.Close()
+
+		if err := checkpoint.WriteCoreDump(outputFile, pid, pageSize); err != nil {
+			log.Fatal(fmt.Errorf("error writing core file: %w", err))
+		}
+	},
+}
+
+// The `crit gdbserver` command
+var gdbServerCmd = &cobra.Command{
+	Use:   "gdbserver DIR",
+	Short: "Serve a process of a checkpoint to gdb or lldb",
+	Long: `Serve the process selected with --pid as a read-only target of the
+GDB Remote Serial Protocol, so that gdb or lldb can inspect the process
+at the time it was checkpointed without restoring it. Connect with
+"target remote ADDRESS" in gdb. Only x86_64 checkpoints are supported.
+The checkpoint may also be an uncompressed tar or zip archive.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if pid == 0 {
+			log.Fatal(errors.New("a process is required with --pid"))
+		}
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		server, err := checkpoint.GDBServer(pid, pageSize)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error reading process: %w", err))
+		}
+		defer server.Close()
+		l, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error listening: %w", err))
+		}
+		log.Printf("Listening on %s", l.Addr())
+		if err := server.Serve(l); err != nil {
+			log.Fatal(fmt.Errorf("error serving debugger: %w", err))
+		}
+	},
+}
+
+// The `crit export-pcap` command
+var exportPcapCmd = &cobra.Command{
+	Use:   "export-pcap DIR",
+	Short: "Export the data queued in sockets as a pcapng file",
+	Long: `Write the data in the queues of the TCP connections and of the packet
+sockets of a checkpoint to a pcapng file, which can be opened with
+Wireshark to see the data that was in flight at checkpoint time. TCP
+segments are synthesized from the addresses, ports, sequence numbers,
+windows and timestamps of the connections. The file is written to
+checkpoint.pcapng unless an output file is given. The checkpoint may
+also be an uncompressed tar or zip archive.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		if outputFilePath == "" {
+			outputFilePath = "checkpoint.pcapng"
+		}
+		outputFile, err := os.Create(outputFilePath)
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening destination file: %w", err))
+		}
+		defer outputFile.Close()
+
+		w := bufio.NewWriter(outputFile)
+		if err := checkpoint.ExportPcap(w); err != nil {
+			log.Fatal(fmt.Errorf("error exporting sockets: %w", err))
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(fmt.Errorf("error writing pcapng file: %w", err))
+		}
+	},
+}
+
+// The `crit mem` command
+var memCmd = &cobra.Command{
+	Use:   "mem",
+	Short: "Export and import the memory of a process",
+}
+
+// The `crit mem export` command
+var memExportCmd = &cobra.Command{
+	Use:   "export DIR OUTDIR",
+	Short: "Export the memory of a process to one file per mapping",
+	Long: `Write the memory of the process selected with --pid to OUTDIR, with
+one sparse file per memory mapping, named after its address range and
+the file backing it, and a manifest.json describing them. Pages which
+are not part of the checkpoint are holes of the files. The checkpoint
+may also be an uncompressed tar or zip archive.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if pid == 0 {
+			log.Fatal(errors.New("a process is required with --pid"))
+		}
+		checkpoint, err := openCheckpoint(args[0])
+		if err != nil {
+			log.Fatal(fmt.Errorf("error opening checkpoint: %w", err))
+		}
+
+		if _, err := checkpoint.ExportMemory(pid, pageSize, args[1]); err != nil {
+			log.Fatal(fmt.Errorf("error exporting memory: %w", err))
+		}
+	},
+}
+
+// The `crit mem import` command
+var memImportCmd = &cobra.Command{
+	Use:   "import EXPORTDIR DIR",
+	Short: "Import the memory exported by mem export",
+	Long: `Rebuild the pagemap and pages images of the process exported to
+EXPORTDIR by mem export, and write them to the checkpoint directory DIR.
+Pages which have been written in the exported files are stored in the
+new images, while holes stay holes.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := crit.ImportMemory(args[0], args[1]); err != nil {
+			log.Fatal(fmt.Errorf("error importing memory: %w", err))
+		}
+	},
+}
+
+// Helper to open a checkpoint from a directory or from an
+// uncompressed tar or zip archive. Archives created by Podman
+// keep the images in a checkpoint directory, which is used if
+// the root of the archive contains no inventory image.
+func openCheckpoint(path string) (*crit.Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return crit.OpenCheckpoint(path)
+	}
+
+	// The archive stays open as long as the process runs
+	var fsys fs.FS
+	if strings.EqualFold(filepath.Ext(path), ".zip") {
+		fsys, err = zip.NewReader(f, info.Size())
+	} else {
+		fsys, err = crit.NewTarFS(f, info.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := fs.Stat(fsys, "inventory.img"); errors.Is(err, fs.ErrNotExist) {
+		if _, err := fs.Stat(fsys, "checkpoint/inventory.img"); err == nil {
+			if fsys, err = fs.Sub(fsys, "checkpoint"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return crit.OpenCheckpointFS(fsys)
+}
+
+// jsonLinesHeader is the first line of JSON Lines output
+type jsonLinesHeader struct {
+	Magic string `json:"magic"`
+}
+
+// Helper to stream the entries of a binary image as JSON Lines
+func decodeJSONLines(in io.Reader, out io.Writer, entryType proto.Message) error {
+	ir, err := crit.NewImageReader(in, entryType, noPayload)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(jsonLinesHeader{Magic: ir.Magic()}); err != nil {
+		return err
+	}
+	for {
+		entry, err := ir.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if entry.Extra, err = ir.ReadExtra(); err != nil {
+			return err
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// Helper to check whether a JSON file contains JSON
+// Lines instead of a single document with all entries
+func isJSONLines(jsonFile *os.File) (bool, error) {
+	var img map[string]json.RawMessage
+	if err := json.NewDecoder(jsonFile).Decode(&img); err != nil {
+		return false, err
+	}
+	// Seek to the beginning of the file
+	if _, err := jsonFile.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	_, ok := img["entries"]
+	return !ok, nil
+}
+
+// Helper to stream JSON Lines into a binary image
+func encodeJSONLines(in io.Reader, out io.Writer, entryType proto.Message) error {
+	decoder := json.NewDecoder(in)
+	var header jsonLinesHeader
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	iw, err := crit.NewImageWriter(w, header.Magic)
+	if err != nil {
+		return err
+	}
+	for i := 0; decoder.More(); i++ {
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err != nil {
+			return err
+		}
+		entry, err := crit.UnmarshalEntry(header.Magic, entryType, i, data)
+		if err != nil {
+			return err
+		}
+		if err := iw.Write(entry); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
 // Add all commands to the root command and configure flags
 func Init() {
 	// Disable completion generation
@@ -283,13 +892,86 @@ func Init() {
 	encodeCmd.Flags().StringVarP(&outputFilePath, "output", "o", "",
 		"Path to the destination image file")
 	rootCmd.AddCommand(encodeCmd)
+	// Directory options
+	decodeDirCmd.Flags().StringVarP(&outputFilePath, "output", "o", "",
+		"Path to the destination JSON file, or directory with --split")
+	decodeDirCmd.Flags().BoolVar(&pretty, "pretty", false,
+		"Provide indented and multi-line JSON output")
+	decodeDirCmd.Flags().BoolVar(&split, "split", false,
+		"Write one JSON file per image to the output directory")
+	rootCmd.AddCommand(decodeDirCmd)
+	encodeDirCmd.Flags().StringVarP(&inputFilePath, "input", "i", "",
+		"Path to the JSON file, or directory with --split")
+	encodeDirCmd.Flags().BoolVar(&split, "split", false,
+		"Read one JSON file per image from the input directory")
+	rootCmd.AddCommand(encodeDirCmd)
 	// Show options
 	showCmd.Flags().BoolVar(&noPayload, "nopl", false,
 		"Do not show payload contents")
 	rootCmd.AddCommand(showCmd)
 	// Info and X commands
 	rootCmd.AddCommand(infoCmd)
+	xCmd.Flags().StringVar(&sysroot, "sysroot", "/",
+		"Root directory of the files mapped by the processes (bt and goroutines only)")
+	xCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
 	rootCmd.AddCommand(xCmd)
+	rootCmd.AddCommand(diffCmd)
+	// Check options
+	checkCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
+	rootCmd.AddCommand(checkCmd)
+	// Memory search options
+	searchCmd.Flags().Uint32Var(&pid, "pid", 0,
+		"Search only the memory of the process with this PID")
+	searchCmd.Flags().BoolVarP(&useRegexp, "regexp", "E", false,
+		"Interpret the pattern as a regular expression")
+	searchCmd.Flags().BoolVar(&hexPattern, "hex", false,
+		"Interpret the pattern as hex encoded bytes")
+	searchCmd.Flags().IntVarP(&contextSize, "context", "C", 0,
+		"Number of bytes to show before and after each match")
+	searchCmd.Flags().IntVar(&maxMatchLen, "max-len", 0,
+		"Maximum length of a regular expression match (default 4096)")
+	searchCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
+	rootCmd.AddCommand(searchCmd)
+	stringsCmd.Flags().Uint32Var(&pid, "pid", 0,
+		"Extract only the strings of the process with this PID")
+	stringsCmd.Flags().IntVarP(&minLength, "min-len", "n", 4,
+		"Minimum number of characters of a string")
+	stringsCmd.Flags().StringVarP(&encoding, "encoding", "e", "ascii",
+		"Encoding of the strings (ascii, utf16le or utf16be)")
+	stringsCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
+	rootCmd.AddCommand(stringsCmd)
+	// Core dump options
+	coreDumpCmd.Flags().Uint32Var(&pid, "pid", 0,
+		"PID of the process to convert")
+	coreDumpCmd.Flags().StringVarP(&outputFilePath, "output", "o", "",
+		"Path to the destination core file (default core.PID)")
+	coreDumpCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
+	rootCmd.AddCommand(coreDumpCmd)
+	// GDB server options
+	gdbServerCmd.Flags().Uint32Var(&pid, "pid", 0,
+		"PID of the process to debug")
+	gdbServerCmd.Flags().StringVar(&listenAddr, "listen", "127.0.0.1:1234",
+		"Address to listen on for debuggers")
+	gdbServerCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
+	rootCmd.AddCommand(gdbServerCmd)
+	// Memory export options
+	memExportCmd.Flags().Uint32Var(&pid, "pid", 0,
+		"PID of the process to export")
+	memExportCmd.Flags().IntVar(&pageSize, "page-size", 0,
+		"Page size of the checkpointed host (default: page size of this host)")
+	memCmd.AddCommand(memExportCmd)
+	memCmd.AddCommand(memImportCmd)
+	rootCmd.AddCommand(memCmd)
+	// Packet capture options
+	exportPcapCmd.Flags().StringVarP(&outputFilePath, "output", "o", "",
+		"Path to the destination pcapng file (default checkpoint.pcapng)")
+	rootCmd.AddCommand(exportPcapCmd)
 }
 
 func Run() {
@@ -0,0 +1,530 @@
+package crit
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	core_x86 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-x86"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+)
+
+// State of a task stopped by a signal
+const taskStopped = 3
+
+// Types of notes in core files which are not part of debug/elf
+const (
+	ntAuxv      = 6
+	ntFile      = 0x46494c45
+	ntX86Xstate = 0x202
+)
+
+// Number of program headers from which the
+// extended numbering of ELF is required
+const pnXnum = 0xffff
+
+// Sizes of the structures of x86_64 core files
+const (
+	elfPrstatusSize = 336
+	elfPrpsinfoSize = 136
+	elfFxsaveSize   = 512
+	// Offset of the XCR0 register in the software
+	// reserved bytes of the xsave area
+	xsaveXcr0Offset = 464
+	xsaveHeaderSize = 64
+)
+
+// Offsets of the components of the xsave area
+// in the standard format, by feature bit
+var xsaveComponents = map[int]int{
+	2: 576,  // AVX
+	3: 960,  // MPX bound registers
+	4: 1024, // MPX bound configuration and status
+	5: 1088, // AVX-512 opmask
+	6: 1152, // AVX-512 ZMM_Hi256
+	7: 1664, // AVX-512 Hi16_ZMM
+	9: 2688, // Protection keys
+}
+
+// elfNote is a note of a core file
+type elfNote struct {
+	name  string
+	ntype uint32
+	desc  []byte
+}
+
+// Helper to get the size of a note in the note segment
+func (n *elfNote) size() int {
+	return 12 + align4(len(n.name)+1) + align4(len(n.desc))
+}
+
+func (n *elfNote) write(w io.Writer) error {
+	header := []uint32{uint32(len(n.name) + 1), uint32(len(n.desc)), n.ntype}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	name := make([]byte, align4(len(n.name)+1))
+	copy(name, n.name)
+	desc := make([]byte, align4(len(n.desc)))
+	copy(desc, n.desc)
+	if _, err := w.Write(name); err != nil {
+		return err
+	}
+	_, err := w.Write(desc)
+	return err
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// coreSegment is a memory mapping written to a core file
+type coreSegment struct {
+	start, end uint64
+	flags      elf.ProgFlag
+	// Set if the pages are stored in the checkpoint
+	dumped bool
+}
+
+// WriteCoreDump writes an ELF core file of the process with the
+// given PID, which can be analyzed with gdb or readelf without
+// restoring the checkpoint. Every memory mapping is split into
+// PT_LOAD segments at the boundaries of the pages stored in the
+// checkpoint. Only those have contents in the core file, while
+// the segments of other pages, such as unmodified code of files
+// or pages which are transferred lazily, are empty. Only x86_64
+// checkpoints are supported. A pageSize of 0 uses the page
+// size of the host.
+func (c *Checkpoint) WriteCoreDump(w io.Writer, pid uint32, pageSize int) error {
+	process, err := c.process(pid)
+	if err != nil {
+		return err
+	}
+	core, err := c.Core(pid)
+	if err != nil {
+		return err
+	}
+	if core.GetMtype() != criu_core.CoreEntry_X86_64 {
+		return fmt.Errorf("core files of %s checkpoints are not supported", core.GetMtype())
+	}
+	mmEntry, err := c.MM(pid)
+	if err != nil {
+		return err
+	}
+	mr, err := c.MemoryReader(pid, pageSize)
+	if err != nil {
+		return err
+	}
+	defer mr.Close()
+
+	notes, err := c.coreNotes(process, core, mmEntry, mr)
+	if err != nil {
+		return err
+	}
+	segments, err := coreSegments(mmEntry, mr)
+	if err != nil {
+		return err
+	}
+	if len(segments)+1 >= pnXnum {
+		return fmt.Errorf("too many memory mappings (%d)", len(segments))
+	}
+
+	// The note segment follows the program headers,
+	// and the page aligned memory follows the notes
+	phoff := uint64(binary.Size(elf.Header64{}))
+	phentsize := uint64(binary.Size(elf.Prog64{}))
+	noteOff := phoff + phentsize*uint64(len(segments)+1)
+	var noteSize uint64
+	for _, note := range notes {
+		noteSize += uint64(note.size())
+	}
+	alignPage := func(n uint64) uint64 {
+		return (n + uint64(mr.pageSize) - 1) &^ (uint64(mr.pageSize) - 1)
+	}
+	dataOff := alignPage(noteOff + noteSize)
+
+	bw := bufio.NewWriter(w)
+	header := elf.Header64{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     phoff,
+		Ehsize:    uint16(phoff),
+		Phentsize: uint16(phentsize),
+		Phnum:     uint16(len(segments) + 1),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	header.Ident[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+	if err := binary.Write(bw, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	progs := []elf.Prog64{{
+		Type:   uint32(elf.PT_NOTE),
+		Off:    noteOff,
+		Filesz: noteSize,
+		Align:  4,
+	}}
+	offset := dataOff
+	for _, segment := range segments {
+		prog := elf.Prog64{
+			Type:  uint32(elf.PT_LOAD),
+			Flags: uint32(segment.flags),
+			Off:   offset,
+			Vaddr: segment.start,
+			Memsz: segment.end - segment.start,
+			Align: uint64(mr.pageSize),
+		}
+		if segment.dumped {
+			prog.Filesz = prog.Memsz
+			offset += prog.Filesz
+		}
+		progs = append(progs, prog)
+	}
+	if err := binary.Write(bw, binary.LittleEndian, progs); err != nil {
+		return err
+	}
+
+	for _, note := range notes {
+		if err := note.write(bw); err != nil {
+			return err
+		}
+	}
+	if _, err := bw.Write(make([]byte, dataOff-noteOff-noteSize)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024*1024)
+	for _, segment := range segments {
+		if !segment.dumped {
+			continue
+		}
+		for addr := segment.start; addr < segment.end; addr += uint64(len(buf)) {
+			chunk := buf
+			if segment.end-addr < uint64(len(chunk)) {
+				chunk = chunk[:segment.end-addr]
+			}
+			if _, err := mr.read(chunk, addr, true); err != nil {
+				return err
+			}
+			if _, err := bw.Write(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Helper to get the process with the given PID from the process tree
+func (c *Checkpoint) process(pid uint32) (*pstree.PstreeEntry, error) {
+	psTree, err := c.Pstree()
+	if err != nil {
+		return nil, err
+	}
+	for _, process := range psTree {
+		if process.GetPid() == pid {
+			return process, nil
+		}
+	}
+	return nil, fmt.Errorf("process %d not found in the checkpoint", pid)
+}
+
+// Helper to get the segments of the memory mappings of a process
+func coreSegments(mmEntry *mm.MmEntry, mr *MemoryReader) ([]coreSegment, error) {
+	ranges, err := mr.Ranges()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]coreSegment, 0, len(mmEntry.GetVmas()))
+	// Index of the first segment of the current mapping
+	first := 0
+	add := func(segment coreSegment) {
+		// Adjacent ranges of a mapping, such as pagemap entries
+		// followed by shared memory, are merged into one segment
+		if n := len(segments); n > first && segments[n-1].end == segment.start &&
+			segments[n-1].dumped == segment.dumped {
+			segments[n-1].end = segment.end
+			return
+		}
+		segments = append(segments, segment)
+	}
+	for _, vma := range mmEntry.GetVmas() {
+		var flags elf.ProgFlag
+		prot := vma.GetProt()
+		if prot&1 != 0 {
+			flags |= elf.PF_R
+		}
+		if prot&2 != 0 {
+			flags |= elf.PF_W
+		}
+		if prot&4 != 0 {
+			flags |= elf.PF_X
+		}
+		first = len(segments)
+		start, end := vma.GetStart(), vma.GetEnd()
+		for _, r := range ranges {
+			if r.Lazy || r.End <= start || r.Start >= end {
+				continue
+			}
+			if r.Start > start {
+				add(coreSegment{start: start, end: r.Start, flags: flags})
+				start = r.Start
+			}
+			dumpedEnd := r.End
+			if dumpedEnd > end {
+				dumpedEnd = end
+			}
+			add(coreSegment{start: start, end: dumpedEnd, flags: flags, dumped: true})
+			start = dumpedEnd
+		}
+		if start < end {
+			add(coreSegment{start: start, end: end, flags: flags})
+		}
+	}
+	return segments, nil
+}
+
+// Helper to build the notes of a core file: the status of the
+// main thread is followed by the notes of the process, and then
+// by the status of all other threads, like in core files of Linux
+func (c *Checkpoint) coreNotes(process *pstree.PstreeEntry, core *criu_core.CoreEntry, mmEntry *mm.MmEntry, mr *MemoryReader) ([]*elfNote, error) {
+	pid := process.GetPid()
+	tids := []uint32{pid}
+	for _, tid := range process.GetThreads() {
+		if tid != pid {
+			tids = append(tids, tid)
+		}
+	}
+
+	var notes []*elfNote
+	for _, tid := range tids {
+		threadCore := core
+		if tid != pid {
+			var err error
+			if threadCore, err = c.Core(tid); err != nil {
+				return nil, err
+			}
+		}
+		threadNotes, err := threadCoreNotes(process, tid, core, threadCore)
+		if err != nil {
+			return nil, fmt.Errorf("thread %d: %w", tid, err)
+		}
+		notes = append(notes, threadNotes[0])
+		if tid == pid {
+			prpsinfo, err := coreDumpPrpsinfo(process, core, mr)
+			if err != nil {
+				return nil, err
+			}
+			notes = append(notes, prpsinfo, coreDumpAuxv(mmEntry))
+			file, err := c.coreDumpFile(mmEntry, mr.pageSize)
+			if err != nil {
+				return nil, err
+			}
+			notes = append(notes, file)
+		}
+		notes = append(notes, threadNotes[1:]...)
+	}
+	return notes, nil
+}
+
+// Helper to build the NT_PRSTATUS, NT_FPREGSET and NT_X86_XSTATE
+// notes of a thread, where core is the state of the main thread
+func threadCoreNotes(process *pstree.PstreeEntry, tid uint32, core, threadCore *criu_core.CoreEntry) ([]*elfNote, error) {
+	info := threadCore.GetThreadInfo()
+	if info.GetGpregs() == nil {
+		return nil, errors.New("no registers in the checkpoint")
+	}
+	gpregs := info.GetGpregs()
+	if gpregs.GetMode() != core_x86.UserX86RegsMode_NATIVE {
+		return nil, errors.New("core files of 32-bit tasks are not supported")
+	}
+
+	prstatus := make([]byte, elfPrstatusSize)
+	le := binary.LittleEndian
+	if core.GetTc().GetTaskState() == taskStopped {
+		le.PutUint16(prstatus[12:], uint16(core.GetTc().GetStopSigno()))
+	}
+	le.PutUint64(prstatus[24:], threadCore.GetThreadCore().GetBlkSigset())
+	le.PutUint32(prstatus[32:], tid)
+	le.PutUint32(prstatus[36:], process.GetPpid())
+	le.PutUint32(prstatus[40:], process.GetPgid())
+	le.PutUint32(prstatus[44:], process.GetSid())
+	regs := []uint64{
+		gpregs.GetR15(), gpregs.GetR14(), gpregs.GetR13(), gpregs.GetR12(),
+		gpregs.GetBp(), gpregs.GetBx(), gpregs.GetR11(), gpregs.GetR10(),
+		gpregs.GetR9(), gpregs.GetR8(), gpregs.GetAx(), gpregs.GetCx(),
+		gpregs.GetDx(), gpregs.GetSi(), gpregs.GetDi(), gpregs.GetOrigAx(),
+		gpregs.GetIp(), gpregs.GetCs(), gpregs.GetFlags(), gpregs.GetSp(),
+		gpregs.GetSs(), gpregs.GetFsBase(), gpregs.GetGsBase(), gpregs.GetDs(),
+		gpregs.GetEs(), gpregs.GetFs(), gpregs.GetGs(),
+	}
+	for i, reg := range regs {
+		le.PutUint64(prstatus[112+8*i:], reg)
+	}
+
+	notes := []*elfNote{{name: "CORE", ntype: uint32(elf.NT_PRSTATUS), desc: prstatus}}
+	if fpregs := info.GetFpregs(); fpregs != nil {
+		le.PutUint32(prstatus[328:], 1)
+		fxsave := coreDumpFxsave(fpregs)
+		notes = append(notes, &elfNote{name: "CORE", ntype: uint32(elf.NT_FPREGSET), desc: fxsave})
+		if xsave := fpregs.GetXsave(); xsave != nil {
+			notes = append(notes, &elfNote{name: "LINUX", ntype: ntX86Xstate, desc: coreDumpXsave(fxsave, xsave)})
+		}
+	}
+	return notes, nil
+}
+
+// Helper to build the fxsave area of the FPU registers
+func coreDumpFxsave(fpregs *core_x86.UserX86FpregsEntry) []byte {
+	fxsave := make([]byte, elfFxsaveSize)
+	le := binary.LittleEndian
+	le.PutUint16(fxsave[0:], uint16(fpregs.GetCwd()))
+	le.PutUint16(fxsave[2:], uint16(fpregs.GetSwd()))
+	le.PutUint16(fxsave[4:], uint16(fpregs.GetTwd()))
+	le.PutUint16(fxsave[6:], uint16(fpregs.GetFop()))
+	le.PutUint64(fxsave[8:], fpregs.GetRip())
+	le.PutUint64(fxsave[16:], fpregs.GetRdp())
+	le.PutUint32(fxsave[24:], fpregs.GetMxcsr())
+	le.PutUint32(fxsave[28:], fpregs.GetMxcsrMask())
+	putUint32s(fxsave[32:160], fpregs.GetStSpace())
+	putUint32s(fxsave[160:416], fpregs.GetXmmSpace())
+	return fxsave
+}
+
+// Helper to build the xsave area of the extended registers. The
+// enabled features are stored in the software reserved bytes of
+// the fxsave area, where gdb expects the value of XCR0.
+func coreDumpXsave(fxsave []byte, xsave *core_x86.UserX86XsaveEntry) []byte {
+	le := binary.LittleEndian
+	components := map[int][]byte{
+		2: uint32Bytes(xsave.GetYmmhSpace()),
+		3: uint64Bytes(xsave.GetBndregState()),
+		4: uint64Bytes(xsave.GetBndcsrState()),
+		5: uint64Bytes(xsave.GetOpmaskReg()),
+		6: uint64Bytes(xsave.GetZmmUpper()),
+		7: uint64Bytes(xsave.GetHi16Zmm()),
+		9: uint32Bytes(xsave.GetPkru()),
+	}
+
+	// x87 and SSE state is always part of the fxsave area
+	xcr0 := uint64(0x3)
+	size := elfFxsaveSize + xsaveHeaderSize
+	for feature, data := range components {
+		if len(data) == 0 {
+			continue
+		}
+		xcr0 |= 1 << feature
+		if end := xsaveComponents[feature] + len(data); end > size {
+			size = end
+		}
+	}
+
+	area := make([]byte, size)
+	copy(area, fxsave)
+	le.PutUint64(area[xsaveXcr0Offset:], xcr0)
+	le.PutUint64(area[elfFxsaveSize:], xsave.GetXstateBv())
+	for feature, data := range components {
+		copy(area[xsaveComponents[feature]:], data)
+	}
+	return area
+}
+
+func putUint32s(b []byte, values []uint32) {
+	for i, v := range values {
+		if 4*i+4 > len(b) {
+			break
+		}
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+}
+
+func uint32Bytes(values []uint32) []byte {
+	b := make([]byte, 4*len(values))
+	putUint32s(b, values)
+	return b
+}
+
+func uint64Bytes(values []uint64) []byte {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[8*i:], v)
+	}
+	return b
+}
+
+// Helper to build the NT_PRPSINFO note of the process. The
+// arguments are read from memory, and replaced by the name
+// of the command if they are not part of the checkpoint.
+func coreDumpPrpsinfo(process *pstree.PstreeEntry, core *criu_core.CoreEntry, mr *MemoryReader) (*elfNote, error) {
+	tc := core.GetTc()
+	prpsinfo := make([]byte, elfPrpsinfoSize)
+	le := binary.LittleEndian
+	switch tc.GetTaskState() {
+	case taskStopped:
+		prpsinfo[0], prpsinfo[1] = 4, 'T'
+	case taskDead:
+		prpsinfo[0], prpsinfo[1], prpsinfo[2] = 16, 'Z', 1
+	default:
+		prpsinfo[1] = 'R'
+	}
+	le.PutUint64(prpsinfo[8:], uint64(tc.GetFlags()))
+	creds := core.GetThreadCore().GetCreds()
+	le.PutUint32(prpsinfo[16:], creds.GetUid())
+	le.PutUint32(prpsinfo[20:], creds.GetGid())
+	le.PutUint32(prpsinfo[24:], process.GetPid())
+	le.PutUint32(prpsinfo[28:], process.GetPpid())
+	le.PutUint32(prpsinfo[32:], process.GetPgid())
+	le.PutUint32(prpsinfo[36:], process.GetSid())
+	copy(prpsinfo[40:55], tc.GetComm())
+
+	psargs := tc.GetComm()
+	if args, err := mr.GetPsArgs(); err == nil && args.Len() > 0 {
+		psargs = strings.TrimRight(strings.ReplaceAll(args.String(), "\x00", " "), " ")
+	} else if err != nil && !errors.Is(err, ErrUnmapped) && !errors.Is(err, ErrPageLazy) && !errors.Is(err, ErrPageMissing) {
+		return nil, err
+	}
+	copy(prpsinfo[56:135], psargs)
+
+	return &elfNote{name: "CORE", ntype: uint32(elf.NT_PRPSINFO), desc: prpsinfo}, nil
+}
+
+// Helper to build the NT_AUXV note with the auxiliary vector
+func coreDumpAuxv(mmEntry *mm.MmEntry) *elfNote {
+	return &elfNote{name: "CORE", ntype: ntAuxv, desc: uint64Bytes(mmEntry.GetMmSavedAuxv())}
+}
+
+// Helper to build the NT_FILE note with the file-backed mappings
+func (c *Checkpoint) coreDumpFile(mmEntry *mm.MmEntry, pageSize int) (*elfNote, error) {
+	var (
+		mappings []uint64
+		names    bytes.Buffer
+	)
+	for _, vma := range mmEntry.GetVmas() {
+		if vma.GetStatus()&(vmaFilePrivate|vmaFileShared) == 0 {
+			continue
+		}
+		name, err := c.filePath(uint32(vma.GetShmid()), fdinfo.FdTypes_REG)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, vma.GetStart(), vma.GetEnd(), vma.GetPgoff()/uint64(pageSize))
+		names.WriteString(name)
+		names.WriteByte(0)
+	}
+
+	desc := uint64Bytes(append([]uint64{uint64(len(mappings) / 3), uint64(pageSize)}, mappings...))
+	desc = append(desc, names.Bytes()...)
+	return &elfNote{name: "CORE", ntype: ntFile, desc: desc}, nil
+}
@@ -0,0 +1,174 @@
+package crit
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeTestProcess is a helper to create a checkpoint of process
+// 1 with the threads 1 and 3, which has the memory created by
+// writeTestMemory, the executable /bin/test mapped at 0x7000
+// and the library /lib/libc.so.6 mapped at 0x9000
+func writeTestProcess(t *testing.T, dir string) ([]byte, *mm.MmEntry) {
+	t.Helper()
+	writeTestFds(t, dir, "/bin/test")
+	writeTestImg(t, dir, "files.img", "FILES",
+		testRegFile(1, "/bin/test", 0, 0o100755),
+		testRegFile(2, "/", 0, 0o40755),
+		testRegFile(3, "/lib/libc.so.6", 0, 0o100755),
+	)
+	pages := writeTestMemory(t, dir)
+	writeTestImg(t, dir, "pstree.img", "PSTREE", &pstree.PstreeEntry{
+		Pid:     proto.Uint32(1),
+		Ppid:    proto.Uint32(0),
+		Pgid:    proto.Uint32(1),
+		Sid:     proto.Uint32(1),
+		Threads: []uint32{1, 3},
+	})
+	writeTestImg(t, dir, "core-1.img", "CORE", testCore(0x401000, 0, 1000))
+	writeTestImg(t, dir, "core-3.img", "CORE", testCore(0x402000, 0, 1000))
+
+	// The mappings of files have no pages
+	mmEntry := testMm(0x1000, 0x2000, 0x5000, 0x7000, 0x9000)
+	mmEntry.ExeFileId = proto.Uint32(1)
+	for i, id := range map[int]uint64{3: 1, 4: 3} {
+		mmEntry.Vmas[i].Status = proto.Uint32(1 | vmaFilePrivate)
+		mmEntry.Vmas[i].Shmid = proto.Uint64(id)
+	}
+	mmEntry.Vmas[3].Pgoff = proto.Uint64(0x2000)
+	mmEntry.MmSavedAuxv = []uint64{6, 0x1000, 0, 0}
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+	return pages, mmEntry
+}
+
+func TestWriteCoreDump(t *testing.T) {
+	dir := t.TempDir()
+	pages, mmEntry := writeTestProcess(t, dir)
+
+	var buf bytes.Buffer
+	if err := newCheckpoint(dir).WriteCoreDump(&buf, 1, 0x1000); err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != elf.ET_CORE || f.Machine != elf.EM_X86_64 || len(f.Progs) != 6 {
+		t.Fatalf("unexpected core file %+v with %d segments", f.FileHeader, len(f.Progs))
+	}
+
+	for i, want := range [][]byte{pages[:0x1000], pages[0x1000:0x2000], pages[0x2000:], nil, nil} {
+		prog := f.Progs[i+1]
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prog.Type != elf.PT_LOAD || prog.Flags != elf.PF_R || prog.Memsz != 0x1000 || !bytes.Equal(data, want) {
+			t.Errorf("unexpected segment %+v", prog.ProgHeader)
+		}
+	}
+
+	// Parse the notes of the note segment
+	notes, err := io.ReadAll(f.Progs[0].Open())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		types []uint32
+		descs [][]byte
+	)
+	for len(notes) > 0 {
+		namesz, descsz := binary.LittleEndian.Uint32(notes), binary.LittleEndian.Uint32(notes[4:])
+		types = append(types, binary.LittleEndian.Uint32(notes[8:]))
+		off := 12 + align4(int(namesz))
+		descs = append(descs, notes[off:off+int(descsz)])
+		notes = notes[off+align4(int(descsz)):]
+	}
+
+	wantTypes := []uint32{
+		uint32(elf.NT_PRSTATUS), uint32(elf.NT_PRPSINFO), ntAuxv, ntFile, uint32(elf.NT_FPREGSET),
+		uint32(elf.NT_PRSTATUS), uint32(elf.NT_FPREGSET),
+	}
+	if len(types) != len(wantTypes) {
+		t.Fatalf("unexpected notes %v", types)
+	}
+	for i := range types {
+		if types[i] != wantTypes[i] {
+			t.Fatalf("unexpected notes %v", types)
+		}
+	}
+
+	for i, want := range map[int]struct{ tid, ip uint64 }{0: {1, 0x401000}, 5: {3, 0x402000}} {
+		if tid := binary.LittleEndian.Uint32(descs[i][32:]); uint64(tid) != want.tid {
+			t.Errorf("unexpected thread %d", tid)
+		}
+		if ip := binary.LittleEndian.Uint64(descs[i][112+16*8:]); ip != want.ip {
+			t.Errorf("unexpected IP 0x%x of thread %d", ip, want.tid)
+		}
+	}
+	if uid := binary.LittleEndian.Uint32(descs[1][16:]); uid != 1000 {
+		t.Errorf("unexpected UID %d", uid)
+	}
+	if !bytes.Equal(descs[2], uint64Bytes(mmEntry.MmSavedAuxv)) {
+		t.Errorf("unexpected auxiliary vector %v", descs[2])
+	}
+	wantFile := append(uint64Bytes([]uint64{2, 0x1000, 0x7000, 0x8000, 2, 0x9000, 0xa000, 0}),
+		"/bin/test\x00/lib/libc.so.6\x00"...)
+	if !bytes.Equal(descs[3], wantFile) {
+		t.Errorf("unexpected file note %q", descs[3])
+	}
+}
+
+func TestWriteCoreDumpPartial(t *testing.T) {
+	dir := t.TempDir()
+	writeTestProcess(t, dir)
+	// Only the second page of the file mapping was written,
+	// and its last page is transferred lazily
+	writeTestPages(t, dir, []byte("a"),
+		testPagemapEntry(0x11000, 1, pagemapPresent),
+		testPagemapEntry(0x13000, 1, pagemapLazy),
+	)
+	mmEntry := testMm(0x10000)
+	mmEntry.ExeFileId = proto.Uint32(1)
+	mmEntry.Vmas[0].End = proto.Uint64(0x14000)
+	mmEntry.Vmas[0].Status = proto.Uint32(1 | vmaFilePrivate)
+	mmEntry.Vmas[0].Shmid = proto.Uint64(1)
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	var buf bytes.Buffer
+	if err := newCheckpoint(dir).WriteCoreDump(&buf, 1, 0x1000); err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		vaddr, memsz uint64
+		data         []byte
+	}{
+		{0x10000, 0x1000, nil},
+		{0x11000, 0x1000, bytes.Repeat([]byte("a"), 0x1000)},
+		{0x12000, 0x2000, nil},
+	}
+	if len(f.Progs) != len(want)+1 {
+		t.Fatalf("unexpected number of segments %d", len(f.Progs))
+	}
+	for i, w := range want {
+		prog := f.Progs[i+1]
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prog.Type != elf.PT_LOAD || prog.Vaddr != w.vaddr || prog.Memsz != w.memsz || !bytes.Equal(data, w.data) {
+			t.Errorf("unexpected segment %+v", prog.ProgHeader)
+		}
+	}
+}
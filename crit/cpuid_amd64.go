@@ -0,0 +1,118 @@
+package crit
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cpuinfo"
+	"google.golang.org/protobuf/proto"
+)
+
+// cpuid executes the CPUID instruction for the given leaf and subleaf
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+// xgetbv reads the extended control register XCR0
+func xgetbv() (eax, edx uint32)
+
+// osxsave is the CPUID(1) ECX bit set when the
+// kernel has enabled XSAVE and XGETBV can be used
+const osxsave = 1 << 27
+
+// Helper to build an x86 CPU description of the current host with
+// CPUID. The words of the capability layout which are defined by
+// the Linux kernel instead of the CPU are left empty.
+func cpuidX86Entry() *cpuinfo.CpuinfoX86Entry {
+	maxLeaf, ebx, ecx, edx := cpuid(0, 0)
+	vendor := make([]byte, 12)
+	binary.LittleEndian.PutUint32(vendor[0:], ebx)
+	binary.LittleEndian.PutUint32(vendor[4:], edx)
+	binary.LittleEndian.PutUint32(vendor[8:], ecx)
+
+	x86 := &cpuinfo.CpuinfoX86Entry{
+		VendorId:      cpuinfo.CpuinfoX86Entry_UNKNOWN.Enum(),
+		CapabilityVer: proto.Uint32(x86CapabilityVer),
+		Capability:    make([]uint32, x86NCapInts),
+	}
+	switch string(vendor) {
+	case "GenuineIntel":
+		x86.VendorId = cpuinfo.CpuinfoX86Entry_INTEL.Enum()
+	case "AuthenticAMD":
+		x86.VendorId = cpuinfo.CpuinfoX86Entry_AMD.Enum()
+	}
+
+	eax, _, ecx, edx := cpuid(1, 0)
+	family := (eax >> 8) & 0xf
+	model := (eax >> 4) & 0xf
+	if family == 0xf {
+		family += (eax >> 20) & 0xff
+	}
+	if family >= 6 {
+		model += ((eax >> 16) & 0xf) << 4
+	}
+	x86.CpuFamily = proto.Uint32(family)
+	x86.Model = proto.Uint32(model)
+	x86.Stepping = proto.Uint32(eax & 0xf)
+	x86.Capability[x86Cpuid1EDX] = edx
+	x86.Capability[x86Cpuid1ECX] = ecx
+
+	if maxLeaf >= 6 {
+		eax, _, _, _ = cpuid(6, 0)
+		x86.Capability[x86Cpuid6EAX] = eax
+	}
+	if maxLeaf >= 7 {
+		_, ebx, ecx, edx = cpuid(7, 0)
+		x86.Capability[x86Cpuid7EBX] = ebx
+		x86.Capability[x86Cpuid7ECX] = ecx
+		x86.Capability[x86Cpuid7EDX] = edx
+	}
+	if maxLeaf >= 0xd {
+		// The features enabled by the kernel are in XCR0,
+		// while CPUID only reports those the CPU supports
+		_, ebx, ecx, _ = cpuid(0xd, 0)
+		x86.XsaveSize = proto.Uint32(ebx)
+		x86.XsaveSizeMax = proto.Uint32(ecx)
+		if x86.Capability[x86Cpuid1ECX]&osxsave != 0 {
+			eax, edx = xgetbv()
+			x86.XfeaturesMask = proto.Uint64(uint64(edx)<<32 | uint64(eax))
+		}
+		eax, _, _, _ = cpuid(0xd, 1)
+		x86.Capability[x86CpuidD1EAX] = eax
+	}
+	if maxLeaf >= 0xf {
+		_, _, _, edx = cpuid(0xf, 0)
+		x86.Capability[x86CpuidF0EDX] = edx
+		_, _, _, edx = cpuid(0xf, 1)
+		x86.Capability[x86CpuidF1EDX] = edx
+	}
+
+	maxExtLeaf, _, _, _ := cpuid(0x80000000, 0)
+	if maxExtLeaf >= 0x80000001 {
+		_, _, ecx, edx = cpuid(0x80000001, 0)
+		x86.Capability[x86Cpuid80000001EDX] = edx
+		x86.Capability[x86Cpuid80000001ECX] = ecx
+	}
+	if maxExtLeaf >= 0x80000004 {
+		brand := make([]byte, 0, 48)
+		for leaf := uint32(0x80000002); leaf <= 0x80000004; leaf++ {
+			eax, ebx, ecx, edx = cpuid(leaf, 0)
+			for _, reg := range []uint32{eax, ebx, ecx, edx} {
+				brand = binary.LittleEndian.AppendUint32(brand, reg)
+			}
+		}
+		x86.ModelId = proto.String(strings.TrimSpace(strings.TrimRight(string(brand), "\x00")))
+	}
+	if maxExtLeaf >= 0x80000007 {
+		_, ebx, _, _ = cpuid(0x80000007, 0)
+		x86.Capability[x86Cpuid80000007EBX] = ebx
+	}
+	if maxExtLeaf >= 0x80000008 {
+		_, ebx, _, _ = cpuid(0x80000008, 0)
+		x86.Capability[x86Cpuid80000008EBX] = ebx
+	}
+	if maxExtLeaf >= 0x8000000a {
+		_, _, _, edx = cpuid(0x8000000a, 0)
+		x86.Capability[x86Cpuid8000000AEDX] = edx
+	}
+
+	return x86
+}
@@ -0,0 +1,11 @@
+//go:build !amd64
+// +build !amd64
+
+package crit
+
+import "github.com/checkpoint-restore/go-criu/v7/crit/images/cpuinfo"
+
+// CPUID is only used on amd64
+func cpuidX86Entry() *cpuinfo.CpuinfoX86Entry {
+	return nil
+}
@@ -0,0 +1,484 @@
+package crit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cpuinfo"
+	"google.golang.org/protobuf/proto"
+)
+
+// Version and number of words of the x86 capability
+// layout written by CRIU in cpuinfo_x86_entry
+const (
+	x86CapabilityVer = 2
+	x86NCapInts      = 19
+)
+
+// Words of the x86 capability layout
+const (
+	x86Cpuid1EDX        = 0
+	x86Cpuid80000001EDX = 1
+	x86Cpuid1ECX        = 4
+	x86Cpuid80000001ECX = 6
+	x86Cpuid7EBX        = 9
+	x86CpuidD1EAX       = 10
+	x86Cpuid7ECX        = 11
+	x86CpuidF1EDX       = 12
+	x86Cpuid80000008EBX = 13
+	x86Cpuid6EAX        = 14
+	x86Cpuid8000000AEDX = 15
+	x86CpuidF0EDX       = 16
+	x86Cpuid80000007EBX = 17
+	x86Cpuid7EDX        = 18
+)
+
+// x86Feature describes a bit of the x86 capability
+// layout. Only features which can be used by a restored
+// process are listed; all other bits are not compared.
+type x86Feature struct {
+	word int
+	bit  uint
+	name string
+	// Features required by CRIU to restore the FPU state
+	fpu bool
+}
+
+var x86Features = []x86Feature{
+	{x86Cpuid1EDX, 0, "fpu", true},
+	{x86Cpuid1EDX, 4, "tsc", false},
+	{x86Cpuid1EDX, 8, "cx8", false},
+	{x86Cpuid1EDX, 11, "sep", false},
+	{x86Cpuid1EDX, 15, "cmov", false},
+	{x86Cpuid1EDX, 19, "clflush", false},
+	{x86Cpuid1EDX, 23, "mmx", false},
+	{x86Cpuid1EDX, 24, "fxsr", true},
+	{x86Cpuid1EDX, 25, "sse", false},
+	{x86Cpuid1EDX, 26, "sse2", false},
+
+	{x86Cpuid80000001EDX, 11, "syscall", false},
+	{x86Cpuid80000001EDX, 20, "nx", false},
+	{x86Cpuid80000001EDX, 22, "mmxext", false},
+	{x86Cpuid80000001EDX, 27, "rdtscp", false},
+	{x86Cpuid80000001EDX, 29, "lm", false},
+	{x86Cpuid80000001EDX, 30, "3dnowext", false},
+	{x86Cpuid80000001EDX, 31, "3dnow", false},
+
+	{x86Cpuid1ECX, 0, "pni", false},
+	{x86Cpuid1ECX, 1, "pclmulqdq", false},
+	{x86Cpuid1ECX, 9, "ssse3", false},
+	{x86Cpuid1ECX, 12, "fma", false},
+	{x86Cpuid1ECX, 13, "cx16", false},
+	{x86Cpuid1ECX, 19, "sse4_1", false},
+	{x86Cpuid1ECX, 20, "sse4_2", false},
+	{x86Cpuid1ECX, 22, "movbe", false},
+	{x86Cpuid1ECX, 23, "popcnt", false},
+	{x86Cpuid1ECX, 25, "aes", false},
+	{x86Cpuid1ECX, 26, "xsave", false},
+	{x86Cpuid1ECX, 27, "osxsave", true},
+	{x86Cpuid1ECX, 28, "avx", false},
+	{x86Cpuid1ECX, 29, "f16c", false},
+	{x86Cpuid1ECX, 30, "rdrand", false},
+
+	{x86Cpuid80000001ECX, 0, "lahf_lm", false},
+	{x86Cpuid80000001ECX, 5, "abm", false},
+	{x86Cpuid80000001ECX, 6, "sse4a", false},
+	{x86Cpuid80000001ECX, 7, "misalignsse", false},
+	{x86Cpuid80000001ECX, 8, "3dnowprefetch", false},
+	{x86Cpuid80000001ECX, 11, "xop", false},
+	{x86Cpuid80000001ECX, 16, "fma4", false},
+	{x86Cpuid80000001ECX, 21, "tbm", false},
+	{x86Cpuid80000001ECX, 29, "mwaitx", false},
+
+	{x86Cpuid7EBX, 0, "fsgsbase", false},
+	{x86Cpuid7EBX, 3, "bmi1", false},
+	{x86Cpuid7EBX, 4, "hle", false},
+	{x86Cpuid7EBX, 5, "avx2", false},
+	{x86Cpuid7EBX, 8, "bmi2", false},
+	{x86Cpuid7EBX, 9, "erms", false},
+	{x86Cpuid7EBX, 11, "rtm", false},
+	{x86Cpuid7EBX, 14, "mpx", false},
+	{x86Cpuid7EBX, 16, "avx512f", false},
+	{x86Cpuid7EBX, 17, "avx512dq", false},
+	{x86Cpuid7EBX, 18, "rdseed", false},
+	{x86Cpuid7EBX, 19, "adx", false},
+	{x86Cpuid7EBX, 21, "avx512ifma", false},
+	{x86Cpuid7EBX, 23, "clflushopt", false},
+	{x86Cpuid7EBX, 24, "clwb", false},
+	{x86Cpuid7EBX, 26, "avx512pf", false},
+	{x86Cpuid7EBX, 27, "avx512er", false},
+	{x86Cpuid7EBX, 28, "avx512cd", false},
+	{x86Cpuid7EBX, 29, "sha_ni", false},
+	{x86Cpuid7EBX, 30, "avx512bw", false},
+	{x86Cpuid7EBX, 31, "avx512vl", false},
+
+	{x86CpuidD1EAX, 0, "xsaveopt", false},
+	{x86CpuidD1EAX, 1, "xsavec", false},
+	{x86CpuidD1EAX, 3, "xsaves", true},
+
+	{x86Cpuid7ECX, 1, "avx512vbmi", false},
+	{x86Cpuid7ECX, 3, "pku", false},
+	{x86Cpuid7ECX, 5, "waitpkg", false},
+	{x86Cpuid7ECX, 6, "avx512_vbmi2", false},
+	{x86Cpuid7ECX, 8, "gfni", false},
+	{x86Cpuid7ECX, 9, "vaes", false},
+	{x86Cpuid7ECX, 10, "vpclmulqdq", false},
+	{x86Cpuid7ECX, 11, "avx512_vnni", false},
+	{x86Cpuid7ECX, 12, "avx512_bitalg", false},
+	{x86Cpuid7ECX, 14, "avx512_vpopcntdq", false},
+	{x86Cpuid7ECX, 22, "rdpid", false},
+	{x86Cpuid7ECX, 25, "cldemote", false},
+	{x86Cpuid7ECX, 27, "movdiri", false},
+	{x86Cpuid7ECX, 28, "movdir64b", false},
+
+	{x86Cpuid7EDX, 2, "avx512_4vnniw", false},
+	{x86Cpuid7EDX, 3, "avx512_4fmaps", false},
+	{x86Cpuid7EDX, 4, "fsrm", false},
+	{x86Cpuid7EDX, 8, "avx512_vp2intersect", false},
+	{x86Cpuid7EDX, 14, "serialize", false},
+	{x86Cpuid7EDX, 16, "tsxldtrk", false},
+	{x86Cpuid7EDX, 22, "amx_bf16", false},
+	{x86Cpuid7EDX, 23, "avx512_fp16", false},
+	{x86Cpuid7EDX, 24, "amx_tile", false},
+	{x86Cpuid7EDX, 25, "amx_int8", false},
+}
+
+// Names of the state components of the XSAVE feature set
+var x86XFeatures = []string{
+	"x87", "sse", "avx", "bndregs", "bndcsr", "opmask", "zmm_hi256", "hi16_zmm",
+	"pt", "pkru", "pasid", "cet_user", "cet_supervisor", "hdc", "uintr", "lbr",
+	"hwp", "xtilecfg", "xtiledata", "apx",
+}
+
+func xFeatureName(bit int) string {
+	if bit < len(x86XFeatures) {
+		return x86XFeatures[bit]
+	}
+	return fmt.Sprintf("xfeature%d", bit)
+}
+
+// CPUReport contains the result of a comparison between
+// the CPU of a checkpoint and the CPU of a target host.
+type CPUReport struct {
+	// Missing lists the features of the source CPU
+	// which are not available on the target CPU
+	Missing  []string   `json:"missing"`
+	Problems []*Problem `json:"problems"`
+}
+
+// Compatible returns false if a restore on the
+// target CPU is refused by CRIU
+func (r *CPUReport) Compatible() bool {
+	for _, problem := range r.Problems {
+		if problem.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CPUReport) add(severity Severity, format string, a ...any) {
+	r.Problems = append(r.Problems, &Problem{
+		Severity: severity,
+		Check:    "cpu",
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+func (r *CPUReport) missing(severity Severity, name, format string, a ...any) {
+	r.Missing = append(r.Missing, name)
+	r.add(severity, format, a...)
+}
+
+// ReadCPUInfo reads the CPU description from a cpuinfo image
+func ReadCPUInfo(path string) (*cpuinfo.CpuinfoEntry, error) {
+	cpuinfoImg, err := getImg(path, &cpuinfo.CpuinfoEntry{})
+	if err != nil {
+		return nil, err
+	}
+	if len(cpuinfoImg.Entries) == 0 {
+		return nil, errors.New("no entries in cpuinfo image")
+	}
+	return cpuinfoImg.Entries[0].Message.(*cpuinfo.CpuinfoEntry), nil
+}
+
+// CheckCPU compares the CPU recorded in the checkpoint
+// directory with the CPU of the current host.
+func CheckCPU(dir string) (*CPUReport, error) {
+	source, err := ReadCPUInfo(filepath.Join(dir, "cpuinfo.img"))
+	if err != nil {
+		return nil, err
+	}
+	target, err := HostCPUInfo()
+	if err != nil {
+		return nil, err
+	}
+	return CompareCPUInfo(source, target), nil
+}
+
+// CompareCPUInfo reports the features of the source CPU which
+// are missing on the target CPU. As CRIU compares only the FPU
+// state by default, missing XSAVE state components and FPU
+// features make a restore fail and are reported as errors.
+// Other missing instruction set extensions are reported as
+// warnings: they make a restore fail only if CRIU is asked to
+// compare instruction sets, otherwise the restored process
+// crashes once it uses them.
+// Both descriptions may be read from images, which allows
+// to compare two hosts offline.
+func CompareCPUInfo(source, target *cpuinfo.CpuinfoEntry) *CPUReport {
+	report := &CPUReport{
+		Missing:  make([]string, 0),
+		Problems: make([]*Problem, 0),
+	}
+
+	// CRIU does not describe the CPU on other architectures
+	sourceArch, targetArch := cpuArch(source), cpuArch(target)
+	if sourceArch == "" {
+		return report
+	}
+	if sourceArch != targetArch {
+		if targetArch == "" {
+			targetArch = "an unknown architecture"
+		}
+		report.add(SeverityError, "checkpoint was created on %s, target is %s", sourceArch, targetArch)
+		return report
+	}
+
+	switch sourceArch {
+	case "x86":
+		compareX86(source.GetX86Entry()[0], target.GetX86Entry()[0], report)
+	case "ppc64":
+		sourcePpc64, targetPpc64 := source.GetPpc64Entry()[0], target.GetPpc64Entry()[0]
+		if sourcePpc64.GetEndian() != targetPpc64.GetEndian() {
+			report.add(SeverityError, "checkpoint was created on a %s CPU, target is %s",
+				sourcePpc64.GetEndian(), targetPpc64.GetEndian())
+		}
+		compareHwcap(sourcePpc64.GetHwcap(), targetPpc64.GetHwcap(), report)
+	case "s390":
+		compareHwcap(source.GetS390Entry()[0].GetHwcap(), target.GetS390Entry()[0].GetHwcap(), report)
+	}
+
+	return report
+}
+
+// Helper to get the architecture of a CPU description
+func cpuArch(info *cpuinfo.CpuinfoEntry) string {
+	switch {
+	case len(info.GetX86Entry()) > 0:
+		return "x86"
+	case len(info.GetPpc64Entry()) > 0:
+		return "ppc64"
+	case len(info.GetS390Entry()) > 0:
+		return "s390"
+	}
+	return ""
+}
+
+func compareX86(source, target *cpuinfo.CpuinfoX86Entry, report *CPUReport) {
+	if source.GetVendorId() != target.GetVendorId() {
+		report.add(SeverityWarning, "checkpoint was created on a %s CPU, target is %s",
+			source.GetVendorId(), target.GetVendorId())
+	}
+
+	sourceCaps, targetCaps := source.GetCapability(), target.GetCapability()
+	for _, feature := range x86Features {
+		if feature.word >= len(sourceCaps) || feature.word >= len(targetCaps) {
+			continue
+		}
+		mask := uint32(1) << feature.bit
+		if sourceCaps[feature.word]&mask == 0 || targetCaps[feature.word]&mask != 0 {
+			continue
+		}
+		if feature.fpu {
+			report.missing(SeverityError, feature.name, "feature %s is required to restore the FPU state", feature.name)
+		} else {
+			report.missing(SeverityWarning, feature.name, "feature %s is not available on the target", feature.name)
+		}
+	}
+
+	// The XSAVE layout is unknown if the target was read from /proc/cpuinfo
+	if source.XfeaturesMask == nil || target.XfeaturesMask == nil {
+		return
+	}
+	missing := source.GetXfeaturesMask() &^ target.GetXfeaturesMask()
+	for bit := 0; bit < 64; bit++ {
+		if missing&(1<<bit) == 0 {
+			continue
+		}
+		name := xFeatureName(bit)
+		report.missing(SeverityError, "xstate:"+name, "XSAVE state component %s is not available on the target", name)
+	}
+	if source.GetXsaveSize() > target.GetXsaveSizeMax() {
+		report.add(SeverityError, "XSAVE area of %d bytes does not fit into %d bytes on the target",
+			source.GetXsaveSize(), target.GetXsaveSizeMax())
+	}
+}
+
+func compareHwcap(source, target []uint64, report *CPUReport) {
+	for i, hwcap := range source {
+		var targetHwcap uint64
+		if i < len(target) {
+			targetHwcap = target[i]
+		}
+		auxName := "AT_HWCAP"
+		if i > 0 {
+			auxName = fmt.Sprintf("AT_HWCAP%d", i+1)
+		}
+		missing := hwcap &^ targetHwcap
+		for bit := 0; bit < 64; bit++ {
+			if missing&(1<<bit) == 0 {
+				continue
+			}
+			name := fmt.Sprintf("%s:%d", auxName, bit)
+			report.missing(SeverityError, name, "hardware capability %d of %s is not available on the target",
+				bit, auxName)
+		}
+	}
+}
+
+// HostCPUInfo returns a description of the CPU of the
+// current host in the format used by the cpuinfo image.
+// On amd64, it is read with the CPUID instruction; other
+// architectures use /proc/cpuinfo and the auxiliary vector.
+func HostCPUInfo() (*cpuinfo.CpuinfoEntry, error) {
+	if x86 := cpuidX86Entry(); x86 != nil {
+		return &cpuinfo.CpuinfoEntry{X86Entry: []*cpuinfo.CpuinfoX86Entry{x86}}, nil
+	}
+
+	switch runtime.GOARCH {
+	case "386":
+		x86, err := procCPUInfoX86Entry()
+		if err != nil {
+			return nil, err
+		}
+		return &cpuinfo.CpuinfoEntry{X86Entry: []*cpuinfo.CpuinfoX86Entry{x86}}, nil
+	case "ppc64", "ppc64le":
+		hwcap, err := auxvHwcap()
+		if err != nil {
+			return nil, err
+		}
+		endian := cpuinfo.CpuinfoPpc64Entry_LITTLEENDIAN
+		if runtime.GOARCH == "ppc64" {
+			endian = cpuinfo.CpuinfoPpc64Entry_BIGENDIAN
+		}
+		return &cpuinfo.CpuinfoEntry{Ppc64Entry: []*cpuinfo.CpuinfoPpc64Entry{{
+			Endian: endian.Enum(),
+			Hwcap:  hwcap,
+		}}}, nil
+	case "s390x":
+		hwcap, err := auxvHwcap()
+		if err != nil {
+			return nil, err
+		}
+		return &cpuinfo.CpuinfoEntry{S390Entry: []*cpuinfo.CpuinfoS390Entry{{
+			Hwcap: hwcap,
+		}}}, nil
+	}
+
+	return nil, fmt.Errorf("CPU description is not supported on %s", runtime.GOARCH)
+}
+
+// Helper to build an x86 CPU description from the flags in /proc/cpuinfo
+func procCPUInfoX86Entry() (*cpuinfo.CpuinfoX86Entry, error) {
+	f, err := os.Open(filepath.Join(hostProcPath, "cpuinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	featureBits := make(map[string]x86Feature, len(x86Features))
+	for _, feature := range x86Features {
+		featureBits[feature.name] = feature
+	}
+
+	x86 := &cpuinfo.CpuinfoX86Entry{
+		VendorId:      cpuinfo.CpuinfoX86Entry_UNKNOWN.Enum(),
+		CpuFamily:     proto.Uint32(0),
+		Model:         proto.Uint32(0),
+		Stepping:      proto.Uint32(0),
+		CapabilityVer: proto.Uint32(x86CapabilityVer),
+		Capability:    make([]uint32, x86NCapInts),
+	}
+
+	// Only the first CPU is described
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			if strings.TrimSpace(key) == "" {
+				break
+			}
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		number, _ := strconv.ParseUint(value, 10, 32)
+		switch key {
+		case "vendor_id":
+			switch value {
+			case "GenuineIntel":
+				x86.VendorId = cpuinfo.CpuinfoX86Entry_INTEL.Enum()
+			case "AuthenticAMD":
+				x86.VendorId = cpuinfo.CpuinfoX86Entry_AMD.Enum()
+			}
+		case "cpu family":
+			x86.CpuFamily = proto.Uint32(uint32(number))
+		case "model":
+			x86.Model = proto.Uint32(uint32(number))
+		case "stepping":
+			x86.Stepping = proto.Uint32(uint32(number))
+		case "model name":
+			x86.ModelId = proto.String(value)
+		case "flags":
+			for _, flag := range strings.Fields(value) {
+				if feature, ok := featureBits[flag]; ok {
+					x86.Capability[feature.word] |= 1 << feature.bit
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return x86, nil
+}
+
+// Values of AT_HWCAP and AT_HWCAP2 in the auxiliary vector
+const (
+	atHwcap  = 16
+	atHwcap2 = 26
+)
+
+// Helper to read AT_HWCAP and AT_HWCAP2 of the current process
+func auxvHwcap() ([]uint64, error) {
+	data, err := os.ReadFile(filepath.Join(hostProcPath, "self", "auxv"))
+	if err != nil {
+		return nil, err
+	}
+
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	switch runtime.GOARCH {
+	case "ppc64", "s390x":
+		byteOrder = binary.BigEndian
+	}
+
+	hwcap := make([]uint64, 2)
+	for i := 0; i+16 <= len(data); i += 16 {
+		switch byteOrder.Uint64(data[i:]) {
+		case atHwcap:
+			hwcap[0] = byteOrder.Uint64(data[i+8:])
+		case atHwcap2:
+			hwcap[1] = byteOrder.Uint64(data[i+8:])
+		}
+	}
+
+	return hwcap, nil
+}
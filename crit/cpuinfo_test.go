@@ -0,0 +1,138 @@
+package crit
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cpuinfo"
+	"google.golang.org/protobuf/proto"
+)
+
+func testCPUInfo(caps map[int]uint32, xfeatures uint64, xsaveSize uint32) *cpuinfo.CpuinfoEntry {
+	capability := make([]uint32, x86NCapInts)
+	for word, bits := range caps {
+		capability[word] = bits
+	}
+	return &cpuinfo.CpuinfoEntry{
+		X86Entry: []*cpuinfo.CpuinfoX86Entry{{
+			VendorId:      cpuinfo.CpuinfoX86Entry_INTEL.Enum(),
+			CpuFamily:     proto.Uint32(6),
+			Model:         proto.Uint32(85),
+			Stepping:      proto.Uint32(4),
+			CapabilityVer: proto.Uint32(x86CapabilityVer),
+			Capability:    capability,
+			XfeaturesMask: proto.Uint64(xfeatures),
+			XsaveSize:     proto.Uint32(xsaveSize),
+			XsaveSizeMax:  proto.Uint32(xsaveSize),
+		}},
+	}
+}
+
+func TestCompareCPUInfo(t *testing.T) {
+	dir := t.TempDir()
+	// fpu, fxsr, osxsave, avx and avx2 with x87, SSE and AVX state
+	writeTestImg(t, dir, "source.img", "CPUINFO", testCPUInfo(map[int]uint32{
+		x86Cpuid1EDX: 1<<0 | 1<<24,
+		x86Cpuid1ECX: 1<<27 | 1<<28,
+		x86Cpuid7EBX: 1 << 5,
+	}, 0x7, 832))
+	// fpu, fxsr and osxsave with x87 and SSE state
+	writeTestImg(t, dir, "target.img", "CPUINFO", testCPUInfo(map[int]uint32{
+		x86Cpuid1EDX: 1<<0 | 1<<24,
+		x86Cpuid1ECX: 1 << 27,
+	}, 0x3, 576))
+
+	source, err := ReadCPUInfo(filepath.Join(dir, "source.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := ReadCPUInfo(filepath.Join(dir, "target.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := CompareCPUInfo(source, target)
+	want := []string{"avx", "avx2", "xstate:avx"}
+	if len(report.Missing) != len(want) {
+		t.Fatalf("want missing features %v, got %v", want, report.Missing)
+	}
+	for i := range want {
+		if report.Missing[i] != want[i] {
+			t.Errorf("want: %s, got: %s", want[i], report.Missing[i])
+		}
+	}
+	if report.Compatible() {
+		t.Error("expected incompatible CPUs")
+	}
+	// Missing instructions, missing state component and xsave size
+	if len(report.Problems) != 4 {
+		t.Errorf("want 4 problems, got %d", len(report.Problems))
+	}
+
+	report = CompareCPUInfo(target, source)
+	if len(report.Missing) != 0 || !report.Compatible() {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	s390 := &cpuinfo.CpuinfoEntry{S390Entry: []*cpuinfo.CpuinfoS390Entry{{Hwcap: []uint64{0x3, 0}}}}
+	if CompareCPUInfo(source, s390).Compatible() {
+		t.Error("expected incompatible architectures")
+	}
+	report = CompareCPUInfo(s390, &cpuinfo.CpuinfoEntry{
+		S390Entry: []*cpuinfo.CpuinfoS390Entry{{Hwcap: []uint64{0x1, 0}}},
+	})
+	if len(report.Missing) != 1 || report.Missing[0] != "AT_HWCAP:1" {
+		t.Errorf("unexpected missing features %v", report.Missing)
+	}
+}
+
+func TestHostCPUInfo(t *testing.T) {
+	procDir := t.TempDir()
+	defer func(path string) { hostProcPath = path }(hostProcPath)
+	hostProcPath = procDir
+	procCPUInfo := []byte("processor\t: 0\n" +
+		"vendor_id\t: AuthenticAMD\n" +
+		"cpu family\t: 25\n" +
+		"model\t\t: 33\n" +
+		"model name\t: AMD Ryzen 9 5950X 16-Core Processor\n" +
+		"stepping\t: 0\n" +
+		"flags\t\t: fpu vme fxsr sse sse2 ssse3 avx avx2 rep_good\n" +
+		"\n" +
+		"processor\t: 1\n" +
+		"flags\t\t: fpu avx512f\n")
+	if err := os.WriteFile(filepath.Join(procDir, "cpuinfo"), procCPUInfo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	x86, err := procCPUInfoX86Entry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x86.GetVendorId() != cpuinfo.CpuinfoX86Entry_AMD || x86.GetCpuFamily() != 25 || x86.GetModel() != 33 {
+		t.Errorf("unexpected CPU %+v", x86)
+	}
+	caps := x86.GetCapability()
+	if caps[x86Cpuid1EDX] != 1<<0|1<<24|1<<25|1<<26 {
+		t.Errorf("unexpected capability word 0: %#x", caps[x86Cpuid1EDX])
+	}
+	if caps[x86Cpuid7EBX] != 1<<5 {
+		t.Errorf("unexpected capability word 9: %#x", caps[x86Cpuid7EBX])
+	}
+
+	if runtime.GOARCH != "amd64" {
+		return
+	}
+	host, err := HostCPUInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostX86 := host.GetX86Entry()[0]
+	if hostX86.GetCapability()[x86Cpuid1EDX]&1 == 0 {
+		t.Error("expected fpu on the host")
+	}
+	if report := CompareCPUInfo(host, host); !report.Compatible() {
+		t.Errorf("host is not compatible with itself: %+v", report.Problems)
+	}
+}
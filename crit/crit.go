@@ -34,6 +34,7 @@ type Critter interface {
 // * Path of the input directory (for `crit explore`)
 // * Boolean to format and indent JSON output
 // * Boolean to skip payload data
+// * Checkpoint of the input directory
 type crit struct {
 	inputFile  *os.File
 	outputFile *os.File
@@ -41,6 +42,7 @@ type crit struct {
 	inputDirPath string
 	pretty       bool
 	noPayload    bool
+	checkpoint   *Checkpoint
 }
 
 // New creates an instance of the CRIT service
@@ -55,13 +57,14 @@ func New(
 		inputDirPath: inputDirPath,
 		pretty:       pretty,
 		noPayload:    noPayload,
+		checkpoint:   newCheckpoint(inputDirPath),
 	}
 }
 
 // Decode loads a binary image file into a CriuImage object
 func (c *crit) Decode(entryType proto.Message) (*CriuImage, error) {
 	// Convert binary image to Go struct
-	return decodeImg(c.inputFile, entryType, c.noPayload)
+	return decodeImg(c.inputFile, entryType, c.noPayload, DefaultDecodeLimits)
 }
 
 // Info loads a binary image file into a CriuImage object
@@ -93,3 +96,28 @@ func (c *crit) Encode(img *CriuImage) error {
 	// Convert JSON to Go struct
 	return encodeImg(img, c.outputFile)
 }
+
+// ExplorePs constructs the process tree of the input directory
+func (c *crit) ExplorePs() (*PsTree, error) {
+	return c.checkpoint.ExplorePs()
+}
+
+// ExploreFds returns the open files of the input directory
+func (c *crit) ExploreFds() ([]*Fd, error) {
+	return c.checkpoint.ExploreFds()
+}
+
+// ExploreMems returns the memory mappings of the input directory
+func (c *crit) ExploreMems() ([]*MemMap, error) {
+	return c.checkpoint.ExploreMems()
+}
+
+// ExploreRss returns the RSS mappings of the input directory
+func (c *crit) ExploreRss() ([]*RssMap, error) {
+	return c.checkpoint.ExploreRss()
+}
+
+// ExploreSk returns the sockets of the input directory
+func (c *crit) ExploreSk() ([]*Sk, error) {
+	return c.checkpoint.ExploreSk()
+}
@@ -0,0 +1,247 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// CriuDir represents all files of a checkpoint directory
+type CriuDir struct {
+	Images []*CriuDirImage `json:"images"`
+}
+
+// CriuDirImage represents a single file of a checkpoint
+// directory. Protobuf images are decoded into Image. Other
+// files, such as pages-*.img, are either embedded in Data
+// or referenced by Path, which is relative to the document.
+// Symlinks, such as the parent link of an incremental
+// checkpoint, are recorded with their target in Link.
+type CriuDirImage struct {
+	Name  string     `json:"name"`
+	Image *CriuImage `json:"image,omitempty"`
+	Data  []byte     `json:"data,omitempty"`
+	Path  string     `json:"path,omitempty"`
+	Link  string     `json:"link,omitempty"`
+}
+
+// readLinkFS is implemented by file systems
+// which can read the target of a symlink,
+// such as the one returned by os.DirFS()
+// since Go 1.25
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+// Helper to record a symlink of a checkpoint directory. File
+// systems of os.DirFS() without ReadLink are read from their root.
+func readDirLink(fsys fs.FS, name string) (*CriuDirImage, error) {
+	var link string
+	var err error
+	if linkFS, ok := fsys.(readLinkFS); ok {
+		link, err = linkFS.ReadLink(name)
+	} else if root, ok := dirFSRoot(fsys); ok {
+		link, err = os.Readlink(filepath.Join(root, filepath.FromSlash(name)))
+	} else {
+		return nil, fmt.Errorf("cannot read symlink %s from %T", name, fsys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CriuDirImage{Name: name, Link: link}, nil
+}
+
+// Helper to get the root directory of a file system
+// returned by os.DirFS(), whose type is a string
+func dirFSRoot(fsys fs.FS) (string, bool) {
+	if reflect.TypeOf(fsys) != reflect.TypeOf(os.DirFS("")) {
+		return "", false
+	}
+	return reflect.ValueOf(fsys).String(), true
+}
+
+// UnmarshalJSON is the unmarshaler for CriuDirImage.
+// This is required as the entry type of the image
+// depends on its magic, which has to be read first.
+func (i *CriuDirImage) UnmarshalJSON(data []byte) error {
+	var dirImage struct {
+		Name  string          `json:"name"`
+		Image json.RawMessage `json:"image"`
+		Data  []byte          `json:"data"`
+		Path  string          `json:"path"`
+		Link  string          `json:"link"`
+	}
+	if err := json.Unmarshal(data, &dirImage); err != nil {
+		return err
+	}
+	i.Name = dirImage.Name
+	i.Data = dirImage.Data
+	i.Path = dirImage.Path
+	i.Link = dirImage.Link
+
+	if len(dirImage.Image) == 0 || string(dirImage.Image) == "null" {
+		return nil
+	}
+	img, err := unmarshalDirImage(dirImage.Image)
+	if err != nil {
+		return err
+	}
+	i.Image = img
+	return nil
+}
+
+// Helper to unmarshal a JSON image
+// with the entry type of its magic
+func unmarshalDirImage(data []byte) (*CriuImage, error) {
+	var header struct {
+		Magic string `json:"magic"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	entryType, err := GetEntryType(header.Magic)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &CriuImage{EntryType: entryType}
+	if err := json.Unmarshal(data, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// DecodeDir decodes every file of the checkpoint in fsys. Files
+// which are not protobuf images, as well as images which would
+// not be encoded back to the same bytes, are embedded as raw
+// data if embedRaw is true, or referenced by their path in fsys
+// otherwise. Memory pages are never decoded.
+func DecodeDir(fsys fs.FS, embedRaw bool) (*CriuDir, error) {
+	dir := &CriuDir{Images: make([]*CriuDirImage, 0)}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			dirImage, err := readDirLink(fsys, name)
+			if err != nil {
+				return err
+			}
+			dir.Images = append(dir.Images, dirImage)
+			return nil
+		}
+
+		dirImage := &CriuDirImage{Name: name}
+		pages, _ := path.Match("pages-*.img", path.Base(name))
+		if pages && !embedRaw {
+			dirImage.Path = name
+			dir.Images = append(dir.Images, dirImage)
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if !pages {
+			dirImage.Image = decodeDirImage(data)
+		}
+		if dirImage.Image == nil {
+			if embedRaw {
+				dirImage.Data = data
+			} else {
+				dirImage.Path = name
+			}
+		}
+		dir.Images = append(dir.Images, dirImage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dir, nil
+}
+
+// Helper to decode a protobuf image of a checkpoint directory.
+// The JSON representation drops fields which are unknown to
+// the bindings, so nil is returned unless the image can be
+// rebuilt from its JSON representation.
+func decodeDirImage(data []byte) *CriuImage {
+	magic, err := readMagic(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	entryType, err := GetEntryType(magic)
+	if err != nil {
+		return nil
+	}
+	img, err := decodeImg(bytes.NewReader(data), entryType, false, DefaultDecodeLimits)
+	if err != nil {
+		return nil
+	}
+
+	jsonData, err := json.Marshal(img)
+	if err != nil {
+		return nil
+	}
+	rebuiltImg, err := unmarshalDirImage(jsonData)
+	if err != nil {
+		return nil
+	}
+	var rebuilt bytes.Buffer
+	if err := encodeImg(rebuiltImg, &rebuilt); err != nil || !bytes.Equal(rebuilt.Bytes(), data) {
+		return nil
+	}
+
+	return img
+}
+
+// ReadDirJSON reads a checkpoint written by WriteDirJSON().
+// Files with a .json suffix are decoded as images, symlinks
+// are recorded with their target, and all other files are
+// referenced by their path in fsys.
+func ReadDirJSON(fsys fs.FS) (*CriuDir, error) {
+	dir := &CriuDir{Images: make([]*CriuDirImage, 0)}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			dirImage, err := readDirLink(fsys, name)
+			if err != nil {
+				return err
+			}
+			dir.Images = append(dir.Images, dirImage)
+			return nil
+		}
+
+		if !strings.HasSuffix(name, jsonSuffix) {
+			dir.Images = append(dir.Images, &CriuDirImage{Name: name, Path: name})
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		img, err := unmarshalDirImage(data)
+		if err != nil {
+			return fmt.Errorf("error decoding %s: %w", name, err)
+		}
+		dir.Images = append(dir.Images, &CriuDirImage{
+			Name:  strings.TrimSuffix(name, jsonSuffix),
+			Image: img,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dir, nil
+}
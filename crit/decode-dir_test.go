@@ -0,0 +1,171 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Helper to check that two directories contain the same files
+func compareTestDirs(t *testing.T, want, got string) {
+	t.Helper()
+	entries, err := os.ReadDir(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotEntries, err := os.ReadDir(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotEntries) != len(entries) {
+		t.Errorf("want %d files, got %d", len(entries), len(gotEntries))
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink != 0 {
+			wantLink, _ := os.Readlink(filepath.Join(want, entry.Name()))
+			gotLink, err := os.Readlink(filepath.Join(got, entry.Name()))
+			if err != nil || gotLink != wantLink {
+				t.Errorf("want symlink %s to %s, got %q (%v)", entry.Name(), wantLink, gotLink, err)
+			}
+			continue
+		}
+		wantData, err := os.ReadFile(filepath.Join(want, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, err := os.ReadFile(filepath.Join(got, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wantData, gotData) {
+			t.Errorf("%s differs", entry.Name())
+		}
+	}
+}
+
+func TestDecodeDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFds(t, dir, "/a")
+	writeTestMemory(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, "dump.log"), []byte("log"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Fields unknown to the bindings are lost in JSON
+	unknown := testFdInfo(2, 1, fdinfo.FdTypes_REG)
+	unknown.ProtoReflect().SetUnknown(protowire.AppendVarint(protowire.AppendTag(nil, 1000, protowire.VarintType), 1))
+	writeTestImg(t, dir, "fdinfo-2.img", "FDINFO", unknown)
+	if err := os.Symlink("../pre-dump", filepath.Join(dir, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	criuDir, err := DecodeDir(os.DirFS(dir), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dirImage := range criuDir.Images {
+		decoded := dirImage.Image != nil
+		switch dirImage.Name {
+		case "files.img", "pagemap-1.img":
+			if !decoded {
+				t.Errorf("%s is not decoded", dirImage.Name)
+			}
+		case "pages-1.img", "dump.log", "fdinfo-2.img":
+			if decoded || dirImage.Data == nil {
+				t.Errorf("%s is not embedded", dirImage.Name)
+			}
+		case "parent":
+			if dirImage.Link != "../pre-dump" {
+				t.Errorf("unexpected parent %+v", dirImage)
+			}
+		}
+	}
+
+	jsonData, err := json.MarshalIndent(criuDir, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedDir := &CriuDir{}
+	if err := json.Unmarshal(jsonData, parsedDir); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	if err := EncodeDir(parsedDir, outDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	compareTestDirs(t, dir, outDir)
+
+	// Directory of JSON files
+	criuDir, err = DecodeDir(os.DirFS(dir), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonDir := t.TempDir()
+	if err := WriteDirJSON(criuDir, jsonDir, os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(jsonDir, "files.img.json")); err != nil {
+		t.Error(err)
+	}
+	parsedDir, err = ReadDirJSON(os.DirFS(jsonDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir = t.TempDir()
+	if err := EncodeDir(parsedDir, outDir, os.DirFS(jsonDir)); err != nil {
+		t.Fatal(err)
+	}
+	compareTestDirs(t, dir, outDir)
+
+	badDir := &CriuDir{Images: []*CriuDirImage{{Name: "../escape.img"}}}
+	if err := EncodeDir(badDir, t.TempDir(), nil); err == nil {
+		t.Error("expected error for name outside of the directory")
+	}
+	badDir = &CriuDir{Images: []*CriuDirImage{{Name: "parent", Link: "/tmp"}, {Name: "parent/escape.img"}}}
+	if err := EncodeDir(badDir, t.TempDir(), nil); err == nil {
+		t.Error("expected error for name below a symlink")
+	}
+
+	// A file must not be written through a symlink of the same
+	// name, whether it is in the document or in the directory
+	target := filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(target, []byte("target"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	badDir = &CriuDir{Images: []*CriuDirImage{{Name: "pages-1.img", Link: target}, {Name: "pages-1.img", Data: []byte("x")}}}
+	if err := EncodeDir(badDir, t.TempDir(), nil); err == nil {
+		t.Error("expected error for duplicate names")
+	}
+	outDir = t.TempDir()
+	if err := os.Symlink(target, filepath.Join(outDir, "pages-1.img")); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeDir(&CriuDir{Images: []*CriuDirImage{{Name: "pages-1.img", Data: []byte("x")}}}, outDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "target" {
+		t.Errorf("file has been written through a symlink: %q %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outDir, "pages-1.img")); err != nil || string(data) != "x" {
+		t.Errorf("unexpected file %q %v", data, err)
+	}
+}
+
+func TestDirFSRoot(t *testing.T) {
+	dir := t.TempDir()
+	if root, ok := dirFSRoot(os.DirFS(dir)); !ok || root != dir {
+		t.Errorf("unexpected root %q of os.DirFS(%q)", root, dir)
+	}
+	if _, ok := dirFSRoot(os.DirFS(dir).(fs.StatFS)); !ok {
+		t.Error("root of os.DirFS() behind an interface not found")
+	}
+	if _, ok := dirFSRoot(fstest.MapFS{}); ok {
+		t.Error("unexpected root of a MapFS")
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"os"
 
 	bpfmap_data "github.com/checkpoint-restore/go-criu/v7/crit/images/bpfmap-data"
+	ghost_file "github.com/checkpoint-restore/go-criu/v7/crit/images/ghost-file"
 	ipc_msg "github.com/checkpoint-restore/go-criu/v7/crit/images/ipc-msg"
 	ipc_sem "github.com/checkpoint-restore/go-criu/v7/crit/images/ipc-sem"
 	ipc_shm "github.com/checkpoint-restore/go-criu/v7/crit/images/ipc-shm"
@@ -19,9 +19,46 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// Extra data handler for ghost files. The contents of a
+// ghost file either follow the primary entry until the end
+// of the image, or are split into chunks with an entry each.
+func decodeGhostData(
+	f io.Reader,
+	payload proto.Message,
+	noPayload bool,
+) (string, error) {
+	var extraBuf []byte
+	var err error
+	switch p := payload.(type) {
+	case *ghost_file.GhostFileEntry:
+		if p.GetChunks() {
+			return "", nil
+		}
+		if noPayload {
+			_, err = io.Copy(io.Discard, f)
+			return "", err
+		}
+		if extraBuf, err = io.ReadAll(f); err != nil {
+			return "", err
+		}
+	case *ghost_file.GhostChunkEntry:
+		if noPayload {
+			_, err = io.CopyN(io.Discard, f, int64(p.GetLen()))
+			return "", err
+		}
+		extraBuf, err = readFullBuf(f, int64(p.GetLen()))
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("unable to assert payload type")
+	}
+	return base64.StdEncoding.EncodeToString(extraBuf), nil
+}
+
 // Extra data handler for pipe and FIFO data
 func decodePipesData(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -32,14 +69,13 @@ func decodePipesData(
 	extraSize := p.GetBytes()
 
 	if noPayload {
-		_, err := f.Seek(int64(extraSize), 1)
-		if err != nil {
+		if _, err := io.CopyN(io.Discard, f, int64(extraSize)); err != nil {
 			return "", err
 		}
 		return countBytes(int64(extraSize)), nil
 	}
-	extraBuf := make([]byte, extraSize)
-	if _, err := f.Read(extraBuf); err != nil {
+	extraBuf, err := readFullBuf(f, int64(extraSize))
+	if err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(extraBuf), nil
@@ -47,7 +83,7 @@ func decodePipesData(
 
 // Extra data handler for socket queues
 func decodeSkQueues(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -58,14 +94,13 @@ func decodeSkQueues(
 	extraSize := p.GetLength()
 
 	if noPayload {
-		_, err := f.Seek(int64(extraSize), 1)
-		if err != nil {
+		if _, err := io.CopyN(io.Discard, f, int64(extraSize)); err != nil {
 			return "", err
 		}
 		return countBytes(int64(extraSize)), nil
 	}
-	extraBuf := make([]byte, extraSize)
-	if _, err := f.Read(extraBuf); err != nil {
+	extraBuf, err := readFullBuf(f, int64(extraSize))
+	if err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(extraBuf), nil
@@ -78,7 +113,7 @@ type tcpStreamExtra struct {
 
 // Extra data handler for TCP streams
 func decodeTCPStream(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -90,21 +125,20 @@ func decodeTCPStream(
 	outQLen := p.GetOutqLen()
 
 	if noPayload {
-		_, err := f.Seek(0, 2)
-		if err != nil {
+		if _, err := io.CopyN(io.Discard, f, int64(inQLen)+int64(outQLen)); err != nil {
 			return "", err
 		}
-		return countBytes(int64(inQLen + outQLen)), nil
+		return countBytes(int64(inQLen) + int64(outQLen)), nil
 	}
 
 	extra := tcpStreamExtra{}
-	extraBuf := make([]byte, inQLen)
-	if _, err := f.Read(extraBuf); err != nil {
+	extraBuf, err := readFullBuf(f, int64(inQLen))
+	if err != nil {
 		return "", err
 	}
 	extra.InQ = base64.StdEncoding.EncodeToString(extraBuf)
-	extraBuf = make([]byte, outQLen)
-	if _, err := f.Read(extraBuf); err != nil {
+	extraBuf, err = readFullBuf(f, int64(outQLen))
+	if err != nil {
 		return "", err
 	}
 	extra.OutQ = base64.StdEncoding.EncodeToString(extraBuf)
@@ -115,7 +149,7 @@ func decodeTCPStream(
 
 // Extra data handler for BPF map data
 func decodeBpfmapData(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -126,14 +160,13 @@ func decodeBpfmapData(
 	extraSize := p.GetKeysBytes() + p.GetValuesBytes()
 
 	if noPayload {
-		_, err := f.Seek(int64(extraSize), 1)
-		if err != nil {
+		if _, err := io.CopyN(io.Discard, f, int64(extraSize)); err != nil {
 			return "", err
 		}
 		return countBytes(int64(extraSize)), nil
 	}
-	extraBuf := make([]byte, extraSize)
-	if _, err := f.Read(extraBuf); err != nil {
+	extraBuf, err := readFullBuf(f, int64(extraSize))
+	if err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(extraBuf), nil
@@ -141,7 +174,7 @@ func decodeBpfmapData(
 
 // Extra data handler for IPC semaphores
 func decodeIpcSem(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -155,8 +188,7 @@ func decodeIpcSem(
 	roundedSize := (extraSize/8 + 1) * 8
 
 	if noPayload {
-		_, err := f.Seek(roundedSize, 1)
-		if err != nil {
+		if _, err := io.CopyN(io.Discard, f, roundedSize); err != nil {
 			return "", err
 		}
 		return countBytes(extraSize), nil
@@ -165,13 +197,12 @@ func decodeIpcSem(
 	for i := 0; i < int(extraSize/2); i++ {
 		// Create 16-bit buffer
 		extraBuf := make([]byte, 2)
-		if _, err := f.Read(extraBuf); err != nil {
+		if _, err := io.ReadFull(f, extraBuf); err != nil {
 			return "", err
 		}
 		extraPayload = append(extraPayload, binary.LittleEndian.Uint16(extraBuf))
 	}
-	_, err := f.Seek(roundedSize-extraSize, 1)
-	if err != nil {
+	if _, err := io.CopyN(io.Discard, f, roundedSize-extraSize); err != nil {
 		return "", err
 	}
 	extraJSON, err := json.Marshal(extraPayload)
@@ -180,7 +211,7 @@ func decodeIpcSem(
 
 // Extra data handler for IPC shared memory
 func decodeIpcShm(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -189,22 +220,20 @@ func decodeIpcShm(
 		return "", errors.New("unable to assert payload type")
 	}
 	extraSize := int64(p.GetSize())
-	// Round off to nearest 32-bit multiple
-	roundedSize := (extraSize/4 + 1) * 4
+	// Round up to nearest 32-bit multiple
+	roundedSize := (extraSize + 3) / 4 * 4
 
 	if noPayload {
-		_, err := f.Seek(roundedSize, 1)
-		if err != nil {
+		if _, err := io.CopyN(io.Discard, f, roundedSize); err != nil {
 			return "", err
 		}
 		return countBytes(extraSize), nil
 	}
-	extraBuf := make([]byte, extraSize)
-	if _, err := f.Read(extraBuf); err != nil {
+	extraBuf, err := readFullBuf(f, extraSize)
+	if err != nil {
 		return "", err
 	}
-	_, err := f.Seek(roundedSize-extraSize, 1)
-	if err != nil {
+	if _, err := io.CopyN(io.Discard, f, roundedSize-extraSize); err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(extraBuf), nil
@@ -212,7 +241,7 @@ func decodeIpcShm(
 
 // Extra data handler for IPC messages
 func decodeIpcMsg(
-	f *os.File,
+	f io.Reader,
 	payload proto.Message,
 	noPayload bool,
 ) (string, error) {
@@ -228,20 +257,19 @@ func decodeIpcMsg(
 	extraPayload := []string{}
 
 	for i := 0; i < int(msgQNum); i++ {
-		n, err := f.Read(sizeBuf)
-		if n == 0 {
+		if _, err := io.ReadFull(f, sizeBuf); err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
 			return "", err
 		}
 		extraSize := uint64(binary.LittleEndian.Uint32(sizeBuf))
-		msgBuf := make([]byte, extraSize)
-		if _, err = f.Read(msgBuf); err != nil {
+		msgBuf, err := readFullBuf(f, int64(extraSize))
+		if err != nil {
 			return "", err
 		}
 		msg := &ipc_msg.IpcMsg{}
-		if err = proto.Unmarshal(msgBuf, msg); err != nil {
+		if err := proto.Unmarshal(msgBuf, msg); err != nil {
 			return "", err
 		}
 		msgSize := int64(msg.GetMsize())
@@ -249,8 +277,7 @@ func decodeIpcMsg(
 		roundedMsgSize := (msgSize/8 + 1) * 8
 
 		if noPayload {
-			_, err = f.Seek(roundedMsgSize, 1)
-			if err != nil {
+			if _, err := io.CopyN(io.Discard, f, roundedMsgSize); err != nil {
 				return "", err
 			}
 			totalSize += int64(extraSize) + msgSize
@@ -261,14 +288,13 @@ func decodeIpcMsg(
 			}
 			extraPayload = append(extraPayload, string(jsonMsg))
 
-			msgDataBuf := make([]byte, msgSize)
-			if _, err = f.Read(msgDataBuf); err != nil {
+			msgDataBuf, err := readFullBuf(f, msgSize)
+			if err != nil {
 				return "", err
 			}
 			msgData := base64.StdEncoding.EncodeToString(msgDataBuf)
 			extraPayload = append(extraPayload, msgData)
-			_, err = f.Seek(roundedMsgSize-msgSize, 1)
-			if err != nil {
+			if _, err = io.CopyN(io.Discard, f, roundedMsgSize-msgSize); err != nil {
 				return "", err
 			}
 		}
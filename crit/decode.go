@@ -1,200 +1,354 @@
 package crit
 
 import (
-	"encoding/base64"
+	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"os"
 
 	ghost_file "github.com/checkpoint-restore/go-criu/v7/crit/images/ghost-file"
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
 	"google.golang.org/protobuf/proto"
 )
 
-// decodeImg identifies the type of image file
-// and calls the appropriate decode handler
-func decodeImg(f *os.File, entryType proto.Message, noPayload bool) (*CriuImage, error) {
-	img := CriuImage{EntryType: entryType}
-	var err error
+// ErrLimitExceeded is returned when an image
+// exceeds the limits used to decode it
+var ErrLimitExceeded = errors.New("decode limit exceeded")
+
+// DecodeLimits bound the memory used to decode an image,
+// as the sizes stored in images cannot be trusted. A
+// limit of 0 disables the corresponding check.
+type DecodeLimits struct {
+	// Maximum size of a single protobuf entry
+	MaxEntrySize int64
+	// Maximum size of the extra payload of an entry
+	MaxExtraSize int64
+	// Maximum number of entries in an image
+	MaxEntries int
+}
+
+// DefaultDecodeLimits are the limits used by ImageReader
+// and Checkpoint unless other limits are configured
+var DefaultDecodeLimits = DecodeLimits{
+	MaxEntrySize: 64 << 20,
+	MaxExtraSize: 1 << 30,
+	MaxEntries:   1 << 24,
+}
+
+// DecodeError describes where the decoding of an image failed
+type DecodeError struct {
+	// Name of the image, if it is known
+	Image string
+	// Index of the entry, or -1 for the magic of the image
+	Index int
+	// Offset of the entry in the image
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	image := e.Image
+	if image == "" {
+		image = "image"
+	}
+	if e.Index < 0 {
+		return fmt.Sprintf("%s: invalid magic: %v", image, e.Err)
+	}
+	return fmt.Sprintf("%s: entry %d at offset %d: %v", image, e.Index, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Helper to add the name of an image to a DecodeError
+func withImageName(err error, name string) error {
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) && decodeErr.Image == "" {
+		decodeErr.Image = name
+	}
+	return err
+}
 
-	// Identify magic
-	if img.Magic, err = ReadMagic(f); err != nil {
+// decodeImg reads all entries of an image file,
+// including their extra payloads, into a CriuImage
+func decodeImg(f io.Reader, entryType proto.Message, noPayload bool, limits DecodeLimits) (*CriuImage, error) {
+	ir, err := NewImageReader(f, entryType, noPayload)
+	if err != nil {
 		return nil, err
 	}
+	ir.SetLimits(limits)
 
-	switch img.Magic {
-	// Special handlers
-	case "PAGEMAP":
-		err = img.decodePagemap(f)
+	img := CriuImage{Magic: ir.Magic(), EntryType: entryType}
+	for {
+		entry, err := ir.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if entry.Extra, err = ir.ReadExtra(); err != nil {
+			return nil, err
+		}
+		img.Entries = append(img.Entries, entry)
+	}
+
+	return &img, nil
+}
+
+// ImageReader decodes the entries of an image one at a time,
+// so that the memory used does not depend on the size of the
+// image. New instances should be created with NewImageReader().
+type ImageReader struct {
+	r           *countingReader
+	magic       string
+	entryType   proto.Message
+	noPayload   bool
+	limits      DecodeLimits
+	decodeExtra func(io.Reader, proto.Message, bool) (string, error)
+	index       int
+	// Offset of the entry last returned by Next()
+	offset int64
+	// Entry whose extra payload has not been read yet
+	pending proto.Message
+}
+
+// countingReader counts the bytes read from an image
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// extraReader fails with ErrLimitExceeded once more
+// than the allowed size of extra payload is read
+type extraReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (er *extraReader) Read(p []byte) (int, error) {
+	if er.n <= 0 {
+		// Only fail if there is data beyond the limit
+		if n, err := er.r.Read(make([]byte, 1)); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("extra payload larger than %d bytes: %w", er.max, ErrLimitExceeded)
+	}
+	if int64(len(p)) > er.n {
+		p = p[:er.n]
+	}
+	n, err := er.r.Read(p)
+	er.n -= int64(n)
+	return n, err
+}
+
+// NewImageReader reads the magic of the image in r and returns
+// an ImageReader for its entries. The entryType must match the
+// magic of the image. If noPayload is true, the extra payloads
+// of the entries are skipped and only their size is reported.
+// The image is decoded with DefaultDecodeLimits, unless other
+// limits are set with SetLimits().
+func NewImageReader(r io.Reader, entryType proto.Message, noPayload bool) (*ImageReader, error) {
+	ir := &ImageReader{
+		r:         &countingReader{r: bufio.NewReader(r)},
+		entryType: entryType,
+		noPayload: noPayload,
+		limits:    DefaultDecodeLimits,
+	}
+
+	var err error
+	if ir.magic, err = readMagic(ir.r); err != nil {
+		return nil, &DecodeError{Index: -1, Err: err}
+	}
+	if entryType != nil && !entryTypeMatches(ir.magic, entryType) {
+		return nil, &DecodeError{
+			Index: -1,
+			Err:   fmt.Errorf("%s does not contain %s entries", ir.magic, proto.MessageName(entryType)),
+		}
+	}
+
+	switch ir.magic {
 	case "GHOST_FILE":
-		err = img.decodeGhostFile(f, noPayload)
-	// Default handler with func for extra data
-	case "PIPES_DATA":
-		err = img.decodeDefault(f, decodePipesData, noPayload)
-	case "FIFO_DATA":
-		err = img.decodeDefault(f, decodePipesData, noPayload)
+		ir.decodeExtra = decodeGhostData
+	case "PIPES_DATA", "FIFO_DATA":
+		ir.decodeExtra = decodePipesData
 	case "SK_QUEUES":
-		err = img.decodeDefault(f, decodeSkQueues, noPayload)
+		ir.decodeExtra = decodeSkQueues
 	case "TCP_STREAM":
-		err = img.decodeDefault(f, decodeTCPStream, noPayload)
+		ir.decodeExtra = decodeTCPStream
 	case "BPFMAP_DATA":
-		err = img.decodeDefault(f, decodeBpfmapData, noPayload)
+		ir.decodeExtra = decodeBpfmapData
 	case "IPCNS_SEM":
-		err = img.decodeDefault(f, decodeIpcSem, noPayload)
+		ir.decodeExtra = decodeIpcSem
 	case "IPCNS_SHM":
-		err = img.decodeDefault(f, decodeIpcShm, noPayload)
+		ir.decodeExtra = decodeIpcShm
 	case "IPCNS_MSG":
-		err = img.decodeDefault(f, decodeIpcMsg, noPayload)
-	default:
-		err = img.decodeDefault(f, nil, noPayload)
-	}
-	if err != nil {
-		return nil, err
+		ir.decodeExtra = decodeIpcMsg
 	}
 
-	return &img, nil
+	return ir, nil
 }
 
-// decodeDefault is used for all image files
-// that are in the standard protobuf format
-func (img *CriuImage) decodeDefault(
-	f *os.File,
-	decodeExtra func(*os.File, proto.Message, bool) (string, error),
-	noPayload bool,
-) error {
-	sizeBuf := make([]byte, 4)
-	// Read payload size and payload until EOF
-	for {
-		if n, err := f.Read(sizeBuf); err != nil {
-			if n == 0 && err == io.EOF {
-				break
-			}
-			return err
-		}
-		// Create proto struct to hold payload
-		payload := proto.Clone(img.EntryType)
-		payloadSize := uint64(binary.LittleEndian.Uint32(sizeBuf))
-		payloadBuf := make([]byte, payloadSize)
-		if _, err := f.Read(payloadBuf); err != nil {
-			return err
+// Magic returns the magic of the image
+func (ir *ImageReader) Magic() string {
+	return ir.magic
+}
+
+// SetLimits sets the limits used to decode the following entries
+func (ir *ImageReader) SetLimits(limits DecodeLimits) {
+	ir.limits = limits
+}
+
+// Next decodes the next entry of the image and returns io.EOF
+// when no entries are left. The extra payload of the entry is
+// not read; it can be retrieved with ReadExtra() before the next
+// call to Next(), otherwise it is skipped without being stored.
+// Images which are corrupt or exceed the limits of the reader
+// result in a *DecodeError.
+func (ir *ImageReader) Next() (*CriuEntry, error) {
+	if ir.pending != nil {
+		if _, err := ir.readExtra(true); err != nil {
+			return nil, err
 		}
-		if err := proto.Unmarshal(payloadBuf, payload); err != nil {
-			return err
+	}
+
+	ir.offset = ir.r.n
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(ir.r, sizeBuf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, err
 		}
-		entry := CriuEntry{Message: payload}
-		if decodeExtra != nil {
-			extraPayload, err := decodeExtra(f, payload, noPayload)
-			if err != nil {
-				return err
-			}
-			entry.Extra = extraPayload
+		return nil, ir.error(ir.index, err)
+	}
+	if ir.limits.MaxEntries > 0 && ir.index >= ir.limits.MaxEntries {
+		return nil, ir.error(ir.index, fmt.Errorf("more than %d entries: %w", ir.limits.MaxEntries, ErrLimitExceeded))
+	}
+	// Create proto struct to hold payload
+	payload := imgEntryType(ir.magic, ir.entryType, ir.index)
+	if payload == nil {
+		return nil, ir.error(ir.index, errors.New("no protobuf binding"))
+	}
+	payloadSize := int64(binary.LittleEndian.Uint32(sizeBuf))
+	if ir.limits.MaxEntrySize > 0 && payloadSize > ir.limits.MaxEntrySize {
+		return nil, ir.error(ir.index, fmt.Errorf("entry of %d bytes: %w", payloadSize, ErrLimitExceeded))
+	}
+	payloadBuf, err := readFullBuf(ir.r, payloadSize)
+	if err != nil {
+		return nil, ir.error(ir.index, err)
+	}
+	if err := proto.Unmarshal(payloadBuf, payload); err != nil {
+		return nil, ir.error(ir.index, err)
+	}
+	ir.index++
+
+	if ir.decodeExtra != nil {
+		ir.pending = payload
+	}
+	return &CriuEntry{Message: payload}, nil
+}
+
+// ReadExtra reads the extra payload of the entry last returned
+// by Next(). It returns an empty string if there is none.
+func (ir *ImageReader) ReadExtra() (string, error) {
+	if ir.pending == nil {
+		return "", nil
+	}
+	return ir.readExtra(ir.noPayload)
+}
+
+// Helper to read the pending extra payload within the limits
+func (ir *ImageReader) readExtra(noPayload bool) (string, error) {
+	payload := ir.pending
+	ir.pending = nil
+
+	var r io.Reader = ir.r
+	if ir.limits.MaxExtraSize > 0 {
+		r = &extraReader{r: ir.r, n: ir.limits.MaxExtraSize, max: ir.limits.MaxExtraSize}
+	}
+	extra, err := ir.decodeExtra(r, payload, noPayload)
+	if err != nil {
+		// The entry announced its extra payload,
+		// so the image must not end before it
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
 		}
-		img.Entries = append(img.Entries, &entry)
+		return "", ir.error(ir.index-1, err)
 	}
-	return nil
+	return extra, nil
 }
 
-// Special handler for pagemap image
-func (img *CriuImage) decodePagemap(f *os.File) error {
-	sizeBuf := make([]byte, 4)
-	// First entry is pagemap head
-	var payload proto.Message = &pagemap.PagemapHead{}
-	// Read payload size and payload until EOF
-	for {
-		if n, err := f.Read(sizeBuf); err != nil {
-			if n == 0 && err == io.EOF {
-				break
+// Helper to describe where the decoding of an entry failed
+func (ir *ImageReader) error(index int, err error) error {
+	return &DecodeError{Index: index, Offset: ir.offset, Err: err}
+}
+
+// readFullBuf reads exactly size bytes from r. Large buffers grow
+// with the data read, so that a corrupt size cannot allocate more
+// memory than the image actually contains.
+func readFullBuf(r io.Reader, size int64) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	if size <= 1<<16 {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) && size > 0 {
+				err = io.ErrUnexpectedEOF
 			}
-			return err
+			return nil, err
 		}
+		return buf, nil
+	}
 
-		payloadSize := uint64(binary.LittleEndian.Uint32(sizeBuf))
-		payloadBuf := make([]byte, payloadSize)
-		if _, err := f.Read(payloadBuf); err != nil {
-			return err
-		}
-		if err := proto.Unmarshal(payloadBuf, payload); err != nil {
-			return err
-		}
-		entry := CriuEntry{Message: payload}
-		img.Entries = append(img.Entries, &entry)
-		// Create struct for next entry
-		payload = &pagemap.PagemapEntry{}
+	buf, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if int64(len(buf)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
 }
 
-// Special handler for ghost image
-func (img *CriuImage) decodeGhostFile(f *os.File, noPayload bool) error {
-	sizeBuf := make([]byte, 4)
-	if _, err := f.Read(sizeBuf); err != nil {
-		return err
-	}
-	// Create proto struct for primary entry
-	payload := &ghost_file.GhostFileEntry{}
-	payloadSize := uint64(binary.LittleEndian.Uint32(sizeBuf))
-	payloadBuf := make([]byte, payloadSize)
-	if _, err := f.Read(payloadBuf); err != nil {
-		return err
+// Helper to check whether the entries of an image with
+// the given magic can be decoded into entryType
+func entryTypeMatches(magic string, entryType proto.Message) bool {
+	name := proto.MessageName(entryType)
+	switch magic {
+	case "PAGEMAP", "GHOST_FILE":
+		return name == proto.MessageName(imgEntryType(magic, nil, 0)) ||
+			name == proto.MessageName(imgEntryType(magic, nil, 1))
 	}
-	if err := proto.Unmarshal(payloadBuf, payload); err != nil {
-		return err
-	}
-	entry := CriuEntry{Message: payload}
-
-	if payload.GetChunks() {
-		img.Entries = append(img.Entries, &entry)
-		for {
-			n, err := f.Read(sizeBuf)
-			if n == 0 {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				return err
-			}
-			// Create proto struct for chunk
-			payload := &ghost_file.GhostChunkEntry{}
-			payloadSize := uint64(binary.LittleEndian.Uint32(sizeBuf))
-			payloadBuf := make([]byte, payloadSize)
-			if _, err := f.Read(payloadBuf); err != nil {
-				return err
-			}
-			if err := proto.Unmarshal(payloadBuf, payload); err != nil {
-				return err
-			}
-			entry = CriuEntry{Message: payload}
-			if noPayload {
-				if _, err = f.Seek(int64(payload.GetLen()), 1); err != nil {
-					return err
-				}
-			} else {
-				extraBuf := make([]byte, payload.GetLen())
-				if _, err := f.Read(extraBuf); err != nil {
-					return err
-				}
-				entry.Extra = base64.StdEncoding.EncodeToString(extraBuf)
-			}
-			img.Entries = append(img.Entries, &entry)
+	expected, err := GetEntryType(magic)
+	return err == nil && expected != nil && proto.MessageName(expected) == name
+}
+
+// Helper to get the type of the entry at the given index,
+// as the first entry of some images has a different type
+func imgEntryType(magic string, entryType proto.Message, index int) proto.Message {
+	switch magic {
+	case "PAGEMAP":
+		if index == 0 {
+			return &pagemap.PagemapHead{}
 		}
-	} else {
-		if noPayload {
-			// Seek to the end of the file
-			if _, err := f.Seek(0, 2); err != nil {
-				return err
-			}
-		} else {
-			fInfo, err := f.Stat()
-			if err != nil {
-				return err
-			}
-			extraBuf := make([]byte, uint64(fInfo.Size())-4-payloadSize)
-			if _, err := f.Read(extraBuf); err != nil {
-				return err
-			}
-			entry.Extra = base64.StdEncoding.EncodeToString(extraBuf)
+		return &pagemap.PagemapEntry{}
+	case "GHOST_FILE":
+		if index == 0 {
+			return &ghost_file.GhostFileEntry{}
 		}
-		img.Entries = append(img.Entries, &entry)
+		return &ghost_file.GhostChunkEntry{}
+	}
+	if entryType == nil {
+		return nil
 	}
-	return nil
+	return proto.Clone(entryType)
 }
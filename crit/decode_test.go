@@ -0,0 +1,252 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	ghost_file "github.com/checkpoint-restore/go-criu/v7/crit/images/ghost-file"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	pipe_data "github.com/checkpoint-restore/go-criu/v7/crit/images/pipe-data"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	"google.golang.org/protobuf/proto"
+)
+
+func testPipeData(pipeID uint32, data string) *CriuEntry {
+	return &CriuEntry{
+		Message: &pipe_data.PipeDataEntry{
+			PipeId: proto.Uint32(pipeID),
+			Bytes:  proto.Uint32(uint32(len(data))),
+		},
+		Extra: base64.StdEncoding.EncodeToString([]byte(data)),
+	}
+}
+
+func TestImageReader(t *testing.T) {
+	var buf bytes.Buffer
+	iw, err := NewImageWriter(&buf, "PIPES_DATA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []*CriuEntry{
+		testPipeData(1, "hello"),
+		testPipeData(2, "skipped"),
+		testPipeData(3, "world"),
+	}
+	for _, entry := range entries {
+		if err := iw.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+
+	ir, err := NewImageReader(bytes.NewReader(data), &pipe_data.PipeDataEntry{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Magic() != "PIPES_DATA" {
+		t.Errorf("want magic PIPES_DATA, got %s", ir.Magic())
+	}
+	for i, entry := range entries {
+		next, err := ir.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pipeID := next.Message.(*pipe_data.PipeDataEntry).GetPipeId(); pipeID != uint32(i+1) {
+			t.Errorf("want pipe %d, got %d", i+1, pipeID)
+		}
+		// The extra payload of the second entry is skipped
+		if i == 1 {
+			continue
+		}
+		extra, err := ir.ReadExtra()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extra != entry.Extra {
+			t.Errorf("want extra %s, got %s", entry.Extra, extra)
+		}
+	}
+	if _, err := ir.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("want io.EOF, got %v", err)
+	}
+
+	ir, err = NewImageReader(bytes.NewReader(data), &pipe_data.PipeDataEntry{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ir.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if extra, err := ir.ReadExtra(); err != nil || extra != "5 B" {
+		t.Errorf("want extra 5 B, got %s (%v)", extra, err)
+	}
+
+	// Truncated entries are reported
+	ir, err = NewImageReader(bytes.NewReader(data[:len(data)-2]), &pipe_data.PipeDataEntry{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		if _, err = ir.Next(); err == nil {
+			_, err = ir.ReadExtra()
+		}
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("want io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestImageRecodeGhostFile(t *testing.T) {
+	chunk := func(off uint64, data string) *CriuEntry {
+		return &CriuEntry{
+			Message: &ghost_file.GhostChunkEntry{
+				Len: proto.Uint64(uint64(len(data))),
+				Off: proto.Uint64(off),
+			},
+			Extra: base64.StdEncoding.EncodeToString([]byte(data)),
+		}
+	}
+	img := &CriuImage{
+		Magic: "GHOST_FILE",
+		Entries: []*CriuEntry{
+			{Message: &ghost_file.GhostFileEntry{
+				Uid:    proto.Uint32(0),
+				Gid:    proto.Uint32(0),
+				Mode:   proto.Uint32(0o100644),
+				Chunks: proto.Bool(true),
+			}},
+			chunk(0, "first chunk"),
+			chunk(4096, "second chunk"),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImg(img, &buf); err != nil {
+		t.Fatal(err)
+	}
+	decodedImg, err := decodeImg(bytes.NewReader(buf.Bytes()), &ghost_file.GhostFileEntry{}, false, DefaultDecodeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decodedImg.Entries) != 3 {
+		t.Fatalf("want 3 entries, got %d", len(decodedImg.Entries))
+	}
+	if decodedImg.Entries[2].Extra != img.Entries[2].Extra {
+		t.Errorf("want extra %s, got %s", img.Entries[2].Extra, decodedImg.Entries[2].Extra)
+	}
+
+	var recoded bytes.Buffer
+	if err := encodeImg(decodedImg, &recoded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), recoded.Bytes()) {
+		t.Error("recoded image does not match")
+	}
+}
+
+func TestUnmarshalEntry(t *testing.T) {
+	entry, err := UnmarshalEntry("PAGEMAP", &pagemap.PagemapEntry{}, 0, []byte(`{"pages_id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, ok := entry.Message.(*pagemap.PagemapHead); !ok || head.GetPagesId() != 1 {
+		t.Errorf("unexpected pagemap head %v", entry.Message)
+	}
+
+	entry, err = UnmarshalEntry("PIPES_DATA", &pipe_data.PipeDataEntry{}, 1,
+		[]byte(`{"pipe_id":1,"bytes":5,"extra":"aGVsbG8="}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Extra != "aGVsbG8=" {
+		t.Errorf("want extra aGVsbG8=, got %s", entry.Extra)
+	}
+}
+
+// Helper to decode an image and return the resulting DecodeError
+func decodeTestErr(t *testing.T, data []byte, entryType proto.Message, limits DecodeLimits) *DecodeError {
+	t.Helper()
+	_, err := decodeImg(bytes.NewReader(data), entryType, false, limits)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expected DecodeError, got %v", err)
+	}
+	return decodeErr
+}
+
+func TestDecodeCorruptImage(t *testing.T) {
+	var buf bytes.Buffer
+	iw, err := NewImageWriter(&buf, "PIPES_DATA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Write(testPipeData(1, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	entryType := &pipe_data.PipeDataEntry{}
+
+	// No truncation of the image may cause a panic
+	for i := 0; i < len(valid); i++ {
+		_, err := decodeImg(bytes.NewReader(valid[:i]), entryType, false, DefaultDecodeLimits)
+		if i > 8 && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated to %d bytes: unexpected error %v", i, err)
+		}
+	}
+
+	// The size of the entry must not be trusted
+	hostile := append(append([]byte{}, valid[:8]...), 0xff, 0xff, 0xff, 0xff)
+	decodeErr := decodeTestErr(t, hostile, entryType, DefaultDecodeLimits)
+	if !errors.Is(decodeErr, ErrLimitExceeded) || decodeErr.Index != 0 || decodeErr.Offset != 8 {
+		t.Errorf("unexpected error %v", decodeErr)
+	}
+	decodeErr = decodeTestErr(t, hostile, entryType, DecodeLimits{})
+	if !errors.Is(decodeErr, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error %v", decodeErr)
+	}
+
+	// Neither must the size of the extra payload
+	buf.Reset()
+	iw, _ = NewImageWriter(&buf, "PIPES_DATA")
+	entry := testPipeData(1, "hello")
+	entry.Message.(*pipe_data.PipeDataEntry).Bytes = proto.Uint32(1 << 31)
+	if err := iw.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	decodeErr = decodeTestErr(t, buf.Bytes(), entryType, DecodeLimits{})
+	if !errors.Is(decodeErr, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error %v", decodeErr)
+	}
+	decodeErr = decodeTestErr(t, buf.Bytes(), entryType, DecodeLimits{MaxExtraSize: 4})
+	if !errors.Is(decodeErr, ErrLimitExceeded) {
+		t.Errorf("unexpected error %v", decodeErr)
+	}
+}
+
+func TestDecodeCorruptCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImg(t, dir, "pstree.img", "PAGEMAP", &pagemap.PagemapHead{PagesId: proto.Uint32(1)})
+
+	// The magic does not match the name of the image
+	_, err := newCheckpoint(dir).Pstree()
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Image != "pstree.img" || decodeErr.Index != -1 {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// The parent of process 2 is missing
+	writeTestImg(t, dir, "pstree.img", "PSTREE",
+		&pstree.PstreeEntry{Pid: proto.Uint32(1), Ppid: proto.Uint32(0), Pgid: proto.Uint32(1), Sid: proto.Uint32(1)},
+		&pstree.PstreeEntry{Pid: proto.Uint32(2), Ppid: proto.Uint32(3), Pgid: proto.Uint32(1), Sid: proto.Uint32(1)},
+	)
+	for _, pID := range []uint32{1, 2} {
+		writeTestImg(t, dir, fmt.Sprintf("core-%d.img", pID), "CORE", testCore(0, 0, 0))
+	}
+	if _, err := newCheckpoint(dir).ExplorePs(); err == nil {
+		t.Error("expected error for missing parent")
+	}
+}
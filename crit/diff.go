@@ -0,0 +1,622 @@
+package crit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cgroup"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mnt"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ChangeType tells how an object differs between two checkpoints
+type ChangeType string
+
+const (
+	ChangeAdded   ChangeType = "added"
+	ChangeRemoved ChangeType = "removed"
+	ChangeChanged ChangeType = "changed"
+)
+
+// Change is a single difference between two checkpoints. The
+// category is one of pstree, core, creds, cgroup, mm, fd, sk
+// or mnt. Changed objects report the field which differs with
+// its old and new value; added and removed objects may report
+// a description of the object as their new or old value.
+type Change struct {
+	Category string     `json:"category"`
+	Object   string     `json:"object"`
+	Type     ChangeType `json:"type"`
+	Field    string     `json:"field,omitempty"`
+	Old      string     `json:"old,omitempty"`
+	New      string     `json:"new,omitempty"`
+}
+
+// CheckpointDiff holds the differences between two checkpoints
+type CheckpointDiff struct {
+	Changes []*Change `json:"changes"`
+}
+
+// Equal returns true if no differences were found
+func (d *CheckpointDiff) Equal() bool {
+	return len(d.Changes) == 0
+}
+
+// Category returns the changes of the given category
+func (d *CheckpointDiff) Category(category string) []*Change {
+	changes := make([]*Change, 0)
+	for _, change := range d.Changes {
+		if change.Category == category {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func (d *CheckpointDiff) add(category, object string, changeType ChangeType, field, oldValue, newValue string) {
+	d.Changes = append(d.Changes, &Change{
+		Category: category,
+		Object:   object,
+		Type:     changeType,
+		Field:    field,
+		Old:      oldValue,
+		New:      newValue,
+	})
+}
+
+// Helper to report a changed field if its values differ
+func (d *CheckpointDiff) compare(category, object, field, oldValue, newValue string) {
+	if oldValue != newValue {
+		d.add(category, object, ChangeChanged, field, oldValue, newValue)
+	}
+}
+
+// Diff compares two checkpoints, such as a pre-dump and the
+// following dump, at the level of the objects they contain.
+// Images which are missing from a checkpoint are treated as
+// empty, so that all their objects are reported as added or
+// removed.
+func Diff(a, b *Checkpoint) (*CheckpointDiff, error) {
+	d := &CheckpointDiff{Changes: make([]*Change, 0)}
+	for _, diffFn := range []func(*CheckpointDiff, *Checkpoint, *Checkpoint) error{
+		diffProcesses,
+		diffMems,
+		diffFds,
+		diffSockets,
+		diffMounts,
+	} {
+		if err := diffFn(d, a, b); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// Helper to ignore errors caused by missing images
+func ignoreMissing(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// diffKey is the type of the keys used to match objects
+type diffKey interface {
+	~uint32 | ~uint64 | ~string
+}
+
+// Helper to match the objects of two checkpoints by
+// their key and to visit them in the order of the keys
+func diffMaps[K diffKey, V any](a, b map[K]V, added, removed func(K, V), changed func(K, V, V)) {
+	keys := make([]K, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		x, inA := a[key]
+		y, inB := b[key]
+		switch {
+		case !inA:
+			added(key, y)
+		case !inB:
+			removed(key, x)
+		default:
+			changed(key, x, y)
+		}
+	}
+}
+
+// Helper to index the processes of a checkpoint by PID
+func diffPstree(c *Checkpoint) (map[uint32]*pstree.PstreeEntry, error) {
+	processes, err := c.Pstree()
+	if err != nil {
+		return nil, ignoreMissing(err)
+	}
+	pstreeMap := make(map[uint32]*pstree.PstreeEntry, len(processes))
+	for _, process := range processes {
+		pstreeMap[process.GetPid()] = process
+	}
+	return pstreeMap, nil
+}
+
+// Helper to compare the process trees and the state of
+// the threads of processes which exist in both checkpoints
+func diffProcesses(d *CheckpointDiff, a, b *Checkpoint) error {
+	pstreeA, err := diffPstree(a)
+	if err != nil {
+		return err
+	}
+	pstreeB, err := diffPstree(b)
+	if err != nil {
+		return err
+	}
+	cgroupsA, err := diffCgroupSets(a)
+	if err != nil {
+		return err
+	}
+	cgroupsB, err := diffCgroupSets(b)
+	if err != nil {
+		return err
+	}
+
+	var diffErr error
+	diffMaps(pstreeA, pstreeB,
+		func(pID uint32, _ *pstree.PstreeEntry) {
+			d.add("pstree", fmt.Sprintf("process %d", pID), ChangeAdded, "", "", "")
+		},
+		func(pID uint32, _ *pstree.PstreeEntry) {
+			d.add("pstree", fmt.Sprintf("process %d", pID), ChangeRemoved, "", "", "")
+		},
+		func(pID uint32, x, y *pstree.PstreeEntry) {
+			object := fmt.Sprintf("process %d", pID)
+			d.compare("pstree", object, "ppid", fmt.Sprint(x.GetPpid()), fmt.Sprint(y.GetPpid()))
+			d.compare("pstree", object, "pgid", fmt.Sprint(x.GetPgid()), fmt.Sprint(y.GetPgid()))
+			d.compare("pstree", object, "sid", fmt.Sprint(x.GetSid()), fmt.Sprint(y.GetSid()))
+
+			diffMaps(processThreads(x), processThreads(y),
+				func(tID uint32, _ bool) {
+					d.add("pstree", fmt.Sprintf("process %d thread %d", pID, tID), ChangeAdded, "", "", "")
+				},
+				func(tID uint32, _ bool) {
+					d.add("pstree", fmt.Sprintf("process %d thread %d", pID, tID), ChangeRemoved, "", "", "")
+				},
+				func(tID uint32, _, _ bool) {
+					if diffErr == nil {
+						diffErr = diffThread(d, a, b, pID, tID, cgroupsA, cgroupsB)
+					}
+				},
+			)
+		},
+	)
+
+	return diffErr
+}
+
+// Helper to get the threads of a process,
+// which include at least the main thread
+func processThreads(process *pstree.PstreeEntry) map[uint32]bool {
+	threads := map[uint32]bool{process.GetPid(): true}
+	for _, tID := range process.GetThreads() {
+		threads[tID] = true
+	}
+	return threads
+}
+
+// Helper to compare the core image of a thread
+func diffThread(d *CheckpointDiff, a, b *Checkpoint, pID, tID uint32, cgroupsA, cgroupsB map[uint32]map[string]string) error {
+	coreA, err := a.Core(tID)
+	if err != nil {
+		return ignoreMissing(err)
+	}
+	coreB, err := b.Core(tID)
+	if err != nil {
+		return ignoreMissing(err)
+	}
+
+	object := fmt.Sprintf("process %d", pID)
+	if tID != pID {
+		object = fmt.Sprintf("process %d thread %d", pID, tID)
+	}
+	report := func(category string) func(string, string, string) {
+		return func(field, oldValue, newValue string) {
+			d.add(category, object, ChangeChanged, field, oldValue, newValue)
+		}
+	}
+
+	// Registers are stored in the thread info of the architecture
+	diffFields("regs", threadRegs(coreA), threadRegs(coreB), nil, report("core"))
+	// Credentials and cgroups are reported in their own category
+	skip := map[string]bool{
+		"tc.cg_set":          true,
+		"thread_core.creds":  true,
+		"thread_core.cg_set": true,
+	}
+	diffFields("tc", coreA.GetTc().ProtoReflect(), coreB.GetTc().ProtoReflect(), skip, report("core"))
+	diffFields("thread_core", coreA.GetThreadCore().ProtoReflect(), coreB.GetThreadCore().ProtoReflect(), skip, report("core"))
+	diffFields("", coreA.GetThreadCore().GetCreds().ProtoReflect(), coreB.GetThreadCore().GetCreds().ProtoReflect(), nil, report("creds"))
+
+	if tID == pID {
+		diffMaps(cgroupsA[cgroupSet(coreA)], cgroupsB[cgroupSet(coreB)],
+			func(name, path string) {
+				d.add("cgroup", object, ChangeAdded, name, "", path)
+			},
+			func(name, path string) {
+				d.add("cgroup", object, ChangeRemoved, name, path, "")
+			},
+			func(name, x, y string) {
+				d.compare("cgroup", object, name, x, y)
+			},
+		)
+	}
+
+	return nil
+}
+
+// Helper to get the general purpose registers
+// from the thread info of any architecture
+func threadRegs(core *criu_core.CoreEntry) protoreflect.Message {
+	msg := core.ProtoReflect()
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		name := string(field.Name())
+		if name != "thread_info" && !strings.HasPrefix(name, "ti_") || !msg.Has(field) {
+			continue
+		}
+		threadInfo := msg.Get(field).Message()
+		if gpregs := threadInfo.Descriptor().Fields().ByName("gpregs"); gpregs != nil {
+			return threadInfo.Get(gpregs).Message()
+		}
+		return threadInfo
+	}
+	return nil
+}
+
+// Helper to get the cgroup set of a process
+func cgroupSet(core *criu_core.CoreEntry) uint32 {
+	if core.GetTc().CgSet != nil {
+		return core.GetTc().GetCgSet()
+	}
+	return core.GetThreadCore().GetCgSet()
+}
+
+// Helper to map every cgroup set of a checkpoint
+// to the paths of its controllers
+func diffCgroupSets(c *Checkpoint) (map[uint32]map[string]string, error) {
+	sets := make(map[uint32]map[string]string)
+	entry, err := c.entry("cgroup.img", &cgroup.CgroupEntry{})
+	if err != nil {
+		return sets, ignoreMissing(err)
+	}
+	for _, set := range entry.(*cgroup.CgroupEntry).GetSets() {
+		paths := make(map[string]string)
+		for _, ctl := range set.GetCtls() {
+			paths[ctl.GetName()] = ctl.GetPath()
+		}
+		sets[set.GetId()] = paths
+	}
+	return sets, nil
+}
+
+// Helper to report the fields of two messages which differ.
+// Nested messages are compared field by field, while repeated
+// fields are compared as a whole. Fields are named by their
+// path below prefix, and fields whose path is in skip are not
+// compared. Either message may be nil or invalid.
+func diffFields(prefix string, a, b protoreflect.Message, skip map[string]bool, report func(field, oldValue, newValue string)) {
+	if a == nil || !a.IsValid() {
+		if b == nil || !b.IsValid() {
+			return
+		}
+		a = b.Type().Zero()
+	}
+	if b == nil || !b.IsValid() {
+		b = a.Type().Zero()
+	}
+	if a.Descriptor() != b.Descriptor() {
+		// Messages of different types, like the registers
+		// of different architectures, differ as a whole
+		report(prefix, string(a.Descriptor().FullName()), string(b.Descriptor().FullName()))
+		return
+	}
+
+	fields := a.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		name := string(field.Name())
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if skip[name] {
+			continue
+		}
+
+		switch {
+		case field.IsList() || field.IsMap():
+			if !fieldEqual(a, b, field) {
+				report(name, fieldLen(a, field), fieldLen(b, field))
+			}
+		case field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind:
+			if !a.Has(field) && !b.Has(field) {
+				continue
+			}
+			diffFields(name, a.Get(field).Message(), b.Get(field).Message(), skip, report)
+		default:
+			oldValue, newValue := fieldString(a, field), fieldString(b, field)
+			if oldValue != newValue {
+				report(name, oldValue, newValue)
+			}
+		}
+	}
+}
+
+// Helper to compare a repeated field of two messages
+func fieldEqual(a, b protoreflect.Message, field protoreflect.FieldDescriptor) bool {
+	x, y := a.Type().New(), b.Type().New()
+	if a.Has(field) {
+		x.Set(field, a.Get(field))
+	}
+	if b.Has(field) {
+		y.Set(field, b.Get(field))
+	}
+	return proto.Equal(x.Interface(), y.Interface())
+}
+
+// Helper to describe a repeated field by its length
+func fieldLen(msg protoreflect.Message, field protoreflect.FieldDescriptor) string {
+	length := 0
+	switch {
+	case !msg.Has(field):
+	case field.IsList():
+		length = msg.Get(field).List().Len()
+	case field.IsMap():
+		length = msg.Get(field).Map().Len()
+	}
+	return fmt.Sprintf("%d entries", length)
+}
+
+// Helper to format a scalar field, with 64-bit values such
+// as registers and signal masks in hexadecimal notation
+func fieldString(msg protoreflect.Message, field protoreflect.FieldDescriptor) string {
+	if !msg.Has(field) {
+		return ""
+	}
+	value := msg.Get(field)
+	switch field.Kind() {
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return fmt.Sprintf("0x%x", value.Uint())
+	case protoreflect.BytesKind:
+		return fmt.Sprintf("%x", value.Bytes())
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByNumber(value.Enum()); enumValue != nil {
+			return string(enumValue.Name())
+		}
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// Helper to compare the VMAs of processes
+// which exist in both checkpoints
+func diffMems(d *CheckpointDiff, a, b *Checkpoint) error {
+	index := func(c *Checkpoint) (map[uint32]*MemMap, error) {
+		memMaps, err := c.ExploreMems()
+		if err != nil {
+			return nil, ignoreMissing(err)
+		}
+		index := make(map[uint32]*MemMap, len(memMaps))
+		for _, memMap := range memMaps {
+			index[memMap.PId] = memMap
+		}
+		return index, nil
+	}
+	memsA, err := index(a)
+	if err != nil {
+		return err
+	}
+	memsB, err := index(b)
+	if err != nil {
+		return err
+	}
+
+	vmas := func(memMap *MemMap) map[uint64]*Mem {
+		vmas := make(map[uint64]*Mem, len(memMap.Mems))
+		for _, mem := range memMap.Mems {
+			start, _ := strconv.ParseUint(mem.Start, 16, 64)
+			vmas[start] = mem
+		}
+		return vmas
+	}
+	describe := func(mem *Mem) string {
+		return strings.TrimSpace(fmt.Sprintf("0x%s-0x%s %s %s", mem.Start, mem.End, mem.Protection, mem.Resource))
+	}
+	diffMaps(memsA, memsB, func(uint32, *MemMap) {}, func(uint32, *MemMap) {},
+		func(pID uint32, x, y *MemMap) {
+			d.compare("mm", fmt.Sprintf("process %d", pID), "exe", x.Exe, y.Exe)
+			diffMaps(vmas(x), vmas(y),
+				func(start uint64, mem *Mem) {
+					d.add("mm", fmt.Sprintf("process %d vma 0x%x", pID, start), ChangeAdded, "", "", describe(mem))
+				},
+				func(start uint64, mem *Mem) {
+					d.add("mm", fmt.Sprintf("process %d vma 0x%x", pID, start), ChangeRemoved, "", describe(mem), "")
+				},
+				func(start uint64, x, y *Mem) {
+					object := fmt.Sprintf("process %d vma 0x%x", pID, start)
+					d.compare("mm", object, "end", "0x"+x.End, "0x"+y.End)
+					d.compare("mm", object, "protection", x.Protection, y.Protection)
+					d.compare("mm", object, "resource", x.Resource, y.Resource)
+				},
+			)
+		},
+	)
+
+	return nil
+}
+
+// Helper to compare the files opened by processes
+// which exist in both checkpoints
+func diffFds(d *CheckpointDiff, a, b *Checkpoint) error {
+	index := func(c *Checkpoint) (map[uint32]map[string]*File, error) {
+		fds, err := c.ExploreFds()
+		if err != nil {
+			return nil, ignoreMissing(err)
+		}
+		index := make(map[uint32]map[string]*File, len(fds))
+		for _, fd := range fds {
+			files := make(map[string]*File, len(fd.Files))
+			for _, file := range fd.Files {
+				files[file.Fd] = file
+			}
+			index[fd.PId] = files
+		}
+		return index, nil
+	}
+	fdsA, err := index(a)
+	if err != nil {
+		return err
+	}
+	fdsB, err := index(b)
+	if err != nil {
+		return err
+	}
+
+	describe := func(file *File) string {
+		return strings.TrimSpace(fmt.Sprintf("%s %s", file.Type, file.Path))
+	}
+	diffMaps(fdsA, fdsB, func(uint32, map[string]*File) {}, func(uint32, map[string]*File) {},
+		func(pID uint32, x, y map[string]*File) {
+			diffMaps(x, y,
+				func(fd string, file *File) {
+					d.add("fd", fmt.Sprintf("process %d fd %s", pID, fd), ChangeAdded, "", "", describe(file))
+				},
+				func(fd string, file *File) {
+					d.add("fd", fmt.Sprintf("process %d fd %s", pID, fd), ChangeRemoved, "", describe(file), "")
+				},
+				func(fd string, x, y *File) {
+					object := fmt.Sprintf("process %d fd %s", pID, fd)
+					d.compare("fd", object, "type", x.Type, y.Type)
+					d.compare("fd", object, "path", x.Path, y.Path)
+				},
+			)
+		},
+	)
+
+	return nil
+}
+
+// Helper to compare the state of sockets which
+// are open in the same process in both checkpoints.
+// Opened and closed sockets are reported as fds.
+func diffSockets(d *CheckpointDiff, a, b *Checkpoint) error {
+	index := func(c *Checkpoint) (map[uint32]map[uint32]*Socket, error) {
+		sks, err := c.ExploreSk()
+		if err != nil {
+			return nil, ignoreMissing(err)
+		}
+		index := make(map[uint32]map[uint32]*Socket, len(sks))
+		for _, sk := range sks {
+			sockets := make(map[uint32]*Socket, len(sk.Sockets))
+			for _, socket := range sk.Sockets {
+				sockets[socket.Fd] = socket
+			}
+			index[sk.PId] = sockets
+		}
+		return index, nil
+	}
+	socketsA, err := index(a)
+	if err != nil {
+		return err
+	}
+	socketsB, err := index(b)
+	if err != nil {
+		return err
+	}
+
+	ignore := func(uint32, *Socket) {}
+	diffMaps(socketsA, socketsB, func(uint32, map[uint32]*Socket) {}, func(uint32, map[uint32]*Socket) {},
+		func(pID uint32, x, y map[uint32]*Socket) {
+			diffMaps(x, y, ignore, ignore, func(fd uint32, x, y *Socket) {
+				object := fmt.Sprintf("process %d socket %d", pID, fd)
+				d.compare("sk", object, "type", x.FdType, y.FdType)
+				d.compare("sk", object, "state", x.State, y.State)
+				d.compare("sk", object, "src", fmt.Sprintf("%s:%d", x.SrcAddr, x.SrcPort), fmt.Sprintf("%s:%d", y.SrcAddr, y.SrcPort))
+				d.compare("sk", object, "dst", fmt.Sprintf("%s:%d", x.DestAddr, x.DestPort), fmt.Sprintf("%s:%d", y.DestAddr, y.DestPort))
+			})
+		},
+	)
+
+	return nil
+}
+
+// Helper to compare the mounts of both checkpoints, matched by their
+// mount namespace and mountpoint. Mounts stacked on the same mountpoint
+// are matched in the order of the images, as mount IDs are not stable.
+func diffMounts(d *CheckpointDiff, a, b *Checkpoint) error {
+	index := func(c *Checkpoint) (map[string]*mnt.MntEntry, error) {
+		mntImgs, err := fs.Glob(c.fsys, "mountpoints-*.img")
+		if err != nil {
+			return nil, err
+		}
+		index := make(map[string]*mnt.MntEntry)
+		for _, mntImg := range mntImgs {
+			img, err := c.image(mntImg, &mnt.MntEntry{})
+			if err != nil {
+				return nil, err
+			}
+			nsID := strings.TrimSuffix(strings.TrimPrefix(mntImg, "mountpoints-"), ".img")
+			stacked := make(map[string]int)
+			for _, entry := range img.Entries {
+				mntEntry := entry.Message.(*mnt.MntEntry)
+				mountpoint := mntEntry.GetMountpoint()
+				object := fmt.Sprintf("mount %s (ns %s)", mountpoint, nsID)
+				if n := stacked[mountpoint]; n > 0 {
+					object = fmt.Sprintf("mount %s #%d (ns %s)", mountpoint, n+1, nsID)
+				}
+				stacked[mountpoint]++
+				index[object] = mntEntry
+			}
+		}
+		return index, nil
+	}
+	mountsA, err := index(a)
+	if err != nil {
+		return err
+	}
+	mountsB, err := index(b)
+	if err != nil {
+		return err
+	}
+
+	describe := func(mntEntry *mnt.MntEntry) string {
+		return fmt.Sprintf("%s %s", mntEntry.GetSource(), mntEntry.GetRoot())
+	}
+	diffMaps(mountsA, mountsB,
+		func(object string, mntEntry *mnt.MntEntry) {
+			d.add("mnt", object, ChangeAdded, "", "", describe(mntEntry))
+		},
+		func(object string, mntEntry *mnt.MntEntry) {
+			d.add("mnt", object, ChangeRemoved, "", describe(mntEntry), "")
+		},
+		func(object string, x, y *mnt.MntEntry) {
+			diffFields("", x.ProtoReflect(), y.ProtoReflect(), nil, func(field, oldValue, newValue string) {
+				d.add("mnt", object, ChangeChanged, field, oldValue, newValue)
+			})
+		},
+	)
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package crit
+
+import (
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cgroup"
+	core_aarch64 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-aarch64"
+	core_x86 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-x86"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/creds"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/vma"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// fillRequired is a helper to set all required fields of a
+// message, which are not set yet, to their default value
+func fillRequired(msg protoreflect.Message) {
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		switch {
+		case field.IsList():
+			if field.Kind() == protoreflect.MessageKind {
+				list := msg.Get(field).List()
+				for j := 0; j < list.Len(); j++ {
+					fillRequired(list.Get(j).Message())
+				}
+			}
+		case field.Kind() == protoreflect.MessageKind:
+			if msg.Has(field) || field.Cardinality() == protoreflect.Required {
+				fillRequired(msg.Mutable(field).Message())
+			}
+		case field.Cardinality() == protoreflect.Required && !msg.Has(field):
+			msg.Set(field, field.Default())
+		}
+	}
+}
+
+// testCore is a helper to create the core
+// of a thread with the given IP and sigmask
+func testCore(ip, sigmask uint64, uid uint32) *criu_core.CoreEntry {
+	core := &criu_core.CoreEntry{
+		Mtype: criu_core.CoreEntry_X86_64.Enum(),
+		ThreadInfo: &core_x86.ThreadInfoX86{
+			Gpregs: &core_x86.UserX86RegsEntry{Ip: proto.Uint64(ip)},
+		},
+		Tc: &criu_core.TaskCoreEntry{
+			Comm:      proto.String("test"),
+			BlkSigset: proto.Uint64(sigmask),
+			CgSet:     proto.Uint32(1),
+		},
+		ThreadCore: &criu_core.ThreadCoreEntry{
+			Creds: &creds.CredsEntry{Uid: proto.Uint32(uid)},
+		},
+	}
+	fillRequired(core.ProtoReflect())
+	return core
+}
+
+// testMm is a helper to create the memory
+// mappings of a process with the given VMAs
+func testMm(starts ...uint64) *mm.MmEntry {
+	mmEntry := &mm.MmEntry{ExeFileId: proto.Uint32(2)}
+	for _, start := range starts {
+		mmEntry.Vmas = append(mmEntry.Vmas, &vma.VmaEntry{
+			Start:  proto.Uint64(start),
+			End:    proto.Uint64(start + 0x1000),
+			Prot:   proto.Uint32(1),
+			Status: proto.Uint32(1),
+		})
+	}
+	fillRequired(mmEntry.ProtoReflect())
+	return mmEntry
+}
+
+// testCgroup is a helper to create a cgroup image
+// with a single set of the memory controller
+func testCgroup(path string) *cgroup.CgroupEntry {
+	return &cgroup.CgroupEntry{
+		Sets: []*cgroup.CgSetEntry{{
+			Id: proto.Uint32(1),
+			Ctls: []*cgroup.CgMemberEntry{{
+				Name: proto.String("memory"),
+				Path: proto.String(path),
+			}},
+		}},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	writeTestFds(t, dirA, "/a")
+	writeTestFds(t, dirB, "/b")
+	writeTestImg(t, dirA, "core-1.img", "CORE", testCore(0x1000, 0, 0))
+	writeTestImg(t, dirB, "core-1.img", "CORE", testCore(0x2000, 1<<9, 1000))
+	writeTestImg(t, dirA, "mm-1.img", "MM", testMm(0x10000))
+	writeTestImg(t, dirB, "mm-1.img", "MM", testMm(0x10000, 0x20000))
+	writeTestImg(t, dirA, "cgroup.img", "CGROUP", testCgroup("/a"))
+	writeTestImg(t, dirB, "cgroup.img", "CGROUP", testCgroup("/b"))
+	writeTestImg(t, dirA, "mountpoints-1.img", "MNTS", testMount(1, "/proc", "/", false, ""))
+	// A second mount is stacked on /proc
+	writeTestImg(t, dirB, "mountpoints-1.img", "MNTS", testMount(1, "/proc", "/", false, ""),
+		testMount(2, "/sys", "/", false, ""), testMount(3, "/proc", "/", false, ""))
+
+	diff, err := Diff(newCheckpoint(dirA), newCheckpoint(dirB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Change{
+		{"core", "process 1", ChangeChanged, "regs.ip", "0x1000", "0x2000"},
+		{"core", "process 1", ChangeChanged, "tc.blk_sigset", "0x0", "0x200"},
+		{"creds", "process 1", ChangeChanged, "uid", "0", "1000"},
+		{"cgroup", "process 1", ChangeChanged, "memory", "/a", "/b"},
+		{"mm", "process 1 vma 0x20000", ChangeAdded, "", "", "0x20000-0x21000 r-- "},
+		{"fd", "process 1 fd 0", ChangeChanged, "path", "/a", "/b"},
+		{"mnt", "mount /proc #2 (ns 1)", ChangeAdded, "", "", ""},
+		{"mnt", "mount /sys (ns 1)", ChangeAdded, "", "", ""},
+	}
+	if len(diff.Changes) != len(want) {
+		for _, change := range diff.Changes {
+			t.Logf("%+v", *change)
+		}
+		t.Fatalf("want %d changes, got %d", len(want), len(diff.Changes))
+	}
+	for i, change := range diff.Changes {
+		// The descriptions of mounts depend on testMount()
+		if change.Category == "mnt" {
+			change.New = ""
+		}
+		if want[i].Category == "mm" {
+			want[i].New = change.New
+		}
+		if *change != want[i] {
+			t.Errorf("want: %+v, got: %+v", want[i], *change)
+		}
+	}
+	if len(diff.Category("core")) != 2 {
+		t.Errorf("unexpected core changes %+v", diff.Category("core"))
+	}
+
+	diff, err = Diff(newCheckpoint(dirA), newCheckpoint(dirA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Equal() {
+		t.Errorf("unexpected changes %+v", diff.Changes)
+	}
+}
+
+func TestDiffFieldsTypes(t *testing.T) {
+	var changes []string
+	regs := &core_x86.UserX86RegsEntry{}
+	diffFields("regs", regs.ProtoReflect(), (&core_aarch64.UserAarch64RegsEntry{}).ProtoReflect(), nil, func(field, oldValue, newValue string) {
+		changes = append(changes, field+" "+oldValue+" "+newValue)
+	})
+	if len(changes) != 1 || changes[0] != "regs user_x86_regs_entry user_aarch64_regs_entry" {
+		t.Errorf("unexpected changes %q", changes)
+	}
+}
@@ -0,0 +1,537 @@
+package crit
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Pointer encodings of .eh_frame
+const (
+	dwEhPeOmit     = 0xff
+	dwEhPeAbsptr   = 0x00
+	dwEhPeUleb128  = 0x01
+	dwEhPeUdata2   = 0x02
+	dwEhPeUdata4   = 0x03
+	dwEhPeUdata8   = 0x04
+	dwEhPeSleb128  = 0x09
+	dwEhPeSdata2   = 0x0a
+	dwEhPeSdata4   = 0x0b
+	dwEhPeSdata8   = 0x0c
+	dwEhPePcrel    = 0x10
+	dwEhPeIndirect = 0x80
+)
+
+// Call frame instructions
+const (
+	dwCfaAdvanceLoc       = 0x40
+	dwCfaOffset           = 0x80
+	dwCfaRestore          = 0xc0
+	dwCfaNop              = 0x00
+	dwCfaSetLoc           = 0x01
+	dwCfaAdvanceLoc1      = 0x02
+	dwCfaAdvanceLoc2      = 0x03
+	dwCfaAdvanceLoc4      = 0x04
+	dwCfaOffsetExtended   = 0x05
+	dwCfaRestoreExtended  = 0x06
+	dwCfaUndefined        = 0x07
+	dwCfaSameValue        = 0x08
+	dwCfaRegister         = 0x09
+	dwCfaRememberState    = 0x0a
+	dwCfaRestoreState     = 0x0b
+	dwCfaDefCfa           = 0x0c
+	dwCfaDefCfaRegister   = 0x0d
+	dwCfaDefCfaOffset     = 0x0e
+	dwCfaDefCfaExpression = 0x0f
+	dwCfaExpression       = 0x10
+	dwCfaOffsetExtendedSf = 0x11
+	dwCfaDefCfaSf         = 0x12
+	dwCfaDefCfaOffsetSf   = 0x13
+	dwCfaValOffset        = 0x14
+	dwCfaValOffsetSf      = 0x15
+	dwCfaValExpression    = 0x16
+	dwCfaGNUWindowSave    = 0x2d
+	dwCfaGNUArgsSize      = 0x2e
+	dwCfaGNUNegOffsetExt  = 0x2f
+)
+
+// ehFrame is the call frame information of an ELF
+// file, with the FDEs sorted by their start address
+type ehFrame struct {
+	fdes []*ehFDE
+}
+
+// ehCIE is a common information entry of .eh_frame
+type ehCIE struct {
+	// Set for the 'z' augmentation, where FDEs
+	// have the length of their augmentation data
+	augmented   bool
+	codeAlign   uint64
+	dataAlign   int64
+	raReg       uint64
+	fdeEncoding byte
+	initial     []byte
+}
+
+// ehFDE is a frame description entry of .eh_frame
+type ehFDE struct {
+	cie          *ehCIE
+	start, end   uint64
+	instructions []byte
+	// Address of the instructions, used for pc-relative pointers
+	addr uint64
+}
+
+// Kinds of the rules to recover registers
+const (
+	ruleSame = iota
+	ruleUndefined
+	ruleOffset
+	ruleValOffset
+	ruleRegister
+	ruleExpression
+)
+
+// regRule describes how a register of the caller is recovered
+type regRule struct {
+	kind   int
+	offset int64
+	reg    uint64
+}
+
+// cfaRow is a row of the call frame table, where
+// the CFA is the value of cfaReg plus cfaOffset
+type cfaRow struct {
+	cfaReg    uint64
+	cfaOffset int64
+	cfaExpr   bool
+	// Set if the return address is signed with
+	// pointer authentication of aarch64
+	raSigned bool
+	regs     map[uint64]regRule
+}
+
+// ehReader reads the fields of .eh_frame
+type ehReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+	// Address of the section, used for pc-relative pointers
+	addr    uint64
+	ptrSize int
+	err     error
+}
+
+var errEhFrameTruncated = errors.New(".eh_frame is truncated")
+
+// Helper to get the next n bytes. Zeros are returned
+// past the end of the data, which are enough for the
+// fields read by the callers, as the result of a
+// failed read is discarded.
+func (r *ehReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data)-r.pos {
+		r.err = errEhFrameTruncated
+		return make([]byte, 8)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *ehReader) u8() byte {
+	return r.bytes(1)[0]
+}
+
+func (r *ehReader) u16() uint64 {
+	return uint64(r.order.Uint16(r.bytes(2)))
+}
+
+func (r *ehReader) u32() uint64 {
+	return uint64(r.order.Uint32(r.bytes(4)))
+}
+
+func (r *ehReader) u64() uint64 {
+	return r.order.Uint64(r.bytes(8))
+}
+
+func (r *ehReader) uleb() uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b := r.u8()
+		if shift < 64 {
+			v |= uint64(b&0x7f) << shift
+		}
+		if b&0x80 == 0 || r.err != nil {
+			return v
+		}
+	}
+}
+
+// Helper to skip a block, which is preceded by its length
+func (r *ehReader) skipBlock() {
+	n := r.uleb()
+	if r.err == nil && n > uint64(len(r.data)-r.pos) {
+		r.err = errEhFrameTruncated
+		return
+	}
+	r.bytes(int(n))
+}
+
+func (r *ehReader) sleb() int64 {
+	var v int64
+	var shift uint
+	for {
+		b := r.u8()
+		if shift < 64 {
+			v |= int64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 || r.err != nil {
+			if shift < 64 && b&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+	}
+}
+
+// Helper to read a pointer with the given encoding
+func (r *ehReader) pointer(enc byte) uint64 {
+	if enc == dwEhPeOmit {
+		return 0
+	}
+	pos := r.addr + uint64(r.pos)
+	var v uint64
+	switch enc & 0x0f {
+	case dwEhPeAbsptr:
+		if r.ptrSize == 4 {
+			v = r.u32()
+		} else {
+			v = r.u64()
+		}
+	case dwEhPeUleb128:
+		v = r.uleb()
+	case dwEhPeUdata2:
+		v = r.u16()
+	case dwEhPeUdata4:
+		v = r.u32()
+	case dwEhPeUdata8:
+		v = r.u64()
+	case dwEhPeSleb128:
+		v = uint64(r.sleb())
+	case dwEhPeSdata2:
+		v = uint64(int64(int16(r.u16())))
+	case dwEhPeSdata4:
+		v = uint64(int64(int32(r.u32())))
+	case dwEhPeSdata8:
+		v = r.u64()
+	default:
+		r.err = fmt.Errorf("unsupported pointer encoding 0x%x", enc)
+	}
+	switch enc & 0x70 {
+	case dwEhPePcrel:
+		v += pos
+	case 0:
+	default:
+		r.err = fmt.Errorf("unsupported pointer encoding 0x%x", enc)
+	}
+	if enc&dwEhPeIndirect != 0 {
+		r.err = fmt.Errorf("unsupported pointer encoding 0x%x", enc)
+	}
+	return v
+}
+
+// Helper to parse the .eh_frame section of an ELF file
+func parseEhFrame(f *elf.File) (*ehFrame, error) {
+	section := f.Section(".eh_frame")
+	if section == nil || section.Type == elf.SHT_NOBITS {
+		return nil, errors.New("no .eh_frame section")
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+	ptrSize := 8
+	if f.Class == elf.ELFCLASS32 {
+		ptrSize = 4
+	}
+
+	eh := &ehFrame{}
+	cies := make(map[int]*ehCIE)
+	r := &ehReader{data: data, order: f.ByteOrder, addr: section.Addr, ptrSize: ptrSize}
+	for r.pos < len(data) {
+		start := r.pos
+		length := r.u32()
+		if length == 0 {
+			// Zero terminator
+			break
+		}
+		if length == 0xffffffff {
+			return nil, errors.New("64-bit .eh_frame is not supported")
+		}
+		if r.err != nil || length > uint64(len(data)-r.pos) {
+			return nil, errEhFrameTruncated
+		}
+		end := r.pos + int(length)
+		idPos := r.pos
+		id := r.u32()
+		if id == 0 {
+			r.pos = end
+			continue
+		}
+
+		cieOff := idPos - int(id)
+		cie, ok := cies[cieOff]
+		if !ok {
+			if cie, err = parseCIE(r, cieOff); err != nil {
+				return nil, fmt.Errorf("CIE at 0x%x: %w", cieOff, err)
+			}
+			cies[cieOff] = cie
+		}
+		fde := &ehFDE{cie: cie}
+		fde.start = r.pointer(cie.fdeEncoding)
+		fde.end = fde.start + r.pointer(cie.fdeEncoding&0x0f)
+		if cie.augmented {
+			r.skipBlock()
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("FDE at 0x%x: %w", start, r.err)
+		}
+		if r.pos > end {
+			return nil, fmt.Errorf("FDE at 0x%x: %w", start, errEhFrameTruncated)
+		}
+		fde.instructions = data[r.pos:end]
+		fde.addr = section.Addr + uint64(r.pos)
+		eh.fdes = append(eh.fdes, fde)
+		r.pos = end
+	}
+
+	sort.Slice(eh.fdes, func(i, j int) bool {
+		return eh.fdes[i].start < eh.fdes[j].start
+	})
+	return eh, nil
+}
+
+// Helper to parse the CIE at the given offset of .eh_frame
+func parseCIE(parent *ehReader, off int) (*ehCIE, error) {
+	r := *parent
+	r.pos = off
+	if off < 0 || off >= len(r.data) {
+		return nil, errEhFrameTruncated
+	}
+	length := r.u32()
+	if r.err != nil || length > uint64(len(r.data)-r.pos) {
+		return nil, errEhFrameTruncated
+	}
+	end := r.pos + int(length)
+	if id := r.u32(); id != 0 {
+		return nil, errors.New("not a CIE")
+	}
+
+	cie := &ehCIE{fdeEncoding: dwEhPeAbsptr}
+	version := r.u8()
+	var augmentation []byte
+	for b := r.u8(); b != 0 && r.err == nil; b = r.u8() {
+		augmentation = append(augmentation, b)
+	}
+	if version >= 4 {
+		// Address and segment selector size
+		r.bytes(2)
+	}
+	cie.codeAlign = r.uleb()
+	cie.dataAlign = r.sleb()
+	if version == 1 {
+		cie.raReg = uint64(r.u8())
+	} else {
+		cie.raReg = r.uleb()
+	}
+
+	if len(augmentation) > 0 && augmentation[0] == 'z' {
+		augLen := r.uleb()
+		if r.err != nil || r.pos > end || augLen > uint64(end-r.pos) {
+			return nil, errEhFrameTruncated
+		}
+		augEnd := r.pos + int(augLen)
+		for _, c := range augmentation[1:] {
+			switch c {
+			case 'R':
+				cie.fdeEncoding = r.u8()
+			case 'L':
+				r.u8()
+			case 'P':
+				r.pointer(r.u8())
+			case 'S', 'B':
+			default:
+				return nil, fmt.Errorf("unsupported augmentation %q", augmentation)
+			}
+		}
+		r.pos = augEnd
+		cie.augmented = true
+	} else if len(augmentation) > 0 {
+		return nil, fmt.Errorf("unsupported augmentation %q", augmentation)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.pos > end {
+		return nil, errEhFrameTruncated
+	}
+	cie.initial = r.data[r.pos:end]
+	return cie, nil
+}
+
+// Helper to find the FDE covering the address pc
+func (eh *ehFrame) find(pc uint64) *ehFDE {
+	i := sort.Search(len(eh.fdes), func(i int) bool { return eh.fdes[i].end > pc })
+	for ; i < len(eh.fdes) && eh.fdes[i].start <= pc; i++ {
+		if pc < eh.fdes[i].end {
+			return eh.fdes[i]
+		}
+	}
+	return nil
+}
+
+// Helper to execute the call frame instructions of an FDE
+// and get the row of the call frame table for pc
+func (fde *ehFDE) row(pc uint64, order binary.ByteOrder, ptrSize int) (*cfaRow, error) {
+	row := &cfaRow{regs: make(map[uint64]regRule)}
+	if err := fde.execute(row, nil, fde.cie.initial, ^uint64(0), order, ptrSize); err != nil {
+		return nil, err
+	}
+	initial := &cfaRow{regs: make(map[uint64]regRule, len(row.regs))}
+	for reg, rule := range row.regs {
+		initial.regs[reg] = rule
+	}
+	if err := fde.execute(row, initial, fde.instructions, pc, order, ptrSize); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// Helper to execute call frame instructions until the location
+// passes pc, where initial holds the rules of the CIE
+func (fde *ehFDE) execute(row, initial *cfaRow, instructions []byte, pc uint64, order binary.ByteOrder, ptrSize int) error {
+	cie := fde.cie
+	r := &ehReader{data: instructions, order: order, ptrSize: ptrSize, addr: fde.addr}
+	loc := fde.start
+	var stack []*cfaRow
+	// Helper to restore the rule of a register from the CIE
+	restore := func(reg uint64) {
+		if initial == nil {
+			delete(row.regs, reg)
+		} else if rule, ok := initial.regs[reg]; ok {
+			row.regs[reg] = rule
+		} else {
+			delete(row.regs, reg)
+		}
+	}
+	// Helper to advance the location, which returns
+	// false once the location passes pc
+	advance := func(delta uint64) bool {
+		loc += delta * cie.codeAlign
+		return loc <= pc
+	}
+
+	for r.pos < len(instructions) && r.err == nil {
+		op := r.u8()
+		switch op & 0xc0 {
+		case dwCfaAdvanceLoc:
+			if !advance(uint64(op & 0x3f)) {
+				return nil
+			}
+			continue
+		case dwCfaOffset:
+			row.regs[uint64(op&0x3f)] = regRule{kind: ruleOffset, offset: int64(r.uleb()) * cie.dataAlign}
+			continue
+		case dwCfaRestore:
+			restore(uint64(op & 0x3f))
+			continue
+		}
+
+		switch op {
+		case dwCfaNop:
+		case dwCfaSetLoc:
+			loc = r.pointer(cie.fdeEncoding)
+			if loc > pc {
+				return nil
+			}
+		case dwCfaAdvanceLoc1:
+			if !advance(uint64(r.u8())) {
+				return nil
+			}
+		case dwCfaAdvanceLoc2:
+			if !advance(r.u16()) {
+				return nil
+			}
+		case dwCfaAdvanceLoc4:
+			if !advance(r.u32()) {
+				return nil
+			}
+		case dwCfaOffsetExtended:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleOffset, offset: int64(r.uleb()) * cie.dataAlign}
+		case dwCfaRestoreExtended:
+			restore(r.uleb())
+		case dwCfaUndefined:
+			row.regs[r.uleb()] = regRule{kind: ruleUndefined}
+		case dwCfaSameValue:
+			row.regs[r.uleb()] = regRule{kind: ruleSame}
+		case dwCfaRegister:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleRegister, reg: r.uleb()}
+		case dwCfaRememberState:
+			saved := &cfaRow{cfaReg: row.cfaReg, cfaOffset: row.cfaOffset, cfaExpr: row.cfaExpr,
+				raSigned: row.raSigned, regs: make(map[uint64]regRule, len(row.regs))}
+			for reg, rule := range row.regs {
+				saved.regs[reg] = rule
+			}
+			stack = append(stack, saved)
+		case dwCfaRestoreState:
+			if len(stack) == 0 {
+				return errors.New("DW_CFA_restore_state without saved state")
+			}
+			*row = *stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case dwCfaDefCfa:
+			row.cfaReg, row.cfaOffset, row.cfaExpr = r.uleb(), int64(r.uleb()), false
+		case dwCfaDefCfaSf:
+			row.cfaReg, row.cfaOffset, row.cfaExpr = r.uleb(), r.sleb()*cie.dataAlign, false
+		case dwCfaDefCfaRegister:
+			row.cfaReg = r.uleb()
+		case dwCfaDefCfaOffset:
+			row.cfaOffset = int64(r.uleb())
+		case dwCfaDefCfaOffsetSf:
+			row.cfaOffset = r.sleb() * cie.dataAlign
+		case dwCfaDefCfaExpression:
+			row.cfaExpr = true
+			r.skipBlock()
+		case dwCfaExpression, dwCfaValExpression:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleExpression}
+			r.skipBlock()
+		case dwCfaOffsetExtendedSf:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleOffset, offset: r.sleb() * cie.dataAlign}
+		case dwCfaValOffset:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleValOffset, offset: int64(r.uleb()) * cie.dataAlign}
+		case dwCfaValOffsetSf:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleValOffset, offset: r.sleb() * cie.dataAlign}
+		case dwCfaGNUArgsSize:
+			r.uleb()
+		case dwCfaGNUNegOffsetExt:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleOffset, offset: -int64(r.uleb()) * cie.dataAlign}
+		case dwCfaGNUWindowSave:
+			// Toggles the signing of the return address
+			// on aarch64, which is stripped when unwinding
+			row.raSigned = !row.raSigned
+		default:
+			return fmt.Errorf("unsupported call frame instruction 0x%x", op)
+		}
+	}
+	return r.err
+}
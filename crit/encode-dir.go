@@ -0,0 +1,135 @@
+package crit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Suffix of the images written by WriteDirJSON()
+const jsonSuffix = ".json"
+
+// EncodeDir writes every file of a decoded checkpoint
+// to dir, which is created if it does not exist. Files
+// referenced by path are copied from fsys.
+func EncodeDir(criuDir *CriuDir, dir string, fsys fs.FS) error {
+	return writeDir(criuDir, dir, fsys, false)
+}
+
+// WriteDirJSON writes a decoded checkpoint to dir with one
+// indented JSON file per protobuf image, named after the image
+// with a .json suffix. All other files are written as they are,
+// copied from fsys if they are referenced by path. The result
+// can be read back with ReadDirJSON().
+func WriteDirJSON(criuDir *CriuDir, dir string, fsys fs.FS) error {
+	return writeDir(criuDir, dir, fsys, true)
+}
+
+// Helper to write the files of a decoded checkpoint
+func writeDir(criuDir *CriuDir, dir string, fsys fs.FS, asJSON bool) error {
+	// Names come from documents which may not be trusted,
+	// so they must not point outside of the directory,
+	// which includes paths through recreated symlinks
+	names := make(map[string]bool)
+	links := make(map[string]bool)
+	for _, dirImage := range criuDir.Images {
+		if !fs.ValidPath(dirImage.Name) || dirImage.Name == "." {
+			return fmt.Errorf("invalid image name %q", dirImage.Name)
+		}
+		name := outputName(dirImage, asJSON)
+		if names[name] {
+			return fmt.Errorf("duplicate image name %q", name)
+		}
+		names[name] = true
+		if dirImage.Link != "" {
+			links[name] = true
+		}
+	}
+	for _, dirImage := range criuDir.Images {
+		name := outputName(dirImage, asJSON)
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if links[parent] {
+				return fmt.Errorf("invalid image name %q below symlink %s", dirImage.Name, parent)
+			}
+			// Symlinks may also be left by earlier runs
+			info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(parent)))
+			if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("invalid image name %q below symlink %s", dirImage.Name, parent)
+			}
+		}
+		outPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+			return err
+		}
+
+		if err := writeDirImage(dirImage, outPath, fsys, asJSON); err != nil {
+			return fmt.Errorf("error writing %s: %w", dirImage.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Helper to get the name of the file written for an image
+func outputName(dirImage *CriuDirImage, asJSON bool) string {
+	if asJSON && dirImage.Image != nil {
+		return dirImage.Name + jsonSuffix
+	}
+	return dirImage.Name
+}
+
+// Helper to write a single file of a decoded checkpoint
+func writeDirImage(dirImage *CriuDirImage, path string, fsys fs.FS, asJSON bool) error {
+	// Existing files are replaced instead of being opened,
+	// so that symlinks in the directory are not followed
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if dirImage.Link != "" {
+		return os.Symlink(dirImage.Link, path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch {
+	case dirImage.Image != nil && asJSON:
+		data, err := json.MarshalIndent(dirImage.Image, "", "    ")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	case dirImage.Image != nil:
+		if err := encodeImg(dirImage.Image, f); err != nil {
+			return err
+		}
+	case dirImage.Path != "":
+		if fsys == nil {
+			return fmt.Errorf("no file system to read %s from", dirImage.Path)
+		}
+		src, err := fsys.Open(dirImage.Path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.Copy(f, src); err != nil {
+			return err
+		}
+	default:
+		if _, err := f.Write(dirImage.Data); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
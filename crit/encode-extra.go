@@ -10,6 +10,11 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// Extra payload handler for ghost files and ghost chunks
+func encodeGhostData(extra string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(extra)
+}
+
 // Extra payload handler for pipe and FIFO data
 func encodePipesData(extra string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(extra)
@@ -73,8 +78,8 @@ func encodeIpcShm(extra string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Round off to nearest 32-bit multiple
-	roundedSize := len(extraPayload)
+	// Round up to nearest 32-bit multiple
+	roundedSize := (len(extraPayload) + 3) / 4 * 4
 	// Append zeroes for remaining bytes
 	extraPayload = append(extraPayload, make([]byte, roundedSize-len(extraPayload))...)
 
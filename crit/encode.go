@@ -1,168 +1,118 @@
 package crit
 
 import (
-	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
+	"io"
 
 	"github.com/checkpoint-restore/go-criu/v7/magic"
 	"google.golang.org/protobuf/proto"
 )
 
-// encodeImg identifies the type of image file
-// and calls the appropriate encode handler
-func encodeImg(img *CriuImage, f *os.File) error {
+// encodeImg writes all entries of a CriuImage,
+// including their extra payloads, to an image file
+func encodeImg(img *CriuImage, f io.Writer) error {
+	iw, err := NewImageWriter(f, img.Magic)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range img.Entries {
+		if err := iw.Write(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImageWriter encodes the entries of an image one at a time.
+// New instances should be created with NewImageWriter().
+type ImageWriter struct {
+	w           io.Writer
+	magic       string
+	encodeExtra func(string) ([]byte, error)
+}
+
+// NewImageWriter writes the header of an image with the given
+// magic to w and returns an ImageWriter for its entries.
+func NewImageWriter(w io.Writer, magicName string) (*ImageWriter, error) {
 	magicMap := magic.LoadMagic()
-	var err error
 
 	// Write magic
-	magic, ok := magicMap.ByName[img.Magic]
+	magicValue, ok := magicMap.ByName[magicName]
 	if !ok {
-		return errors.New(fmt.Sprint("unknown magic ", img.Magic))
+		return nil, errors.New(fmt.Sprint("unknown magic ", magicName))
 	}
 	magicBuf := make([]byte, 4)
-	if img.Magic != "INVENTORY" {
-		if img.Magic == "STATS" || img.Magic == "IRMAP_CACHE" {
+	if magicName != "INVENTORY" {
+		if magicName == "STATS" || magicName == "IRMAP_CACHE" {
 			binary.LittleEndian.PutUint32(magicBuf, uint32(magicMap.ByName["IMG_SERVICE"]))
 		} else {
 			binary.LittleEndian.PutUint32(magicBuf, uint32(magicMap.ByName["IMG_COMMON"]))
 		}
-		if _, err = f.Write(magicBuf); err != nil {
-			return err
+		if _, err := w.Write(magicBuf); err != nil {
+			return nil, err
 		}
 	}
-	binary.LittleEndian.PutUint32(magicBuf, uint32(magic))
-	if _, err = f.Write(magicBuf); err != nil {
-		return err
+	binary.LittleEndian.PutUint32(magicBuf, uint32(magicValue))
+	if _, err := w.Write(magicBuf); err != nil {
+		return nil, err
 	}
 
-	// Call handler for entries
-	switch img.Magic {
-	// Special handler for ghost files
+	iw := &ImageWriter{w: w, magic: magicName}
+	switch magicName {
 	case "GHOST_FILE":
-		err = img.encodeGhostFile(f)
-	// Default handler with func for extra data
+		iw.encodeExtra = encodeGhostData
 	case "BPFMAP_DATA":
-		err = img.encodeDefault(f, encodeBpfmapData)
-	case "FIFO_DATA":
-		err = img.encodeDefault(f, encodePipesData)
+		iw.encodeExtra = encodeBpfmapData
+	case "FIFO_DATA", "PIPES_DATA":
+		iw.encodeExtra = encodePipesData
 	case "IPCNS_MSG":
-		err = img.encodeDefault(f, encodeIpcMsg)
+		iw.encodeExtra = encodeIpcMsg
 	case "IPCNS_SEM":
-		err = img.encodeDefault(f, encodeIpcSem)
+		iw.encodeExtra = encodeIpcSem
 	case "IPCNS_SHM":
-		err = img.encodeDefault(f, encodeIpcShm)
-	case "PIPES_DATA":
-		err = img.encodeDefault(f, encodePipesData)
+		iw.encodeExtra = encodeIpcShm
 	case "SK_QUEUES":
-		err = img.encodeDefault(f, encodeSkQueues)
+		iw.encodeExtra = encodeSkQueues
 	case "TCP_STREAM":
-		err = img.encodeDefault(f, encodeTCPStream)
-	default:
-		err = img.encodeDefault(f, nil)
-	}
-	if err != nil {
-		return err
+		iw.encodeExtra = encodeTCPStream
 	}
 
-	return nil
+	return iw, nil
 }
 
-// encodeDefault is used for all image files
-// that are in the standard protobuf format
-func (img *CriuImage) encodeDefault(
-	f *os.File,
-	encodeExtra func(string) ([]byte, error),
-) error {
-	sizeBuf := make([]byte, 4)
-
-	for _, entry := range img.Entries {
-		payload, err := proto.Marshal(entry.Message)
-		if err != nil {
-			return err
-		}
-		// Write size of payload into buffer
-		binary.LittleEndian.PutUint32(sizeBuf, uint32(len(payload)))
-
-		if _, err = f.Write(sizeBuf); err != nil {
-			return err
-		}
-		if _, err = f.Write(payload); err != nil {
-			return err
-		}
-
-		// Write extra data
-		if encodeExtra != nil {
-			if entry.Extra != "" {
-				extraPayload, err := encodeExtra(entry.Extra)
-				if err != nil {
-					return err
-				}
-				if _, err = f.Write(extraPayload); err != nil {
-					return err
-				}
-			}
-		}
-	}
-
-	return nil
+// Magic returns the magic of the image
+func (iw *ImageWriter) Magic() string {
+	return iw.magic
 }
 
-// Special handler for ghost image
-func (img *CriuImage) encodeGhostFile(f *os.File) error {
-	sizeBuf := make([]byte, 4)
-	// Write primary entry
-	payload, err := proto.Marshal(img.Entries[0].Message)
+// Write encodes a single entry followed by its extra payload
+func (iw *ImageWriter) Write(entry *CriuEntry) error {
+	payload, err := proto.Marshal(entry.Message)
 	if err != nil {
 		return err
 	}
 	// Write size of payload into buffer
+	sizeBuf := make([]byte, 4)
 	binary.LittleEndian.PutUint32(sizeBuf, uint32(len(payload)))
 
-	if _, err = f.Write(sizeBuf); err != nil {
+	if _, err = iw.w.Write(sizeBuf); err != nil {
 		return err
 	}
-	if _, err = f.Write(payload); err != nil {
+	if _, err = iw.w.Write(payload); err != nil {
 		return err
 	}
 
-	// If there is only one entry,
-	// then no chunks are present
-	if len(img.Entries) == 1 {
-		// Write extra data
-		extraPayload, err := base64.StdEncoding.DecodeString(img.Entries[0].Extra)
+	// Write extra data
+	if iw.encodeExtra != nil && entry.Extra != "" {
+		extraPayload, err := iw.encodeExtra(entry.Extra)
 		if err != nil {
 			return err
 		}
-		if _, err = f.Write(extraPayload); err != nil {
-			return err
-		}
-
-		return nil
-	}
-
-	// Write chunks
-	for _, entry := range img.Entries[1:] {
-		payload, err = proto.Marshal(entry.Message)
-		if err != nil {
-			return err
-		}
-		extraPayload, err := base64.StdEncoding.DecodeString(entry.Extra)
-		if err != nil {
-			return err
-		}
-
-		binary.LittleEndian.PutUint32(sizeBuf, uint32(len(extraPayload)))
-
-		if _, err = f.Write(sizeBuf); err != nil {
-			return err
-		}
-		if _, err = f.Write(payload); err != nil {
-			return err
-		}
-		if _, err = f.Write(extraPayload); err != nil {
+		if _, err = iw.w.Write(extraPayload); err != nil {
 			return err
 		}
 	}
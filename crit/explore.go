@@ -1,15 +1,12 @@
 package crit
 
 import (
+	"errors"
 	"fmt"
-	"path/filepath"
 	"strconv"
 
 	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
-	"github.com/checkpoint-restore/go-criu/v7/crit/images/fs"
-	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
-	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
 )
 
@@ -25,23 +22,21 @@ type PsTree struct {
 }
 
 // ExplorePs constructs the process tree and returns the root process
-func (c *crit) ExplorePs() (*PsTree, error) {
-	psTreeImg, err := getImg(filepath.Join(c.inputDirPath, "pstree.img"), &pstree.PstreeEntry{})
+func (c *Checkpoint) ExplorePs() (*PsTree, error) {
+	psTree, err := c.Pstree()
 	if err != nil {
 		return nil, err
 	}
 
 	processes := make(map[uint32]*PsTree)
 	var psTreeRoot *PsTree
-	for _, entry := range psTreeImg.Entries {
-		process := entry.Message.(*pstree.PstreeEntry)
+	for _, process := range psTree {
 		pID := process.GetPid()
 
-		coreImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("core-%d.img", pID)), &criu_core.CoreEntry{})
+		coreData, err := c.Core(pID)
 		if err != nil {
 			return nil, err
 		}
-		coreData := coreImg.Entries[0].Message.(*criu_core.CoreEntry)
 
 		ps := &PsTree{
 			PID:     pID,
@@ -60,9 +55,19 @@ func (c *crit) ExplorePs() (*PsTree, error) {
 
 	for _, ps := range processes {
 		parent := ps.Process.GetPpid()
-		if parent != 0 {
-			processes[parent].Children = append(processes[parent].Children, ps)
+		if parent == 0 {
+			continue
+		}
+		if parent == ps.PID {
+			return nil, fmt.Errorf("process %d is its own parent", ps.PID)
 		}
+		if _, ok := processes[parent]; !ok {
+			return nil, fmt.Errorf("parent %d of process %d not found in pstree", parent, ps.PID)
+		}
+		processes[parent].Children = append(processes[parent].Children, ps)
+	}
+	if psTreeRoot == nil {
+		return nil, errors.New("no root process found in pstree")
 	}
 
 	return psTreeRoot, nil
@@ -83,33 +88,29 @@ type File struct {
 
 // ExploreFds searches the process tree for open files
 // and returns a list of PIDs with the corresponding files
-func (c *crit) ExploreFds() ([]*Fd, error) {
-	psTreeImg, err := getImg(filepath.Join(c.inputDirPath, "pstree.img"), &pstree.PstreeEntry{})
+func (c *Checkpoint) ExploreFds() ([]*Fd, error) {
+	psTree, err := c.Pstree()
 	if err != nil {
 		return nil, err
 	}
 
 	fds := make([]*Fd, 0)
-	for _, entry := range psTreeImg.Entries {
-		process := entry.Message.(*pstree.PstreeEntry)
+	for _, process := range psTree {
 		pID := process.GetPid()
 		// Get file with object IDs
-		idsImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("ids-%d.img", pID)), &criu_core.TaskKobjIdsEntry{})
+		ids, err := c.Ids(pID)
 		if err != nil {
 			return nil, err
 		}
-		filesID := idsImg.Entries[0].Message.(*criu_core.TaskKobjIdsEntry).GetFilesId()
 		// Get open file descriptors
-		fdInfoImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("fdinfo-%d.img", filesID)), &fdinfo.FdinfoEntry{})
+		fdInfos, err := c.Fdinfo(ids.GetFilesId())
 		if err != nil {
 			return nil, err
 		}
 
 		fdEntry := Fd{PId: pID}
-		for _, fdInfoEntry := range fdInfoImg.Entries {
-			fdInfo := fdInfoEntry.Message.(*fdinfo.FdinfoEntry)
-			filePath, err := getFilePath(c.inputDirPath,
-				fdInfo.GetId(), fdInfo.GetType())
+		for _, fdInfo := range fdInfos {
+			filePath, err := c.filePath(fdInfo.GetId(), fdInfo.GetType())
 			if err != nil {
 				return nil, err
 			}
@@ -121,13 +122,11 @@ func (c *crit) ExploreFds() ([]*Fd, error) {
 			fdEntry.Files = append(fdEntry.Files, &file)
 		}
 		// Get chroot and chdir info
-		fsImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("fs-%d.img", pID)), &fs.FsEntry{})
+		fs, err := c.Fs(pID)
 		if err != nil {
 			return nil, err
 		}
-		fs := fsImg.Entries[0].Message.(*fs.FsEntry)
-		filePath, err := getFilePath(c.inputDirPath,
-			fs.GetCwdId(), fdinfo.FdTypes_REG)
+		filePath, err := c.filePath(fs.GetCwdId(), fdinfo.FdTypes_REG)
 		if err != nil {
 			return nil, err
 		}
@@ -135,8 +134,7 @@ func (c *crit) ExploreFds() ([]*Fd, error) {
 			Fd:   "cwd",
 			Path: filePath,
 		})
-		filePath, err = getFilePath(c.inputDirPath,
-			fs.GetRootId(), fdinfo.FdTypes_REG)
+		filePath, err = c.filePath(fs.GetRootId(), fdinfo.FdTypes_REG)
 		if err != nil {
 			return nil, err
 		}
@@ -173,8 +171,8 @@ type Mem struct {
 
 // ExploreMems traverses the process tree and returns a
 // list of processes with the corresponding memory mapping
-func (c *crit) ExploreMems() ([]*MemMap, error) {
-	psTreeImg, err := getImg(filepath.Join(c.inputDirPath, "pstree.img"), &pstree.PstreeEntry{})
+func (c *Checkpoint) ExploreMems() ([]*MemMap, error) {
+	psTree, err := c.Pstree()
 	if err != nil {
 		return nil, err
 	}
@@ -190,17 +188,14 @@ func (c *crit) ExploreMems() ([]*MemMap, error) {
 	}
 
 	memMaps := make([]*MemMap, 0)
-	for _, entry := range psTreeImg.Entries {
-		process := entry.Message.(*pstree.PstreeEntry)
+	for _, process := range psTree {
 		pID := process.GetPid()
 		// Get memory mappings
-		mmImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("mm-%d.img", pID)), &mm.MmEntry{})
+		mmInfo, err := c.MM(pID)
 		if err != nil {
 			return nil, err
 		}
-		mmInfo := mmImg.Entries[0].Message.(*mm.MmEntry)
-		exePath, err := getFilePath(c.inputDirPath,
-			mmInfo.GetExeFileId(), fdinfo.FdTypes_REG)
+		exePath, err := c.filePath(mmInfo.GetExeFileId(), fdinfo.FdTypes_REG)
 		if err != nil {
 			return nil, err
 		}
@@ -218,8 +213,7 @@ func (c *crit) ExploreMems() ([]*MemMap, error) {
 			switch status := vma.GetStatus(); {
 			// Pages used by a file
 			case status&((1<<7)|(1<<6)) != 0:
-				file, err := getFilePath(c.inputDirPath,
-					uint32(vma.GetShmid()), fdinfo.FdTypes_REG)
+				file, err := c.filePath(uint32(vma.GetShmid()), fdinfo.FdTypes_REG)
 				if err != nil {
 					return nil, err
 				}
@@ -249,19 +243,7 @@ func (c *crit) ExploreMems() ([]*MemMap, error) {
 				mem.Resource = fmt.Sprint(mem.Resource, " *")
 			}
 
-			// Check page protection
-			r, w, x := "-", "-", "-"
-			prot := vma.GetProt()
-			if prot&1 != 0 {
-				r = "r"
-			}
-			if prot&2 != 0 {
-				w = "w"
-			}
-			if prot&4 != 0 {
-				x = "x"
-			}
-			mem.Protection = fmt.Sprint(r, w, x)
+			mem.Protection = vmaProtection(vma.GetProt())
 
 			memMap.Mems = append(memMap.Mems, &mem)
 		}
@@ -300,33 +282,30 @@ type Vma struct {
 
 // ExploreRss traverses the process tree and returns
 // a list of processes with their RSS mappings
-func (c *crit) ExploreRss() ([]*RssMap, error) {
-	psTreeImg, err := getImg(filepath.Join(c.inputDirPath, "pstree.img"), &pstree.PstreeEntry{})
+func (c *Checkpoint) ExploreRss() ([]*RssMap, error) {
+	psTree, err := c.Pstree()
 	if err != nil {
 		return nil, err
 	}
 
 	rssMaps := make([]*RssMap, 0)
-	for _, entry := range psTreeImg.Entries {
-		process := entry.Message.(*pstree.PstreeEntry)
+	for _, process := range psTree {
 		pID := process.GetPid()
 		// Get virtual memory addresses
-		mmImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("mm-%d.img", pID)), &mm.MmEntry{})
+		mmInfo, err := c.MM(pID)
 		if err != nil {
 			return nil, err
 		}
-		vmas := mmImg.Entries[0].Message.(*mm.MmEntry).GetVmas()
+		vmas := mmInfo.GetVmas()
 		// Get physical memory addresses
-		pagemapImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("pagemap-%d.img", pID)), &pagemap.PagemapEntry{})
+		_, pagemapEntries, err := c.Pagemap(pID)
 		if err != nil {
 			return nil, err
 		}
 
 		vmaIndex, vmaIndexPrev := 0, -1
 		rssMap := RssMap{PId: pID}
-		// Skip pagemap head entry
-		for _, pagemapEntry := range pagemapImg.Entries[1:] {
-			pagemapData := pagemapEntry.Message.(*pagemap.PagemapEntry)
+		for _, pagemapData := range pagemapEntries {
 			rss := Rss{
 				PhyAddr:  strconv.FormatUint(pagemapData.GetVaddr(), 16),
 				PhyPages: int64(pagemapData.GetNrPages()),
@@ -352,8 +331,7 @@ func (c *crit) ExploreRss() ([]*RssMap, error) {
 				})
 				// Pages used by a file
 				if vmas[vmaIndex].GetStatus()&((1<<6)|(1<<7)) != 0 {
-					file, err := getFilePath(c.inputDirPath,
-						uint32(vmas[vmaIndex].GetShmid()), fdinfo.FdTypes_REG)
+					file, err := c.filePath(uint32(vmas[vmaIndex].GetShmid()), fdinfo.FdTypes_REG)
 					if err != nil {
 						return nil, err
 					}
@@ -398,31 +376,28 @@ type Socket struct {
 
 // ExploreSk searches the process tree for sockets
 // and returns a list of PIDs with the associated sockets
-func (c *crit) ExploreSk() ([]*Sk, error) {
-	psTreeImg, err := getImg(filepath.Join(c.inputDirPath, "pstree.img"), &pstree.PstreeEntry{})
+func (c *Checkpoint) ExploreSk() ([]*Sk, error) {
+	psTree, err := c.Pstree()
 	if err != nil {
 		return nil, err
 	}
 
 	sks := make([]*Sk, 0)
-	for _, entry := range psTreeImg.Entries {
-		process := entry.Message.(*pstree.PstreeEntry)
+	for _, process := range psTree {
 		pID := process.GetPid()
 		// Get file with object IDs
-		idsImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("ids-%d.img", pID)), &criu_core.TaskKobjIdsEntry{})
+		ids, err := c.Ids(pID)
 		if err != nil {
 			return nil, err
 		}
-		filesID := idsImg.Entries[0].Message.(*criu_core.TaskKobjIdsEntry).GetFilesId()
 		// Get open file descriptors
-		fdInfoImg, err := getImg(filepath.Join(c.inputDirPath, fmt.Sprintf("fdinfo-%d.img", filesID)), &fdinfo.FdinfoEntry{})
+		fdInfos, err := c.Fdinfo(ids.GetFilesId())
 		if err != nil {
 			return nil, err
 		}
 		skEntry := Sk{PId: pID}
-		for _, fdInfoEntry := range fdInfoImg.Entries {
-			fdInfo := fdInfoEntry.Message.(*fdinfo.FdinfoEntry)
-			file, err := getFile(c.inputDirPath, fdInfo.GetId())
+		for _, fdInfo := range fdInfos {
+			file, err := c.file(fdInfo.GetId())
 			if err != nil {
 				return nil, err
 			}
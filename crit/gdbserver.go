@@ -0,0 +1,706 @@
+package crit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	core_x86 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-x86"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+)
+
+// Size of the registers of x86_64 targets in the order of
+// gdb, which is described by gdbTargetXML
+var gdbRegSizes = func() []int {
+	sizes := make([]int, 0, 60)
+	// General purpose registers and rip
+	for i := 0; i < 17; i++ {
+		sizes = append(sizes, 8)
+	}
+	// eflags and segment selectors
+	for i := 0; i < 7; i++ {
+		sizes = append(sizes, 4)
+	}
+	// x87 registers and their control registers
+	for i := 0; i < 8; i++ {
+		sizes = append(sizes, 10)
+	}
+	for i := 0; i < 8; i++ {
+		sizes = append(sizes, 4)
+	}
+	// SSE registers and mxcsr
+	for i := 0; i < 16; i++ {
+		sizes = append(sizes, 16)
+	}
+	sizes = append(sizes, 4)
+	// orig_rax, fs_base and gs_base
+	return append(sizes, 8, 8, 8)
+}()
+
+// Target description of x86_64 processes. The registers
+// are numbered in the order of their features.
+var gdbTargetXML = func() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<architecture>i386:x86-64</architecture>
+<osabi>GNU/Linux</osabi>
+<feature name="org.gnu.gdb.i386.core">
+`)
+	reg := func(name string, bitsize int, typ, group string) {
+		fmt.Fprintf(&b, `<reg name="%s" bitsize="%d" type="%s"`, name, bitsize, typ)
+		if group != "" {
+			fmt.Fprintf(&b, ` group="%s"`, group)
+		}
+		b.WriteString("/>\n")
+	}
+	for _, name := range []string{
+		"rax", "rbx", "rcx", "rdx", "rsi", "rdi", "rbp", "rsp",
+		"r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15",
+	} {
+		typ := "int64"
+		if name == "rbp" || name == "rsp" {
+			typ = "data_ptr"
+		}
+		reg(name, 64, typ, "")
+	}
+	reg("rip", 64, "code_ptr", "")
+	reg("eflags", 32, "int32", "")
+	for _, name := range []string{"cs", "ss", "ds", "es", "fs", "gs"} {
+		reg(name, 32, "int32", "")
+	}
+	for i := 0; i < 8; i++ {
+		reg(fmt.Sprintf("st%d", i), 80, "i387_ext", "")
+	}
+	for _, name := range []string{"fctrl", "fstat", "ftag", "fiseg", "fioff", "foseg", "fooff", "fop"} {
+		reg(name, 32, "int", "float")
+	}
+	b.WriteString("</feature>\n<feature name=\"org.gnu.gdb.i386.sse\">\n")
+	for i := 0; i < 16; i++ {
+		reg(fmt.Sprintf("xmm%d", i), 128, "uint128", "vector")
+	}
+	reg("mxcsr", 32, "int", "vector")
+	b.WriteString("</feature>\n<feature name=\"org.gnu.gdb.i386.linux\">\n")
+	reg("orig_rax", 64, "int", "system")
+	b.WriteString("</feature>\n<feature name=\"org.gnu.gdb.i386.segments\">\n")
+	reg("fs_base", 64, "int", "")
+	reg("gs_base", 64, "int", "")
+	b.WriteString("</feature>\n</target>\n")
+	return b.String()
+}()
+
+// GDBServer serves a process of a checkpoint as a read-only target
+// of the GDB Remote Serial Protocol, so that gdb or lldb can inspect
+// the process at the time it was checkpointed. Memory and registers
+// can be read, but not written, and the process cannot be resumed.
+// Multiple debuggers may be connected at the same time. New
+// instances should be created with Checkpoint.GDBServer().
+type GDBServer struct {
+	mr        *MemoryReader
+	threads   []*gdbThread
+	auxv      []byte
+	exe       string
+	libraries string
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	// Connections accepted by Serve, and all running sessions
+	conns    map[net.Conn]bool
+	sessions sync.WaitGroup
+	closed   bool
+}
+
+// gdbThread holds the registers of a thread in the order of gdb
+type gdbThread struct {
+	tid  uint32
+	comm string
+	regs []byte
+}
+
+// GDBServer creates a GDBServer for the process with the given PID.
+// Only x86_64 checkpoints are supported. A pageSize of 0 uses the
+// page size of the host.
+func (c *Checkpoint) GDBServer(pid uint32, pageSize int) (*GDBServer, error) {
+	process, err := c.process(pid)
+	if err != nil {
+		return nil, err
+	}
+	mmEntry, err := c.MM(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &GDBServer{
+		auxv: uint64Bytes(mmEntry.GetMmSavedAuxv()),
+	}
+	tids := []uint32{pid}
+	for _, tid := range process.GetThreads() {
+		if tid != pid {
+			tids = append(tids, tid)
+		}
+	}
+	for _, tid := range tids {
+		core, err := c.Core(tid)
+		if err != nil {
+			return nil, err
+		}
+		regs, err := gdbRegs(core)
+		if err != nil {
+			return nil, fmt.Errorf("thread %d: %w", tid, err)
+		}
+		comm := core.GetThreadCore().GetComm()
+		if comm == "" {
+			comm = core.GetTc().GetComm()
+		}
+		s.threads = append(s.threads, &gdbThread{tid: tid, comm: comm, regs: regs})
+	}
+	if s.exe, err = c.filePath(mmEntry.GetExeFileId(), fdinfo.FdTypes_REG); err != nil {
+		return nil, err
+	}
+	if s.libraries, err = c.gdbLibraries(mmEntry); err != nil {
+		return nil, err
+	}
+
+	if s.mr, err = c.MemoryReader(pid, pageSize); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Helper to get the registers of a thread in the order of gdb
+func gdbRegs(core *criu_core.CoreEntry) ([]byte, error) {
+	if core.GetMtype() != criu_core.CoreEntry_X86_64 {
+		return nil, fmt.Errorf("debugging %s checkpoints is not supported", core.GetMtype())
+	}
+	gpregs := core.GetThreadInfo().GetGpregs()
+	if gpregs == nil {
+		return nil, errors.New("no registers in the checkpoint")
+	}
+	if gpregs.GetMode() != core_x86.UserX86RegsMode_NATIVE {
+		return nil, errors.New("debugging 32-bit tasks is not supported")
+	}
+
+	var b bytes.Buffer
+	put := func(size int, v uint64) {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		b.Write(buf[:size])
+	}
+	for _, v := range []uint64{
+		gpregs.GetAx(), gpregs.GetBx(), gpregs.GetCx(), gpregs.GetDx(),
+		gpregs.GetSi(), gpregs.GetDi(), gpregs.GetBp(), gpregs.GetSp(),
+		gpregs.GetR8(), gpregs.GetR9(), gpregs.GetR10(), gpregs.GetR11(),
+		gpregs.GetR12(), gpregs.GetR13(), gpregs.GetR14(), gpregs.GetR15(),
+		gpregs.GetIp(),
+	} {
+		put(8, v)
+	}
+	for _, v := range []uint64{
+		gpregs.GetFlags(), gpregs.GetCs(), gpregs.GetSs(), gpregs.GetDs(),
+		gpregs.GetEs(), gpregs.GetFs(), gpregs.GetGs(),
+	} {
+		put(4, v)
+	}
+
+	fpregs := core.GetThreadInfo().GetFpregs()
+	st := paddedBytes(uint32Bytes(fpregs.GetStSpace()), 128)
+	for i := 0; i < 8; i++ {
+		b.Write(st[16*i : 16*i+10])
+	}
+	swd := fpregs.GetSwd()
+	for _, v := range []uint64{
+		uint64(fpregs.GetCwd()), uint64(swd), uint64(x87TagWord(st, swd, fpregs.GetTwd())),
+		fpregs.GetRip() >> 32, fpregs.GetRip() & 0xffffffff,
+		fpregs.GetRdp() >> 32, fpregs.GetRdp() & 0xffffffff,
+		uint64(fpregs.GetFop() & 0x7ff),
+	} {
+		put(4, v)
+	}
+	b.Write(paddedBytes(uint32Bytes(fpregs.GetXmmSpace()), 256))
+	put(4, uint64(fpregs.GetMxcsr()))
+
+	put(8, gpregs.GetOrigAx())
+	put(8, gpregs.GetFsBase())
+	put(8, gpregs.GetGsBase())
+	return b.Bytes(), nil
+}
+
+// Helper to pad or truncate the registers of an area to size bytes
+func paddedBytes(b []byte, size int) []byte {
+	padded := make([]byte, size)
+	copy(padded, b)
+	return padded
+}
+
+// Helper to convert the abridged tag word of the fxsave
+// area into the full tag word of the x87 registers
+func x87TagWord(st []byte, swd, abridged uint32) uint32 {
+	top := (swd >> 11) & 7
+	var tags uint32
+	for reg := uint32(0); reg < 8; reg++ {
+		tag := uint32(3) // Empty
+		if abridged&(1<<reg) != 0 {
+			value := st[16*((reg-top)&7):]
+			exponent := binary.LittleEndian.Uint16(value[8:]) & 0x7fff
+			mantissa := binary.LittleEndian.Uint64(value)
+			switch {
+			case exponent == 0x7fff:
+				tag = 2 // Special
+			case exponent == 0 && mantissa == 0:
+				tag = 1 // Zero
+			case exponent == 0 || mantissa&(1<<63) == 0:
+				tag = 2
+			default:
+				tag = 0 // Valid
+			}
+		}
+		tags |= tag << (2 * reg)
+	}
+	return tags
+}
+
+// Helper to list the shared libraries mapped by the process in the
+// format of qXfer:libraries-svr4. The load address of a library is
+// derived from its mapping at file offset 0; the link map is not
+// known, which gdb can look up in the memory of the process.
+func (c *Checkpoint) gdbLibraries(mmEntry *mm.MmEntry) (string, error) {
+	bases := make(map[uint32]uint64)
+	for _, vma := range mmEntry.GetVmas() {
+		id := uint32(vma.GetShmid())
+		if vma.GetStatus()&(vmaFilePrivate|vmaFileShared) == 0 || id == mmEntry.GetExeFileId() || vma.GetPgoff() != 0 {
+			continue
+		}
+		if base, ok := bases[id]; !ok || vma.GetStart() < base {
+			bases[id] = vma.GetStart()
+		}
+	}
+
+	type library struct {
+		name string
+		base uint64
+	}
+	var libraries []library
+	for id, base := range bases {
+		name, err := c.filePath(id, fdinfo.FdTypes_REG)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ".so") {
+			continue
+		}
+		libraries = append(libraries, library{name: name, base: base})
+	}
+	sort.Slice(libraries, func(i, j int) bool {
+		return libraries[i].base < libraries[j].base
+	})
+
+	var b strings.Builder
+	b.WriteString(`<library-list-svr4 version="1.0">`)
+	for _, lib := range libraries {
+		fmt.Fprintf(&b, `<library name="%s" lm="0x0" l_addr="0x%x" l_ld="0x0"/>`, html.EscapeString(lib.name), lib.base)
+	}
+	b.WriteString("</library-list-svr4>")
+	return b.String(), nil
+}
+
+// Serve accepts connections of debuggers on the listener until the
+// listener or the GDBServer is closed. Every connection is served
+// by its own goroutine.
+func (s *GDBServer) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]bool)
+		}
+		s.conns[conn] = true
+		s.mutex.Unlock()
+
+		go func() {
+			defer func() {
+				s.mutex.Lock()
+				delete(s.conns, conn)
+				s.mutex.Unlock()
+				conn.Close()
+			}()
+			_ = s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn serves a single debugger until it detaches or the
+// connection is closed
+func (s *GDBServer) ServeConn(conn io.ReadWriter) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errors.New("gdbserver is closed")
+	}
+	s.sessions.Add(1)
+	s.mutex.Unlock()
+	defer s.sessions.Done()
+
+	session := &gdbSession{
+		server: s,
+		r:      bufio.NewReader(conn),
+		w:      conn,
+		thread: s.threads[0],
+		ack:    true,
+	}
+	for {
+		packet, err := session.readPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		reply, done := session.handle(packet)
+		if err := session.writePacket(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// Close stops serving new connections, disconnects the debuggers
+// of connections accepted by Serve, and closes the pages images once
+// all sessions have finished. Connections passed to ServeConn are
+// not closed, so they must be closed by the caller for Close to
+// return.
+func (s *GDBServer) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.sessions.Wait()
+	return s.mr.Close()
+}
+
+// gdbSession is the state of the connection of a debugger
+type gdbSession struct {
+	server *GDBServer
+	r      *bufio.Reader
+	w      io.Writer
+	thread *gdbThread
+	// Whether packets are acknowledged
+	ack bool
+}
+
+// Helper to read the next packet, acknowledging it if needed.
+// Acknowledgments and interrupts of the debugger are skipped.
+func (gs *gdbSession) readPacket() (string, error) {
+	for {
+		b, err := gs.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b != '$' {
+			continue
+		}
+
+		data, err := gs.r.ReadString('#')
+		if err != nil {
+			return "", err
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(gs.r, sum[:]); err != nil {
+			return "", err
+		}
+		want, err := strconv.ParseUint(string(sum[:]), 16, 8)
+		if err != nil || byte(want) != gdbChecksum(data) {
+			if gs.ack {
+				if _, err := gs.w.Write([]byte("-")); err != nil {
+					return "", err
+				}
+			}
+			continue
+		}
+		if gs.ack {
+			if _, err := gs.w.Write([]byte("+")); err != nil {
+				return "", err
+			}
+		}
+		return gdbUnescape(data), nil
+	}
+}
+
+// Helper to send a packet. Acknowledgments are not awaited,
+// as the debugger acknowledges each packet before the next one.
+func (gs *gdbSession) writePacket(data string) error {
+	_, err := fmt.Fprintf(gs.w, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// Helper to escape binary data of a reply
+func gdbEscape(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		switch c {
+		case '#', '$', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(c ^ 0x20)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Helper to unescape binary data of a packet
+func gdbUnescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+			continue
+		}
+		b.WriteByte(data[i])
+	}
+	return b.String()
+}
+
+// Maximum size of packets, which is advertised in hex
+const gdbPacketSize = 0x4000
+
+// Errors of replies, as errno values of the debugger
+const (
+	gdbEPERM  = "E01"
+	gdbENOENT = "E02"
+	gdbEFAULT = "E0e"
+	gdbEINVAL = "E16"
+)
+
+// Helper to handle a packet. It returns the reply
+// and whether the connection should be closed.
+func (gs *gdbSession) handle(packet string) (string, bool) {
+	s := gs.server
+	if packet == "" {
+		return "", false
+	}
+	switch {
+	case packet == "?", strings.ContainsAny(packet[:1], "cCsS"):
+		// The process cannot run, so it stops immediately
+		return gs.stopReply(), false
+	case packet == "D" || strings.HasPrefix(packet, "D;"):
+		return "OK", true
+	case packet == "k":
+		return "OK", true
+	case packet == "QStartNoAckMode":
+		gs.ack = false
+		return "OK", false
+	case strings.HasPrefix(packet, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;QStartNoAckMode+;qXfer:features:read+;qXfer:auxv:read+;"+
+			"qXfer:exec-file:read+;qXfer:libraries-svr4:read+", gdbPacketSize), false
+	case packet == "qAttached" || strings.HasPrefix(packet, "qAttached:"):
+		return "1", false
+	case packet == "qC":
+		return fmt.Sprintf("QC%x", gs.thread.tid), false
+	case packet == "qfThreadInfo":
+		tids := make([]string, 0, len(s.threads))
+		for _, t := range s.threads {
+			tids = append(tids, strconv.FormatUint(uint64(t.tid), 16))
+		}
+		return "m" + strings.Join(tids, ","), false
+	case packet == "qsThreadInfo":
+		return "l", false
+	case strings.HasPrefix(packet, "qThreadExtraInfo,"):
+		t := gs.findThread(packet[len("qThreadExtraInfo,"):])
+		if t == nil {
+			return gdbENOENT, false
+		}
+		return hex.EncodeToString([]byte(t.comm)), false
+	case packet == "qSymbol::":
+		return "OK", false
+	case strings.HasPrefix(packet, "qXfer:"):
+		return gs.handleXfer(packet), false
+	case strings.HasPrefix(packet, "H"):
+		if len(packet) < 2 {
+			return gdbEINVAL, false
+		}
+		id := packet[2:]
+		if id == "0" || id == "-1" {
+			return "OK", false
+		}
+		t := gs.findThread(id)
+		if t == nil {
+			return gdbENOENT, false
+		}
+		gs.thread = t
+		return "OK", false
+	case strings.HasPrefix(packet, "T"):
+		if gs.findThread(packet[1:]) == nil {
+			return gdbENOENT, false
+		}
+		return "OK", false
+	case packet == "g":
+		return hex.EncodeToString(gs.thread.regs), false
+	case strings.HasPrefix(packet, "p"):
+		n, err := strconv.ParseUint(packet[1:], 16, 32)
+		if err != nil || n >= uint64(len(gdbRegSizes)) {
+			return gdbEINVAL, false
+		}
+		off := 0
+		for _, size := range gdbRegSizes[:n] {
+			off += size
+		}
+		return hex.EncodeToString(gs.thread.regs[off : off+gdbRegSizes[n]]), false
+	case strings.HasPrefix(packet, "m"):
+		addr, length, ok := parseGDBRange(packet[1:], ",")
+		if !ok {
+			return gdbEINVAL, false
+		}
+		// Addresses above the range of offsets of ReadAt
+		// are in the kernel half of the address space
+		if addr > math.MaxInt64 {
+			return gdbEFAULT, false
+		}
+		// Replies are hex encoded and framed by $ and #XX, and
+		// debuggers handle short reads by reading the rest
+		if length > (gdbPacketSize-4)/2 {
+			length = (gdbPacketSize - 4) / 2
+		}
+		buf := make([]byte, length)
+		n, _ := s.mr.ReadAt(buf, int64(addr))
+		if n == 0 && length > 0 {
+			return gdbEFAULT, false
+		}
+		return hex.EncodeToString(buf[:n]), false
+	case strings.HasPrefix(packet, "G"), strings.HasPrefix(packet, "P"),
+		strings.HasPrefix(packet, "M"), strings.HasPrefix(packet, "X"):
+		// The checkpoint is read-only
+		return gdbEPERM, false
+	}
+	// Unsupported packets have an empty reply
+	return "", false
+}
+
+// Helper to handle qXfer:OBJECT:read:ANNEX:OFFSET,LENGTH packets
+func (gs *gdbSession) handleXfer(packet string) string {
+	s := gs.server
+	fields := strings.SplitN(packet, ":", 5)
+	if len(fields) != 5 || fields[2] != "read" {
+		return ""
+	}
+	offset, length, ok := parseGDBRange(fields[4], ",")
+	if !ok {
+		return gdbEINVAL
+	}
+
+	var data []byte
+	switch fields[1] {
+	case "features":
+		if fields[3] != "target.xml" {
+			return gdbENOENT
+		}
+		data = []byte(gdbTargetXML)
+	case "auxv":
+		data = s.auxv
+	case "exec-file":
+		data = []byte(s.exe)
+	case "libraries-svr4":
+		data = []byte(s.libraries)
+	default:
+		return ""
+	}
+
+	if offset >= uint64(len(data)) {
+		return "l"
+	}
+	data = data[offset:]
+	if uint64(len(data)) > length {
+		return "m" + gdbEscape(data[:length])
+	}
+	return "l" + gdbEscape(data)
+}
+
+// Helper to build the reply of a stopped thread
+func (gs *gdbSession) stopReply() string {
+	return fmt.Sprintf("T05thread:%x;", gs.thread.tid)
+}
+
+// Helper to find a thread by its ID in hex
+func (gs *gdbSession) findThread(id string) *gdbThread {
+	tid, err := strconv.ParseUint(id, 16, 32)
+	if err != nil {
+		return nil
+	}
+	for _, t := range gs.server.threads {
+		if uint64(t.tid) == tid {
+			return t
+		}
+	}
+	return nil
+}
+
+// Helper to parse an address and a length in hex
+func parseGDBRange(s, sep string) (uint64, uint64, bool) {
+	addrHex, lengthHex, ok := strings.Cut(s, sep)
+	if !ok {
+		return 0, 0, false
+	}
+	addr, err := strconv.ParseUint(addrHex, 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(lengthHex, 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return addr, length, true
+}
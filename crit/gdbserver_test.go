@@ -0,0 +1,153 @@
+package crit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// gdbTestClient is a minimal client of the GDB Remote Serial Protocol
+type gdbTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	ack  bool
+}
+
+// Helper to send a packet and return the reply
+func (gc *gdbTestClient) send(packet string) string {
+	gc.t.Helper()
+	if _, err := fmt.Fprintf(gc.conn, "$%s#%02x", packet, gdbChecksum(packet)); err != nil {
+		gc.t.Fatal(err)
+	}
+	if gc.ack {
+		if b, err := gc.r.ReadByte(); err != nil || b != '+' {
+			gc.t.Fatalf("packet %q not acknowledged: %v", packet, err)
+		}
+	}
+	if b, err := gc.r.ReadByte(); err != nil || b != '$' {
+		gc.t.Fatalf("no reply to packet %q: %v", packet, err)
+	}
+	reply, err := gc.r.ReadString('#')
+	if err != nil {
+		gc.t.Fatal(err)
+	}
+	reply = reply[:len(reply)-1]
+	sum := make([]byte, 2)
+	if _, err := gc.r.Read(sum); err != nil {
+		gc.t.Fatal(err)
+	}
+	if string(sum) != fmt.Sprintf("%02x", gdbChecksum(reply)) {
+		gc.t.Fatalf("invalid checksum of reply %q", reply)
+	}
+	if gc.ack {
+		if _, err := gc.conn.Write([]byte("+")); err != nil {
+			gc.t.Fatal(err)
+		}
+	}
+	return gdbUnescape(reply)
+}
+
+func TestGDBServer(t *testing.T) {
+	dir := t.TempDir()
+	pages, mmEntry := writeTestProcess(t, dir)
+
+	server, err := newCheckpoint(dir).GDBServer(1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+	defer func() {
+		if err := server.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	gc := &gdbTestClient{t: t, conn: conn, r: bufio.NewReader(conn), ack: true}
+
+	// A debugger which stays connected is disconnected by Close
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if reply := (&gdbTestClient{t: t, conn: idle, r: bufio.NewReader(idle), ack: true}).send("?"); reply != "T05thread:1;" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := gc.send("qSupported:multiprocess+;xmlRegisters=i386"); !strings.Contains(reply, "qXfer:features:read+") {
+		t.Errorf("unexpected features %q", reply)
+	}
+	if reply := gc.send("QStartNoAckMode"); reply != "OK" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	gc.ack = false
+
+	replies := map[string]string{
+		"?":                           "T05thread:1;",
+		"qfThreadInfo":                "m1,3",
+		"qsThreadInfo":                "l",
+		"qC":                          "QC1",
+		"qThreadExtraInfo,3":          hex.EncodeToString([]byte("test")),
+		"p10":                         "0010400000000000",
+		"m1ffe,4":                     hex.EncodeToString(pages[0xffe:0x1002]),
+		"m3000,4":                     gdbEFAULT,
+		"mffffffffffff0000,4":         gdbEFAULT,
+		"m1000,ffffffff":              hex.EncodeToString(pages[:(gdbPacketSize-4)/2]),
+		"M1000,1:00":                  gdbEPERM,
+		"qXfer:exec-file:read::0,100": "l/bin/test",
+		"qXfer:auxv:read::0,100":      "l" + string(uint64Bytes(mmEntry.MmSavedAuxv)),
+		"qXfer:auxv:read::8,8":        "m" + string(uint64Bytes([]uint64{0x1000})),
+		"qXfer:libraries-svr4:read::0,1000": `l<library-list-svr4 version="1.0">` +
+			`<library name="/lib/libc.so.6" lm="0x0" l_addr="0x9000" l_ld="0x0"/></library-list-svr4>`,
+		"vMustReplyEmpty": "",
+	}
+	for packet, want := range replies {
+		if reply := gc.send(packet); reply != want {
+			t.Errorf("unexpected reply %q to %q, expected %q", reply, packet, want)
+		}
+	}
+
+	if reply := gc.send("qXfer:features:read:target.xml:0,4000"); !strings.Contains(reply, "org.gnu.gdb.i386.core") {
+		t.Errorf("unexpected target description %q", reply)
+	}
+
+	// Switch to the second thread and read its registers
+	if reply := gc.send("Hg3"); reply != "OK" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	regs, err := hex.DecodeString(gc.send("g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for _, s := range gdbRegSizes {
+		size += s
+	}
+	if len(regs) != size || binary.LittleEndian.Uint64(regs[16*8:]) != 0x402000 {
+		t.Errorf("unexpected registers %x", regs)
+	}
+	if reply := gc.send("c"); reply != "T05thread:3;" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := gc.send("D"); reply != "OK" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,578 @@
+package crit
+
+import (
+	"debug/buildinfo"
+	"debug/dwarf"
+	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+)
+
+// States of goroutines of the Go runtime, where
+// goroutineScan is set while the stack is scanned
+const (
+	goroutineRunning = 2
+	goroutineSyscall = 3
+	goroutineWaiting = 4
+	goroutineDead    = 6
+	goroutineScan    = 0x1000
+)
+
+var goroutineStates = []string{
+	"idle", "runnable", "running", "syscall", "waiting",
+	"moribund", "dead", "enqueue", "copystack", "preempted",
+}
+
+// Maximum number of goroutines read from a process
+const maxGoroutines = 1 << 20
+
+// errNotGo is returned for executables which are not Go programs
+var errNotGo = errors.New("not a Go program")
+
+// GoProcess holds the goroutines of a process running a Go program
+type GoProcess struct {
+	PID        uint32       `json:"pid"`
+	Exe        string       `json:"exe"`
+	GoVersion  string       `json:"go_version,omitempty"`
+	Goroutines []*Goroutine `json:"goroutines"`
+	// Reason why the goroutines could not be decoded
+	Error string `json:"error,omitempty"`
+}
+
+// Goroutine is the state of a single goroutine
+type Goroutine struct {
+	ID         uint64 `json:"id"`
+	Status     string `json:"status"`
+	WaitReason string `json:"wait_reason,omitempty"`
+	// Thread executing the goroutine, if any
+	TID       uint32     `json:"tid,omitempty"`
+	Frames    []*GoFrame `json:"frames"`
+	CreatedBy *GoFrame   `json:"created_by,omitempty"`
+	ParentID  uint64     `json:"parent_id,omitempty"`
+	// Reason why the stack could not be unwound completely
+	Error string `json:"error,omitempty"`
+}
+
+// GoFrame is a frame of the stack of a goroutine. Function
+// is empty if the address could not be symbolized.
+type GoFrame struct {
+	PC       uint64 `json:"pc"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Offset   uint64 `json:"offset,omitempty"`
+}
+
+// goLayout holds the offsets of the fields of the structures
+// of the Go runtime, where -1 marks fields which do not exist
+// in the version of the runtime
+type goLayout struct {
+	gSize                         int64
+	goid, status, waitReason, m   int64
+	schedPC, schedBP              int64
+	syscallPC, syscallBP          int64
+	gopc, parentGoid, mProcID     int64
+	waitReasons, waitReasonsCount uint64
+}
+
+// goBinary holds the information of a Go executable
+// needed to decode the state of the Go runtime
+type goBinary struct {
+	version string
+	table   *gosym.Table
+	layout  *goLayout
+	// Address of runtime.allgs in the ELF file
+	allgs uint64
+	// Offset between file offsets and addresses of the first segment
+	loadBias uint64
+}
+
+// Goroutines decodes the goroutines of all processes running Go
+// programs, like the dump printed by Go programs on SIGQUIT. Go
+// executables are read from the sysroot of the options and must
+// match the build-IDs recorded in the checkpoint. The layout of the
+// runtime structures is read from the DWARF information, which must
+// not have been stripped. Stacks are unwound with frame pointers,
+// which are used by the Go runtime on x86_64 and aarch64. Processes
+// which do not run Go programs are not returned.
+func (c *Checkpoint) Goroutines(opts BacktraceOptions) ([]*GoProcess, error) {
+	if opts.Sysroot == "" {
+		opts.Sysroot = "/"
+	}
+	if opts.MaxFrames <= 0 {
+		opts.MaxFrames = defaultMaxFrames
+	}
+	threads, err := c.ExploreThreads()
+	if err != nil {
+		return nil, err
+	}
+	regs := make(map[uint32]Registers)
+	var pIDs []uint32
+	for _, thread := range threads {
+		if thread.Registers == nil {
+			continue
+		}
+		if thread.TID == thread.PID {
+			pIDs = append(pIDs, thread.PID)
+		}
+		regs[thread.TID] = thread.Registers
+	}
+
+	binaries := make(map[string]*goBinary)
+	binaryErrs := make(map[string]error)
+	processes := make([]*GoProcess, 0)
+	for _, pID := range pIDs {
+		mmEntry, err := c.MM(pID)
+		if err != nil {
+			return nil, err
+		}
+		exeID := mmEntry.GetExeFileId()
+		exe, err := c.filePath(exeID, fdinfo.FdTypes_REG)
+		if err != nil {
+			return nil, err
+		}
+		file, err := c.file(exeID)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%s:%v", exe, file.GetReg().GetBuildId())
+		if _, ok := binaries[key]; !ok && binaryErrs[key] == nil {
+			binaries[key], binaryErrs[key] = loadGoBinary(filepath.Join(opts.Sysroot, exe), file.GetReg().GetBuildId())
+		}
+		if errors.Is(binaryErrs[key], errNotGo) {
+			continue
+		}
+
+		process := &GoProcess{PID: pID, Exe: exe, Goroutines: make([]*Goroutine, 0)}
+		processes = append(processes, process)
+		bin := binaries[key]
+		if bin == nil {
+			process.Error = binaryErrs[key].Error()
+			continue
+		}
+		process.GoVersion = bin.version
+		bias, err := goExeBias(mmEntry, exeID, bin)
+		if err != nil {
+			process.Error = err.Error()
+			continue
+		}
+
+		mr, err := c.MemoryReader(pID, opts.PageSize)
+		if err != nil {
+			return nil, err
+		}
+		process.Goroutines, err = bin.goroutines(mr, bias, regs, opts.MaxFrames)
+		mr.Close()
+		if err != nil {
+			process.Error = err.Error()
+		}
+	}
+	return processes, nil
+}
+
+// String formats the goroutines of the process
+// like the dump of the Go runtime on SIGQUIT
+func (p *GoProcess) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Process %d (%s)", p.PID, p.Exe)
+	if p.GoVersion != "" {
+		fmt.Fprintf(&b, " built with %s", p.GoVersion)
+	}
+	b.WriteString(":\n")
+	if p.Error != "" {
+		fmt.Fprintf(&b, "goroutines unavailable: %s\n", p.Error)
+	}
+	for _, g := range p.Goroutines {
+		b.WriteByte('\n')
+		b.WriteString(g.String())
+	}
+	return b.String()
+}
+
+// String formats the goroutine like the Go runtime
+func (g *Goroutine) String() string {
+	var b strings.Builder
+	status := g.Status
+	if g.WaitReason != "" {
+		status = g.WaitReason
+	}
+	fmt.Fprintf(&b, "goroutine %d [%s", g.ID, status)
+	if g.TID != 0 {
+		fmt.Fprintf(&b, ", thread %d", g.TID)
+	}
+	b.WriteString("]:\n")
+	for _, frame := range g.Frames {
+		fmt.Fprintf(&b, "%s()\n%s\n", frame.function(), frame.location())
+	}
+	if g.Error != "" {
+		fmt.Fprintf(&b, "...stack unavailable: %s\n", g.Error)
+	}
+	if g.CreatedBy != nil {
+		fmt.Fprintf(&b, "created by %s", g.CreatedBy.function())
+		if g.ParentID != 0 {
+			fmt.Fprintf(&b, " in goroutine %d", g.ParentID)
+		}
+		fmt.Fprintf(&b, "\n%s\n", g.CreatedBy.location())
+	}
+	return b.String()
+}
+
+// Helper to get the name of the function of a frame
+func (f *GoFrame) function() string {
+	if f.Function == "" {
+		return "?"
+	}
+	return f.Function
+}
+
+// Helper to format the source location of a frame
+func (f *GoFrame) location() string {
+	if f.Function == "" {
+		return fmt.Sprintf("\t?:0 pc=0x%x", f.PC)
+	}
+	return fmt.Sprintf("\t%s:%d +0x%x", f.File, f.Line, f.Offset)
+}
+
+// Helper to load the symbol table, the DWARF information and
+// the runtime symbols of a Go executable, which must have the
+// given build ID if any. errNotGo is returned for other files.
+func loadGoBinary(name string, buildID []uint32) (*goBinary, error) {
+	f, err := elf.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pclntab := f.Section(".gopclntab")
+	if pclntab == nil {
+		return nil, errNotGo
+	}
+	if len(buildID) > 0 {
+		if id, err := elfBuildID(f); err == nil && !equalBuildID(buildID, id) {
+			return nil, fmt.Errorf("build-ID of %s does not match the checkpoint", name)
+		}
+	}
+	if f.Class != elf.ELFCLASS64 || f.ByteOrder != binary.LittleEndian {
+		return nil, fmt.Errorf("%s is not a 64-bit little-endian executable", name)
+	}
+
+	bin := &goBinary{}
+	if info, err := buildinfo.ReadFile(name); err == nil {
+		bin.version = info.GoVersion
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			bin.loadBias = prog.Vaddr - prog.Off
+			break
+		}
+	}
+
+	data, err := pclntab.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .gopclntab of %s: %w", name, err)
+	}
+	var textStart uint64
+	if text := f.Section(".text"); text != nil {
+		textStart = text.Addr
+	}
+	if bin.table, err = gosym.NewTable(nil, gosym.NewLineTable(data, textStart)); err != nil {
+		return nil, fmt.Errorf("failed to parse .gopclntab of %s: %w", name, err)
+	}
+
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("no DWARF information in %s: %w", name, err)
+	}
+	if bin.layout, err = goRuntimeLayout(d); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("no symbols in %s: %w", name, err)
+	}
+	for _, sym := range symbols {
+		switch sym.Name {
+		case "runtime.allgs":
+			bin.allgs = sym.Value
+		case "runtime.waitReasonStrings":
+			bin.layout.waitReasons = sym.Value
+			bin.layout.waitReasonsCount = sym.Size / 16
+		}
+	}
+	if bin.allgs == 0 {
+		return nil, fmt.Errorf("runtime.allgs not found in %s", name)
+	}
+	return bin, nil
+}
+
+// Helper to get the offsets of the fields of the
+// runtime structures from the DWARF information
+func goRuntimeLayout(d *dwarf.Data) (*goLayout, error) {
+	structs := map[string]*dwarf.StructType{"runtime.g": nil, "runtime.m": nil}
+	found := 0
+	r := d.Reader()
+	for found < len(structs) {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag == dwarf.TagCompileUnit {
+			continue
+		}
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		if st, ok := structs[name]; ok && st == nil && entry.Tag == dwarf.TagStructType {
+			typ, err := d.Type(entry.Offset)
+			if err != nil {
+				return nil, err
+			}
+			if st, ok := typ.(*dwarf.StructType); ok && !st.Incomplete {
+				structs[name] = st
+				found++
+			}
+		}
+		r.SkipChildren()
+	}
+	for name, st := range structs {
+		if st == nil {
+			return nil, fmt.Errorf("type %s not found in the DWARF information", name)
+		}
+	}
+
+	g := structs["runtime.g"]
+	layout := &goLayout{gSize: g.ByteSize}
+	fields := map[*int64][]string{
+		&layout.goid:       {"goid"},
+		&layout.status:     {"atomicstatus"},
+		&layout.waitReason: {"waitreason"},
+		&layout.m:          {"m"},
+		&layout.schedPC:    {"sched", "pc"},
+		&layout.schedBP:    {"sched", "bp"},
+		&layout.syscallPC:  {"syscallpc"},
+		&layout.gopc:       {"gopc"},
+	}
+	for off, path := range fields {
+		var ok bool
+		if *off, ok = fieldOffset(g, path...); !ok {
+			return nil, fmt.Errorf("field %s of runtime.g not found", strings.Join(path, "."))
+		}
+	}
+	var ok bool
+	if layout.mProcID, ok = fieldOffset(structs["runtime.m"], "procid"); !ok {
+		return nil, errors.New("field procid of runtime.m not found")
+	}
+	// Older versions of the runtime lack these fields
+	if layout.syscallBP, ok = fieldOffset(g, "syscallbp"); !ok {
+		layout.syscallBP = -1
+	}
+	if layout.parentGoid, ok = fieldOffset(g, "parentGoid"); !ok {
+		layout.parentGoid = -1
+	}
+	return layout, nil
+}
+
+// Helper to get the offset of a possibly nested field of a structure
+func fieldOffset(st *dwarf.StructType, path ...string) (int64, bool) {
+	var off int64
+	var typ dwarf.Type = st
+	for _, name := range path {
+		for {
+			typedef, ok := typ.(*dwarf.TypedefType)
+			if !ok {
+				break
+			}
+			typ = typedef.Type
+		}
+		st, ok := typ.(*dwarf.StructType)
+		if !ok {
+			return 0, false
+		}
+		var field *dwarf.StructField
+		for _, f := range st.Field {
+			if f.Name == name {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return 0, false
+		}
+		off += field.ByteOffset
+		typ = field.Type
+	}
+	return off, true
+}
+
+// Helper to get the difference between the addresses of the process
+// and of the ELF file of the executable, which is not zero for
+// position independent executables
+func goExeBias(mmEntry *mm.MmEntry, exeID uint32, bin *goBinary) (uint64, error) {
+	for _, vma := range mmEntry.GetVmas() {
+		if vma.GetStatus()&(vmaFilePrivate|vmaFileShared) != 0 && uint32(vma.GetShmid()) == exeID {
+			return vma.GetStart() - vma.GetPgoff() - bin.loadBias, nil
+		}
+	}
+	return 0, errors.New("the executable is not mapped")
+}
+
+// Helper to read the goroutines of the process from runtime.allgs,
+// where regs are the registers of the threads of the checkpoint
+func (bin *goBinary) goroutines(mr *MemoryReader, bias uint64, regs map[uint32]Registers, maxFrames int) ([]*Goroutine, error) {
+	allgs, err := readPointer(mr, bin.allgs+bias)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read runtime.allgs: %w", err)
+	}
+	count, err := readPointer(mr, bin.allgs+bias+8)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read runtime.allgs: %w", err)
+	}
+	if count > maxGoroutines {
+		return nil, fmt.Errorf("too many goroutines: %d", count)
+	}
+	gps := make([]byte, 8*count)
+	if _, err := mr.ReadAt(gps, int64(allgs)); err != nil {
+		return nil, fmt.Errorf("failed to read runtime.allgs: %w", err)
+	}
+
+	layout := bin.layout
+	goroutines := make([]*Goroutine, 0, count)
+	buf := make([]byte, layout.gSize)
+	for i := uint64(0); i < count; i++ {
+		gp := binary.LittleEndian.Uint64(gps[8*i:])
+		if _, err := mr.ReadAt(buf, int64(gp)); err != nil {
+			return goroutines, fmt.Errorf("failed to read goroutine at 0x%x: %w", gp, err)
+		}
+		field := func(off int64) uint64 {
+			return binary.LittleEndian.Uint64(buf[off:])
+		}
+		status := binary.LittleEndian.Uint32(buf[layout.status:]) &^ goroutineScan
+		if status == goroutineDead {
+			continue
+		}
+
+		g := &Goroutine{ID: field(layout.goid), Status: fmt.Sprintf("unknown (%d)", status)}
+		if status < uint32(len(goroutineStates)) {
+			g.Status = goroutineStates[status]
+		}
+		if reason := buf[layout.waitReason]; status == goroutineWaiting && reason != 0 {
+			g.WaitReason = bin.waitReason(mr, bias, reason)
+		}
+		if layout.parentGoid >= 0 {
+			g.ParentID = field(layout.parentGoid)
+		}
+		if gopc := field(layout.gopc); gopc != 0 {
+			g.CreatedBy = bin.frame(gopc, bias, true)
+		}
+
+		// The stack is unwound like the execution tracer of the runtime
+		pc, fp := field(layout.schedPC), field(layout.schedBP)
+		switch m := field(layout.m); {
+		case status == goroutineSyscall && layout.syscallBP >= 0:
+			pc, fp = field(layout.syscallPC), field(layout.syscallBP)
+		case m != 0 && (status == goroutineRunning || status == goroutineSyscall):
+			procID, err := readPointer(mr, m+uint64(layout.mProcID))
+			if err != nil {
+				g.Error = err.Error()
+				break
+			}
+			if r, ok := regs[uint32(procID)]; ok {
+				g.TID = uint32(procID)
+				pc, fp = r.InstructionPointer(), r.FramePointer()
+			}
+		}
+		if g.Error == "" {
+			g.Frames, err = bin.unwind(mr, bias, pc, fp, maxFrames)
+			if err != nil {
+				g.Error = err.Error()
+			}
+		}
+		goroutines = append(goroutines, g)
+	}
+	return goroutines, nil
+}
+
+// Helper to read a wait reason from runtime.waitReasonStrings
+func (bin *goBinary) waitReason(mr *MemoryReader, bias uint64, reason uint8) string {
+	layout := bin.layout
+	if uint64(reason) >= layout.waitReasonsCount {
+		return fmt.Sprintf("waitReason(%d)", reason)
+	}
+	addr := layout.waitReasons + bias + 16*uint64(reason)
+	ptr, err := readPointer(mr, addr)
+	if err != nil {
+		return fmt.Sprintf("waitReason(%d)", reason)
+	}
+	size, err := readPointer(mr, addr+8)
+	if err != nil || size > 256 {
+		return fmt.Sprintf("waitReason(%d)", reason)
+	}
+	s := make([]byte, size)
+	if _, err := mr.ReadAt(s, int64(ptr)); err != nil {
+		return fmt.Sprintf("waitReason(%d)", reason)
+	}
+	return string(s)
+}
+
+// Helper to unwind the stack of a goroutine with frame pointers
+// from the address pc, where fp points to the saved frame pointer
+// and the return address of the caller. Unwinding stops at
+// runtime.goexit, which is the outermost frame of all goroutines.
+func (bin *goBinary) unwind(mr *MemoryReader, bias, pc, fp uint64, maxFrames int) ([]*GoFrame, error) {
+	var frames []*GoFrame
+	for pc != 0 {
+		// The return address of outer frames is after the call
+		frame := bin.frame(pc, bias, len(frames) > 0)
+		if frame.Function == "runtime.goexit" {
+			break
+		}
+		frames = append(frames, frame)
+		if len(frames) == maxFrames {
+			return frames, fmt.Errorf("more than %d frames", maxFrames)
+		}
+		if fp == 0 {
+			break
+		}
+
+		next, err := readPointer(mr, fp)
+		if err != nil {
+			return frames, err
+		}
+		if pc, err = readPointer(mr, fp+8); err != nil {
+			return frames, err
+		}
+		if next != 0 && next <= fp {
+			return frames, fmt.Errorf("frame pointer 0x%x does not increase", next)
+		}
+		fp = next
+	}
+	return frames, nil
+}
+
+// Helper to symbolize the address pc, where the function and
+// the line are looked up before pc for return addresses
+func (bin *goBinary) frame(pc, bias uint64, ret bool) *GoFrame {
+	frame := &GoFrame{PC: pc}
+	lookup := pc - bias
+	if ret {
+		lookup--
+	}
+	file, line, fn := bin.table.PCToLine(lookup)
+	if fn == nil {
+		return frame
+	}
+	frame.Function = fn.Name
+	frame.File = file
+	frame.Line = line
+	frame.Offset = pc - bias - fn.Entry
+	return frame
+}
@@ -0,0 +1,196 @@
+package crit
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/vma"
+	"google.golang.org/protobuf/proto"
+)
+
+const testGoProgram = `package main
+
+//go:noinline
+func worker(c chan int) {
+	<-c
+}
+
+func main() {
+	c := make(chan int)
+	go worker(c)
+	worker(c)
+}
+`
+
+// buildTestGoProgram is a helper to build a Go program with
+// the Go toolchain, which skips the test if it is not available
+func buildTestGoProgram(t *testing.T) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the Go toolchain is not available")
+	}
+	dir := t.TempDir()
+	files := map[string]string{"go.mod": "module test\n\ngo 1.20\n", "main.go": testGoProgram}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goCmd, "build", "-o", "test", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOFLAGS=", "GOWORK=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("failed to build Go program: %v\n%s", err, out)
+	}
+	return filepath.Join(dir, "test")
+}
+
+func TestGoroutines(t *testing.T) {
+	exe := buildTestGoProgram(t)
+	bin, err := loadGoBinary(exe, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := bin.layout
+	if layout.gSize > 0x800 || layout.waitReasonsCount < 2 {
+		t.Fatalf("unexpected layout %+v", layout)
+	}
+	entries := make(map[string]uint64)
+	for _, name := range []string{"main.worker", "main.main", "runtime.main", "runtime.goexit"} {
+		fn := bin.table.LookupFunc(name)
+		if fn == nil {
+			t.Fatalf("function %s not found", name)
+		}
+		entries[name] = fn.Entry
+	}
+
+	// The executable is mapped by the process, and the goroutines
+	// and their stacks are in the anonymous mappings of the process
+	dir := t.TempDir()
+	writeTestProcess(t, dir)
+	writeTestImg(t, dir, "files.img", "FILES",
+		testRegFile(1, exe, 0, 0o100755),
+		testRegFile(2, "/", 0, 0o40755),
+		testRegFile(3, "/lib/libc.so.6", 0, 0o100755),
+	)
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mmEntry := testMm(0x1000, 0x2000, 0x5000)
+	mmEntry.ExeFileId = proto.Uint32(1)
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		mapping := &vma.VmaEntry{
+			Start:  proto.Uint64(prog.Vaddr &^ 0xfff),
+			End:    proto.Uint64((prog.Vaddr + prog.Memsz + 0xfff) &^ 0xfff),
+			Pgoff:  proto.Uint64(prog.Off &^ 0xfff),
+			Shmid:  proto.Uint64(1),
+			Prot:   proto.Uint32(1),
+			Status: proto.Uint32(1 | vmaFilePrivate),
+		}
+		fillRequired(mapping.ProtoReflect())
+		mmEntry.Vmas = append(mmEntry.Vmas, mapping)
+	}
+	f.Close()
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+	core := testCore(entries["main.worker"]+8, 0, 1000)
+	core.ThreadInfo.Gpregs.Bp = proto.Uint64(0x5400)
+	writeTestImg(t, dir, "core-3.img", "CORE", core)
+
+	mw, err := NewMemoryWriter(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(addr uint64, data []byte) {
+		t.Helper()
+		if _, err := mw.WriteAt(data, int64(addr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The pages of the data of the executable are dumped, as pages
+	// of files can only be written partially if they are in the pagemap
+	for _, addr := range []uint64{bin.allgs, bin.allgs + 23, layout.waitReasons + 16, layout.waitReasons + 31} {
+		write(addr&^0xfff, make([]byte, 0x1000))
+	}
+
+	// Goroutine 1 waits in worker() called by main(), goroutine
+	// 18 runs worker() on thread 3 and goroutine 19 has exited
+	for gp, g := range map[uint64]struct{ id, status, pc, bp, m, gopc uint64 }{
+		0x1000: {id: 1, status: goroutineWaiting, pc: entries["main.worker"] + 0x10, bp: 0x5100},
+		0x1800: {id: 18, status: goroutineRunning, m: 0x2800, gopc: entries["main.main"] + 0x28},
+		0x2000: {id: 19, status: goroutineDead},
+	} {
+		write(gp, make([]byte, layout.gSize))
+		for off, value := range map[int64]uint64{
+			layout.goid: g.id, layout.schedPC: g.pc, layout.schedBP: g.bp, layout.m: g.m, layout.gopc: g.gopc,
+		} {
+			write(gp+uint64(off), uint64Bytes([]uint64{value}))
+		}
+		write(gp+uint64(layout.status), uint64Bytes([]uint64{g.status})[:4])
+		if layout.parentGoid >= 0 && g.gopc != 0 {
+			write(gp+uint64(layout.parentGoid), uint64Bytes([]uint64{1}))
+		}
+	}
+	write(0x1000+uint64(layout.waitReason), []byte{1})
+	write(0x2800+uint64(layout.mProcID), uint64Bytes([]uint64{3}))
+	write(bin.allgs, uint64Bytes([]uint64{0x2400, 3, 3}))
+	write(0x2400, uint64Bytes([]uint64{0x1000, 0x1800, 0x2000}))
+	write(layout.waitReasons+16, uint64Bytes([]uint64{0x2c00, uint64(len("chan receive"))}))
+	write(0x2c00, []byte("chan receive"))
+	// Frame records of the stacks
+	write(0x5100, uint64Bytes([]uint64{0x5200, entries["main.main"] + 0x20}))
+	write(0x5200, uint64Bytes([]uint64{0x5300, entries["runtime.main"] + 0x30}))
+	write(0x5300, uint64Bytes([]uint64{0, entries["runtime.goexit"] + 1}))
+	write(0x5400, uint64Bytes([]uint64{0, entries["runtime.goexit"] + 1}))
+
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	processes, err := newCheckpoint(dir).Goroutines(BacktraceOptions{PageSize: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 1 || processes[0].Error != "" || !strings.HasPrefix(processes[0].GoVersion, "go") {
+		t.Fatalf("unexpected processes %+v", processes)
+	}
+	goroutines := processes[0].Goroutines
+	if len(goroutines) != 2 {
+		t.Fatalf("unexpected goroutines:\n%s", processes[0])
+	}
+	want := []string{"main.worker,main.main,runtime.main", "main.worker"}
+	for i, g := range goroutines {
+		var functions []string
+		for _, frame := range g.Frames {
+			functions = append(functions, frame.Function)
+			if !strings.HasSuffix(frame.File, ".go") || frame.Line == 0 {
+				t.Errorf("unexpected frame %+v", frame)
+			}
+		}
+		if g.Error != "" || strings.Join(functions, ",") != want[i] {
+			t.Errorf("unexpected goroutine:\n%s", g)
+		}
+	}
+	if g := goroutines[0]; g.ID != 1 || g.Status != "waiting" || g.WaitReason != "chan receive" || g.TID != 0 {
+		t.Errorf("unexpected goroutine %+v", g)
+	}
+	if g := goroutines[1]; g.ID != 18 || g.Status != "running" || g.TID != 3 ||
+		g.CreatedBy == nil || g.CreatedBy.Function != "main.main" || g.CreatedBy.Offset != 0x28 {
+		t.Errorf("unexpected goroutine %+v", g)
+	}
+
+	s := processes[0].String()
+	if !strings.Contains(s, "\ngoroutine 1 [chan receive]:\nmain.worker()\n\t") ||
+		!strings.Contains(s, "\ngoroutine 18 [running, thread 3]:\n") || !strings.Contains(s, "created by main.main") {
+		t.Errorf("unexpected dump:\n%s", s)
+	}
+}
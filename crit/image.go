@@ -1,12 +1,11 @@
 package crit
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
 
-	ghost_file "github.com/checkpoint-restore/go-criu/v7/crit/images/ghost-file"
-	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
@@ -62,23 +61,45 @@ type jsonImage struct {
 // remaining bytes into a proto.Message object
 func (img *CriuImage) UnmarshalJSON(data []byte) error {
 	imgData := jsonImage{}
-	var err error
-
-	if err = json.Unmarshal(data, &imgData); err != nil {
+	if err := json.Unmarshal(data, &imgData); err != nil {
 		return err
 	}
 	img.Magic = imgData.Magic
 
-	switch img.Magic {
-	case "GHOST_FILE":
-		err = unmarshalGhostFile(&imgData, img)
-	case "PAGEMAP":
-		err = unmarshalPagemap(&imgData, img)
-	default:
-		err = unmarshalDefault(&imgData, img)
+	for i, data := range imgData.JSONEntries {
+		entry, err := UnmarshalEntry(img.Magic, img.EntryType, i, data)
+		if err != nil {
+			return err
+		}
+		img.Entries = append(img.Entries, entry)
+	}
+
+	return nil
+}
+
+// UnmarshalEntry is the JSON equivalent of ImageReader.Next().
+// It loads a single entry of an image with the given magic,
+// such as a line of the JSON Lines output of `crit decode`.
+// The index of the entry is required, as the first entry
+// of some images has a different type.
+func UnmarshalEntry(magic string, entryType proto.Message, index int, data []byte) (*CriuEntry, error) {
+	// Create proto struct to hold payload
+	payload := imgEntryType(magic, entryType, index)
+	// Extra data can only be separated from compact JSON
+	var compactData bytes.Buffer
+	if err := json.Compact(&compactData, data); err != nil {
+		return nil, err
+	}
+	jsonPayload, extraPayload := splitJSONData(compactData.Bytes())
+	// Handle proto data
+	if err := protojson.Unmarshal(jsonPayload, payload); err != nil {
+		return nil, err
 	}
 
-	return err
+	return &CriuEntry{
+		Message: payload,
+		Extra:   extraPayload,
+	}, nil
 }
 
 // Helper to separate proto data and extra data
@@ -95,70 +116,3 @@ func splitJSONData(data []byte) ([]byte, string) {
 	}
 	return []byte(dataString), extraPayload
 }
-
-// unmarshalDefault is used for all JSON data
-// that is in the standard protobuf format
-func unmarshalDefault(imgData *jsonImage, img *CriuImage) error {
-	for _, data := range imgData.JSONEntries {
-		// Create proto struct to hold payload
-		payload := proto.Clone(img.EntryType)
-		jsonPayload, extraPayload := splitJSONData(data)
-		// Handle proto data
-		if err := protojson.Unmarshal(jsonPayload, payload); err != nil {
-			return err
-		}
-		img.Entries = append(img.Entries, &CriuEntry{
-			Message: payload,
-			Extra:   extraPayload,
-		})
-	}
-
-	return nil
-}
-
-// Special handler for ghost image
-func unmarshalGhostFile(imgData *jsonImage, img *CriuImage) error {
-	// Process primary entry
-	entry := CriuEntry{Message: &ghost_file.GhostFileEntry{}}
-	jsonPayload, extraPayload := splitJSONData(imgData.JSONEntries[0])
-	if err := protojson.Unmarshal(jsonPayload, entry.Message); err != nil {
-		return err
-	}
-	entry.Extra = extraPayload
-	img.Entries = append(img.Entries, &entry)
-	// If there is only one JSON entry,
-	// then no ghost chunks are present
-	if len(imgData.JSONEntries) == 1 {
-		return nil
-	}
-
-	// Process chunks
-	for _, data := range imgData.JSONEntries[1:] {
-		entry = CriuEntry{Message: &ghost_file.GhostChunkEntry{}}
-		jsonPayload, extraPayload = splitJSONData(data)
-		if err := protojson.Unmarshal(jsonPayload, entry.Message); err != nil {
-			return err
-		}
-		entry.Extra = extraPayload
-		img.Entries = append(img.Entries, &entry)
-	}
-
-	return nil
-}
-
-// Special handler for pagemap image
-func unmarshalPagemap(imgData *jsonImage, img *CriuImage) error {
-	// First entry is pagemap head
-	var payload proto.Message = &pagemap.PagemapHead{}
-	for _, data := range imgData.JSONEntries {
-		entry := CriuEntry{Message: payload}
-		if err := protojson.Unmarshal(data, entry.Message); err != nil {
-			return err
-		}
-		img.Entries = append(img.Entries, &entry)
-		// Create struct for next entry
-		payload = &pagemap.PagemapEntry{}
-	}
-
-	return nil
-}
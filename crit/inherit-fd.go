@@ -0,0 +1,184 @@
+package crit
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/tty"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// Flags set by CRIU in unix_sk_entry.uflags
+// https://github.com/checkpoint-restore/criu/blob/criu-dev/criu/include/sockets.h
+const (
+	uskExtern  = 1 << 0
+	uskService = 1 << 1
+)
+
+// ExternalFd represents a file descriptor of a checkpointed
+// process which refers to a resource outside of the process
+// tree. Such a resource has to be passed to CRIU on restore
+// with an inherit_fd entry matching Key.
+type ExternalFd struct {
+	PID  uint32 `json:"pid"`
+	Fd   uint32 `json:"fd"`
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// ExternalFds searches the process tree in the checkpoint
+// directory for file descriptors referring to external pipes,
+// FIFOs, TTYs and UNIX sockets, and returns them together with
+// the inherit_fd key that CRIU expects for each of them.
+func ExternalFds(dir string) ([]*ExternalFd, error) {
+	c := newCheckpoint(dir)
+	processes, err := c.Pstree()
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the pipe and FIFO ends found in the checkpoint.
+	// A pipe with only one end in the process tree has its
+	// other end in a process that was not checkpointed.
+	readers := make(map[uint32]bool)
+	writers := make(map[uint32]bool)
+	addEnd := func(pipeID, flags uint32) {
+		switch flags & syscall.O_ACCMODE {
+		case syscall.O_RDONLY:
+			readers[pipeID] = true
+		case syscall.O_WRONLY:
+			writers[pipeID] = true
+		default:
+			readers[pipeID] = true
+			writers[pipeID] = true
+		}
+	}
+	// Inodes of all UNIX sockets in the checkpoint
+	unixInodes := make(map[uint32]bool)
+	for _, file := range files {
+		switch file.GetType() {
+		case fdinfo.FdTypes_PIPE:
+			addEnd(file.GetPipe().GetPipeId(), file.GetPipe().GetFlags())
+		case fdinfo.FdTypes_FIFO:
+			if reg := files[file.GetFifo().GetRegfId()]; reg != nil {
+				addEnd(file.GetFifo().GetPipeId(), reg.GetReg().GetFlags())
+			}
+		case fdinfo.FdTypes_UNIXSK:
+			unixInodes[file.GetUsk().GetIno()] = true
+		}
+	}
+	isExternalPipe := func(pipeID uint32) bool {
+		return !readers[pipeID] || !writers[pipeID]
+	}
+
+	// TTY information is only loaded if a TTY is found
+	var ttyInfo map[uint32]*tty.TtyInfoEntry
+
+	externalFds := make([]*ExternalFd, 0)
+	for _, process := range processes {
+		pID := process.GetPid()
+		fdInfos, err := c.processFdinfo(pID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fdInfo := range fdInfos {
+			file, ok := files[fdInfo.GetId()]
+			if !ok {
+				continue
+			}
+
+			var key string
+			switch fdInfo.GetType() {
+			case fdinfo.FdTypes_PIPE:
+				if pipeID := file.GetPipe().GetPipeId(); isExternalPipe(pipeID) {
+					key = fmt.Sprintf("pipe:[%d]", pipeID)
+				}
+			case fdinfo.FdTypes_FIFO:
+				reg := files[file.GetFifo().GetRegfId()]
+				if reg != nil && isExternalPipe(file.GetFifo().GetPipeId()) {
+					key = inheritPath(reg.GetReg().GetName())
+				}
+			case fdinfo.FdTypes_UNIXSK:
+				usk := file.GetUsk()
+				if usk.GetUflags()&uskService != 0 {
+					continue
+				}
+				if usk.GetUflags()&uskExtern != 0 ||
+					(usk.GetPeer() != 0 && !unixInodes[usk.GetPeer()]) {
+					key = fmt.Sprintf("socket:[%d]", usk.GetIno())
+				}
+			case fdinfo.FdTypes_TTY:
+				if ttyInfo == nil {
+					if ttyInfo, err = c.ttyInfo(); err != nil {
+						return nil, err
+					}
+				}
+				info := ttyInfo[file.GetTty().GetTtyInfoId()]
+				if info.GetType() == tty.TtyType_EXT_TTY {
+					key = fmt.Sprintf("tty[%x:%x]", info.GetRdev(), info.GetDev())
+				}
+			}
+			if key == "" {
+				continue
+			}
+
+			externalFds = append(externalFds, &ExternalFd{
+				PID:  pID,
+				Fd:   fdInfo.GetFd(),
+				Type: fdInfo.GetType().String(),
+				Key:  key,
+			})
+		}
+	}
+
+	return externalFds, nil
+}
+
+// InheritFds builds the inherit_fd entries for a restore from
+// a map of inherit_fd keys (as returned by ExternalFds) to open
+// files. The close-on-exec flag is cleared on every file, so
+// that the descriptors are inherited by the CRIU process.
+func InheritFds(files map[string]*os.File) ([]*rpc.InheritFd, error) {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	inheritFds := make([]*rpc.InheritFd, 0, len(keys))
+	for _, key := range keys {
+		f := files[key]
+		if f == nil {
+			return nil, fmt.Errorf("no file provided for %s", key)
+		}
+		fd := f.Fd()
+		if _, err := unix.FcntlInt(fd, unix.F_SETFD, 0); err != nil {
+			return nil, fmt.Errorf("error clearing close-on-exec flag for %s: %w", key, err)
+		}
+		inheritFds = append(inheritFds, &rpc.InheritFd{
+			Key: proto.String(key),
+			Fd:  proto.Int32(int32(fd)),
+		})
+	}
+
+	return inheritFds, nil
+}
+
+// Helper to convert a path into the form used by CRIU
+// to look up inherited files, which is relative to root
+func inheritPath(path string) string {
+	if len(path) > 1 && path[0] == '/' {
+		return path[1:]
+	}
+	return path
+}
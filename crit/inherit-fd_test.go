@@ -0,0 +1,206 @@
+package crit
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fown"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pipe"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	sk_opts "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-opts"
+	sk_unix "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-unix"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/tty"
+	"google.golang.org/protobuf/proto"
+)
+
+func testFown() *fown.FownEntry {
+	return &fown.FownEntry{
+		Uid:     proto.Uint32(0),
+		Euid:    proto.Uint32(0),
+		Signum:  proto.Uint32(0),
+		PidType: proto.Uint32(0),
+		Pid:     proto.Uint32(0),
+	}
+}
+
+// writeTestPsTree is a helper to create the pstree and
+// ids images of a test checkpoint, with every process
+// using its PID as the ID of its file descriptor table
+func writeTestPsTree(t *testing.T, dir string, pIDs ...uint32) {
+	t.Helper()
+	var processes []proto.Message
+	for i, pID := range pIDs {
+		ppID := uint32(0)
+		if i > 0 {
+			ppID = pIDs[0]
+		}
+		processes = append(processes, &pstree.PstreeEntry{
+			Pid:  proto.Uint32(pID),
+			Ppid: proto.Uint32(ppID),
+			Pgid: proto.Uint32(pIDs[0]),
+			Sid:  proto.Uint32(pIDs[0]),
+		})
+		writeTestImg(t, dir, fmt.Sprintf("ids-%d.img", pID), "IDS", &criu_core.TaskKobjIdsEntry{
+			VmId:      proto.Uint32(pID),
+			FilesId:   proto.Uint32(pID),
+			FsId:      proto.Uint32(pID),
+			SighandId: proto.Uint32(pID),
+		})
+	}
+	writeTestImg(t, dir, "pstree.img", "PSTREE", processes...)
+}
+
+func testFdInfo(id, fd uint32, fdType fdinfo.FdTypes) *fdinfo.FdinfoEntry {
+	return &fdinfo.FdinfoEntry{
+		Id:    proto.Uint32(id),
+		Flags: proto.Uint32(0),
+		Type:  fdType.Enum(),
+		Fd:    proto.Uint32(fd),
+	}
+}
+
+func testPipe(id, pipeID, flags uint32) *fdinfo.FileEntry {
+	return &fdinfo.FileEntry{
+		Type: fdinfo.FdTypes_PIPE.Enum(),
+		Id:   proto.Uint32(id),
+		Pipe: &pipe.PipeEntry{
+			Id:     proto.Uint32(id),
+			PipeId: proto.Uint32(pipeID),
+			Flags:  proto.Uint32(flags),
+			Fown:   testFown(),
+		},
+	}
+}
+
+func testSkOpts() *sk_opts.SkOptsEntry {
+	return &sk_opts.SkOptsEntry{
+		SoSndbuf:     proto.Uint32(0),
+		SoRcvbuf:     proto.Uint32(0),
+		SoSndTmoSec:  proto.Uint64(0),
+		SoSndTmoUsec: proto.Uint64(0),
+		SoRcvTmoSec:  proto.Uint64(0),
+		SoRcvTmoUsec: proto.Uint64(0),
+	}
+}
+
+func testUnixSk(id, ino, peer, uflags uint32) *fdinfo.FileEntry {
+	return &fdinfo.FileEntry{
+		Type: fdinfo.FdTypes_UNIXSK.Enum(),
+		Id:   proto.Uint32(id),
+		Usk: &sk_unix.UnixSkEntry{
+			Id:      proto.Uint32(id),
+			Ino:     proto.Uint32(ino),
+			Type:    proto.Uint32(syscall.SOCK_STREAM),
+			State:   proto.Uint32(uint32(tcpEstablished)),
+			Flags:   proto.Uint32(0),
+			Uflags:  proto.Uint32(uflags),
+			Backlog: proto.Uint32(0),
+			Peer:    proto.Uint32(peer),
+			Fown:    testFown(),
+			Opts:    testSkOpts(),
+			Name:    []byte{},
+		},
+	}
+}
+
+func TestExternalFds(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPsTree(t, dir, 1, 2)
+	writeTestImg(t, dir, "files.img", "FILES",
+		// Pipe with only the write end in the process tree
+		testPipe(1, 100, syscall.O_WRONLY),
+		// Pipe with both ends in the process tree
+		testPipe(2, 200, syscall.O_WRONLY),
+		testPipe(3, 200, syscall.O_RDONLY),
+		// Connected sockets in the process tree
+		testUnixSk(4, 300, 301, 0),
+		testUnixSk(5, 301, 300, 0),
+		// Socket connected to a peer outside the process tree
+		testUnixSk(6, 400, 401, 0),
+		&fdinfo.FileEntry{
+			Type: fdinfo.FdTypes_TTY.Enum(),
+			Id:   proto.Uint32(7),
+			Tty: &tty.TtyFileEntry{
+				Id:        proto.Uint32(7),
+				TtyInfoId: proto.Uint32(1),
+				Flags:     proto.Uint32(0),
+				Fown:      testFown(),
+			},
+		},
+	)
+	writeTestImg(t, dir, "tty-info.img", "TTY_INFO", &tty.TtyInfoEntry{
+		Id:         proto.Uint32(1),
+		Type:       tty.TtyType_EXT_TTY.Enum(),
+		Locked:     proto.Bool(false),
+		Exclusive:  proto.Bool(false),
+		PacketMode: proto.Bool(false),
+		Sid:        proto.Uint32(0),
+		Pgrp:       proto.Uint32(0),
+		Rdev:       proto.Uint32(0x8801),
+		Dev:        proto.Uint32(0x16),
+	})
+	writeTestImg(t, dir, "fdinfo-1.img", "FDINFO",
+		testFdInfo(7, 0, fdinfo.FdTypes_TTY),
+		testFdInfo(1, 1, fdinfo.FdTypes_PIPE),
+		testFdInfo(2, 3, fdinfo.FdTypes_PIPE),
+		testFdInfo(4, 4, fdinfo.FdTypes_UNIXSK),
+	)
+	writeTestImg(t, dir, "fdinfo-2.img", "FDINFO",
+		testFdInfo(3, 0, fdinfo.FdTypes_PIPE),
+		testFdInfo(5, 1, fdinfo.FdTypes_UNIXSK),
+		testFdInfo(6, 2, fdinfo.FdTypes_UNIXSK),
+	)
+
+	externalFds, err := ExternalFds(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ExternalFd{
+		{PID: 1, Fd: 0, Type: "TTY", Key: "tty[8801:16]"},
+		{PID: 1, Fd: 1, Type: "PIPE", Key: "pipe:[100]"},
+		{PID: 2, Fd: 2, Type: "UNIXSK", Key: "socket:[400]"},
+	}
+	if len(externalFds) != len(want) {
+		t.Fatalf("want %d external fds, got %d", len(want), len(externalFds))
+	}
+	for i, externalFd := range externalFds {
+		if *externalFd != want[i] {
+			t.Errorf("want: %+v, got: %+v", want[i], *externalFd)
+		}
+	}
+}
+
+func TestInheritFds(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	inheritFds, err := InheritFds(map[string]*os.File{
+		"pipe:[200]": r,
+		"pipe:[100]": w,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inheritFds) != 2 {
+		t.Fatalf("want 2 entries, got %d", len(inheritFds))
+	}
+	if inheritFds[0].GetKey() != "pipe:[100]" || inheritFds[0].GetFd() != int32(w.Fd()) {
+		t.Errorf("unexpected entry %v", inheritFds[0])
+	}
+	if inheritFds[1].GetKey() != "pipe:[200]" || inheritFds[1].GetFd() != int32(r.Fd()) {
+		t.Errorf("unexpected entry %v", inheritFds[1])
+	}
+
+	if _, err := InheritFds(map[string]*os.File{"pipe:[1]": nil}); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
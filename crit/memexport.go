@@ -0,0 +1,340 @@
+package crit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Name of the manifest written by ExportMemory()
+const memManifestName = "manifest.json"
+
+// Characters which are replaced in the names of exported mappings
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// MemoryManifest describes the memory of a process
+// exported by ExportMemory(), with one file per mapping
+type MemoryManifest struct {
+	PID      uint32 `json:"pid"`
+	PageSize int    `json:"page_size"`
+	PagesID  uint32 `json:"pages_id"`
+	// Mappings which have no pages are not exported
+	Mappings []*ExportedMapping `json:"mappings"`
+}
+
+// ExportedMapping is a memory mapping written to File, where the
+// offset in the file is the offset in the mapping. Ranges are the
+// pages of the checkpoint, while all other pages are holes of File.
+type ExportedMapping struct {
+	MemoryMapping
+	File   string        `json:"file"`
+	Ranges []MemoryRange `json:"ranges"`
+	// Status of the VMA, which tells whether
+	// the mapping is backed by a file
+	Status uint32 `json:"status,omitempty"`
+}
+
+// ExportMemory writes the memory of the process with the given PID
+// to dir, with one sparse file per memory mapping and a manifest
+// describing them. Pages which have not been dumped are holes of
+// the files, including pages which are transferred lazily. Pages
+// of parent checkpoints and of shared memory objects are written
+// as well. A pageSize of 0 uses the page size of the host.
+func (c *Checkpoint) ExportMemory(pid uint32, pageSize int, dir string) (*MemoryManifest, error) {
+	mr, err := c.MemoryReader(pid, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	mappings, err := mr.mappings()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := mr.Ranges()
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[uint64]uint32)
+	if len(mappings) > 0 {
+		mm, err := c.MM(pid)
+		if err != nil {
+			return nil, err
+		}
+		for _, vma := range mm.GetVmas() {
+			status[vma.GetStart()] = vma.GetStatus()
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	manifest := &MemoryManifest{
+		PID:      pid,
+		PageSize: mr.pageSize,
+		PagesID:  mr.pagesID,
+		Mappings: make([]*ExportedMapping, 0, len(mappings)),
+	}
+	for _, mapping := range mappings {
+		exported := &ExportedMapping{
+			MemoryMapping: *mapping,
+			File:          exportedName(mapping),
+			Status:        status[mapping.Start],
+		}
+		for _, r := range ranges {
+			if r.Start >= mapping.End || r.End <= mapping.Start {
+				continue
+			}
+			if r.Start < mapping.Start {
+				r.Start = mapping.Start
+			}
+			if r.End > mapping.End {
+				r.End = mapping.End
+			}
+			exported.Ranges = append(exported.Ranges, r)
+		}
+		if len(exported.Ranges) == 0 {
+			continue
+		}
+		if err := mr.exportMapping(exported, filepath.Join(dir, exported.File)); err != nil {
+			return nil, fmt.Errorf("error exporting mapping at 0x%x: %w", mapping.Start, err)
+		}
+		manifest.Mappings = append(manifest.Mappings, exported)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, memManifestName), append(data, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Helper to name the file of a mapping after its
+// address range and the file or object backing it
+func exportedName(mapping *MemoryMapping) string {
+	name := fmt.Sprintf("%016x-%016x", mapping.Start, mapping.End)
+	if resource, _, _ := strings.Cut(mapping.Resource, " + "); resource != "" {
+		resource = unsafeNameChars.ReplaceAllString(path.Base(resource), "_")
+		name += "-" + strings.Trim(resource, "_")
+	}
+	return name + ".mem"
+}
+
+// Helper to write the pages of a mapping to a sparse file
+func (mr *MemoryReader) exportMapping(mapping *ExportedMapping, name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1024*1024)
+	for _, r := range mapping.Ranges {
+		if r.Lazy {
+			continue
+		}
+		for addr := r.Start; addr < r.End; addr += uint64(len(buf)) {
+			chunk := buf
+			if r.End-addr < uint64(len(chunk)) {
+				chunk = chunk[:r.End-addr]
+			}
+			if _, err := mr.read(chunk, addr, false); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(chunk, int64(addr-mapping.Start)); err != nil {
+				return err
+			}
+		}
+	}
+	// Pages after the last range are a hole as well
+	if err := f.Truncate(int64(mapping.End - mapping.Start)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ImportMemory rebuilds the pagemap and pages images of a process
+// from the memory exported to exportDir by ExportMemory(), and writes
+// them to the checkpoint directory checkpointDir. A page is stored
+// in the new images if it was a page of the checkpoint, or if it is
+// not zero, so that pages written into holes are kept. Holes stay
+// holes, and lazy pages stay lazy unless they have been written.
+// Holes of file mappings other than memfd files cannot be written,
+// as they are pages of the file and not zeros.
+// Pages of parent checkpoints are stored in the new pages image,
+// while shared memory is not imported, as it is not part of the
+// pages of the process.
+func ImportMemory(exportDir, checkpointDir string) error {
+	data, err := os.ReadFile(filepath.Join(exportDir, memManifestName))
+	if err != nil {
+		return err
+	}
+	manifest := &MemoryManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return fmt.Errorf("error parsing %s: %w", memManifestName, err)
+	}
+	if _, err := checkPageSize(manifest.PageSize); err != nil || manifest.PageSize == 0 {
+		return fmt.Errorf("invalid page size %d", manifest.PageSize)
+	}
+
+	// The images are written to temporary files, which only
+	// replace the images of the checkpoint once all mappings
+	// have been imported
+	pagesName := fmt.Sprintf("pages-%d.img", manifest.PagesID)
+	pagemapName := fmt.Sprintf("pagemap-%d.img", manifest.PID)
+	pagesFile, err := os.CreateTemp(checkpointDir, pagesName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pagesFile.Name())
+	defer pagesFile.Close()
+	pages := bufio.NewWriter(pagesFile)
+
+	// Pagemap entries are sorted by address
+	sort.Slice(manifest.Mappings, func(i, j int) bool {
+		return manifest.Mappings[i].Start < manifest.Mappings[j].Start
+	})
+	entries := []*CriuEntry{{Message: &pagemap.PagemapHead{PagesId: proto.Uint32(manifest.PagesID)}}}
+	for _, mapping := range manifest.Mappings {
+		// Names come from a manifest which may have been
+		// edited, so they must not point outside of exportDir
+		if !fs.ValidPath(mapping.File) || strings.Contains(mapping.File, "/") {
+			return fmt.Errorf("invalid file name %q", mapping.File)
+		}
+		mappingEntries, err := importMapping(mapping, filepath.Join(exportDir, mapping.File), manifest.PageSize, pages)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %w", mapping.File, err)
+		}
+		entries = append(entries, mappingEntries...)
+	}
+	if err := pages.Flush(); err != nil {
+		return err
+	}
+	if err := pagesFile.Close(); err != nil {
+		return err
+	}
+
+	pagemapFile, err := os.CreateTemp(checkpointDir, pagemapName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pagemapFile.Name())
+	defer pagemapFile.Close()
+	if err := encodeImg(&CriuImage{Magic: "PAGEMAP", Entries: entries}, pagemapFile); err != nil {
+		return err
+	}
+	if err := pagemapFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(pagesFile.Name(), filepath.Join(checkpointDir, pagesName)); err != nil {
+		return err
+	}
+	return os.Rename(pagemapFile.Name(), filepath.Join(checkpointDir, pagemapName))
+}
+
+// Helper to write the pages of an exported mapping to the pages
+// image and return the pagemap entries of the mapping
+func importMapping(mapping *ExportedMapping, name string, pageSize int, pages io.Writer) ([]*CriuEntry, error) {
+	if mapping.Start%uint64(pageSize) != 0 || mapping.End%uint64(pageSize) != 0 || mapping.End < mapping.Start {
+		return nil, fmt.Errorf("invalid mapping 0x%x-0x%x", mapping.Start, mapping.End)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Helper to get the range of the manifest containing addr
+	kind := func(addr uint64) (MemoryRange, bool) {
+		for _, r := range mapping.Ranges {
+			if r.Start <= addr && addr < r.End {
+				return r, true
+			}
+		}
+		return MemoryRange{}, false
+	}
+
+	var (
+		entries []*CriuEntry
+		last    *pagemap.PagemapEntry
+	)
+	page := make([]byte, pageSize)
+	for addr := mapping.Start; addr < mapping.End; addr += uint64(pageSize) {
+		n, err := f.ReadAt(page, int64(addr-mapping.Start))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		// Files which have been truncated end with zeros
+		for i := n; i < len(page); i++ {
+			page[i] = 0
+		}
+
+		r, dumped := kind(addr)
+		if !dumped && !isZero(page) && backedByFile(mapping.Status) {
+			return nil, fmt.Errorf("memory at 0x%x is a page of a file which has not been dumped", addr)
+		}
+		var flags uint32
+		switch {
+		case dumped && r.Shared:
+			// Shared memory is not part of the pages of the process
+		case dumped && !r.Lazy, !isZero(page):
+			flags = pagemapPresent
+		case dumped:
+			flags = pagemapLazy
+		}
+		if flags == 0 {
+			last = nil
+			continue
+		}
+		if flags == pagemapPresent {
+			if _, err := pages.Write(page); err != nil {
+				return nil, err
+			}
+		}
+
+		if last != nil && last.GetFlags() == flags {
+			last.NrPages = proto.Uint32(last.GetNrPages() + 1)
+			continue
+		}
+		last = &pagemap.PagemapEntry{
+			Vaddr:   proto.Uint64(addr),
+			NrPages: proto.Uint32(1),
+			Flags:   proto.Uint32(flags),
+		}
+		entries = append(entries, &CriuEntry{Message: last})
+	}
+	return entries, nil
+}
+
+// Helper to check whether the pages of a mapping which have not been
+// dumped are pages of a file, which is not the case for memfd files
+// stored in the checkpoint
+func backedByFile(status uint32) bool {
+	return status&(vmaFilePrivate|vmaFileShared) != 0 && status&vmaMemfd == 0
+}
+
+// Helper to check whether all bytes of b are zero
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
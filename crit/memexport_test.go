@@ -0,0 +1,146 @@
+package crit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/vma"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExportImportMemory(t *testing.T) {
+	dir, exportDir := t.TempDir(), t.TempDir()
+	pages, mmEntry := writeTestProcess(t, dir)
+
+	// Only the first page of the second mapping is dumped
+	mmEntry.Vmas = []*vma.VmaEntry{mmEntry.Vmas[0], mmEntry.Vmas[2], mmEntry.Vmas[4]}
+	mmEntry.Vmas[0].End = proto.Uint64(0x3000)
+	mmEntry.Vmas[1].End = proto.Uint64(0x8000)
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	manifest, err := newCheckpoint(dir).ExportMemory(1, 0x1000, exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Mappings) != 2 || manifest.Mappings[1].File != "0000000000005000-0000000000008000.mem" ||
+		len(manifest.Mappings[1].Ranges) != 1 || manifest.Mappings[1].Ranges[0].End != 0x6000 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	for i, want := range [][]byte{pages[:0x2000], append(pages[0x2000:0x3000], make([]byte, 0x2000)...)} {
+		data, err := os.ReadFile(filepath.Join(exportDir, manifest.Mappings[i].File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("unexpected contents of %s", manifest.Mappings[i].File)
+		}
+	}
+
+	// Patch a dumped page and write a page into a hole
+	f, err := os.OpenFile(filepath.Join(exportDir, manifest.Mappings[0].File), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 0x10); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = os.OpenFile(filepath.Join(exportDir, manifest.Mappings[1].File), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte("z"), 0x1000), 0x1000); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A manifest which cannot be imported leaves the images
+	// of the checkpoint untouched
+	manifestPath := filepath.Join(exportDir, memManifestName)
+	manifestData, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badData := bytes.Replace(manifestData, []byte(manifest.Mappings[1].File), []byte("missing.mem"), 1)
+	if err := os.WriteFile(manifestPath, badData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportMemory(exportDir, dir); err == nil {
+		t.Error("expected error for a missing mapping file")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "pages-1.img")); err != nil || !bytes.Equal(data, pages) {
+		t.Errorf("pages image has been modified: %v", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.img.*")); len(tmp) > 0 {
+		t.Errorf("temporary files are left: %v", tmp)
+	}
+	if err := os.WriteFile(manifestPath, manifestData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportMemory(exportDir, dir); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := newCheckpoint(dir).MemoryReader(1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	ranges, err := mr.Ranges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MemoryRange{{Start: 0x1000, End: 0x3000}, {Start: 0x5000, End: 0x7000}}
+	if len(ranges) != len(want) || ranges[0] != want[0] || ranges[1] != want[1] {
+		t.Fatalf("unexpected ranges %+v", ranges)
+	}
+
+	buf := make([]byte, 0x1000)
+	if _, err := mr.ReadAt(buf, 0x1000); err != nil || buf[0x10] != 0xff || buf[0] != 0 {
+		t.Errorf("unexpected patched page: %v", err)
+	}
+	if _, err := mr.ReadAt(buf, 0x6000); err != nil || !bytes.Equal(buf, bytes.Repeat([]byte("z"), 0x1000)) {
+		t.Errorf("unexpected written page: %v", err)
+	}
+	if _, err := mr.ReadAt(buf, 0x7000); !errors.Is(err, ErrUnmapped) {
+		t.Errorf("hole has been imported: %v", err)
+	}
+}
+
+func TestImportMemoryFilePages(t *testing.T) {
+	dir, exportDir := t.TempDir(), t.TempDir()
+	_, mmEntry := writeTestProcess(t, dir)
+
+	// Only the first page of the private mapping of /bin/test is dumped
+	mmEntry.Vmas = []*vma.VmaEntry{mmEntry.Vmas[0], mmEntry.Vmas[2]}
+	mmEntry.Vmas[1].End = proto.Uint64(0x8000)
+	mmEntry.Vmas[1].Status = proto.Uint32(1 | vmaFilePrivate)
+	mmEntry.Vmas[1].Shmid = proto.Uint64(1)
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	manifest, err := newCheckpoint(dir).ExportMemory(1, 0x1000, exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Mappings) != 2 || manifest.Mappings[1].Status != 1|vmaFilePrivate {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	// The undumped pages of the file are holes, and
+	// writing into them would replace the file with zeros
+	f, err := os.OpenFile(filepath.Join(exportDir, manifest.Mappings[1].File), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 0x1010); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := ImportMemory(exportDir, dir); err == nil || !strings.Contains(err.Error(), "0x6000") {
+		t.Errorf("expected error for the page of the file: %v", err)
+	}
+}
@@ -6,25 +6,103 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
+	"sync"
 
-	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
 	"golang.org/x/sys/unix"
 )
 
 var sysPageSize = os.Getpagesize()
 
+// Flags of pagemap entries
+const (
+	// Pages are stored in the parent checkpoint
+	pagemapParent = 1 << 0
+	// Pages are transferred lazily on restore
+	pagemapLazy = 1 << 1
+	// Pages are stored in the pages image
+	pagemapPresent = 1 << 2
+)
+
+var (
+	// ErrPageLazy is returned for pages which are not stored in
+	// the checkpoint, as they are transferred lazily on restore
+	ErrPageLazy = errors.New("page is transferred lazily")
+	// ErrPageMissing is returned for pages which should be
+	// stored in a checkpoint, but cannot be found there
+	ErrPageMissing = errors.New("page is missing")
+	// ErrUnmapped is returned by MemoryReader.ReadAt()
+	// for memory which is not part of the checkpoint
+	ErrUnmapped = errors.New("memory is not part of the checkpoint")
+)
+
+// Helper to get the flags of a pagemap entry. Older
+// versions of CRIU only record whether the pages
+// are stored in the parent checkpoint.
+func pagemapFlags(entry *pagemap.PagemapEntry) uint32 {
+	if entry.Flags != nil {
+		return entry.GetFlags()
+	}
+	if entry.GetInParent() {
+		return pagemapParent
+	}
+	return pagemapPresent
+}
+
 // MemoryReader is a struct used to retrieve
 // the content of memory associated with a specific process ID (pid).
+// It implements io.ReaderAt, where offsets are virtual addresses
+// of the process, and may be used by multiple goroutines. The
+// pages image is kept open until Close() is called.
 // New instances should be created with NewMemoryReader()
+// or Checkpoint.MemoryReader()
 type MemoryReader struct {
-	checkpointDir  string
+	checkpoint     *Checkpoint
 	pid            uint32
 	pagesID        uint32
 	pageSize       int
 	pagemapEntries []*pagemap.PagemapEntry
+	// Set for readers of shared memory objects
+	shmem bool
+	shmid uint64
+
+	// Index of the pagemap entries and shared memory
+	// mappings, which is built when memory is first read
+	indexOnce sync.Once
+	index     []memRange
+	indexErr  error
+
+	mutex sync.Mutex
+	pages readerAtCloser
+	// Reader of the parent checkpoint, which is
+	// opened when the first page is read from it
+	parent    *MemoryReader
+	parentErr error
+}
+
+// memRange is a range of pages of a single pagemap
+// entry or the range of a shared memory mapping
+type memRange struct {
+	start, end uint64
+	flags      uint32
+	// Offset of present pages in the pages image,
+	// or of the mapping in the shared memory object
+	offset uint64
+	shared *sharedMem
+}
+
+// MemoryRange is a range of virtual addresses whose
+// pages are part of a checkpoint. Lazy ranges are not
+// stored in the checkpoint, but transferred on restore.
+// Shared ranges are mappings of shared memory objects.
+type MemoryRange struct {
+	Start    uint64 `json:"start"`
+	End      uint64 `json:"end"`
+	InParent bool   `json:"in_parent,omitempty"`
+	Lazy     bool   `json:"lazy,omitempty"`
+	Shared   bool   `json:"shared,omitempty"`
 }
 
 func (mr *MemoryReader) GetPagesID() uint32 {
@@ -33,142 +111,310 @@ func (mr *MemoryReader) GetPagesID() uint32 {
 
 // NewMemoryReader creates a new instance of MemoryReader with all the fields populated
 func NewMemoryReader(checkpointDir string, pid uint32, pageSize int) (*MemoryReader, error) {
-	if pageSize == 0 {
-		pageSize = sysPageSize
-	}
-
-	// Check if the given page size is a positive power of 2, otherwise return an error
-	if (pageSize & (pageSize - 1)) != 0 {
-		return nil, errors.New("page size should be a positive power of 2")
-	}
+	return newCheckpoint(checkpointDir).MemoryReader(pid, pageSize)
+}
 
-	pagemapImg, err := getImg(filepath.Join(checkpointDir, fmt.Sprintf("pagemap-%d.img", pid)), &pagemap.PagemapHead{})
+// MemoryReader creates a MemoryReader for the process with the
+// given PID. The pages are read from the file system of the
+// checkpoint, which allows to read the memory of checkpoints
+// stored in archives.
+func (c *Checkpoint) MemoryReader(pid uint32, pageSize int) (*MemoryReader, error) {
+	pageSize, err := checkPageSize(pageSize)
 	if err != nil {
 		return nil, err
 	}
 
-	pagesID := pagemapImg.Entries[0].Message.(*pagemap.PagemapHead).GetPagesId()
-
-	pagemapEntries := make([]*pagemap.PagemapEntry, 0)
-
-	for _, entry := range pagemapImg.Entries[1:] {
-		pagemapEntries = append(pagemapEntries, entry.Message.(*pagemap.PagemapEntry))
+	pagemapHead, pagemapEntries, err := c.Pagemap(pid)
+	if err != nil {
+		return nil, err
 	}
 
 	return &MemoryReader{
-		checkpointDir:  checkpointDir,
+		checkpoint:     c,
 		pid:            pid,
 		pageSize:       pageSize,
-		pagesID:        pagesID,
+		pagesID:        pagemapHead.GetPagesId(),
 		pagemapEntries: pagemapEntries,
 	}, nil
 }
 
+// Helper to check the page size given to a MemoryReader,
+// where 0 selects the page size of the current host
+func checkPageSize(pageSize int) (int, error) {
+	if pageSize == 0 {
+		pageSize = sysPageSize
+	}
+
+	// Check if the given page size is a positive power of 2, otherwise return an error
+	if (pageSize & (pageSize - 1)) != 0 {
+		return 0, errors.New("page size should be a positive power of 2")
+	}
+	return pageSize, nil
+}
+
 // GetMemPages retrieves the content of memory pages
 // associated with a given process ID (pid).
 // It retrieves the memory content within the
 // specified range defined by the start and end addresses.
+// Pages which have not been dumped are filled with zeros,
+// while reading pages which are transferred lazily or missing
+// from the chain of parent checkpoints fails with ErrPageLazy
+// or ErrPageMissing.
 func (mr *MemoryReader) GetMemPages(start, end uint64) (*bytes.Buffer, error) {
-	size := end - start
+	if end < start {
+		return nil, fmt.Errorf("invalid memory range 0x%x-0x%x", start, end)
+	}
 
-	startPage := start / uint64(mr.pageSize)
-	endPage := end / uint64(mr.pageSize)
+	buf := make([]byte, end-start)
+	if _, err := mr.read(buf, start, true); err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(buf), nil
+}
 
-	var buffer bytes.Buffer
+// ReadAt reads len(p) bytes of memory starting at the virtual
+// address off. Reading memory which is not part of the checkpoint
+// fails with ErrUnmapped, after the bytes before it have been read.
+// Ranges() lists the memory which can be read.
+func (mr *MemoryReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	return mr.read(p, uint64(off), false)
+}
 
-	for pageNumber := startPage; pageNumber <= endPage; pageNumber++ {
-		var page []byte = nil
+// Ranges returns the ranges of memory which are
+// part of the checkpoint, sorted by address
+func (mr *MemoryReader) Ranges() ([]MemoryRange, error) {
+	index, err := mr.memIndex()
+	if err != nil {
+		return nil, err
+	}
 
-		pageMem, err := mr.getPage(pageNumber)
-		if err != nil {
-			return nil, err
+	var ranges []MemoryRange
+	for _, r := range index {
+		memRange := MemoryRange{
+			Start:    r.start,
+			End:      r.end,
+			InParent: r.flags&pagemapPresent == 0 && r.flags&pagemapParent != 0,
+			Lazy:     r.flags&(pagemapPresent|pagemapParent) == 0 && r.flags&pagemapLazy != 0,
+			Shared:   r.shared != nil,
 		}
-
-		if pageMem != nil {
-			page = pageMem
-		} else {
-			page = bytes.Repeat([]byte("\x00"), mr.pageSize)
+		// Merge adjacent pagemap entries of the same kind
+		if n := len(ranges); n > 0 && !memRange.Shared && !ranges[n-1].Shared &&
+			ranges[n-1].End == memRange.Start && ranges[n-1].InParent == memRange.InParent &&
+			ranges[n-1].Lazy == memRange.Lazy {
+			ranges[n-1].End = memRange.End
+			continue
 		}
+		ranges = append(ranges, memRange)
+	}
+	return ranges, nil
+}
 
-		var nSkip, nRead uint64
+// Close closes the pages images opened by the MemoryReader
+func (mr *MemoryReader) Close() error {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
 
-		if pageNumber == startPage {
-			nSkip = start - pageNumber*uint64(mr.pageSize)
-			if startPage == endPage {
-				nRead = size
-			} else {
-				nRead = uint64(mr.pageSize) - nSkip
+	var err error
+	if mr.pages != nil {
+		err = mr.pages.Close()
+		mr.pages = nil
+	}
+	if mr.parent != nil {
+		if parentErr := mr.parent.Close(); err == nil {
+			err = parentErr
+		}
+	}
+	for _, r := range mr.index {
+		if r.shared != nil && r.shared.reader != nil {
+			if sharedErr := r.shared.reader.Close(); err == nil {
+				err = sharedErr
 			}
-		} else if pageNumber == endPage {
-			nSkip = 0
-			nRead = end - pageNumber*uint64(mr.pageSize)
-		} else {
-			nSkip = 0
-			nRead = uint64(mr.pageSize)
 		}
+	}
+	return err
+}
 
-		if _, err := buffer.Write(page[nSkip : nSkip+nRead]); err != nil {
-			return nil, err
+// Helper to get the index of the pagemap entries
+// and shared memory mappings, sorted by address
+func (mr *MemoryReader) memIndex() ([]memRange, error) {
+	mr.indexOnce.Do(func() {
+		mr.index = pagemapIndex(mr.pagemapEntries, mr.pageSize)
+		sort.Slice(mr.index, func(i, j int) bool {
+			return mr.index[i].start < mr.index[j].start
+		})
+		if !mr.shmem {
+			shared, err := mr.sharedRanges(mr.index)
+			if err != nil {
+				mr.indexErr = err
+				return
+			}
+			mr.index = append(mr.index, shared...)
+			sort.Slice(mr.index, func(i, j int) bool {
+				return mr.index[i].start < mr.index[j].start
+			})
 		}
-	}
+	})
+	return mr.index, mr.indexErr
+}
 
-	return &buffer, nil
+// Helper to get the ranges of pagemap entries, with
+// the offsets of present pages in the pages image
+func pagemapIndex(entries []*pagemap.PagemapEntry, pageSize int) []memRange {
+	index := make([]memRange, 0, len(entries))
+	// Only present pages are stored in the pages image
+	var offset uint64
+	for _, entry := range entries {
+		size := uint64(entry.GetNrPages()) * uint64(pageSize)
+		if size == 0 {
+			continue
+		}
+		r := memRange{
+			start:  entry.GetVaddr(),
+			end:    entry.GetVaddr() + size,
+			flags:  pagemapFlags(entry),
+			offset: offset,
+		}
+		if r.flags&pagemapPresent != 0 {
+			offset += size
+		}
+		index = append(index, r)
+	}
+	return index
 }
 
-// getPage retrieves a memory page from the pages.img file.
-func (mr *MemoryReader) getPage(pageNo uint64) ([]byte, error) {
-	var offset uint64 = 0
-
-	// Iterate over pagemap entries to find the corresponding page
-	for _, m := range mr.pagemapEntries {
-		found := false
-		for i := 0; i < int(m.GetNrPages()); i++ {
-			if m.GetVaddr()+uint64(i)*uint64(mr.pageSize) == pageNo*uint64(mr.pageSize) {
-				found = true
-				break
+// Helper to read the memory at addr into p. Memory which is not
+// part of the checkpoint is filled with zeros if fillHoles is true.
+func (mr *MemoryReader) read(p []byte, addr uint64, fillHoles bool) (int, error) {
+	index, err := mr.memIndex()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) {
+		cur := addr + uint64(n)
+		left := uint64(len(p) - n)
+		i := sort.Search(len(index), func(i int) bool { return index[i].end > cur })
+
+		if i == len(index) || index[i].start > cur {
+			if !fillHoles {
+				return n, fmt.Errorf("memory at 0x%x: %w", cur, ErrUnmapped)
 			}
-			offset += uint64(mr.pageSize)
+			hole := left
+			if i < len(index) && index[i].start-cur < hole {
+				hole = index[i].start - cur
+			}
+			for j := range p[n : n+int(hole)] {
+				p[n+j] = 0
+			}
+			n += int(hole)
+			continue
 		}
 
-		if !found {
-			continue
+		r := index[i]
+		size := r.end - cur
+		if size > left {
+			size = left
 		}
-		f, err := os.Open(filepath.Join(mr.checkpointDir, fmt.Sprintf("pages-%d.img", mr.pagesID)))
-		if err != nil {
-			return nil, err
+		if err := mr.readRange(p[n:n+int(size)], r, cur); err != nil {
+			return n, err
 		}
+		n += int(size)
+	}
+	return n, nil
+}
 
-		defer f.Close()
+// Helper to read memory of a single pagemap entry
+func (mr *MemoryReader) readRange(p []byte, r memRange, addr uint64) error {
+	switch {
+	case r.shared != nil:
+		return r.shared.readAt(p, r.offset+addr-r.start)
+	case r.flags&pagemapPresent != 0:
+		pages, err := mr.openPages()
+		if err != nil {
+			return err
+		}
+		offset := r.offset + addr - r.start
+		if _, err := pages.ReadAt(p, int64(offset)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("pages-%d.img is truncated at 0x%x: %w: %w",
+					mr.pagesID, offset, ErrPageMissing, io.ErrUnexpectedEOF)
+			}
+			return err
+		}
+		return nil
+	case r.flags&pagemapParent != 0:
+		parent, err := mr.parentReader()
+		if err != nil {
+			return fmt.Errorf("memory at 0x%x is stored in the parent checkpoint: %w (%w)",
+				addr, ErrPageMissing, err)
+		}
+		if _, err := parent.read(p, addr, false); err != nil {
+			if errors.Is(err, ErrUnmapped) {
+				return fmt.Errorf("memory at 0x%x not found in the parent checkpoint: %w", addr, ErrPageMissing)
+			}
+			return err
+		}
+		return nil
+	case r.flags&pagemapLazy != 0:
+		return fmt.Errorf("memory at 0x%x: %w", addr, ErrPageLazy)
+	}
+	return fmt.Errorf("memory at 0x%x has no contents: %w", addr, ErrPageMissing)
+}
 
-		buff := make([]byte, mr.pageSize)
+// Helper to open the pages image of the process for random access.
+// The image stays open until the MemoryReader is closed.
+func (mr *MemoryReader) openPages() (readerAtCloser, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
 
-		if _, err := f.ReadAt(buff, int64(offset)); err != nil {
+	if mr.pages == nil {
+		pages, err := openReaderAt(mr.checkpoint.fsys, fmt.Sprintf("pages-%d.img", mr.pagesID))
+		if err != nil {
 			return nil, err
 		}
+		mr.pages = pages
+	}
+	return mr.pages, nil
+}
 
-		return buff, nil
+// Helper to get the reader of the parent checkpoint
+func (mr *MemoryReader) parentReader() (*MemoryReader, error) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	if mr.parent == nil && mr.parentErr == nil {
+		parent, err := mr.checkpoint.Parent()
+		if err == nil {
+			if mr.shmem {
+				mr.parent, err = parent.ShmemReader(mr.shmid, mr.pageSize)
+			} else {
+				mr.parent, err = parent.MemoryReader(mr.pid, mr.pageSize)
+			}
+		}
+		mr.parentErr = err
 	}
-	return nil, nil
+	return mr.parent, mr.parentErr
 }
 
 // GetPsArgs retrieves process arguments from memory pages
 func (mr *MemoryReader) GetPsArgs() (*bytes.Buffer, error) {
-	mmImg, err := getImg(filepath.Join(mr.checkpointDir, fmt.Sprintf("mm-%d.img", mr.pid)), &mm.MmEntry{})
+	mm, err := mr.checkpoint.MM(mr.pid)
 	if err != nil {
 		return nil, err
 	}
-	mm := mmImg.Entries[0].Message.(*mm.MmEntry)
 
 	return mr.GetMemPages(mm.GetMmArgStart(), mm.GetMmArgEnd())
 }
 
 // GetPsArgs retrieves process environment variables from memory pages.
 func (mr *MemoryReader) GetPsEnvVars() (*bytes.Buffer, error) {
-	mmImg, err := getImg(filepath.Join(mr.checkpointDir, fmt.Sprintf("mm-%d.img", mr.pid)), &mm.MmEntry{})
+	mm, err := mr.checkpoint.MM(mr.pid)
 	if err != nil {
 		return nil, err
 	}
-	mm := mmImg.Entries[0].Message.(*mm.MmEntry)
 
 	return mr.GetMemPages(mm.GetMmEnvStart(), mm.GetMmEnvEnd())
 }
@@ -179,13 +425,12 @@ func (mr *MemoryReader) GetPagemapEntries() []*pagemap.PagemapEntry {
 
 // GetShmemSize calculates and returns the size of shared memory used by the process.
 func (mr *MemoryReader) GetShmemSize() (int64, error) {
-	mmImg, err := getImg(filepath.Join(mr.checkpointDir, fmt.Sprintf("mm-%d.img", mr.pid)), &mm.MmEntry{})
+	mm, err := mr.checkpoint.MM(mr.pid)
 	if err != nil {
 		return 0, err
 	}
 
 	var size int64
-	mm := mmImg.Entries[0].Message.(*mm.MmEntry)
 	for _, vma := range mm.GetVmas() {
 		// Check if VMA has the MAP_SHARED flag set in its flags
 		if vma.GetFlags()&unix.MAP_SHARED != 0 {
@@ -205,6 +450,11 @@ type PatternMatch struct {
 }
 
 // SearchPattern searches for a pattern in the process memory pages.
+// Pages stored in parent checkpoints are searched as well, while
+// pages which are transferred lazily are skipped.
+//
+// Deprecated: Non-printable bytes are replaced with '?' and matches
+// across chunks are missed. Use Search() instead.
 func (mr *MemoryReader) SearchPattern(pattern string, escapeRegExpCharacters bool, context, chunkSize int) ([]PatternMatch, error) {
 	if context < 0 {
 		return nil, errors.New("context size cannot be negative")
@@ -227,23 +477,16 @@ func (mr *MemoryReader) SearchPattern(pattern string, escapeRegExpCharacters boo
 
 	var results []PatternMatch
 
-	f, err := os.Open(filepath.Join(mr.checkpointDir, fmt.Sprintf("pages-%d.img", mr.pagesID)))
+	ranges, err := mr.Ranges()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	for _, entry := range mr.pagemapEntries {
-		startAddr := entry.GetVaddr()
-		endAddr := startAddr + uint64(entry.GetNrPages())*uint64(mr.pageSize)
-
-		initialOffset := uint64(0)
-		for _, e := range mr.pagemapEntries {
-			if e == entry {
-				break
-			}
-			initialOffset += uint64(e.GetNrPages()) * uint64(mr.pageSize)
+	for _, memRange := range ranges {
+		// Lazy pages are not stored in any checkpoint
+		if memRange.Lazy {
+			continue
 		}
+		startAddr, endAddr := memRange.Start, memRange.End
 
 		for offset := uint64(0); offset < endAddr-startAddr; offset += uint64(chunkSize) {
 			readSize := chunkSize
@@ -252,10 +495,7 @@ func (mr *MemoryReader) SearchPattern(pattern string, escapeRegExpCharacters boo
 			}
 
 			buff := make([]byte, readSize)
-			if _, err := f.ReadAt(buff, int64(initialOffset+offset)); err != nil {
-				if err == io.EOF {
-					break
-				}
+			if _, err := mr.read(buff, startAddr+offset, false); err != nil {
 				return nil, err
 			}
 
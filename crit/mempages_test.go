@@ -1,13 +1,20 @@
 package crit
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -108,7 +115,7 @@ func TestGetMemPages(t *testing.T) {
 		{
 			name: "Zero memory area size",
 			mr: &MemoryReader{
-				checkpointDir:  testImgsDir,
+				checkpoint:     newCheckpoint(testImgsDir),
 				pid:            pid,
 				pageSize:       sysPageSize,
 				pagesID:        mr.pagesID,
@@ -121,7 +128,7 @@ func TestGetMemPages(t *testing.T) {
 		{
 			name: "Valid pagemap entry 1",
 			mr: &MemoryReader{
-				checkpointDir:  testImgsDir,
+				checkpoint:     newCheckpoint(testImgsDir),
 				pid:            pid,
 				pageSize:       sysPageSize,
 				pagesID:        mr.pagesID,
@@ -134,7 +141,7 @@ func TestGetMemPages(t *testing.T) {
 		{
 			name: "Valid pagemap entry 2",
 			mr: &MemoryReader{
-				checkpointDir:  testImgsDir,
+				checkpoint:     newCheckpoint(testImgsDir),
 				pid:            pid,
 				pageSize:       sysPageSize,
 				pagesID:        mr.pagesID,
@@ -147,7 +154,7 @@ func TestGetMemPages(t *testing.T) {
 		{
 			name: "Invalid pages file",
 			mr: &MemoryReader{
-				checkpointDir:  testImgsDir,
+				checkpoint:     newCheckpoint(testImgsDir),
 				pid:            pid,
 				pageSize:       sysPageSize,
 				pagesID:        mr.pagesID + 1,
@@ -160,7 +167,7 @@ func TestGetMemPages(t *testing.T) {
 		{
 			name: "Empty pages file",
 			mr: &MemoryReader{
-				checkpointDir:  os.TempDir(),
+				checkpoint:     newCheckpoint(os.TempDir()),
 				pid:            pid,
 				pageSize:       sysPageSize,
 				pagesID:        0,
@@ -208,8 +215,8 @@ func TestGetPsArgsAndEnvVars(t *testing.T) {
 			name:          "wrong PID",
 			expectedError: errors.New("no such file or directory"),
 			mr: &MemoryReader{
-				checkpointDir: testImgsDir,
-				pid:           0,
+				checkpoint: newCheckpoint(testImgsDir),
+				pid:        0,
 			},
 		},
 		{
@@ -358,3 +365,140 @@ func getTestImgPID() (uint32, error) {
 
 	return process.GetPgid(), nil
 }
+
+// Helper to write the pagemap and pages of process 1,
+// with one page of the given byte per present page
+func writeTestPages(t *testing.T, dir string, fill []byte, entries ...*pagemap.PagemapEntry) {
+	t.Helper()
+	pagemapEntries := []proto.Message{&pagemap.PagemapHead{PagesId: proto.Uint32(1)}}
+	for _, entry := range entries {
+		pagemapEntries = append(pagemapEntries, entry)
+	}
+	writeTestImg(t, dir, "pagemap-1.img", "PAGEMAP", pagemapEntries...)
+
+	var pages []byte
+	for _, b := range fill {
+		pages = append(pages, bytes.Repeat([]byte{b}, 0x1000)...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pages-1.img"), pages, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPagemapEntry(vaddr uint64, nrPages, flags uint32) *pagemap.PagemapEntry {
+	return &pagemap.PagemapEntry{
+		Vaddr:   proto.Uint64(vaddr),
+		NrPages: proto.Uint32(nrPages),
+		Flags:   proto.Uint32(flags),
+	}
+}
+
+func TestMemoryReaderParent(t *testing.T) {
+	root := t.TempDir()
+	parentDir, dir := filepath.Join(root, "pre-dump"), filepath.Join(root, "dump")
+	for _, d := range []string{parentDir, dir} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../pre-dump", filepath.Join(dir, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPages(t, parentDir, []byte("ab"), testPagemapEntry(0x1000, 2, pagemapPresent))
+	writeTestPages(t, dir, []byte("c"),
+		// Images of older versions of CRIU have no flags
+		&pagemap.PagemapEntry{Vaddr: proto.Uint64(0x1000), NrPages: proto.Uint32(1), InParent: proto.Bool(true)},
+		testPagemapEntry(0x2000, 1, pagemapPresent),
+		testPagemapEntry(0x3000, 1, pagemapLazy),
+	)
+
+	mr, err := NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := mr.GetMemPages(0x1800, 0x2800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(bytes.Repeat([]byte("a"), 0x800)) + string(bytes.Repeat([]byte("c"), 0x800))
+	if buf.String() != want {
+		t.Errorf("unexpected memory %q...", buf.String()[:8])
+	}
+	if _, err := mr.GetMemPages(0x3000, 0x3010); !errors.Is(err, ErrPageLazy) {
+		t.Errorf("expected ErrPageLazy, got %v", err)
+	}
+
+	matches, err := mr.SearchPattern("a+|c+", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Vaddr != 0x1000 || matches[1].Vaddr != 0x2000 {
+		t.Errorf("unexpected matches %+v", matches)
+	}
+
+	// The page is not part of the parent checkpoint
+	writeTestPages(t, dir, nil, testPagemapEntry(0x5000, 1, pagemapParent))
+	mr, err = NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mr.GetMemPages(0x5000, 0x5010); !errors.Is(err, ErrPageMissing) {
+		t.Errorf("expected ErrPageMissing, got %v", err)
+	}
+}
+
+func TestMemoryReaderAt(t *testing.T) {
+	dir := t.TempDir()
+	pages := writeTestMemory(t, dir)
+	mr, err := NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	want := []MemoryRange{{Start: 0x1000, End: 0x3000}, {Start: 0x5000, End: 0x6000}}
+	ranges, err := mr.Ranges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("want: %+v, got: %+v", want, ranges)
+	}
+
+	sr := io.NewSectionReader(mr, 0x1000, 0x2000)
+	if err := iotest.TestReader(sr, pages[:0x2000]); err != nil {
+		t.Error(err)
+	}
+
+	// Reads stop at unmapped memory
+	buf := make([]byte, 0x1000)
+	n, err := mr.ReadAt(buf, 0x2800)
+	if n != 0x800 || !errors.Is(err, ErrUnmapped) || !bytes.Equal(buf[:n], pages[0x1800:0x2000]) {
+		t.Errorf("unexpected read of %d bytes: %v", n, err)
+	}
+
+	// Concurrent reads share the pages image
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 0x1000)
+			if _, err := mr.ReadAt(buf, 0x5000); err != nil || !bytes.Equal(buf, pages[0x2000:]) {
+				t.Errorf("unexpected read: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Unmapped memory reads as zeros
+	mem, err := mr.GetMemPages(0x2800, 0x5800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMem := append(append(append([]byte{}, pages[0x1800:0x2000]...), make([]byte, 0x2000)...), pages[0x2000:0x2800]...)
+	if !bytes.Equal(mem.Bytes(), wantMem) {
+		t.Error("unexpected memory around hole")
+	}
+}
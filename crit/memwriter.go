@@ -0,0 +1,358 @@
+package crit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/vma"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryWriter modifies the memory of a process in a checkpoint
+// directory. It implements io.WriterAt, where offsets are virtual
+// addresses of the process, and may be used by multiple goroutines.
+// Pages stored in the pages image are updated in place. Other pages,
+// such as pages which have not been dumped or which are stored in a
+// parent checkpoint, are added to the checkpoint by Close(), which
+// rewrites the pagemap and pages images of the process.
+// New instances should be created with NewMemoryWriter()
+// or Checkpoint.MemoryWriter()
+type MemoryWriter struct {
+	checkpoint *Checkpoint
+	pid        uint32
+	pageSize   int
+	pagesID    uint32
+	mm         *mm.MmEntry
+	index      []memRange
+
+	mutex sync.Mutex
+	pages *os.File
+	// Reader of the checkpoint used to read pages
+	// of parent checkpoints which are modified
+	reader *MemoryReader
+	// Contents of the pages added to the checkpoint
+	added map[uint64][]byte
+}
+
+// NewMemoryWriter creates a MemoryWriter for the process
+// with the given PID in the checkpoint directory
+func NewMemoryWriter(checkpointDir string, pid uint32, pageSize int) (*MemoryWriter, error) {
+	return newCheckpoint(checkpointDir).MemoryWriter(pid, pageSize)
+}
+
+// MemoryWriter creates a MemoryWriter for the process with the given
+// PID. Only checkpoints opened from a directory can be modified.
+// MemoryReaders created before the MemoryWriter has been closed
+// do not see pages added to the checkpoint.
+func (c *Checkpoint) MemoryWriter(pid uint32, pageSize int) (*MemoryWriter, error) {
+	if c.dir == "" {
+		return nil, errors.New("memory can only be written to checkpoint directories")
+	}
+	reader, err := c.MemoryReader(pid, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	mmEntry, err := c.MM(pid)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := os.OpenFile(filepath.Join(c.dir, fmt.Sprintf("pages-%d.img", reader.pagesID)), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	index := pagemapIndex(reader.pagemapEntries, reader.pageSize)
+	sort.SliceStable(index, func(i, j int) bool {
+		return index[i].start < index[j].start
+	})
+	return &MemoryWriter{
+		checkpoint: c,
+		pid:        pid,
+		pageSize:   reader.pageSize,
+		pagesID:    reader.pagesID,
+		mm:         mmEntry,
+		index:      index,
+		pages:      pages,
+		reader:     reader,
+		added:      make(map[uint64][]byte),
+	}, nil
+}
+
+// WriteAt writes p to the memory at the virtual address off.
+// Writing memory which is not mapped by the process fails with
+// ErrUnmapped, and writing shared memory is refused, as it is not
+// stored with the pages of the process. In both cases nothing is
+// written. Pages which are transferred lazily, and pages of file
+// mappings which have not been dumped, can only be replaced as a
+// whole, as their contents are not part of the checkpoint. Pages
+// of private memfd mappings start with the contents of the memfd.
+func (mw *MemoryWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	addr := uint64(off)
+	if addr+uint64(len(p)) < addr {
+		return 0, fmt.Errorf("memory range at 0x%x overflows", addr)
+	}
+	if err := mw.checkMapped(addr, addr+uint64(len(p))); err != nil {
+		return 0, err
+	}
+
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+	if mw.pages == nil {
+		return 0, os.ErrClosed
+	}
+
+	pageSize := uint64(mw.pageSize)
+	n := 0
+	for n < len(p) {
+		cur := addr + uint64(n)
+		page := cur &^ (pageSize - 1)
+		size := page + pageSize - cur
+		if left := uint64(len(p) - n); size > left {
+			size = left
+		}
+		if err := mw.writePage(p[n:n+int(size)], page, cur); err != nil {
+			return n, err
+		}
+		n += int(size)
+	}
+	return n, nil
+}
+
+// Helper to check that the memory from start to end is
+// mapped by private mappings of the process
+func (mw *MemoryWriter) checkMapped(start, end uint64) error {
+	for start < end {
+		var found bool
+		for _, vma := range mw.mm.GetVmas() {
+			if vma.GetStart() > start || vma.GetEnd() <= start {
+				continue
+			}
+			if vma.GetFlags()&unix.MAP_SHARED != 0 || vma.GetStatus()&(vmaAnonShared|vmaSysVIPC) != 0 {
+				return fmt.Errorf("memory at 0x%x is shared and cannot be written", start)
+			}
+			start, found = vma.GetEnd(), true
+			break
+		}
+		if !found {
+			return fmt.Errorf("memory at 0x%x is not mapped: %w", start, ErrUnmapped)
+		}
+	}
+	return nil
+}
+
+// Helper to get the mapping of the process at addr
+func (mw *MemoryWriter) mapping(addr uint64) *vma.VmaEntry {
+	for _, vma := range mw.mm.GetVmas() {
+		if vma.GetStart() <= addr && addr < vma.GetEnd() {
+			return vma
+		}
+	}
+	return nil
+}
+
+// Helper to write p to the memory at addr of a single page
+func (mw *MemoryWriter) writePage(p []byte, page, addr uint64) error {
+	if data, ok := mw.added[page]; ok {
+		copy(data[addr-page:], p)
+		return nil
+	}
+
+	i := sort.Search(len(mw.index), func(i int) bool { return mw.index[i].end > page })
+	var flags uint32
+	if i < len(mw.index) && mw.index[i].start <= page {
+		flags = mw.index[i].flags
+	}
+	if flags&pagemapPresent != 0 {
+		r := mw.index[i]
+		_, err := mw.pages.WriteAt(p, int64(r.offset+addr-r.start))
+		return err
+	}
+
+	// The page is added to the checkpoint with its current contents
+	data := make([]byte, mw.pageSize)
+	if len(p) < mw.pageSize {
+		switch {
+		case flags&pagemapParent != 0:
+			if _, err := mw.reader.read(data, page, false); err != nil {
+				return err
+			}
+		case flags&pagemapLazy != 0:
+			return fmt.Errorf("memory at 0x%x can only be written as a whole page: %w", page, ErrPageLazy)
+		default:
+			// Pages of file mappings which have not been
+			// dumped are pages of the file, which is only
+			// stored in the checkpoint for memfd files
+			status := mw.mapping(page).GetStatus()
+			switch {
+			case status&vmaMemfd != 0:
+				if _, err := mw.reader.read(data, page, true); err != nil {
+					return err
+				}
+			case status&(vmaFilePrivate|vmaFileShared) != 0:
+				return fmt.Errorf("memory at 0x%x is a page of a file and can only be written as a whole page", page)
+			}
+		}
+	}
+	copy(data[addr-page:], p)
+	mw.added[page] = data
+	return nil
+}
+
+// Close writes the pages added to the checkpoint and closes
+// the images. The pagemap and pages images are replaced by new
+// images, where the pagemap entries are sorted by address and the
+// pages are stored in the order of the entries, as expected by CRIU.
+func (mw *MemoryWriter) Close() error {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+	if mw.pages == nil {
+		return nil
+	}
+
+	err := mw.flush()
+	if closeErr := mw.pages.Close(); err == nil {
+		err = closeErr
+	}
+	if readerErr := mw.reader.Close(); err == nil {
+		err = readerErr
+	}
+	mw.pages = nil
+	return err
+}
+
+// Helper to rewrite the pagemap and pages images
+// of the process with the pages which have been added
+func (mw *MemoryWriter) flush() error {
+	if len(mw.added) == 0 {
+		return nil
+	}
+	addrs := make([]uint64, 0, len(mw.added))
+	for addr := range mw.added {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	dir := mw.checkpoint.dir
+	pagesName := fmt.Sprintf("pages-%d.img", mw.pagesID)
+	pagemapName := fmt.Sprintf("pagemap-%d.img", mw.pid)
+	pagesFile, err := os.CreateTemp(dir, pagesName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pagesFile.Name())
+	defer pagesFile.Close()
+	pages := bufio.NewWriter(pagesFile)
+
+	var entries []*CriuEntry
+	var last *pagemap.PagemapEntry
+	pageSize := uint64(mw.pageSize)
+	// Helper to add a range of pages to the new images
+	emit := func(start, end uint64, flags uint32, data io.Reader) error {
+		if start >= end {
+			return nil
+		}
+		if data != nil {
+			if _, err := io.Copy(pages, data); err != nil {
+				return err
+			}
+		}
+		nrPages := uint32((end - start) / pageSize)
+		if last != nil && last.GetFlags() == flags &&
+			last.GetVaddr()+uint64(last.GetNrPages())*pageSize == start {
+			last.NrPages = proto.Uint32(last.GetNrPages() + nrPages)
+			return nil
+		}
+		last = &pagemap.PagemapEntry{
+			Vaddr:   proto.Uint64(start),
+			NrPages: proto.Uint32(nrPages),
+			Flags:   proto.Uint32(flags),
+		}
+		entries = append(entries, &CriuEntry{Message: last})
+		return nil
+	}
+	// Helper to add pages of an existing range
+	emitRange := func(r memRange, start, end uint64) error {
+		var data io.Reader
+		if r.flags&pagemapPresent != 0 {
+			data = io.NewSectionReader(mw.pages, int64(r.offset+start-r.start), int64(end-start))
+		}
+		return emit(start, end, r.flags, data)
+	}
+	// Helper to add the pages added before the address end
+	j := 0
+	emitAdded := func(end uint64) error {
+		for ; j < len(addrs) && addrs[j] < end; j++ {
+			if err := emit(addrs[j], addrs[j]+pageSize, pagemapPresent, bytes.NewReader(mw.added[addrs[j]])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, r := range mw.index {
+		if err := emitAdded(r.start); err != nil {
+			return err
+		}
+		// Added pages replace pages of the range
+		start := r.start
+		for j < len(addrs) && addrs[j] < r.end {
+			if err := emitRange(r, start, addrs[j]); err != nil {
+				return err
+			}
+			start = addrs[j] + pageSize
+			if err := emitAdded(start); err != nil {
+				return err
+			}
+		}
+		if err := emitRange(r, start, r.end); err != nil {
+			return err
+		}
+	}
+	if err := emitAdded(^uint64(0)); err != nil {
+		return err
+	}
+	if err := pages.Flush(); err != nil {
+		return err
+	}
+	if err := pagesFile.Close(); err != nil {
+		return err
+	}
+
+	pagemapFile, err := os.CreateTemp(dir, pagemapName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pagemapFile.Name())
+	defer pagemapFile.Close()
+	head := &pagemap.PagemapHead{PagesId: proto.Uint32(mw.pagesID)}
+	entries = append([]*CriuEntry{{Message: head}}, entries...)
+	if err := encodeImg(&CriuImage{Magic: "PAGEMAP", Entries: entries}, pagemapFile); err != nil {
+		return err
+	}
+	if err := pagemapFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(pagesFile.Name(), filepath.Join(dir, pagesName)); err != nil {
+		return err
+	}
+	if err := os.Rename(pagemapFile.Name(), filepath.Join(dir, pagemapName)); err != nil {
+		return err
+	}
+	mw.added = make(map[uint64][]byte)
+	mw.checkpoint.forget(pagemapName)
+	return nil
+}
@@ -0,0 +1,165 @@
+package crit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/memfd"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMemoryWriter(t *testing.T) {
+	root := t.TempDir()
+	parentDir, dir := filepath.Join(root, "pre-dump"), filepath.Join(root, "dump")
+	for _, d := range []string{parentDir, dir} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../pre-dump", filepath.Join(dir, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPages(t, parentDir, []byte("ab"), testPagemapEntry(0x1000, 2, pagemapPresent))
+	writeTestPages(t, dir, []byte("c"),
+		testPagemapEntry(0x1000, 1, pagemapParent),
+		testPagemapEntry(0x2000, 1, pagemapPresent),
+		testPagemapEntry(0x3000, 1, pagemapLazy),
+	)
+	mmEntry := testMm(0x1000, 0x2000, 0x3000, 0x4000, 0x5000)
+	mmEntry.Vmas[4].Flags = proto.Uint32(unix.MAP_SHARED)
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	mw, err := NewMemoryWriter(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mw.Close()
+
+	// Present pages are written in place
+	if _, err := mw.WriteAt([]byte("yy"), 0x1fff); err != nil {
+		t.Fatal(err)
+	}
+	pages, err := os.ReadFile(filepath.Join(dir, "pages-1.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 0x1000 || pages[0] != 'y' || pages[1] != 'c' {
+		t.Errorf("unexpected pages %q...", pages[:8])
+	}
+
+	if _, err := mw.WriteAt([]byte("l"), 0x3010); !errors.Is(err, ErrPageLazy) {
+		t.Errorf("expected ErrPageLazy, got %v", err)
+	}
+	if _, err := mw.WriteAt(bytes.Repeat([]byte("l"), 0x1000), 0x3000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mw.WriteAt([]byte("h"), 0x4004); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := mw.WriteAt([]byte("u"), 0x6000); n != 0 || !errors.Is(err, ErrUnmapped) {
+		t.Errorf("expected ErrUnmapped, got %v", err)
+	}
+	if n, err := mw.WriteAt([]byte("ss"), 0x4fff); n != 0 || err == nil {
+		t.Error("shared memory has been written")
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries, err := newCheckpoint(dir).Pagemap(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].GetVaddr() != 0x1000 || entries[0].GetNrPages() != 4 ||
+		entries[0].GetFlags() != pagemapPresent {
+		t.Errorf("unexpected pagemap entries %v", entries)
+	}
+
+	want := bytes.Repeat([]byte("a"), 0x1000)
+	want[0xfff] = 'y'
+	want = append(want, 'y')
+	want = append(want, bytes.Repeat([]byte("c"), 0xfff)...)
+	want = append(want, bytes.Repeat([]byte("l"), 0x1000)...)
+	want = append(want, make([]byte, 0x1000)...)
+	want[0x3004] = 'h'
+	mr, err := NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	buf, err := mr.GetMemPages(0x1000, 0x5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("unexpected memory after writing")
+	}
+}
+
+func TestMemoryWriterFileMapping(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPages(t, dir, nil)
+	mmEntry := testMm(0x10000, 0x20000)
+	mmEntry.Vmas[0].Status = proto.Uint32(1 | vmaFilePrivate)
+	mmEntry.Vmas[0].Shmid = proto.Uint64(1)
+	mmEntry.Vmas[1].Status = proto.Uint32(1 | vmaFilePrivate | vmaMemfd)
+	mmEntry.Vmas[1].Shmid = proto.Uint64(3)
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	// The private mapping of a memfd file whose first page is stored
+	file := &fdinfo.FileEntry{
+		Type:  fdinfo.FdTypes_MEMFD.Enum(),
+		Id:    proto.Uint32(3),
+		Memfd: &memfd.MemfdFileEntry{Id: proto.Uint32(3), InodeId: proto.Uint32(9)},
+	}
+	fillRequired(file.ProtoReflect())
+	writeTestImg(t, dir, "files.img", "FILES", file)
+	inode := &memfd.MemfdInodeEntry{InodeId: proto.Uint64(9), Shmid: proto.Uint32(8)}
+	fillRequired(inode.ProtoReflect())
+	writeTestImg(t, dir, "memfd-inode.img", "MEMFD_INODE", inode)
+	writeTestShmem(t, dir, 8, 2, 0, 'm')
+
+	mw, err := NewMemoryWriter(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mw.Close()
+
+	// The contents of the file are not part of the checkpoint
+	if n, err := mw.WriteAt([]byte("f"), 0x10010); n != 0 || err == nil {
+		t.Error("page of a file has been written partially")
+	}
+	if _, err := mw.WriteAt(bytes.Repeat([]byte("f"), 0x1000), 0x10000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mw.WriteAt([]byte("x"), 0x20010); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mr, err := NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	buf := make([]byte, 0x1000)
+	if _, err := mr.ReadAt(buf, 0x20000); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("m"), 0x1000)
+	want[0x10] = 'x'
+	if !bytes.Equal(buf, want) {
+		t.Error("unexpected page of the memfd mapping")
+	}
+	if _, err := mr.ReadAt(buf, 0x10000); err != nil || !bytes.Equal(buf, bytes.Repeat([]byte("f"), 0x1000)) {
+		t.Errorf("unexpected page of the file mapping: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package crit
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mnt"
+)
+
+// ExternalMount represents a mount of a checkpoint which was
+// declared as external on dump. CRIU expects a mapping for
+// Key to a path on the host in order to restore it.
+type ExternalMount struct {
+	MntID      uint32 `json:"mnt_id"`
+	Key        string `json:"key"`
+	Mountpoint string `json:"mountpoint"`
+	Root       string `json:"root"`
+	Source     string `json:"source"`
+}
+
+// ExternalMounts reads the mountpoint images in the checkpoint
+// directory and returns the external mounts for which a mapping
+// has to be provided on restore. Mounts sharing the same key
+// in different mount namespaces are reported only once.
+func ExternalMounts(dir string) ([]*ExternalMount, error) {
+	return newCheckpoint(dir).externalMounts()
+}
+
+// Helper to get the external mounts of a checkpoint
+func (c *Checkpoint) externalMounts() ([]*ExternalMount, error) {
+	mntImgs, err := fs.Glob(c.fsys, "mountpoints-*.img")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(mntImgs)
+
+	keys := make(map[string]bool)
+	mounts := make([]*ExternalMount, 0)
+	for _, mntImg := range mntImgs {
+		img, err := c.image(mntImg, &mnt.MntEntry{})
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range img.Entries {
+			mntEntry := entry.Message.(*mnt.MntEntry)
+			if !mntEntry.GetExtMount() {
+				continue
+			}
+			// Older versions of CRIU store the key in root
+			key := mntEntry.GetExtKey()
+			if key == "" {
+				key = mntEntry.GetRoot()
+			}
+			if keys[key] {
+				continue
+			}
+			keys[key] = true
+
+			mounts = append(mounts, &ExternalMount{
+				MntID:      mntEntry.GetMntId(),
+				Key:        key,
+				Mountpoint: mntEntry.GetMountpoint(),
+				Root:       mntEntry.GetRoot(),
+				Source:     mntEntry.GetSource(),
+			})
+		}
+	}
+
+	return mounts, nil
+}
+
+// ExternalMountOpts returns the values for the external option
+// of a restore which map every external mount in the checkpoint
+// directory to the host path returned by mapping.
+func ExternalMountOpts(dir string, mapping func(*ExternalMount) (string, error)) ([]string, error) {
+	mounts, err := ExternalMounts(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	external := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		path, err := mapping(mount)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			return nil, fmt.Errorf("no host path for external mount %s (%s)", mount.Key, mount.Mountpoint)
+		}
+		external = append(external, fmt.Sprintf("mnt[%s]:%s", mount.Key, path))
+	}
+
+	return external, nil
+}
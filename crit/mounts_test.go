@@ -0,0 +1,85 @@
+package crit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mnt"
+	"google.golang.org/protobuf/proto"
+)
+
+func testMount(mntID uint32, mountpoint, root string, extMount bool, extKey string) *mnt.MntEntry {
+	entry := &mnt.MntEntry{
+		Fstype:      proto.Uint32(uint32(mnt.Fstype_AUTO)),
+		MntId:       proto.Uint32(mntID),
+		RootDev:     proto.Uint32(0),
+		ParentMntId: proto.Uint32(1),
+		Flags:       proto.Uint32(0),
+		Root:        proto.String(root),
+		Mountpoint:  proto.String(mountpoint),
+		Source:      proto.String("/dev/sda1"),
+		Options:     proto.String(""),
+	}
+	if extMount {
+		entry.ExtMount = proto.Bool(true)
+	}
+	if extKey != "" {
+		entry.ExtKey = proto.String(extKey)
+	}
+	return entry
+}
+
+func TestExternalMounts(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImg(t, dir, "mountpoints-12.img", "MNTS",
+		testMount(1, "/", "/", false, ""),
+		testMount(2, "/data", "/srv/data", true, "data"),
+		// Key stored in root by older versions of CRIU
+		testMount(3, "/etc/hosts", "hosts", true, ""),
+	)
+	writeTestImg(t, dir, "mountpoints-13.img", "MNTS",
+		testMount(4, "/data", "/srv/data", true, "data"),
+	)
+
+	mounts, err := ExternalMounts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("want 2 external mounts, got %d", len(mounts))
+	}
+	if mounts[0].Key != "data" || mounts[0].Mountpoint != "/data" {
+		t.Errorf("unexpected mount %+v", mounts[0])
+	}
+	if mounts[1].Key != "hosts" || mounts[1].Mountpoint != "/etc/hosts" {
+		t.Errorf("unexpected mount %+v", mounts[1])
+	}
+
+	external, err := ExternalMountOpts(dir, func(m *ExternalMount) (string, error) {
+		return "/mnt/new" + m.Mountpoint, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"mnt[data]:/mnt/new/data", "mnt[hosts]:/mnt/new/etc/hosts"}
+	for i := range want {
+		if external[i] != want[i] {
+			t.Errorf("want: %s, got: %s", want[i], external[i])
+		}
+	}
+
+	_, err = ExternalMountOpts(dir, func(m *ExternalMount) (string, error) {
+		return "", nil
+	})
+	if err == nil {
+		t.Error("expected error for unmapped mount")
+	}
+
+	mappingErr := errors.New("mapping failed")
+	_, err = ExternalMountOpts(dir, func(m *ExternalMount) (string, error) {
+		return "", mappingErr
+	})
+	if !errors.Is(err, mappingErr) {
+		t.Errorf("want error %v, got %v", mappingErr, err)
+	}
+}
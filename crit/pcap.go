@@ -0,0 +1,444 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	sk_inet "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-inet"
+	sk_packet "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-packet"
+	tcp_stream "github.com/checkpoint-restore/go-criu/v7/crit/images/tcp-stream"
+)
+
+// Types of the blocks of pcapng files
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterface        = 1
+	pcapngEnhancedPacket   = 6
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptEnd           = 0
+	pcapngOptComment       = 1
+	pcapngOptIfName        = 2
+	pcapngOptShbUserAppl   = 4
+	pcapngLinkTypeEther    = 1
+	pcapngLinkTypeRaw      = 101
+	pcapngLinkTypeLinuxSLL = 113
+)
+
+// Flags of TCP segments
+const (
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// Options of TCP connections in the opt_mask of TCP streams
+const tcpOptTimestamps = 1
+
+// Default maximum segment size of synthesized TCP segments
+const defaultTCPMSS = 1460
+
+// pcapWriter writes the blocks of a pcapng file,
+// where interfaces are added when first used
+type pcapWriter struct {
+	w          io.Writer
+	timestamp  uint64
+	interfaces map[string]uint32
+}
+
+// pcapPacket is a packet written to a pcapng file
+type pcapPacket struct {
+	linkType uint16
+	ifName   string
+	data     []byte
+	comment  string
+}
+
+// ExportPcap writes the data queued in the sockets of the checkpoint
+// as a pcapng file, which can be analyzed with Wireshark or tcpdump.
+// For every TCP connection with a stream image, the data in the
+// receive queue and in the send queue is written as TCP segments
+// between the addresses and ports of the socket, with the sequence
+// numbers, windows and timestamps of the connection. A connection
+// without data in one direction is represented by an empty ACK.
+// Packets queued in packet sockets are written as captured by the
+// socket. All packets are timestamped with the modification time
+// of inventory.img, which is written at checkpoint time.
+func (c *Checkpoint) ExportPcap(w io.Writer) error {
+	files, err := c.Files()
+	if err != nil {
+		return err
+	}
+	pw := &pcapWriter{w: w, interfaces: make(map[string]uint32)}
+	if info, err := fs.Stat(c.fsys, "inventory.img"); err == nil && info.ModTime().After(time.Unix(0, 0)) {
+		pw.timestamp = uint64(info.ModTime().UnixMicro())
+	}
+	if err := pw.writeSectionHeader(); err != nil {
+		return err
+	}
+
+	for _, id := range sortedFileIDs(files) {
+		isk := files[id].GetIsk()
+		if files[id].GetType() != fdinfo.FdTypes_INETSK || isk.GetProto() != syscall.IPPROTO_TCP {
+			continue
+		}
+		packets, err := c.tcpStreamPackets(isk)
+		if err != nil {
+			return err
+		}
+		for _, packet := range packets {
+			if err := pw.writePacket(packet); err != nil {
+				return err
+			}
+		}
+	}
+
+	img, err := c.image("sk-queues.img", &sk_packet.SkPacketEntry{})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range img.Entries {
+		packet, err := skQueuePacket(entry, files)
+		if err != nil {
+			return err
+		}
+		if packet == nil {
+			continue
+		}
+		if err := pw.writePacket(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper to synthesize the TCP segments of the queues of a TCP
+// connection, which are empty if the socket has no stream image
+func (c *Checkpoint) tcpStreamPackets(isk *sk_inet.InetSkEntry) ([]*pcapPacket, error) {
+	img, err := c.image(fmt.Sprintf("tcp-stream-%x.img", isk.GetIno()), &tcp_stream.TcpStreamEntry{})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(img.Entries) == 0 {
+		return nil, fmt.Errorf("no entries in the TCP stream of socket %d", isk.GetId())
+	}
+	stream, ok := img.Entries[0].Message.(*tcp_stream.TcpStreamEntry)
+	if !ok {
+		return nil, errors.New("unable to assert payload type")
+	}
+	var queues tcpStreamExtra
+	if err := json.Unmarshal([]byte(img.Entries[0].Extra), &queues); err != nil {
+		return nil, fmt.Errorf("invalid queues of socket %d: %w", isk.GetId(), err)
+	}
+	inQ, err := base64.StdEncoding.DecodeString(queues.InQ)
+	if err != nil {
+		return nil, err
+	}
+	outQ, err := base64.StdEncoding.DecodeString(queues.OutQ)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dst := skAddr(isk.GetSrcAddr()), skAddr(isk.GetDstAddr())
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid addresses of socket %d", isk.GetId())
+	}
+	mss := int(stream.GetMssClamp())
+	if mss == 0 || mss > defaultTCPMSS {
+		mss = defaultTCPMSS
+	}
+	// Addresses of both versions are sent as IPv6
+	ipv6 := src.To4() == nil || dst.To4() == nil
+	var tsVal uint32
+	timestamps := stream.GetOptMask()&tcpOptTimestamps != 0
+	if timestamps {
+		tsVal = stream.GetTimestamp()
+	}
+
+	// The receive queue ends at the next sequence number to be
+	// received, and the send queue at the next one to be written.
+	// Unsent data is at the end of the send queue.
+	rcvNxt, sndNxt := stream.GetInqSeq(), stream.GetOutqSeq()
+	rcvSeq, sndUna := rcvNxt-uint32(len(inQ)), sndNxt-uint32(len(outQ))
+	sent := len(outQ) - int(stream.GetUnsqLen())
+	if sent < 0 {
+		sent = 0
+	}
+	out := &tcpSegmenter{
+		src: src, dst: dst, srcPort: isk.GetSrcPort(), dstPort: isk.GetDstPort(),
+		ack: rcvNxt, window: tcpWindow(stream.RcvWnd, stream.GetRcvWnd(), stream.GetRcvWscale()),
+		ipv6: ipv6, timestamps: timestamps, tsVal: tsVal, mss: mss,
+	}
+	in := &tcpSegmenter{
+		src: dst, dst: src, srcPort: isk.GetDstPort(), dstPort: isk.GetSrcPort(),
+		ack: sndUna, window: tcpWindow(stream.SndWnd, stream.GetSndWnd(), stream.GetSndWscale()),
+		ipv6: ipv6, timestamps: timestamps, tsEcr: tsVal, mss: mss,
+	}
+	name := fmt.Sprintf("socket %d", isk.GetId())
+
+	var packets []*pcapPacket
+	packets = append(packets, in.segments(inQ, rcvSeq, name+": received, not read by the application")...)
+	packets = append(packets, out.segments(outQ[:sent], sndUna, name+": sent, not acknowledged")...)
+	packets = append(packets, out.segments(outQ[sent:], sndUna+uint32(sent), name+": not sent")...)
+	if len(inQ) == 0 {
+		packets = append(packets, in.segments(nil, rcvNxt, name+": state of the peer")...)
+	}
+	if len(outQ) == 0 {
+		packets = append(packets, out.segments(nil, sndNxt, name+": state of the socket")...)
+	}
+	return packets, nil
+}
+
+// Helper to get the window of the TCP header from the window of a
+// TCP stream, where the window is unlimited if it is not in the image
+func tcpWindow(set *uint32, window, scale uint32) uint16 {
+	if set == nil {
+		return 0xffff
+	}
+	window >>= scale
+	if window > 0xffff {
+		return 0xffff
+	}
+	return uint16(window)
+}
+
+// Helper to get the IP address of an inet socket, where
+// IPv4 addresses mapped to IPv6 are converted to IPv4
+func skAddr(parts []uint32) net.IP {
+	if len(parts) != 1 && len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4*len(parts))
+	for i, part := range parts {
+		binary.LittleEndian.PutUint32(ip[4*i:], part)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// tcpSegmenter synthesizes the TCP segments
+// sent in one direction of a connection
+type tcpSegmenter struct {
+	src, dst         net.IP
+	srcPort, dstPort uint32
+	ack              uint32
+	window           uint16
+	ipv6             bool
+	timestamps       bool
+	tsVal, tsEcr     uint32
+	mss              int
+}
+
+// Helper to split data starting at seq into segments, where
+// no data is sent as a single segment acknowledging data
+func (ts *tcpSegmenter) segments(data []byte, seq uint32, comment string) []*pcapPacket {
+	var packets []*pcapPacket
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > ts.mss {
+			n = ts.mss
+		}
+		flags := uint8(tcpFlagACK)
+		if n > 0 && n == len(data) {
+			flags |= tcpFlagPSH
+		}
+		packets = append(packets, &pcapPacket{
+			linkType: pcapngLinkTypeRaw,
+			ifName:   "tcp",
+			data:     ts.packet(data[:n], seq, flags),
+			comment:  comment,
+		})
+		data = data[n:]
+		seq += uint32(n)
+	}
+	return packets
+}
+
+// Helper to build an IP packet holding a TCP segment
+func (ts *tcpSegmenter) packet(payload []byte, seq uint32, flags uint8) []byte {
+	var options []byte
+	if ts.timestamps {
+		// NOP, NOP and the timestamp option
+		options = []byte{1, 1, 8, 10}
+		options = binary.BigEndian.AppendUint32(options, ts.tsVal)
+		options = binary.BigEndian.AppendUint32(options, ts.tsEcr)
+	}
+	tcp := make([]byte, 20, 20+len(options)+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(ts.srcPort))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(ts.dstPort))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ts.ack)
+	tcp[12] = uint8((20+len(options))/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], ts.window)
+	tcp = append(append(tcp, options...), payload...)
+
+	// The checksum covers a pseudo header with the addresses
+	var pseudo bytes.Buffer
+	var header []byte
+	if !ts.ipv6 {
+		pseudo.Write(ts.src.To4())
+		pseudo.Write(ts.dst.To4())
+		pseudo.Write([]byte{0, syscall.IPPROTO_TCP})
+		_ = binary.Write(&pseudo, binary.BigEndian, uint16(len(tcp)))
+
+		header = make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(tcp)))
+		// Don't fragment
+		header[6] = 0x40
+		header[8] = 64
+		header[9] = syscall.IPPROTO_TCP
+		copy(header[12:], ts.src.To4())
+		copy(header[16:], ts.dst.To4())
+		binary.BigEndian.PutUint16(header[10:], inetChecksum(header))
+	} else {
+		pseudo.Write(ts.src.To16())
+		pseudo.Write(ts.dst.To16())
+		_ = binary.Write(&pseudo, binary.BigEndian, uint32(len(tcp)))
+		pseudo.Write([]byte{0, 0, 0, syscall.IPPROTO_TCP})
+
+		header = make([]byte, 40)
+		header[0] = 0x60
+		binary.BigEndian.PutUint16(header[4:], uint16(len(tcp)))
+		header[6] = syscall.IPPROTO_TCP
+		header[7] = 64
+		copy(header[8:], ts.src.To16())
+		copy(header[24:], ts.dst.To16())
+	}
+	pseudo.Write(tcp)
+	binary.BigEndian.PutUint16(tcp[16:], inetChecksum(pseudo.Bytes()))
+	return append(header, tcp...)
+}
+
+// Helper to compute the checksum of IP and TCP headers
+func inetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Helper to get the packet queued in a packet socket, which is nil
+// for the queues of other sockets. Packets of SOCK_RAW sockets are
+// assumed to be Ethernet frames, while packets of SOCK_DGRAM sockets
+// have no link-layer header and get a Linux cooked header.
+func skQueuePacket(entry *CriuEntry, files map[uint32]*fdinfo.FileEntry) (*pcapPacket, error) {
+	p, ok := entry.Message.(*sk_packet.SkPacketEntry)
+	if !ok {
+		return nil, errors.New("unable to assert payload type")
+	}
+	psk := files[p.GetIdFor()].GetPsk()
+	if psk == nil {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(entry.Extra)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := &pcapPacket{
+		linkType: pcapngLinkTypeEther,
+		ifName:   "packet",
+		data:     data,
+		comment:  fmt.Sprintf("socket %d: queued in packet socket", psk.GetId()),
+	}
+	if psk.GetType() == syscall.SOCK_DGRAM {
+		// Incoming packet of an Ethernet device without address
+		header := make([]byte, 16)
+		binary.BigEndian.PutUint16(header[2:], syscall.ARPHRD_ETHER)
+		binary.BigEndian.PutUint16(header[14:], uint16(psk.GetProtocol()))
+		packet.linkType = pcapngLinkTypeLinuxSLL
+		packet.ifName = "packet-cooked"
+		packet.data = append(header, data...)
+	}
+	return packet, nil
+}
+
+// Helper to write the section header of the file
+func (pw *pcapWriter) writeSectionHeader() error {
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	// Version 1.0 with an unknown section length
+	body = binary.LittleEndian.AppendUint16(body, 1)
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0))
+	body = appendPcapngOption(body, pcapngOptShbUserAppl, []byte("crit"))
+	body = appendPcapngOption(body, pcapngOptEnd, nil)
+	return pw.writeBlock(pcapngSectionHeader, body)
+}
+
+// Helper to write a packet, after the description
+// of its interface if it is the first one
+func (pw *pcapWriter) writePacket(packet *pcapPacket) error {
+	id, ok := pw.interfaces[packet.ifName]
+	if !ok {
+		id = uint32(len(pw.interfaces))
+		pw.interfaces[packet.ifName] = id
+		// Packets are not truncated
+		body := binary.LittleEndian.AppendUint16(nil, packet.linkType)
+		body = binary.LittleEndian.AppendUint16(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, 0)
+		body = appendPcapngOption(body, pcapngOptIfName, []byte(packet.ifName))
+		body = appendPcapngOption(body, pcapngOptEnd, nil)
+		if err := pw.writeBlock(pcapngInterface, body); err != nil {
+			return err
+		}
+	}
+
+	// Timestamps are in microseconds
+	body := binary.LittleEndian.AppendUint32(nil, id)
+	body = binary.LittleEndian.AppendUint32(body, uint32(pw.timestamp>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(pw.timestamp))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet.data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet.data)))
+	body = append(body, packet.data...)
+	body = append(body, make([]byte, align4(len(packet.data))-len(packet.data))...)
+	if packet.comment != "" {
+		body = appendPcapngOption(body, pcapngOptComment, []byte(packet.comment))
+		body = appendPcapngOption(body, pcapngOptEnd, nil)
+	}
+	return pw.writeBlock(pcapngEnhancedPacket, body)
+}
+
+// Helper to write a block, where the length of the
+// block is written before and after the body
+func (pw *pcapWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := pw.w.Write(block)
+	return err
+}
+
+// Helper to append an option padded to 32 bits
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, align4(len(value))-len(value))...)
+}
@@ -0,0 +1,180 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	packet_sock "github.com/checkpoint-restore/go-criu/v7/crit/images/packet-sock"
+	sk_packet "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-packet"
+	tcp_stream "github.com/checkpoint-restore/go-criu/v7/crit/images/tcp-stream"
+	"google.golang.org/protobuf/proto"
+)
+
+// testPcapPacket is a packet read from a pcapng file
+type testPcapPacket struct {
+	linkType uint16
+	data     []byte
+	comment  string
+}
+
+// readTestPcap is a helper to read the packets of a pcapng file
+func readTestPcap(t *testing.T, data []byte) []*testPcapPacket {
+	t.Helper()
+	le := binary.LittleEndian
+	var linkTypes []uint16
+	var packets []*testPcapPacket
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block %x", data)
+		}
+		blockType, length := le.Uint32(data), le.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || le.Uint32(data[length-4:]) != length {
+			t.Fatalf("invalid block of type %d with length %d", blockType, length)
+		}
+		body := data[8 : length-4]
+		switch blockType {
+		case pcapngSectionHeader:
+			if le.Uint32(body) != pcapngByteOrderMagic {
+				t.Fatal("invalid byte order magic")
+			}
+		case pcapngInterface:
+			linkTypes = append(linkTypes, le.Uint16(body))
+		case pcapngEnhancedPacket:
+			size := le.Uint32(body[12:])
+			packet := &testPcapPacket{linkType: linkTypes[le.Uint32(body)], data: body[20 : 20+size]}
+			if options := body[20+align4(int(size)):]; len(options) > 0 && le.Uint16(options) == pcapngOptComment {
+				packet.comment = string(options[4 : 4+le.Uint16(options[2:])])
+			}
+			packets = append(packets, packet)
+		}
+		data = data[length:]
+	}
+	return packets
+}
+
+// writeTestEntries is a helper to create an image
+// with entries which are followed by extra data
+func writeTestEntries(t *testing.T, dir, name, magic string, entries ...*CriuEntry) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := encodeImg(&CriuImage{Magic: magic, Entries: entries}, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportPcap(t *testing.T) {
+	dir := t.TempDir()
+	psk := &fdinfo.FileEntry{
+		Type: fdinfo.FdTypes_PACKETSK.Enum(),
+		Id:   proto.Uint32(3),
+		Psk: &packet_sock.PacketSockEntry{
+			Id:       proto.Uint32(3),
+			Type:     proto.Uint32(syscall.SOCK_DGRAM),
+			Protocol: proto.Uint32(0x0800),
+			Fown:     testFown(),
+			Opts:     testSkOpts(),
+		},
+	}
+	fillRequired(psk.ProtoReflect())
+	writeTestImg(t, dir, "files.img", "FILES",
+		testInetSk(1, syscall.SOCK_STREAM, syscall.IPPROTO_TCP, tcpListen, 80, 0),
+		testInetSk(2, syscall.SOCK_STREAM, syscall.IPPROTO_TCP, tcpEstablished, 80, 40000),
+		psk,
+		testUnixSk(4, 400, 0, 0),
+	)
+
+	// Three of the eight bytes of the send queue
+	// have not been sent, and segments have 4 bytes
+	extra, err := json.Marshal(tcpStreamExtra{
+		InQ:  base64.StdEncoding.EncodeToString([]byte("hello")),
+		OutQ: base64.StdEncoding.EncodeToString([]byte("abcdefgh")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestEntries(t, dir, "tcp-stream-2.img", "TCP_STREAM", &CriuEntry{
+		Message: &tcp_stream.TcpStreamEntry{
+			InqLen:    proto.Uint32(5),
+			InqSeq:    proto.Uint32(1005),
+			OutqLen:   proto.Uint32(8),
+			OutqSeq:   proto.Uint32(2008),
+			OptMask:   proto.Uint32(tcpOptTimestamps),
+			SndWscale: proto.Uint32(2),
+			MssClamp:  proto.Uint32(4),
+			Timestamp: proto.Uint32(777),
+			UnsqLen:   proto.Uint32(3),
+			SndWnd:    proto.Uint32(0x20000),
+			RcvWnd:    proto.Uint32(1000),
+		},
+		Extra: string(extra),
+	})
+	skQueue := func(id uint32, data string) *CriuEntry {
+		return &CriuEntry{
+			Message: &sk_packet.SkPacketEntry{IdFor: proto.Uint32(id), Length: proto.Uint32(uint32(len(data)))},
+			Extra:   base64.StdEncoding.EncodeToString([]byte(data)),
+		}
+	}
+	writeTestEntries(t, dir, "sk-queues.img", "SK_QUEUES", skQueue(4, "unix"), skQueue(3, "ping"))
+
+	var buf bytes.Buffer
+	if err := newCheckpoint(dir).ExportPcap(&buf); err != nil {
+		t.Fatal(err)
+	}
+	packets := readTestPcap(t, buf.Bytes())
+	if len(packets) != 6 {
+		t.Fatalf("unexpected number of packets %d", len(packets))
+	}
+
+	want := []struct {
+		srcPort, dstPort   uint16
+		seq, ack, tsVal    uint32
+		window             uint16
+		payload, direction string
+	}{
+		{40000, 80, 1000, 2000, 0, 0x8000, "hell", "received, not read by the application"},
+		{40000, 80, 1004, 2000, 0, 0x8000, "o", "received, not read by the application"},
+		{80, 40000, 2000, 1005, 777, 1000, "abcd", "sent, not acknowledged"},
+		{80, 40000, 2004, 1005, 777, 1000, "e", "sent, not acknowledged"},
+		{80, 40000, 2005, 1005, 777, 1000, "fgh", "not sent"},
+	}
+	be := binary.BigEndian
+	for i, w := range want {
+		packet := packets[i]
+		ip := packet.data
+		if packet.linkType != pcapngLinkTypeRaw || ip[0] != 0x45 || inetChecksum(ip[:20]) != 0 ||
+			int(be.Uint16(ip[2:])) != len(ip) || !bytes.Equal(ip[12:20], []byte{127, 0, 0, 1, 127, 0, 0, 1}) {
+			t.Errorf("unexpected IP header %x", ip[:20])
+			continue
+		}
+		tcp := ip[20:]
+		pseudo := append(append([]byte{}, ip[12:20]...), 0, syscall.IPPROTO_TCP, 0, byte(len(tcp)))
+		if inetChecksum(append(pseudo, tcp...)) != 0 {
+			t.Errorf("invalid TCP checksum of packet %d", i)
+		}
+		if be.Uint16(tcp) != w.srcPort || be.Uint16(tcp[2:]) != w.dstPort || be.Uint32(tcp[4:]) != w.seq ||
+			be.Uint32(tcp[8:]) != w.ack || be.Uint16(tcp[14:]) != w.window || tcp[12] != 8<<4 ||
+			be.Uint32(tcp[24:]) != w.tsVal || string(tcp[32:]) != w.payload {
+			t.Errorf("unexpected TCP segment %d: %x", i, tcp)
+		}
+		if packet.comment != "socket 2: "+w.direction {
+			t.Errorf("unexpected comment %q", packet.comment)
+		}
+	}
+
+	// The packet of the packet socket gets a cooked header
+	if packet := packets[5]; packet.linkType != pcapngLinkTypeLinuxSLL ||
+		be.Uint16(packet.data[14:]) != 0x0800 || string(packet.data[16:]) != "ping" {
+		t.Errorf("unexpected packet %+v", packet)
+	}
+}
@@ -0,0 +1,467 @@
+package crit
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/cpuinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	remap_file_path "github.com/checkpoint-restore/go-criu/v7/crit/images/remap-file-path"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/userns"
+)
+
+// Path of procfs on the current host
+var hostProcPath = "/proc"
+
+// Severity indicates how serious a problem found in a checkpoint is
+type Severity string
+
+const (
+	// SeverityError is used for problems that make a restore fail
+	SeverityError Severity = "error"
+	// SeverityWarning is used for problems that may affect a restore
+	SeverityWarning Severity = "warning"
+)
+
+// Problem represents a single problem found by a check
+type Problem struct {
+	Severity Severity `json:"severity"`
+	Check    string   `json:"check"`
+	Message  string   `json:"message"`
+}
+
+// PreflightReport contains the problems found by PreflightRestore
+type PreflightReport struct {
+	Problems []*Problem `json:"problems"`
+}
+
+// Blocking returns the problems which make a restore fail
+func (r *PreflightReport) Blocking() []*Problem {
+	var problems []*Problem
+	for _, problem := range r.Problems {
+		if problem.Severity == SeverityError {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func (r *PreflightReport) add(severity Severity, check, format string, a ...any) {
+	r.Problems = append(r.Problems, &Problem{
+		Severity: severity,
+		Check:    check,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// PreflightRestore verifies that the checkpoint in the given
+// directory can be restored on the current host. It checks the
+// regular files used by the processes, the ports of listening
+// sockets, the availability of PIDs, the CPU and the user
+// namespace ID mappings. An error is only returned if the
+// images cannot be read; problems that would make the restore
+// fail are reported with SeverityError.
+func PreflightRestore(dir string) (*PreflightReport, error) {
+	c := newCheckpoint(dir)
+	report := &PreflightReport{Problems: make([]*Problem, 0)}
+
+	checks := []func(*Checkpoint, *PreflightReport) error{
+		checkRegFiles,
+		checkPorts,
+		checkPIDs,
+		checkCPU,
+		checkUserns,
+	}
+	for _, check := range checks {
+		if err := check(c, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// Configuration of the bytes used for the checksum of a regular file
+const (
+	checksumFull = iota
+	checksumFirstN
+	checksumPeriod
+)
+
+// Helper to verify that the regular files exist on
+// the host and match the recorded size, mode and ID
+func checkRegFiles(c *Checkpoint, report *PreflightReport) error {
+	files, err := c.Files()
+	if err != nil {
+		return err
+	}
+
+	// Files that were deleted or unreachable on dump are
+	// restored from ghost files or links and not opened
+	remapped := make(map[uint32]bool)
+	remapImg, err := c.image("remap-fpath.img", &remap_file_path.RemapFilePathEntry{})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if remapImg != nil {
+		for _, entry := range remapImg.Entries {
+			remapped[entry.Message.(*remap_file_path.RemapFilePathEntry).GetOrigId()] = true
+		}
+	}
+
+	for _, id := range sortedFileIDs(files) {
+		file := files[id]
+		reg := file.GetReg()
+		if file.GetType() != fdinfo.FdTypes_REG || reg == nil || remapped[reg.GetId()] {
+			continue
+		}
+		name := reg.GetName()
+		if !filepath.IsAbs(name) {
+			continue
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Stat(name, &st); err != nil {
+			report.add(SeverityError, "reg-files", "%s: %v", name, err)
+			continue
+		}
+		if reg.Mode != nil && reg.GetMode() != st.Mode {
+			report.add(SeverityError, "reg-files", "%s: mode is %o, expected %o", name, st.Mode, reg.GetMode())
+			continue
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		if reg.Size != nil && reg.GetSize() != uint64(st.Size) {
+			report.add(SeverityError, "reg-files", "%s: size is %d, expected %d", name, st.Size, reg.GetSize())
+			continue
+		}
+		if len(reg.GetBuildId()) > 0 {
+			buildID, err := readBuildID(name)
+			if err != nil {
+				report.add(SeverityWarning, "reg-files", "%s: cannot read build-ID: %v", name, err)
+			} else if !equalBuildID(reg.GetBuildId(), buildID) {
+				report.add(SeverityError, "reg-files", "%s: build-ID does not match", name)
+			}
+			continue
+		}
+		if reg.Checksum != nil {
+			checksum, err := fileChecksum(name, reg.GetChecksumConfig(), reg.GetChecksumParameter())
+			if err != nil {
+				report.add(SeverityWarning, "reg-files", "%s: cannot compute checksum: %v", name, err)
+			} else if checksum != reg.GetChecksum() {
+				report.add(SeverityError, "reg-files", "%s: checksum does not match", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Helper to compare a build-ID stored in an image,
+// with one byte per element, with a build-ID
+func equalBuildID(stored []uint32, buildID []byte) bool {
+	if len(stored) != len(buildID) {
+		return false
+	}
+	for i := range stored {
+		if stored[i] != uint32(buildID[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// readBuildID returns the GNU build-ID of an ELF file
+func readBuildID(path string) ([]byte, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return elfBuildID(f)
+}
+
+// Helper to get the GNU build-ID of an opened ELF file
+func elfBuildID(f *elf.File) ([]byte, error) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		notes, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return nil, err
+		}
+		if buildID := findBuildIDNote(notes, f.ByteOrder); buildID != nil {
+			return buildID, nil
+		}
+	}
+
+	return nil, errors.New("no build-ID note found")
+}
+
+// Type of the ELF note containing the build-ID
+const ntGNUBuildID = 3
+
+// Helper to find the NT_GNU_BUILD_ID note in a note segment
+func findBuildIDNote(notes []byte, order binary.ByteOrder) []byte {
+	align := func(n uint32) uint32 { return (n + 3) &^ 3 }
+	for len(notes) >= 12 {
+		nameSize := order.Uint32(notes[0:4])
+		descSize := order.Uint32(notes[4:8])
+		noteType := order.Uint32(notes[8:12])
+		notes = notes[12:]
+		if uint64(align(nameSize))+uint64(align(descSize)) > uint64(len(notes)) {
+			return nil
+		}
+		name := notes[:nameSize]
+		desc := notes[align(nameSize) : align(nameSize)+descSize]
+		if noteType == ntGNUBuildID && string(bytes.TrimRight(name, "\x00")) == "GNU" {
+			return desc
+		}
+		notes = notes[align(nameSize)+align(descSize):]
+	}
+	return nil
+}
+
+// Helper to compute the CRC32C checksum of a file
+// with the configuration recorded by CRIU
+func fileChecksum(path string, config, parameter uint32) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	switch config {
+	case checksumFull:
+		_, err = io.Copy(hash, f)
+	case checksumFirstN:
+		_, err = io.Copy(hash, io.LimitReader(f, int64(parameter)))
+	case checksumPeriod:
+		if parameter == 0 {
+			return 0, errors.New("invalid checksum period")
+		}
+		b := make([]byte, 1)
+		for off := int64(0); ; off += int64(parameter) {
+			if _, err = f.ReadAt(b, off); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				break
+			}
+			hash.Write(b)
+		}
+	default:
+		return 0, fmt.Errorf("unknown checksum configuration %d", config)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return hash.Sum32(), nil
+}
+
+// Helper to verify that the ports of listening TCP sockets
+// and bound UDP sockets are free on the host. This is skipped
+// for checkpoints that contain their own network namespace.
+func checkPorts(c *Checkpoint, report *PreflightReport) error {
+	netnsImgs, err := fs.Glob(c.fsys, "netns-*.img")
+	if err != nil {
+		return err
+	}
+	if len(netnsImgs) > 0 {
+		return nil
+	}
+
+	files, err := c.Files()
+	if err != nil {
+		return err
+	}
+	for _, id := range sortedFileIDs(files) {
+		file := files[id]
+		isk := file.GetIsk()
+		if isk == nil || isk.GetSrcPort() == 0 {
+			continue
+		}
+		network := "tcp"
+		switch {
+		case isk.GetProto() == syscall.IPPROTO_TCP && tcpState(isk.GetState()) == tcpListen:
+		case isk.GetProto() == syscall.IPPROTO_UDP:
+			network = "udp"
+		default:
+			continue
+		}
+		if isk.GetFamily() == syscall.AF_INET6 {
+			network += "6"
+		} else {
+			network += "4"
+		}
+
+		address := net.JoinHostPort(processIP(isk.GetSrcAddr()), strconv.Itoa(int(isk.GetSrcPort())))
+		var l io.Closer
+		if strings.HasPrefix(network, "tcp") {
+			l, err = net.Listen(network, address)
+		} else {
+			l, err = net.ListenPacket(network, address)
+		}
+		if err != nil {
+			report.add(SeverityError, "ports", "%s %s is not available: %v", network, address, err)
+			continue
+		}
+		l.Close()
+	}
+
+	return nil
+}
+
+// Helper to verify that the PIDs of the process tree are
+// free on the host. This is skipped for checkpoints with
+// a PID namespace, where the root process has PID 1.
+func checkPIDs(c *Checkpoint, report *PreflightReport) error {
+	processes, err := c.Pstree()
+	if err != nil {
+		return err
+	}
+
+	for _, process := range processes {
+		if process.GetPpid() == 0 && process.GetPid() == 1 {
+			return nil
+		}
+	}
+
+	for _, process := range processes {
+		pIDs := append([]uint32{process.GetPid()}, process.GetThreads()...)
+		for _, pID := range pIDs {
+			_, err := os.Stat(filepath.Join(hostProcPath, strconv.FormatUint(uint64(pID), 10)))
+			if err == nil {
+				report.add(SeverityError, "pids", "PID %d is in use", pID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Helper to verify that the CPU recorded in the
+// checkpoint is compatible with the CPU of the host
+func checkCPU(c *Checkpoint, report *PreflightReport) error {
+	entry, err := c.entry("cpuinfo.img", &cpuinfo.CpuinfoEntry{})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	source := entry.(*cpuinfo.CpuinfoEntry)
+	target, err := HostCPUInfo()
+	if err != nil {
+		report.add(SeverityWarning, "cpu", "%v", err)
+		return nil
+	}
+	report.Problems = append(report.Problems, CompareCPUInfo(source, target).Problems...)
+
+	return nil
+}
+
+// Helper to verify that the user namespace ID mappings of
+// the checkpoint can be set up from the current process
+func checkUserns(c *Checkpoint, report *PreflightReport) error {
+	usernsImgs, err := fs.Glob(c.fsys, "userns-*.img")
+	if err != nil {
+		return err
+	}
+	if len(usernsImgs) == 0 {
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		report.add(SeverityWarning, "userns", "setting up ID mappings requires CAP_SETUID and CAP_SETGID")
+	}
+
+	for _, usernsImg := range usernsImgs {
+		img, err := c.image(usernsImg, &userns.UsernsEntry{})
+		if err != nil {
+			return err
+		}
+		for _, entry := range img.Entries {
+			usernsEntry := entry.Message.(*userns.UsernsEntry)
+			for _, m := range []struct {
+				name    string
+				extents []*userns.UidGidExtent
+			}{
+				{"uid_map", usernsEntry.GetUidMap()},
+				{"gid_map", usernsEntry.GetGidMap()},
+			} {
+				hostExtents, err := readIDMap(filepath.Join(hostProcPath, "self", m.name))
+				if err != nil {
+					return err
+				}
+				for _, extent := range m.extents {
+					if !containsIDs(hostExtents, extent.GetLowerFirst(), extent.GetCount()) {
+						report.add(SeverityError, "userns", "%s range %d-%d is not mapped on the host",
+							m.name, extent.GetLowerFirst(), uint64(extent.GetLowerFirst())+uint64(extent.GetCount())-1)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Helper to read the ID ranges mapped in the user namespace
+// of the current process from /proc/self/{uid,gid}_map
+func readIDMap(path string) ([][2]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var extents [][2]uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		first, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, [2]uint64{first, first + count})
+	}
+
+	return extents, scanner.Err()
+}
+
+// Helper to check if a range of IDs is
+// contained in one of the given extents
+func containsIDs(extents [][2]uint64, first, count uint32) bool {
+	start, end := uint64(first), uint64(first)+uint64(count)
+	for _, extent := range extents {
+		if start >= extent[0] && end <= extent[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package crit
+
+import (
+	"hash/crc32"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/regfile"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/userns"
+	"google.golang.org/protobuf/proto"
+)
+
+func testRegFile(id uint32, name string, size uint64, mode uint32) *fdinfo.FileEntry {
+	return &fdinfo.FileEntry{
+		Type: fdinfo.FdTypes_REG.Enum(),
+		Id:   proto.Uint32(id),
+		Reg: &regfile.RegFileEntry{
+			Id:    proto.Uint32(id),
+			Flags: proto.Uint32(0),
+			Pos:   proto.Uint64(0),
+			Fown:  testFown(),
+			Name:  proto.String(name),
+			Size:  proto.Uint64(size),
+			Mode:  proto.Uint32(mode),
+		},
+	}
+}
+
+func TestPreflightRestore(t *testing.T) {
+	procDir := t.TempDir()
+	defer func(path string) { hostProcPath = path }(hostProcPath)
+	hostProcPath = procDir
+	if err := os.MkdirAll(filepath.Join(procDir, "self"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// PID 4243 is in use on the host
+	if err := os.Mkdir(filepath.Join(procDir, "4243"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"uid_map", "gid_map"} {
+		idMap := []byte("         0          0       1000\n")
+		if err := os.WriteFile(filepath.Join(procDir, "self", name), idMap, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Regular file with the recorded size and mode
+	regFile := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(regFile, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// TCP port already in use
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+
+	dir := t.TempDir()
+	writeTestImg(t, dir, "pstree.img", "PSTREE",
+		&pstree.PstreeEntry{
+			Pid:     proto.Uint32(4242),
+			Ppid:    proto.Uint32(0),
+			Pgid:    proto.Uint32(4242),
+			Sid:     proto.Uint32(4242),
+			Threads: []uint32{4242, 4243},
+		},
+	)
+	writeTestImg(t, dir, "files.img", "FILES",
+		testRegFile(1, regFile, 5, syscall.S_IFREG|0o600),
+		testRegFile(2, regFile, 10, syscall.S_IFREG|0o600),
+		testRegFile(3, filepath.Join(dir, "missing"), 5, syscall.S_IFREG|0o600),
+		testInetSk(4, syscall.SOCK_STREAM, syscall.IPPROTO_TCP, tcpListen, port, 0),
+	)
+	writeTestImg(t, dir, "userns-11.img", "USERNS", &userns.UsernsEntry{
+		UidMap: []*userns.UidGidExtent{
+			{First: proto.Uint32(0), LowerFirst: proto.Uint32(100), Count: proto.Uint32(10)},
+		},
+		GidMap: []*userns.UidGidExtent{
+			{First: proto.Uint32(0), LowerFirst: proto.Uint32(100000), Count: proto.Uint32(65536)},
+		},
+	})
+
+	report, err := PreflightRestore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong size, missing file, port, PID and gid_map
+	blocking := report.Blocking()
+	if len(blocking) != 5 {
+		t.Fatalf("want 5 blocking problems, got %d", len(blocking))
+	}
+	for i, check := range []string{"reg-files", "reg-files", "ports", "pids", "userns"} {
+		if blocking[i].Check != check {
+			t.Errorf("want problem %d from check %s, got %+v", i, check, blocking[i])
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, []byte("123456789"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	tests := []struct {
+		config, parameter uint32
+		want              uint32
+	}{
+		// CRC32C check value of "123456789"
+		{checksumFull, 0, 0xe3069283},
+		{checksumFirstN, 9, 0xe3069283},
+		{checksumPeriod, 1, 0xe3069283},
+		{checksumFirstN, 4, crc32.Checksum([]byte("1234"), castagnoli)},
+		{checksumPeriod, 2, crc32.Checksum([]byte("13579"), castagnoli)},
+	}
+	for _, test := range tests {
+		got, err := fileChecksum(path, test.config, test.parameter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("want: %x, got: %x", test.want, got)
+		}
+	}
+}
+
+func TestCheckPortsIPv6(t *testing.T) {
+	// One port is in use on ::1 and the other one is free
+	used, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer used.Close()
+	free, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := uint32(free.Addr().(*net.TCPAddr).Port)
+	free.Close()
+
+	loopback := []uint32{0, 0, 0, 0x01000000}
+	sk := func(id, port uint32) *fdinfo.FileEntry {
+		file := testInetSk(id, syscall.SOCK_STREAM, syscall.IPPROTO_TCP, tcpListen, port, 0)
+		file.Isk.Family = proto.Uint32(syscall.AF_INET6)
+		file.Isk.SrcAddr = loopback
+		file.Isk.DstAddr = []uint32{0, 0, 0, 0}
+		return file
+	}
+	dir := t.TempDir()
+	writeTestImg(t, dir, "files.img", "FILES",
+		sk(1, uint32(used.Addr().(*net.TCPAddr).Port)),
+		sk(2, freePort),
+	)
+
+	report := &PreflightReport{}
+	if err := checkPorts(newCheckpoint(dir), report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0].Message, "[::1]") {
+		t.Errorf("unexpected problems %+v", report.Problems)
+	}
+}
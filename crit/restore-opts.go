@@ -0,0 +1,213 @@
+package crit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	file_lock "github.com/checkpoint-restore/go-criu/v7/crit/images/file-lock"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/inventory"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mnt"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/tty"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// Reason explains why a restore option is recommended.
+// Options which cannot be derived from the images alone,
+// such as external mount paths, are reported with a
+// reason but are not set in the recommended options.
+type Reason struct {
+	Option  string `json:"option"`
+	Message string `json:"message"`
+}
+
+// Network lock methods of inventory images
+var inventoryLockMethods = map[uint32]rpc.CriuNetworkLockMethod{
+	0: rpc.CriuNetworkLockMethod_IPTABLES,
+	1: rpc.CriuNetworkLockMethod_NFTABLES,
+	2: rpc.CriuNetworkLockMethod_SKIP,
+}
+
+// RecommendRestoreOpts scans the images in the checkpoint
+// directory and returns the restore options required by
+// its contents, each with the reason it is needed.
+func RecommendRestoreOpts(dir string) (*rpc.CriuOpts, []Reason, error) {
+	c := newCheckpoint(dir)
+	opts := &rpc.CriuOpts{}
+	reasons := make([]Reason, 0)
+	recommend := func(option, format string, a ...any) {
+		reasons = append(reasons, Reason{
+			Option:  option,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	inventoryImg, err := c.image("inventory.img", &inventory.InventoryEntry{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(inventoryImg.Entries) == 0 {
+		return nil, nil, errors.New("no entries in inventory image")
+	}
+	inv := inventoryImg.Entries[0].Message.(*inventory.InventoryEntry)
+	if inv.GetTcpClose() {
+		opts.TcpClose = proto.Bool(true)
+		recommend("tcp_close", "checkpoint was created with TCP connections closed")
+	}
+	if inv.NetworkLockMethod != nil {
+		// The inventory stores the 0-based method of CRIU,
+		// while the methods of RPC options start at 1
+		if lockMethod, ok := inventoryLockMethods[inv.GetNetworkLockMethod()]; ok {
+			opts.NetworkLock = lockMethod.Enum()
+			recommend("network_lock", "network was locked with %s on dump", lockMethod)
+		} else {
+			recommend("network_lock", "network was locked with unknown method %d on dump", inv.GetNetworkLockMethod())
+		}
+	}
+	if lsm := inv.GetLsmtype(); lsm != inventory.Lsmtype_NO_LSM {
+		recommend("lsm_profile", "checkpoint uses %s; a profile must be set if the host uses a different LSM", lsm)
+	}
+
+	// Session and process group leaders outside of
+	// the process tree require a shell job restore
+	processes, err := c.Pstree()
+	if err != nil {
+		return nil, nil, err
+	}
+	pIDs := make(map[uint32]bool)
+	for _, process := range processes {
+		pIDs[process.GetPid()] = true
+	}
+	for _, process := range processes {
+		if !pIDs[process.GetSid()] || !pIDs[process.GetPgid()] {
+			opts.ShellJob = proto.Bool(true)
+			recommend("shell_job", "session %d or process group %d of process %d is not part of the checkpoint",
+				process.GetSid(), process.GetPgid(), process.GetPid())
+			break
+		}
+	}
+
+	files, err := c.Files()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ttyInfo map[uint32]*tty.TtyInfoEntry
+	unixInodes := make(map[uint32]bool)
+	for _, file := range files {
+		if usk := file.GetUsk(); usk != nil {
+			unixInodes[usk.GetIno()] = true
+		}
+	}
+	for _, id := range sortedFileIDs(files) {
+		file := files[id]
+		switch file.GetType() {
+		case fdinfo.FdTypes_INETSK:
+			isk := file.GetIsk()
+			state := tcpState(isk.GetState())
+			if isk.GetProto() != syscall.IPPROTO_TCP || state == tcpListen || state == tcpClose {
+				continue
+			}
+			if !opts.GetTcpEstablished() {
+				opts.TcpEstablished = proto.Bool(true)
+				recommend("tcp_established", "TCP socket %s:%d -> %s:%d is in state %s",
+					processIP(isk.GetSrcAddr()), isk.GetSrcPort(),
+					processIP(isk.GetDstAddr()), isk.GetDstPort(), getSkState(state))
+			}
+		case fdinfo.FdTypes_UNIXSK:
+			usk := file.GetUsk()
+			if usk.GetUflags()&uskService != 0 {
+				continue
+			}
+			external := usk.GetUflags()&uskExtern != 0 ||
+				(usk.GetPeer() != 0 && !unixInodes[usk.GetPeer()])
+			if external && !opts.GetExtUnixSk() {
+				opts.ExtUnixSk = proto.Bool(true)
+				recommend("ext_unix_sk", "UNIX socket %d is connected to peer %d outside of the checkpoint",
+					usk.GetIno(), usk.GetPeer())
+			}
+		case fdinfo.FdTypes_TTY:
+			// A controlling terminal of a session outside of
+			// the process tree requires a shell job restore
+			if opts.GetShellJob() {
+				continue
+			}
+			if ttyInfo == nil {
+				if ttyInfo, err = c.ttyInfo(); err != nil {
+					return nil, nil, err
+				}
+			}
+			info := ttyInfo[file.GetTty().GetTtyInfoId()]
+			if sid := info.GetSid(); sid != 0 && !pIDs[sid] {
+				opts.ShellJob = proto.Bool(true)
+				recommend("shell_job", "%s is the controlling tty of session %d outside of the checkpoint",
+					ttyName(info), sid)
+			}
+		}
+	}
+
+	fileLocksImg, err := c.image("filelocks.img", &file_lock.FileLockEntry{})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if fileLocksImg != nil && len(fileLocksImg.Entries) > 0 {
+		opts.FileLocks = proto.Bool(true)
+		recommend("file_locks", "checkpoint contains %d file locks", len(fileLocksImg.Entries))
+	}
+
+	mounts, err := c.externalMounts()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mount := range mounts {
+		recommend("external", "external mount %s (%s) must be mapped to a host path", mount.Key, mount.Mountpoint)
+	}
+
+	// Mounts which are slaves of a peer group that
+	// was not dumped require external masters
+	mntImgs, err := fs.Glob(c.fsys, "mountpoints-*.img")
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedIDs := make(map[uint32]bool)
+	var mntEntries []*mnt.MntEntry
+	for _, mntImg := range mntImgs {
+		img, err := c.image(mntImg, &mnt.MntEntry{})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range img.Entries {
+			mntEntry := entry.Message.(*mnt.MntEntry)
+			sharedIDs[mntEntry.GetSharedId()] = true
+			mntEntries = append(mntEntries, mntEntry)
+		}
+	}
+	for _, mntEntry := range mntEntries {
+		if masterID := mntEntry.GetMasterId(); masterID != 0 && !sharedIDs[masterID] {
+			opts.ExtMasters = proto.Bool(true)
+			recommend("ext_masters", "mount %s is a slave of peer group %d outside of the checkpoint",
+				mntEntry.GetMountpoint(), masterID)
+			break
+		}
+	}
+
+	return opts, reasons, nil
+}
+
+// ttyName returns a name of a tty for messages, which is
+// the device path for pseudo terminals and consoles
+func ttyName(info *tty.TtyInfoEntry) string {
+	rdev := uint64(info.GetRdev())
+	switch info.GetType() {
+	case tty.TtyType_PTY:
+		return fmt.Sprintf("/dev/pts/%d", info.GetPty().GetIndex())
+	case tty.TtyType_CONSOLE:
+		return "/dev/console"
+	case tty.TtyType_VT:
+		return fmt.Sprintf("/dev/tty%d", unix.Minor(rdev))
+	}
+	return fmt.Sprintf("%s tty %d:%d", info.GetType(), unix.Major(rdev), unix.Minor(rdev))
+}
@@ -0,0 +1,189 @@
+package crit
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	file_lock "github.com/checkpoint-restore/go-criu/v7/crit/images/file-lock"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/inventory"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pstree"
+	sk_inet "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-inet"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/tty"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func testInetSk(id uint32, sockType, protocol uint32, state tcpState, srcPort, dstPort uint32) *fdinfo.FileEntry {
+	return &fdinfo.FileEntry{
+		Type: fdinfo.FdTypes_INETSK.Enum(),
+		Id:   proto.Uint32(id),
+		Isk: &sk_inet.InetSkEntry{
+			Id:      proto.Uint32(id),
+			Ino:     proto.Uint32(id),
+			Family:  proto.Uint32(syscall.AF_INET),
+			Type:    proto.Uint32(sockType),
+			Proto:   proto.Uint32(protocol),
+			State:   proto.Uint32(uint32(state)),
+			SrcPort: proto.Uint32(srcPort),
+			DstPort: proto.Uint32(dstPort),
+			Flags:   proto.Uint32(0),
+			Backlog: proto.Uint32(0),
+			SrcAddr: []uint32{16777343},
+			DstAddr: []uint32{16777343},
+			Fown:    testFown(),
+			Opts:    testSkOpts(),
+		},
+	}
+}
+
+func TestRecommendRestoreOpts(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImg(t, dir, "inventory.img", "INVENTORY", &inventory.InventoryEntry{
+		ImgVersion: proto.Uint32(2),
+		Lsmtype:    inventory.Lsmtype_APPARMOR.Enum(),
+		// Locked with nftables, which is 1 in the inventory
+		NetworkLockMethod: proto.Uint32(1),
+	})
+	// The leader of the process group is outside the checkpoint
+	writeTestImg(t, dir, "pstree.img", "PSTREE",
+		&pstree.PstreeEntry{
+			Pid:  proto.Uint32(1),
+			Ppid: proto.Uint32(0),
+			Pgid: proto.Uint32(100),
+			Sid:  proto.Uint32(1),
+		},
+	)
+	writeTestImg(t, dir, "files.img", "FILES",
+		testInetSk(1, syscall.SOCK_STREAM, syscall.IPPROTO_TCP, tcpListen, 80, 0),
+		testInetSk(2, syscall.SOCK_STREAM, syscall.IPPROTO_TCP, tcpEstablished, 80, 40000),
+		testUnixSk(3, 300, 400, 0),
+	)
+	writeTestImg(t, dir, "filelocks.img", "FILE_LOCKS", &file_lock.FileLockEntry{
+		Flag:  proto.Uint32(1),
+		Type:  proto.Uint32(1),
+		Pid:   proto.Int32(1),
+		Fd:    proto.Int32(3),
+		Start: proto.Int64(0),
+		Len:   proto.Int64(0),
+	})
+	writeTestImg(t, dir, "mountpoints-12.img", "MNTS",
+		testMount(1, "/", "/", false, ""),
+		testMount(2, "/data", "/srv/data", true, "data"),
+	)
+
+	opts, reasons, err := RecommendRestoreOpts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.GetTcpEstablished() {
+		t.Error("want tcp_established to be set")
+	}
+	if !opts.GetExtUnixSk() {
+		t.Error("want ext_unix_sk to be set")
+	}
+	if !opts.GetShellJob() {
+		t.Error("want shell_job to be set")
+	}
+	if !opts.GetFileLocks() {
+		t.Error("want file_locks to be set")
+	}
+	if opts.GetTcpClose() || opts.GetExtMasters() {
+		t.Error("unexpected options set")
+	}
+	if opts.GetNetworkLock() != rpc.CriuNetworkLockMethod_NFTABLES {
+		t.Errorf("want network_lock NFTABLES, got %s", opts.GetNetworkLock())
+	}
+
+	options := make(map[string]bool)
+	for _, reason := range reasons {
+		options[reason.Option] = true
+	}
+	for _, option := range []string{
+		"tcp_established", "ext_unix_sk", "shell_job", "file_locks",
+		"network_lock", "lsm_profile", "external",
+	} {
+		if !options[option] {
+			t.Errorf("want reason for %s", option)
+		}
+	}
+	if len(reasons) != 7 {
+		t.Errorf("want 7 reasons, got %d: %v", len(reasons), reasons)
+	}
+}
+
+func TestRecommendRestoreOptsTty(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImg(t, dir, "inventory.img", "INVENTORY", &inventory.InventoryEntry{
+		ImgVersion: proto.Uint32(2),
+		Lsmtype:    inventory.Lsmtype_NO_LSM.Enum(),
+	})
+	// The process leads its own session, but has the
+	// controlling tty of another session opened
+	writeTestImg(t, dir, "pstree.img", "PSTREE",
+		&pstree.PstreeEntry{
+			Pid:  proto.Uint32(1),
+			Ppid: proto.Uint32(0),
+			Pgid: proto.Uint32(1),
+			Sid:  proto.Uint32(1),
+		},
+	)
+	writeTestImg(t, dir, "files.img", "FILES", &fdinfo.FileEntry{
+		Type: fdinfo.FdTypes_TTY.Enum(),
+		Id:   proto.Uint32(1),
+		Tty: &tty.TtyFileEntry{
+			Id:        proto.Uint32(1),
+			TtyInfoId: proto.Uint32(2),
+			Flags:     proto.Uint32(0),
+			Fown:      testFown(),
+		},
+	})
+	writeTestImg(t, dir, "tty-info.img", "TTY_INFO", &tty.TtyInfoEntry{
+		Id:         proto.Uint32(2),
+		Type:       tty.TtyType_PTY.Enum(),
+		Locked:     proto.Bool(false),
+		Exclusive:  proto.Bool(false),
+		PacketMode: proto.Bool(false),
+		Sid:        proto.Uint32(100),
+		Pgrp:       proto.Uint32(100),
+		Rdev:       proto.Uint32(0x8803),
+		Pty:        &tty.TtyPtyEntry{Index: proto.Uint32(3)},
+	})
+
+	opts, reasons, err := RecommendRestoreOpts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.GetShellJob() {
+		t.Error("want shell_job to be set")
+	}
+	want := "/dev/pts/3 is the controlling tty of session 100 outside of the checkpoint"
+	if len(reasons) != 1 || reasons[0].Option != "shell_job" || reasons[0].Message != want {
+		t.Errorf("unexpected reasons %v", reasons)
+	}
+}
+
+func TestRecommendRestoreOptsNetworkLock(t *testing.T) {
+	for method, want := range map[uint32]rpc.CriuNetworkLockMethod{
+		0: rpc.CriuNetworkLockMethod_IPTABLES,
+		2: rpc.CriuNetworkLockMethod_SKIP,
+	} {
+		dir := t.TempDir()
+		writeTestImg(t, dir, "inventory.img", "INVENTORY", &inventory.InventoryEntry{
+			ImgVersion:        proto.Uint32(2),
+			Lsmtype:           inventory.Lsmtype_NO_LSM.Enum(),
+			NetworkLockMethod: proto.Uint32(method),
+		})
+		writeTestPsTree(t, dir, 1)
+		writeTestImg(t, dir, "files.img", "FILES")
+
+		opts, _, err := RecommendRestoreOpts(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.NetworkLock == nil || opts.GetNetworkLock() != want {
+			t.Errorf("want network_lock %s for method %d, got %v", want, method, opts.NetworkLock)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package crit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/vma"
+)
+
+// Status bits of VMAs, in addition to those of shared memory objects
+const (
+	vmaStack       = 1 << 1
+	vmaVsyscall    = 1 << 2
+	vmaVdso        = 1 << 3
+	vmaHeap        = 1 << 5
+	vmaFilePrivate = 1 << 6
+	vmaFileShared  = 1 << 7
+	vmaSocket      = 1 << 11
+	vmaVvar        = 1 << 12
+)
+
+const (
+	// Default number of bytes read at a time while searching
+	defaultChunkSize = 10 * 1024 * 1024
+	// Default maximum length of a regular expression match
+	defaultMaxMatchLen = 4096
+	// Default minimum length of strings
+	defaultMinStringLen = 4
+)
+
+// MemoryPattern is a pattern searched for in the memory of
+// a process. It is created with BytePattern() or RegexpPattern().
+type MemoryPattern interface {
+	// findAll returns the indexes of all non-overlapping matches
+	findAll(buf []byte) [][]int
+	// maxLen returns the maximum length of a match
+	maxLen() int
+}
+
+type bytePattern []byte
+
+// BytePattern creates a pattern which matches the given bytes
+func BytePattern(pattern []byte) MemoryPattern {
+	return bytePattern(pattern)
+}
+
+func (p bytePattern) findAll(buf []byte) [][]int {
+	var indexes [][]int
+	for offset := 0; offset+len(p) <= len(buf); {
+		i := bytes.Index(buf[offset:], p)
+		if i < 0 {
+			break
+		}
+		indexes = append(indexes, []int{offset + i, offset + i + len(p)})
+		offset += i + len(p)
+	}
+	return indexes
+}
+
+func (p bytePattern) maxLen() int {
+	return len(p)
+}
+
+type regexpPattern struct {
+	re  *regexp.Regexp
+	max int
+}
+
+// RegexpPattern creates a pattern which matches the regular
+// expression on the raw bytes of memory. Bytes which are not
+// part of valid UTF-8 sequences only match classes such as . or
+// [^a]; use BytePattern() to search for arbitrary bytes. Matches
+// are found across chunk boundaries as long as they are not
+// longer than maxLen bytes, where 0 selects a limit of 4 KiB.
+func RegexpPattern(re *regexp.Regexp, maxLen int) MemoryPattern {
+	if maxLen <= 0 {
+		maxLen = defaultMaxMatchLen
+	}
+	return &regexpPattern{re: re, max: maxLen}
+}
+
+func (p *regexpPattern) findAll(buf []byte) [][]int {
+	return p.re.FindAllIndex(buf, -1)
+}
+
+func (p *regexpPattern) maxLen() int {
+	return p.max
+}
+
+// SearchOptions configures a memory search
+type SearchOptions struct {
+	// Number of bytes before and after each match
+	// which are returned with the match
+	Context int
+	// Number of bytes read at a time, 10 MiB by default
+	ChunkSize int
+}
+
+// MemoryMapping describes the memory mapping of a process which
+// contains a match, with the file or object backing the memory
+type MemoryMapping struct {
+	Start      uint64 `json:"start"`
+	End        uint64 `json:"end"`
+	Protection string `json:"protection"`
+	Resource   string `json:"resource,omitempty"`
+}
+
+// MemoryMatch is a match of a pattern in the memory of a process
+type MemoryMatch struct {
+	PID     uint32         `json:"pid"`
+	Vaddr   uint64         `json:"vaddr"`
+	Match   []byte         `json:"match"`
+	Before  []byte         `json:"before,omitempty"`
+	After   []byte         `json:"after,omitempty"`
+	Mapping *MemoryMapping `json:"mapping,omitempty"`
+}
+
+// StringEncoding is the encoding of strings extracted from memory
+type StringEncoding string
+
+const (
+	// Printable 7-bit ASCII characters and tabs
+	StringsASCII StringEncoding = "ascii"
+	// ASCII characters encoded as 16-bit little-endian
+	StringsUTF16LE StringEncoding = "utf16le"
+	// ASCII characters encoded as 16-bit big-endian
+	StringsUTF16BE StringEncoding = "utf16be"
+)
+
+// StringsOptions configures the extraction of strings
+type StringsOptions struct {
+	// Minimum number of characters, 4 by default
+	MinLength int
+	// Encoding of the characters, ASCII by default.
+	// 16-bit characters are read at even addresses.
+	Encoding StringEncoding
+	// Number of bytes read at a time, 10 MiB by default
+	ChunkSize int
+}
+
+// MemoryString is a string found in the memory of a process
+type MemoryString struct {
+	PID   uint32 `json:"pid"`
+	Vaddr uint64 `json:"vaddr"`
+	// Number of bytes of the string in memory
+	Length  int            `json:"length"`
+	Value   string         `json:"value"`
+	Mapping *MemoryMapping `json:"mapping,omitempty"`
+}
+
+// Search searches for a pattern in the memory of the process,
+// including pages stored in parent checkpoints and mappings of
+// shared memory objects. Pages which are transferred lazily are
+// skipped. Matches do not overlap, and are found across the
+// boundaries of chunks and pagemap entries.
+func (mr *MemoryReader) Search(pattern MemoryPattern, opts SearchOptions) ([]MemoryMatch, error) {
+	if opts.Context < 0 {
+		return nil, errors.New("context size cannot be negative")
+	}
+	if pattern.maxLen() == 0 {
+		return nil, errors.New("pattern cannot be empty")
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	// Each chunk is read together with the bytes needed
+	// to complete a match starting at its end
+	overlap := uint64(pattern.maxLen() - 1)
+
+	regions, err := mr.regions()
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := mr.mappings()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []MemoryMatch
+	for _, region := range regions {
+		for pos := region.Start; pos < region.End; {
+			size := uint64(chunkSize) + overlap
+			if region.End-pos < size {
+				size = region.End - pos
+			}
+			final := pos+size == region.End
+			buf := make([]byte, size)
+			if _, err := mr.read(buf, pos, false); err != nil {
+				return nil, err
+			}
+
+			// Matches starting after the chunk are
+			// found with the following chunk
+			limit, next := size, pos+size
+			if !final {
+				limit, next = uint64(chunkSize), pos+uint64(chunkSize)
+			}
+			for _, index := range pattern.findAll(buf) {
+				start, end := uint64(index[0]), uint64(index[1])
+				if start >= limit {
+					break
+				}
+				if start == end {
+					continue
+				}
+				match := MemoryMatch{
+					PID:     mr.pid,
+					Vaddr:   pos + start,
+					Match:   bytes.Clone(buf[start:end]),
+					Mapping: findMapping(mappings, pos+start),
+				}
+				if opts.Context > 0 {
+					if match.Before, match.After, err = mr.context(buf, pos, region, match, opts.Context); err != nil {
+						return nil, err
+					}
+				}
+				matches = append(matches, match)
+				// The following chunk continues after the match
+				if pos+end > next {
+					next = pos + end
+				}
+			}
+			if final {
+				break
+			}
+			pos = next
+		}
+	}
+	return matches, nil
+}
+
+// Helper to get the bytes before and after a match, which are
+// read again if they are not part of the current chunk
+func (mr *MemoryReader) context(buf []byte, pos uint64, region MemoryRange, match MemoryMatch, size int) ([]byte, []byte, error) {
+	start, end := match.Vaddr, match.Vaddr+uint64(len(match.Match))
+	before := region.Start
+	if start-region.Start > uint64(size) {
+		before = start - uint64(size)
+	}
+	after := region.End
+	if region.End-end > uint64(size) {
+		after = end + uint64(size)
+	}
+
+	slice := func(from, to uint64) ([]byte, error) {
+		if from >= pos && to <= pos+uint64(len(buf)) {
+			return bytes.Clone(buf[from-pos : to-pos]), nil
+		}
+		b := make([]byte, to-from)
+		_, err := mr.read(b, from, false)
+		return b, err
+	}
+	b, err := slice(before, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := slice(end, after)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, a, nil
+}
+
+// Strings extracts the strings of printable characters from the
+// memory of the process, like strings(1). The same memory as
+// with Search() is read, and strings continue across the
+// boundaries of chunks and pagemap entries.
+func (mr *MemoryReader) Strings(opts StringsOptions) ([]MemoryString, error) {
+	minLength := opts.MinLength
+	if minLength <= 0 {
+		minLength = defaultMinStringLen
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	var decode func(b []byte) (byte, bool)
+	charSize := 1
+	switch opts.Encoding {
+	case "", StringsASCII:
+		decode = func(b []byte) (byte, bool) { return b[0], isPrintable(b[0]) }
+	case StringsUTF16LE:
+		charSize = 2
+		decode = func(b []byte) (byte, bool) { return b[0], b[1] == 0 && isPrintable(b[0]) }
+	case StringsUTF16BE:
+		charSize = 2
+		decode = func(b []byte) (byte, bool) { return b[1], b[0] == 0 && isPrintable(b[1]) }
+	default:
+		return nil, fmt.Errorf("unknown string encoding %q", opts.Encoding)
+	}
+	// Chunks are read in whole characters
+	chunkSize -= chunkSize % charSize
+	if chunkSize == 0 {
+		chunkSize = charSize
+	}
+
+	regions, err := mr.regions()
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := mr.mappings()
+	if err != nil {
+		return nil, err
+	}
+
+	var strs []MemoryString
+	for _, region := range regions {
+		var (
+			value []byte
+			start uint64
+		)
+		flush := func() {
+			if len(value) >= minLength {
+				strs = append(strs, MemoryString{
+					PID:     mr.pid,
+					Vaddr:   start,
+					Length:  len(value) * charSize,
+					Value:   string(value),
+					Mapping: findMapping(mappings, start),
+				})
+			}
+			value = nil
+		}
+
+		for pos := region.Start; pos < region.End; pos += uint64(chunkSize) {
+			size := uint64(chunkSize)
+			if region.End-pos < size {
+				size = region.End - pos
+			}
+			buf := make([]byte, size)
+			if _, err := mr.read(buf, pos, false); err != nil {
+				return nil, err
+			}
+
+			for i := 0; i+charSize <= len(buf); i += charSize {
+				c, ok := decode(buf[i : i+charSize])
+				if !ok {
+					flush()
+					continue
+				}
+				if value == nil {
+					start = pos + uint64(i)
+				}
+				value = append(value, c)
+			}
+		}
+		flush()
+	}
+	return strs, nil
+}
+
+// Helper to check whether a character is printable like in strings(1)
+func isPrintable(c byte) bool {
+	return c == '\t' || (c >= 0x20 && c < 0x7f)
+}
+
+// Helper to get the contiguous ranges of memory which are
+// stored in the checkpoint. Lazy pages are skipped.
+func (mr *MemoryReader) regions() ([]MemoryRange, error) {
+	ranges, err := mr.Ranges()
+	if err != nil {
+		return nil, err
+	}
+
+	var regions []MemoryRange
+	for _, r := range ranges {
+		if r.Lazy {
+			continue
+		}
+		if n := len(regions); n > 0 && regions[n-1].End == r.Start {
+			regions[n-1].End = r.End
+			continue
+		}
+		regions = append(regions, MemoryRange{Start: r.Start, End: r.End})
+	}
+	return regions, nil
+}
+
+// Helper to get the memory mappings of the process, sorted by
+// address. Readers of shared memory objects have no mappings.
+func (mr *MemoryReader) mappings() ([]*MemoryMapping, error) {
+	if mr.shmem {
+		return nil, nil
+	}
+	mm, err := mr.checkpoint.MM(mr.pid)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	mappings := make([]*MemoryMapping, 0, len(mm.GetVmas()))
+	for _, vma := range mm.GetVmas() {
+		resource, err := mr.checkpoint.vmaResource(vma)
+		if err != nil {
+			return nil, err
+		}
+		if resource == "" && vma.GetStart() < mm.GetMmBrk() && vma.GetEnd() > mm.GetMmStartBrk() {
+			resource = "[heap]"
+		}
+		mappings = append(mappings, &MemoryMapping{
+			Start:      vma.GetStart(),
+			End:        vma.GetEnd(),
+			Protection: vmaProtection(vma.GetProt()),
+			Resource:   resource,
+		})
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Start < mappings[j].Start
+	})
+	return mappings, nil
+}
+
+// Helper to find the memory mapping containing addr
+func findMapping(mappings []*MemoryMapping, addr uint64) *MemoryMapping {
+	i := sort.Search(len(mappings), func(i int) bool { return mappings[i].End > addr })
+	if i < len(mappings) && mappings[i].Start <= addr {
+		return mappings[i]
+	}
+	return nil
+}
+
+// Helper to describe the file or object backing a memory mapping.
+// It is empty for anonymous memory.
+func (c *Checkpoint) vmaResource(vma *vma.VmaEntry) (string, error) {
+	status := vma.GetStatus()
+	switch {
+	case status&vmaMemfd != 0:
+		inode, err := c.memfdInode(uint32(vma.GetShmid()))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("memfd:%s + 0x%x", inode.GetName(), vma.GetPgoff()), nil
+	case status&(vmaFilePrivate|vmaFileShared) != 0:
+		file, err := c.filePath(uint32(vma.GetShmid()), fdinfo.FdTypes_REG)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s + 0x%x", file, vma.GetPgoff()), nil
+	case status&vmaVdso != 0:
+		return "[vdso]", nil
+	case status&vmaVvar != 0:
+		return "[vvar]", nil
+	case status&vmaVsyscall != 0:
+		return "[vsyscall]", nil
+	case status&vmaStack != 0:
+		return "[stack]", nil
+	case status&vmaHeap != 0:
+		return "[heap]", nil
+	case status&vmaSocket != 0:
+		return fmt.Sprintf("packet[0x%x]", vma.GetShmid()), nil
+	case status&vmaSysVIPC != 0:
+		return fmt.Sprintf("sysv-shm[%d]", vma.GetShmid()), nil
+	case status&vmaAnonShared != 0:
+		return fmt.Sprintf("shmem[0x%x]", vma.GetShmid()), nil
+	}
+	return "", nil
+}
+
+// Helper to format the protection of a memory mapping
+func vmaProtection(prot uint32) string {
+	r, w, x := "-", "-", "-"
+	if prot&1 != 0 {
+		r = "r"
+	}
+	if prot&2 != 0 {
+		w = "w"
+	}
+	if prot&4 != 0 {
+		x = "x"
+	}
+	return fmt.Sprint(r, w, x)
+}
+
+// SearchMemory searches for a pattern in the memory of all
+// processes of the checkpoint concurrently, as MemoryReader.Search()
+// does. Matches are sorted by the order of the process tree and
+// by address. Processes without memory, such as zombies, are skipped.
+func (c *Checkpoint) SearchMemory(pattern MemoryPattern, pageSize int, opts SearchOptions) ([]MemoryMatch, error) {
+	return searchProcesses(c, pageSize, func(mr *MemoryReader) ([]MemoryMatch, error) {
+		return mr.Search(pattern, opts)
+	})
+}
+
+// MemoryStrings extracts the strings from the memory of all
+// processes of the checkpoint concurrently, as MemoryReader.Strings()
+// does. Strings are sorted by the order of the process tree and
+// by address.
+func (c *Checkpoint) MemoryStrings(pageSize int, opts StringsOptions) ([]MemoryString, error) {
+	return searchProcesses(c, pageSize, func(mr *MemoryReader) ([]MemoryString, error) {
+		return mr.Strings(opts)
+	})
+}
+
+// Helper to run a search on the memory of all processes,
+// with at most one search per CPU at a time
+func searchProcesses[T any](c *Checkpoint, pageSize int, search func(*MemoryReader) ([]T, error)) ([]T, error) {
+	psTree, err := c.Pstree()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]T, len(psTree))
+	errs := make([]error, len(psTree))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i, process := range psTree {
+		wg.Add(1)
+		go func(i int, pID uint32) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			mr, err := c.MemoryReader(pID, pageSize)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					errs[i] = fmt.Errorf("process %d: %w", pID, err)
+				}
+				return
+			}
+			defer mr.Close()
+			if results[i], err = search(mr); err != nil {
+				errs[i] = fmt.Errorf("process %d: %w", pID, err)
+			}
+		}(i, process.GetPid())
+	}
+	wg.Wait()
+
+	var all []T
+	for i := range psTree {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		all = append(all, results[i]...)
+	}
+	return all, nil
+}
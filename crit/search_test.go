@@ -0,0 +1,99 @@
+package crit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSearch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPsTree(t, dir, 1, 2)
+	writeTestImg(t, dir, "mm-1.img", "MM", testMm(0x1000, 0x2000, 0x3000))
+
+	// Two pagemap entries of three pages in total, with
+	// matches across the boundaries of pages and entries
+	pattern := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02}
+	pages := make([]byte, 0x3000)
+	copy(pages[0x0100:], "hello world")
+	copy(pages[0x0ffa:], "SECRET=12345")
+	copy(pages[0x1ffd:], pattern)
+	copy(pages[0x2100:], []byte{'W', 0, 'I', 0, 'D', 0, 'E', 0})
+	writeTestPages(t, dir, nil,
+		testPagemapEntry(0x1000, 2, pagemapPresent),
+		testPagemapEntry(0x3000, 1, pagemapPresent),
+	)
+	if err := os.WriteFile(filepath.Join(dir, "pages-1.img"), pages, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second process has a match at the start of its memory
+	writeTestImg(t, dir, "pagemap-2.img", "PAGEMAP",
+		&pagemap.PagemapHead{PagesId: proto.Uint32(2)},
+		testPagemapEntry(0x8000, 1, pagemapPresent),
+	)
+	pages = make([]byte, 0x1000)
+	copy(pages, pattern)
+	if err := os.WriteFile(filepath.Join(dir, "pages-2.img"), pages, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCheckpoint(dir)
+	mr, err := c.MemoryReader(1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	opts := SearchOptions{Context: 2, ChunkSize: 0x1000}
+
+	matches, err := mr.Search(BytePattern(pattern), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Vaddr != 0x2ffd || !bytes.Equal(matches[0].Match, pattern) ||
+		!bytes.Equal(matches[0].Before, []byte{0, 0}) || !bytes.Equal(matches[0].After, []byte{0, 0}) {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+	if mapping := matches[0].Mapping; mapping == nil || mapping.Start != 0x2000 || mapping.Protection != "r--" {
+		t.Errorf("unexpected mapping %+v", mapping)
+	}
+
+	matches, err = mr.Search(RegexpPattern(regexp.MustCompile(`SECRET=[0-9]+`), 64), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Vaddr != 0x1ffa || string(matches[0].Match) != "SECRET=12345" {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+
+	matches, err = c.SearchMemory(BytePattern(pattern), 0x1000, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].PID != 1 || matches[1].PID != 2 ||
+		matches[1].Vaddr != 0x8000 || len(matches[1].Before) != 0 || matches[1].Mapping != nil {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+
+	strs, err := mr.Strings(StringsOptions{ChunkSize: 0x1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strs) != 2 || strs[0].Value != "hello world" || strs[0].Vaddr != 0x1100 ||
+		strs[1].Value != "SECRET=12345" || strs[1].Vaddr != 0x1ffa {
+		t.Fatalf("unexpected strings %+v", strs)
+	}
+
+	strs, err = c.MemoryStrings(0x1000, StringsOptions{MinLength: 3, Encoding: StringsUTF16LE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strs) != 1 || strs[0].Value != "WIDE" || strs[0].Vaddr != 0x3100 || strs[0].Length != 8 {
+		t.Fatalf("unexpected strings %+v", strs)
+	}
+}
@@ -0,0 +1,227 @@
+package crit
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	ipc_shm "github.com/checkpoint-restore/go-criu/v7/crit/images/ipc-shm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/memfd"
+)
+
+// Status bits of VMAs which map shared memory objects
+const (
+	vmaAnonShared = 1 << 8
+	vmaSysVIPC    = 1 << 10
+	vmaMemfd      = 1 << 14
+)
+
+// sharedMem is the content of a shared memory object. CRIU
+// stores shared anonymous memory, memfd files and most SysV
+// segments in a pagemap-shmem image, while older versions
+// store SysV segments in the payload of the ipcns-shm image.
+type sharedMem struct {
+	reader *MemoryReader
+	data   []byte
+}
+
+// Helper to read the shared memory object at offset off.
+// Pages which have not been dumped are filled with zeros.
+func (m *sharedMem) readAt(p []byte, off uint64) error {
+	if m.reader != nil {
+		_, err := m.reader.read(p, off, true)
+		return err
+	}
+
+	n := 0
+	if off < uint64(len(m.data)) {
+		n = copy(p, m.data[off:])
+	}
+	for i := range p[n:] {
+		p[n+i] = 0
+	}
+	return nil
+}
+
+// ShmemReader creates a MemoryReader for the shared memory object
+// with the given ID, which is stored in a pagemap-shmem image.
+// Its addresses are offsets in the shared memory object.
+func (c *Checkpoint) ShmemReader(shmid uint64, pageSize int) (*MemoryReader, error) {
+	pageSize, err := checkPageSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pagemapHead, pagemapEntries, err := c.ShmemPagemap(shmid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryReader{
+		checkpoint:     c,
+		pageSize:       pageSize,
+		pagesID:        pagemapHead.GetPagesId(),
+		pagemapEntries: pagemapEntries,
+		shmem:          true,
+		shmid:          shmid,
+	}, nil
+}
+
+// Helper to get the ranges of the mappings of shared memory
+// objects of the process. Checkpoints without the memory
+// mappings of the process have no shared ranges. The pages
+// of private memfd mappings which were written are in the
+// pagemap, so only the holes between the sorted ranges of
+// the pagemap are read from the memfd file.
+func (mr *MemoryReader) sharedRanges(pagemapRanges []memRange) ([]memRange, error) {
+	mm, err := mr.checkpoint.MM(mr.pid)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ranges []memRange
+	// Objects mapped more than once are only read once
+	objects := make(map[string]*sharedMem)
+	for _, vma := range mm.GetVmas() {
+		var key string
+		status := vma.GetStatus()
+		switch {
+		case status&vmaSysVIPC != 0:
+			key = fmt.Sprintf("sysv-%d", vma.GetShmid())
+		case status&vmaMemfd != 0:
+			key = fmt.Sprintf("memfd-%d", vma.GetShmid())
+		case status&vmaAnonShared != 0:
+			key = fmt.Sprintf("shmem-%d", vma.GetShmid())
+		default:
+			continue
+		}
+
+		shared, ok := objects[key]
+		if !ok {
+			switch {
+			case status&vmaSysVIPC != 0:
+				shared, err = mr.sysvShm(vma.GetShmid())
+			case status&vmaMemfd != 0:
+				shared, err = mr.memfdShm(uint32(vma.GetShmid()))
+			default:
+				shared, err = mr.anonShm(vma.GetShmid())
+			}
+			if err != nil {
+				return nil, fmt.Errorf("shared mapping at 0x%x: %w", vma.GetStart(), err)
+			}
+			objects[key] = shared
+		}
+
+		r := memRange{
+			start:  vma.GetStart(),
+			end:    vma.GetEnd(),
+			offset: vma.GetPgoff(),
+			shared: shared,
+		}
+		if status&vmaMemfd != 0 && status&vmaFileShared == 0 {
+			ranges = append(ranges, rangeHoles(r, pagemapRanges)...)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Helper to split the range of a mapping into the
+// parts which are not covered by the sorted ranges
+func rangeHoles(r memRange, sorted []memRange) []memRange {
+	var holes []memRange
+	i := sort.Search(len(sorted), func(i int) bool { return sorted[i].end > r.start })
+	for ; i < len(sorted) && sorted[i].start < r.end; i++ {
+		if sorted[i].start > r.start {
+			hole := r
+			hole.end = sorted[i].start
+			holes = append(holes, hole)
+		}
+		if sorted[i].end >= r.end {
+			return holes
+		}
+		r.offset += sorted[i].end - r.start
+		r.start = sorted[i].end
+	}
+	return append(holes, r)
+}
+
+// Helper to get a shared memory object of a pagemap-shmem image,
+// which stores shared anonymous memory, memfd files and SysV segments
+func (mr *MemoryReader) anonShm(shmid uint64) (*sharedMem, error) {
+	reader, err := mr.checkpoint.ShmemReader(shmid, mr.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedMem{reader: reader}, nil
+}
+
+// Helper to get the shared memory object of a memfd file
+func (mr *MemoryReader) memfdShm(fileID uint32) (*sharedMem, error) {
+	inode, err := mr.checkpoint.memfdInode(fileID)
+	if err != nil {
+		return nil, err
+	}
+	return mr.anonShm(uint64(inode.GetShmid()))
+}
+
+// Helper to get the inode of a memfd file
+func (c *Checkpoint) memfdInode(fileID uint32) (*memfd.MemfdInodeEntry, error) {
+	file, err := c.file(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if file.GetType() != fdinfo.FdTypes_MEMFD || file.GetMemfd() == nil {
+		return nil, fmt.Errorf("file 0x%x is not a memfd file", fileID)
+	}
+
+	img, err := c.image("memfd-inode.img", &memfd.MemfdInodeEntry{})
+	if err != nil {
+		return nil, err
+	}
+	inodeID := file.GetMemfd().GetInodeId()
+	for _, entry := range img.Entries {
+		inode := entry.Message.(*memfd.MemfdInodeEntry)
+		if inode.GetInodeId() == uint64(inodeID) {
+			return inode, nil
+		}
+	}
+	return nil, fmt.Errorf("memfd inode 0x%x not found", inodeID)
+}
+
+// Helper to get a SysV shared memory segment
+// of the IPC namespace of the process
+func (mr *MemoryReader) sysvShm(shmid uint64) (*sharedMem, error) {
+	ids, err := mr.checkpoint.Ids(mr.pid)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("ipcns-shm-%d.img", ids.GetIpcNsId())
+	img, err := mr.checkpoint.image(name, &ipc_shm.IpcShmEntry{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range img.Entries {
+		shm := entry.Message.(*ipc_shm.IpcShmEntry)
+		if uint64(shm.GetDesc().GetId()) != shmid {
+			continue
+		}
+		if shm.GetInPagemaps() {
+			return mr.anonShm(shmid)
+		}
+		data, err := base64.StdEncoding.DecodeString(entry.Extra)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedMem{data: data}, nil
+	}
+	return nil, fmt.Errorf("SysV shared memory segment %d not found in %s", shmid, name)
+}
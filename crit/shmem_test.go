@@ -0,0 +1,171 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/fdinfo"
+	ipc_desc "github.com/checkpoint-restore/go-criu/v7/crit/images/ipc-desc"
+	ipc_shm "github.com/checkpoint-restore/go-criu/v7/crit/images/ipc-shm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/memfd"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/mm"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/pagemap"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/vma"
+	"google.golang.org/protobuf/proto"
+)
+
+// Helper to write a shared memory object with a single page
+// of the given byte at offset, stored in the pages image pagesID
+func writeTestShmem(t *testing.T, dir string, shmid uint64, pagesID uint32, offset uint64, fill byte) {
+	t.Helper()
+	writeTestImg(t, dir, fmt.Sprintf("pagemap-shmem-%d.img", shmid), "PAGEMAP",
+		&pagemap.PagemapHead{PagesId: proto.Uint32(pagesID)},
+		testPagemapEntry(offset, 1, pagemapPresent),
+	)
+	pages := bytes.Repeat([]byte{fill}, 0x1000)
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("pages-%d.img", pagesID)), pages, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSharedVma(start, pgoff, shmid uint64, status uint32) *vma.VmaEntry {
+	return &vma.VmaEntry{
+		Start:  proto.Uint64(start),
+		End:    proto.Uint64(start + 0x1000),
+		Pgoff:  proto.Uint64(pgoff),
+		Shmid:  proto.Uint64(shmid),
+		Prot:   proto.Uint32(3),
+		Flags:  proto.Uint32(1),
+		Status: proto.Uint32(status | 1),
+		Fd:     proto.Int64(-1),
+	}
+}
+
+func TestMemoryReaderShared(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPages(t, dir, []byte("p"), testPagemapEntry(0x1000, 1, pagemapPresent))
+
+	mmEntry := &mm.MmEntry{Vmas: []*vma.VmaEntry{
+		testSharedVma(0x10000, 0, 7, vmaAnonShared),
+		testSharedVma(0x20000, 0x1000, 3, vmaMemfd|(1<<7)),
+		testSharedVma(0x30000, 0, 5, vmaSysVIPC|vmaAnonShared),
+	}}
+	fillRequired(mmEntry.ProtoReflect())
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	// Shared anonymous memory
+	writeTestShmem(t, dir, 7, 2, 0, 'a')
+
+	// A memfd file whose second page is mapped
+	file := &fdinfo.FileEntry{
+		Type:  fdinfo.FdTypes_MEMFD.Enum(),
+		Id:    proto.Uint32(3),
+		Memfd: &memfd.MemfdFileEntry{Id: proto.Uint32(3), InodeId: proto.Uint32(9)},
+	}
+	fillRequired(file.ProtoReflect())
+	writeTestImg(t, dir, "files.img", "FILES", file)
+	inode := &memfd.MemfdInodeEntry{InodeId: proto.Uint64(9), Shmid: proto.Uint32(8)}
+	fillRequired(inode.ProtoReflect())
+	writeTestImg(t, dir, "memfd-inode.img", "MEMFD_INODE", inode)
+	writeTestShmem(t, dir, 8, 3, 0x1000, 'm')
+
+	// A SysV segment stored in the payload of the IPC image
+	writeTestImg(t, dir, "ids-1.img", "IDS", &criu_core.TaskKobjIdsEntry{
+		VmId:      proto.Uint32(1),
+		FilesId:   proto.Uint32(1),
+		FsId:      proto.Uint32(1),
+		SighandId: proto.Uint32(1),
+		IpcNsId:   proto.Uint32(4),
+	})
+	desc := &ipc_desc.IpcDescEntry{Id: proto.Uint32(5)}
+	fillRequired(desc.ProtoReflect())
+	f, err := os.Create(filepath.Join(dir, "ipcns-shm-4.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = encodeImg(&CriuImage{Magic: "IPCNS_SHM", Entries: []*CriuEntry{{
+		Message: &ipc_shm.IpcShmEntry{Desc: desc, Size: proto.Uint64(0x1000)},
+		Extra:   base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 0x1000)),
+	}}}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr, err := NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	for addr, want := range map[int64]byte{0x1000: 'p', 0x10000: 'a', 0x20000: 'm', 0x30000: 's'} {
+		buf := make([]byte, 0x1000)
+		if _, err := mr.ReadAt(buf, addr); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, bytes.Repeat([]byte{want}, 0x1000)) {
+			t.Errorf("unexpected memory at 0x%x", addr)
+		}
+	}
+
+	ranges, err := mr.Ranges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 4 || ranges[0].Shared || !ranges[1].Shared {
+		t.Errorf("unexpected ranges %+v", ranges)
+	}
+}
+
+func TestMemoryReaderPrivateMemfd(t *testing.T) {
+	dir := t.TempDir()
+	// The first page of the private mapping was written
+	writeTestPages(t, dir, []byte("p"), testPagemapEntry(0x40000, 1, pagemapPresent))
+
+	mapping := testSharedVma(0x40000, 0, 3, vmaMemfd|vmaFilePrivate)
+	mapping.End = proto.Uint64(0x43000)
+	mmEntry := &mm.MmEntry{Vmas: []*vma.VmaEntry{mapping}}
+	fillRequired(mmEntry.ProtoReflect())
+	writeTestImg(t, dir, "mm-1.img", "MM", mmEntry)
+
+	file := &fdinfo.FileEntry{
+		Type:  fdinfo.FdTypes_MEMFD.Enum(),
+		Id:    proto.Uint32(3),
+		Memfd: &memfd.MemfdFileEntry{Id: proto.Uint32(3), InodeId: proto.Uint32(9)},
+	}
+	fillRequired(file.ProtoReflect())
+	writeTestImg(t, dir, "files.img", "FILES", file)
+	inode := &memfd.MemfdInodeEntry{InodeId: proto.Uint64(9), Shmid: proto.Uint32(8)}
+	fillRequired(inode.ProtoReflect())
+	writeTestImg(t, dir, "memfd-inode.img", "MEMFD_INODE", inode)
+	writeTestShmem(t, dir, 8, 3, 0x1000, 'm')
+
+	mr, err := NewMemoryReader(dir, 1, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	buf := make([]byte, 0x3000)
+	if _, err := mr.ReadAt(buf, 0x40000); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(bytes.Repeat([]byte("p"), 0x1000), bytes.Repeat([]byte("m"), 0x1000)...), make([]byte, 0x1000)...)
+	if !bytes.Equal(buf, want) {
+		t.Error("unexpected memory of the private memfd mapping")
+	}
+
+	ranges, err := mr.Ranges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].Shared || ranges[0].End != 0x41000 ||
+		!ranges[1].Shared || ranges[1].Start != 0x41000 || ranges[1].End != 0x43000 {
+		t.Errorf("unexpected ranges %+v", ranges)
+	}
+}
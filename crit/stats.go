@@ -2,8 +2,6 @@ package crit
 
 import (
 	"errors"
-	"os"
-	"path/filepath"
 
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/stats"
 )
@@ -14,20 +12,13 @@ const (
 )
 
 // Helper function to load stats file into Go struct
-func getStats(path string) (*stats.StatsEntry, error) {
-	statsFile, err := os.Open(path)
+func (c *Checkpoint) stats(name string) (*stats.StatsEntry, error) {
+	entry, err := c.entry(name, &stats.StatsEntry{})
 	if err != nil {
 		return nil, err
 	}
-	defer statsFile.Close()
 
-	c := New(statsFile, nil, "", false, false)
-	statsImg, err := c.Decode(&stats.StatsEntry{})
-	if err != nil {
-		return nil, err
-	}
-
-	stats, ok := statsImg.Entries[0].Message.(*stats.StatsEntry)
+	stats, ok := entry.(*stats.StatsEntry)
 	if !ok {
 		return nil, errors.New("failed to type assert stats image")
 	}
@@ -35,10 +26,9 @@ func getStats(path string) (*stats.StatsEntry, error) {
 	return stats, nil
 }
 
-// GetDumpStats returns the dump statistics of a checkpoint.
-// dir is the path to the directory with the checkpoint images.
-func GetDumpStats(dir string) (*stats.DumpStatsEntry, error) {
-	stats, err := getStats(filepath.Join(dir, StatsDump))
+// DumpStats returns the dump statistics of the checkpoint
+func (c *Checkpoint) DumpStats() (*stats.DumpStatsEntry, error) {
+	stats, err := c.stats(StatsDump)
 	if err != nil {
 		return nil, err
 	}
@@ -46,13 +36,24 @@ func GetDumpStats(dir string) (*stats.DumpStatsEntry, error) {
 	return stats.GetDump(), nil
 }
 
-// GetRestoreStats returns the restore statistics of a checkpoint.
-// dir is the path to the directory with the checkpoint images.
-func GetRestoreStats(dir string) (*stats.RestoreStatsEntry, error) {
-	stats, err := getStats(filepath.Join(dir, StatsRestore))
+// RestoreStats returns the restore statistics of the checkpoint
+func (c *Checkpoint) RestoreStats() (*stats.RestoreStatsEntry, error) {
+	stats, err := c.stats(StatsRestore)
 	if err != nil {
 		return nil, err
 	}
 
 	return stats.GetRestore(), nil
 }
+
+// GetDumpStats returns the dump statistics of a checkpoint.
+// dir is the path to the directory with the checkpoint images.
+func GetDumpStats(dir string) (*stats.DumpStatsEntry, error) {
+	return newCheckpoint(dir).DumpStats()
+}
+
+// GetRestoreStats returns the restore statistics of a checkpoint.
+// dir is the path to the directory with the checkpoint images.
+func GetRestoreStats(dir string) (*stats.RestoreStatsEntry, error) {
+	return newCheckpoint(dir).RestoreStats()
+}
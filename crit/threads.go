@@ -0,0 +1,335 @@
+package crit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"syscall"
+
+	core_x86 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-x86"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// State of tasks which are running
+const taskAlive = 1
+
+// Registers provides the general purpose registers
+// of a thread for any architecture supported by CRIU
+type Registers interface {
+	// Arch returns the name of the architecture
+	Arch() string
+	// Names returns the names of the registers,
+	// in the order used by the checkpoint
+	Names() []string
+	// Register returns the value of the register with the given name
+	Register(name string) (uint64, bool)
+	// InstructionPointer returns the address of the next instruction
+	InstructionPointer() uint64
+	// StackPointer returns the address of the top of the stack
+	StackPointer() uint64
+	// FramePointer returns the value of the register
+	// used as frame pointer by the ABI of the architecture
+	FramePointer() uint64
+}
+
+// archRegs describes the registers of an architecture,
+// where lists maps the names of repeated fields to the
+// format of the names of their registers
+type archRegs struct {
+	arch       string
+	ip, sp, fp string
+	lists      map[string]string
+}
+
+var archRegisters = map[criu_core.CoreEntryMarch]archRegs{
+	criu_core.CoreEntry_X86_64:  {arch: "x86_64", ip: "ip", sp: "sp", fp: "bp"},
+	criu_core.CoreEntry_ARM:     {arch: "arm", ip: "pc", sp: "sp", fp: "fp"},
+	criu_core.CoreEntry_AARCH64: {arch: "aarch64", ip: "pc", sp: "sp", fp: "x29", lists: map[string]string{"regs": "x%d"}},
+	criu_core.CoreEntry_PPC64:   {arch: "ppc64", ip: "nip", sp: "r1", fp: "r1", lists: map[string]string{"gpr": "r%d"}},
+	criu_core.CoreEntry_S390: {arch: "s390x", ip: "psw_addr", sp: "r15", fp: "r11",
+		lists: map[string]string{"gprs": "r%d", "acrs": "a%d"}},
+	criu_core.CoreEntry_MIPS: {arch: "mips64", ip: "cp0_epc", sp: "r29", fp: "r30"},
+}
+
+// registerSet implements Registers for all architectures
+type registerSet struct {
+	arch       string
+	names      []string
+	values     map[string]uint64
+	ip, sp, fp uint64
+}
+
+// ThreadRegisters returns the general purpose registers
+// of the thread whose state is stored in core
+func ThreadRegisters(core *criu_core.CoreEntry) (Registers, error) {
+	desc, ok := archRegisters[core.GetMtype()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported architecture %s", core.GetMtype())
+	}
+	gpregs := threadRegs(core)
+	if gpregs == nil {
+		return nil, errors.New("no registers in the checkpoint")
+	}
+
+	regs := &registerSet{arch: desc.arch, values: make(map[string]uint64)}
+	if core.GetThreadInfo().GetGpregs().GetMode() == core_x86.UserX86RegsMode_COMPAT {
+		regs.arch = "i386"
+	}
+	fields := gpregs.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if !gpregs.Has(field) || field.Kind() == protoreflect.EnumKind {
+			continue
+		}
+		name := string(field.Name())
+		if !field.IsList() {
+			regs.add(name, gpregs.Get(field).Uint())
+			continue
+		}
+		list := gpregs.Get(field).List()
+		for j := 0; j < list.Len(); j++ {
+			regs.add(fmt.Sprintf(desc.lists[name], j), list.Get(j).Uint())
+		}
+	}
+
+	for name, value := range map[string]*uint64{desc.ip: &regs.ip, desc.sp: &regs.sp, desc.fp: &regs.fp} {
+		if *value, ok = regs.values[name]; !ok {
+			return nil, fmt.Errorf("register %s not found in the checkpoint", name)
+		}
+	}
+	return regs, nil
+}
+
+// Helper to add a register to the set
+func (r *registerSet) add(name string, value uint64) {
+	r.names = append(r.names, name)
+	r.values[name] = value
+}
+
+func (r *registerSet) Arch() string {
+	return r.arch
+}
+
+func (r *registerSet) Names() []string {
+	return r.names
+}
+
+func (r *registerSet) Register(name string) (uint64, bool) {
+	value, ok := r.values[name]
+	return value, ok
+}
+
+func (r *registerSet) InstructionPointer() uint64 {
+	return r.ip
+}
+
+func (r *registerSet) StackPointer() uint64 {
+	return r.sp
+}
+
+func (r *registerSet) FramePointer() uint64 {
+	return r.fp
+}
+
+// MarshalJSON encodes the registers as an object
+// of hexadecimal values in the order of the checkpoint
+func (r *registerSet) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, name := range r.names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, `%s:"0x%x"`, key, r.values[name])
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Thread represents the state of a single thread
+type Thread struct {
+	PID            uint32               `json:"pid"`
+	TID            uint32               `json:"tid"`
+	Comm           string               `json:"comm"`
+	State          string               `json:"state"`
+	SigBlk         string               `json:"sigblk"`
+	BlockedSignals []string             `json:"blocked_signals,omitempty"`
+	RobustList     *RobustList          `json:"robust_list,omitempty"`
+	SchedPolicy    string               `json:"sched_policy"`
+	SchedNice      int32                `json:"sched_nice"`
+	SchedPrio      uint32               `json:"sched_prio,omitempty"`
+	Rseq           *Rseq                `json:"rseq,omitempty"`
+	Arch           string               `json:"arch,omitempty"`
+	IP             string               `json:"ip,omitempty"`
+	SP             string               `json:"sp,omitempty"`
+	Registers      Registers            `json:"registers,omitempty"`
+	Core           *criu_core.CoreEntry `json:"-"`
+}
+
+// RobustList represents the robust futex list of a thread
+type RobustList struct {
+	Head string `json:"head"`
+	Len  uint32 `json:"len"`
+}
+
+// Rseq represents the restartable sequences area of a thread
+type Rseq struct {
+	ABIPointer string `json:"abi_pointer"`
+	ABISize    uint32 `json:"abi_size"`
+	Signature  string `json:"signature"`
+	CSPointer  string `json:"cs_pointer,omitempty"`
+}
+
+// ExploreThreads returns the state and the registers of all threads
+// of the process tree. Registers are not available for dead tasks.
+func (c *Checkpoint) ExploreThreads() ([]*Thread, error) {
+	psTree, err := c.Pstree()
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make([]*Thread, 0)
+	for _, process := range psTree {
+		pID := process.GetPid()
+		core, err := c.Core(pID)
+		if err != nil {
+			return nil, err
+		}
+		state := core.GetTc().GetTaskState()
+
+		tIDs := []uint32{pID}
+		for _, tID := range process.GetThreads() {
+			if tID != pID {
+				tIDs = append(tIDs, tID)
+			}
+		}
+		for _, tID := range tIDs {
+			threadCore := core
+			if tID != pID {
+				if threadCore, err = c.Core(tID); err != nil {
+					return nil, err
+				}
+			}
+			thread := exploreThread(pID, tID, core, threadCore)
+			if state != taskDead && state != taskHelper {
+				regs, err := ThreadRegisters(threadCore)
+				if err != nil {
+					return nil, fmt.Errorf("thread %d: %w", tID, err)
+				}
+				thread.Arch = regs.Arch()
+				thread.IP = fmt.Sprintf("0x%x", regs.InstructionPointer())
+				thread.SP = fmt.Sprintf("0x%x", regs.StackPointer())
+				thread.Registers = regs
+			}
+			threads = append(threads, thread)
+		}
+	}
+	return threads, nil
+}
+
+// Helper to get the state of a thread, where core
+// is the state of the main thread of the process
+func exploreThread(pID, tID uint32, core, threadCore *criu_core.CoreEntry) *Thread {
+	tc := threadCore.GetThreadCore()
+	thread := &Thread{
+		PID:         pID,
+		TID:         tID,
+		Comm:        tc.GetComm(),
+		State:       taskState(core.GetTc().GetTaskState()),
+		SchedPolicy: schedPolicy(tc.GetSchedPolicy()),
+		SchedNice:   tc.GetSchedNice(),
+		SchedPrio:   tc.GetSchedPrio(),
+		Core:        threadCore,
+	}
+	if thread.Comm == "" {
+		thread.Comm = core.GetTc().GetComm()
+	}
+
+	// Older versions of CRIU only store the mask of the main thread
+	sigset, extended := tc.GetBlkSigset(), tc.GetBlkSigsetExtended()
+	if tc.BlkSigset == nil {
+		sigset, extended = core.GetTc().GetBlkSigset(), core.GetTc().GetBlkSigsetExtended()
+	}
+	thread.SigBlk = fmt.Sprintf("%016x", sigset)
+	if extended != 0 {
+		thread.SigBlk = fmt.Sprintf("%016x%016x", extended, sigset)
+	}
+	for i, set := range []uint64{sigset, extended} {
+		for bit := 0; bit < 64; bit++ {
+			if set&(1<<bit) != 0 {
+				thread.BlockedSignals = append(thread.BlockedSignals, signalName(64*i+bit+1))
+			}
+		}
+	}
+
+	if tc.GetFutexRla() != 0 {
+		thread.RobustList = &RobustList{
+			Head: fmt.Sprintf("0x%x", tc.GetFutexRla()),
+			Len:  tc.GetFutexRlaLen(),
+		}
+	}
+	if rseq := tc.GetRseqEntry(); rseq != nil && rseq.GetRseqAbiPointer() != 0 {
+		thread.Rseq = &Rseq{
+			ABIPointer: fmt.Sprintf("0x%x", rseq.GetRseqAbiPointer()),
+			ABISize:    rseq.GetRseqAbiSize(),
+			Signature:  fmt.Sprintf("0x%x", rseq.GetSignature()),
+		}
+		if rseq.GetRseqCsPointer() != 0 {
+			thread.Rseq.CSPointer = fmt.Sprintf("0x%x", rseq.GetRseqCsPointer())
+		}
+	}
+	return thread
+}
+
+// Helper to get the name of the state of a task
+func taskState(state uint32) string {
+	switch state {
+	case taskAlive:
+		return "alive"
+	case taskDead:
+		return "dead"
+	case taskStopped:
+		return "stopped"
+	case taskHelper:
+		return "helper"
+	}
+	return fmt.Sprintf("unknown (%d)", state)
+}
+
+// Helper to get the name of a scheduling policy
+func schedPolicy(policy uint32) string {
+	switch policy &^ unix.SCHED_RESET_ON_FORK {
+	case unix.SCHED_NORMAL:
+		return "SCHED_OTHER"
+	case unix.SCHED_FIFO:
+		return "SCHED_FIFO"
+	case unix.SCHED_RR:
+		return "SCHED_RR"
+	case unix.SCHED_BATCH:
+		return "SCHED_BATCH"
+	case unix.SCHED_IDLE:
+		return "SCHED_IDLE"
+	case unix.SCHED_DEADLINE:
+		return "SCHED_DEADLINE"
+	}
+	return fmt.Sprintf("unknown (%d)", policy)
+}
+
+// Helper to get the name of a signal, where real-time
+// signals are numbered from SIGRTMIN of the kernel
+func signalName(sig int) string {
+	if name := unix.SignalName(syscall.Signal(sig)); name != "" {
+		return name
+	}
+	if sig >= 32 {
+		return fmt.Sprintf("SIGRT%d", sig-32)
+	}
+	return fmt.Sprintf("SIG%d", sig)
+}
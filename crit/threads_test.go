@@ -0,0 +1,96 @@
+package crit
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	core_aarch64 "github.com/checkpoint-restore/go-criu/v7/crit/images/core-aarch64"
+	criu_core "github.com/checkpoint-restore/go-criu/v7/crit/images/criu-core"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/rseq"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExploreThreads(t *testing.T) {
+	dir := t.TempDir()
+	writeTestProcess(t, dir)
+	core := testCore(0x402000, 0, 1000)
+	core.Tc = nil
+	core.ThreadCore.Comm = proto.String("worker")
+	core.ThreadCore.BlkSigset = proto.Uint64(1<<1 | 1<<33)
+	core.ThreadCore.FutexRla = proto.Uint64(0x7f00)
+	core.ThreadCore.FutexRlaLen = proto.Uint32(24)
+	core.ThreadCore.SchedPolicy = proto.Uint32(2)
+	core.ThreadCore.SchedPrio = proto.Uint32(10)
+	core.ThreadCore.RseqEntry = &rseq.RseqEntry{
+		RseqAbiPointer: proto.Uint64(0x7e00),
+		RseqAbiSize:    proto.Uint32(32),
+		Signature:      proto.Uint32(0x53053053),
+	}
+	writeTestImg(t, dir, "core-3.img", "CORE", core)
+
+	threads, err := newCheckpoint(dir).ExploreThreads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 2 || threads[0].TID != 1 || threads[1].TID != 3 {
+		t.Fatalf("unexpected threads %+v", threads)
+	}
+	thread := threads[1]
+	if thread.PID != 1 || thread.Comm != "worker" || thread.SchedPolicy != "SCHED_RR" || thread.SchedPrio != 10 ||
+		thread.SigBlk != "0000000200000002" || strings.Join(thread.BlockedSignals, ",") != "SIGINT,SIGRT2" {
+		t.Errorf("unexpected thread %+v", thread)
+	}
+	if thread.RobustList == nil || thread.RobustList.Head != "0x7f00" || thread.Rseq == nil || thread.Rseq.Signature != "0x53053053" {
+		t.Errorf("unexpected robust list %+v or rseq %+v", thread.RobustList, thread.Rseq)
+	}
+	if thread.Arch != "x86_64" || thread.IP != "0x402000" || thread.Registers.InstructionPointer() != 0x402000 {
+		t.Errorf("unexpected registers of thread %+v", thread)
+	}
+	if threads[0].Comm != "test" || threads[0].SchedPolicy != "SCHED_OTHER" {
+		t.Errorf("unexpected main thread %+v", threads[0])
+	}
+
+	data, err := json.Marshal(thread.Registers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), `{"r15":"0x0","r14":"0x0",`) || !strings.Contains(string(data), `"ip":"0x402000"`) {
+		t.Errorf("unexpected JSON %s", data)
+	}
+}
+
+func TestThreadRegisters(t *testing.T) {
+	core := &criu_core.CoreEntry{
+		Mtype: criu_core.CoreEntry_AARCH64.Enum(),
+		TiAarch64: &core_aarch64.ThreadInfoAarch64{
+			Gpregs: &core_aarch64.UserAarch64RegsEntry{
+				Regs: make([]uint64, 31),
+				Sp:   proto.Uint64(0x7ff0),
+				Pc:   proto.Uint64(0x401000),
+			},
+		},
+	}
+	core.TiAarch64.Gpregs.Regs[29] = 0x7ff8
+	fillRequired(core.ProtoReflect())
+
+	regs, err := ThreadRegisters(core)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := regs.Names()
+	if regs.Arch() != "aarch64" || len(names) != 34 || names[30] != "x30" || names[31] != "sp" {
+		t.Errorf("unexpected registers %s %v", regs.Arch(), names)
+	}
+	if regs.InstructionPointer() != 0x401000 || regs.StackPointer() != 0x7ff0 || regs.FramePointer() != 0x7ff8 {
+		t.Errorf("unexpected registers %x %x %x", regs.InstructionPointer(), regs.StackPointer(), regs.FramePointer())
+	}
+	if x29, ok := regs.Register("x29"); !ok || x29 != 0x7ff8 {
+		t.Errorf("unexpected value of x29: %x", x29)
+	}
+
+	core.Mtype = criu_core.CoreEntry_UNKNOWN.Enum()
+	if _, err := ThreadRegisters(core); err == nil {
+		t.Error("expected error for unknown architecture")
+	}
+}
@@ -2,11 +2,13 @@ package crit
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"syscall"
 
@@ -14,22 +16,27 @@ import (
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/pipe"
 	"github.com/checkpoint-restore/go-criu/v7/crit/images/regfile"
 	sk_unix "github.com/checkpoint-restore/go-criu/v7/crit/images/sk-unix"
+	"github.com/checkpoint-restore/go-criu/v7/crit/images/tty"
 	"github.com/checkpoint-restore/go-criu/v7/magic"
 	"google.golang.org/protobuf/proto"
 )
 
 // Helper to decode magic name from hex value
 func ReadMagic(f *os.File) (string, error) {
+	return readMagic(f)
+}
+
+func readMagic(r io.Reader) (string, error) {
 	magicMap := magic.LoadMagic()
 	// Read magic
 	magicBuf := make([]byte, 4)
-	if _, err := f.Read(magicBuf); err != nil {
+	if _, err := io.ReadFull(r, magicBuf); err != nil {
 		return "", err
 	}
 	magicValue := uint64(binary.LittleEndian.Uint32(magicBuf))
 	if magicValue == magicMap.ByName["IMG_COMMON"] ||
 		magicValue == magicMap.ByName["IMG_SERVICE"] {
-		if _, err := f.Read(magicBuf); err != nil {
+		if _, err := io.ReadFull(r, magicBuf); err != nil {
 			return "", err
 		}
 		magicValue = uint64(binary.LittleEndian.Uint32(magicBuf))
@@ -67,22 +74,27 @@ func countImg(f *os.File) (*CriuImage, error) {
 	if img.Magic, err = ReadMagic(f); err != nil {
 		return nil, err
 	}
+	entryType, err := GetEntryType(img.Magic)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
 
+	// Decode the entries to skip their extra payloads
+	ir, err := NewImageReader(f, entryType, true)
+	if err != nil {
+		return nil, err
+	}
 	count := 0
-	sizeBuf := make([]byte, 4)
-	// Read payload size and increment counter until EOF
 	for {
-		if n, err := f.Read(sizeBuf); err != nil {
-			if n == 0 && err == io.EOF {
+		if _, err := ir.Next(); err != nil {
+			if errors.Is(err, io.EOF) {
 				break
 			}
 			return nil, err
 		}
-
-		payloadSize := int64(binary.LittleEndian.Uint32(sizeBuf))
-		if _, err = f.Seek(payloadSize, 1); err != nil {
-			return nil, err
-		}
 		count++
 	}
 	// Decrement counter by 1 for pagemap file,
@@ -104,52 +116,56 @@ func getImg(path string, entryType proto.Message) (*CriuImage, error) {
 	}
 	defer file.Close()
 
-	return decodeImg(file, entryType, false)
+	img, err := decodeImg(file, entryType, false, DefaultDecodeLimits)
+	return img, withImageName(err, path)
 }
 
-// Global variables to cache loaded images
-var (
-	filesImg, regImg, pipeImg, unixSkImg *CriuImage
-)
+// Helper to get the IDs of loaded files in ascending order
+func sortedFileIDs(files map[uint32]*fdinfo.FileEntry) []uint32 {
+	ids := make([]uint32, 0, len(files))
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
 
-// Helper to fetch a file if it exists in files.img
-func getFile(dir string, fID uint32) (*fdinfo.FileEntry, error) {
-	var err error
-	if filesImg == nil {
-		filesImg, err = getImg(filepath.Join(dir, "files.img"), &fdinfo.FileEntry{})
-		if err != nil {
-			return nil, err
+// Helper to load all entries of tty-info.img indexed by ID
+func (c *Checkpoint) ttyInfo() (map[uint32]*tty.TtyInfoEntry, error) {
+	ttyInfo := make(map[uint32]*tty.TtyInfoEntry)
+	ttyInfoImg, err := c.image("tty-info.img", &tty.TtyInfoEntry{})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ttyInfo, nil
 		}
+		return nil, err
 	}
 
-	var file *fdinfo.FileEntry
-	for _, entry := range filesImg.Entries {
-		file = entry.Message.(*fdinfo.FileEntry)
-		if file.GetId() == fID {
-			return file, nil
-		}
+	for _, entry := range ttyInfoImg.Entries {
+		info := entry.Message.(*tty.TtyInfoEntry)
+		ttyInfo[info.GetId()] = info
 	}
 
-	return nil, nil
+	return ttyInfo, nil
 }
 
 // Helper to get file path for exploring file descriptors
-func getFilePath(dir string, fID uint32, fType fdinfo.FdTypes) (string, error) {
+func (c *Checkpoint) filePath(fID uint32, fType fdinfo.FdTypes) (string, error) {
 	var filePath string
 	var err error
 	// Fetch the file, if it exists in file.img
-	file, err := getFile(dir, fID)
+	file, err := c.file(fID)
 	if err != nil {
 		return "", err
 	}
 
 	switch fType {
 	case fdinfo.FdTypes_REG:
-		filePath, err = getRegFilePath(dir, file, fID)
+		filePath, err = c.regFilePath(file, fID)
 	case fdinfo.FdTypes_PIPE:
-		filePath, err = getPipeFilePath(dir, file, fID)
+		filePath, err = c.pipeFilePath(file, fID)
 	case fdinfo.FdTypes_UNIXSK:
-		filePath, err = getUnixSkFilePath(dir, file, fID)
+		filePath, err = c.unixSkFilePath(file, fID)
 	default:
 		filePath = fmt.Sprintf("%s.%d", fType.String(), fID)
 	}
@@ -158,8 +174,7 @@ func getFilePath(dir string, fID uint32, fType fdinfo.FdTypes) (string, error) {
 }
 
 // Helper to get file path of regular files
-func getRegFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, error) {
-	var err error
+func (c *Checkpoint) regFilePath(file *fdinfo.FileEntry, fID uint32) (string, error) {
 	if file != nil {
 		if file.GetReg() != nil {
 			return file.GetReg().GetName(), nil
@@ -167,11 +182,9 @@ func getRegFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, err
 		return "unknown", nil
 	}
 
-	if regImg == nil {
-		regImg, err = getImg(filepath.Join(dir, "reg-files.img"), &regfile.RegFileEntry{})
-		if err != nil {
-			return "", err
-		}
+	regImg, err := c.image("reg-files.img", &regfile.RegFileEntry{})
+	if err != nil {
+		return "", err
 	}
 	for _, entry := range regImg.Entries {
 		regFile := entry.Message.(*regfile.RegFileEntry)
@@ -184,8 +197,7 @@ func getRegFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, err
 }
 
 // Helper to get file path of pipe files
-func getPipeFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, error) {
-	var err error
+func (c *Checkpoint) pipeFilePath(file *fdinfo.FileEntry, fID uint32) (string, error) {
 	if file != nil {
 		if file.GetPipe() != nil {
 			return fmt.Sprintf("pipe[%d]", file.GetPipe().GetPipeId()), nil
@@ -193,11 +205,9 @@ func getPipeFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, er
 		return "pipe[?]", nil
 	}
 
-	if pipeImg == nil {
-		pipeImg, err = getImg(filepath.Join(dir, "pipes.img"), &pipe.PipeEntry{})
-		if err != nil {
-			return "", err
-		}
+	pipeImg, err := c.image("pipes.img", &pipe.PipeEntry{})
+	if err != nil {
+		return "", err
 	}
 	for _, entry := range pipeImg.Entries {
 		pipeFile := entry.Message.(*pipe.PipeEntry)
@@ -210,8 +220,7 @@ func getPipeFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, er
 }
 
 // Helper to get file path of UNIX socket files
-func getUnixSkFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string, error) {
-	var err error
+func (c *Checkpoint) unixSkFilePath(file *fdinfo.FileEntry, fID uint32) (string, error) {
 	if file != nil {
 		if file.GetUsk() != nil {
 			return fmt.Sprintf(
@@ -224,11 +233,9 @@ func getUnixSkFilePath(dir string, file *fdinfo.FileEntry, fID uint32) (string,
 		return "unix[?]", nil
 	}
 
-	if unixSkImg == nil {
-		unixSkImg, err = getImg(filepath.Join(dir, "unixsk.img"), &sk_unix.UnixSkEntry{})
-		if err != nil {
-			return "", err
-		}
+	unixSkImg, err := c.image("unixsk.img", &sk_unix.UnixSkEntry{})
+	if err != nil {
+		return "", err
 	}
 	for _, entry := range unixSkImg.Entries {
 		unixSkFile := entry.Message.(*sk_unix.UnixSkEntry)
@@ -270,8 +277,8 @@ func processIP(parts []uint32) string {
 	// IPv6
 	if len(parts) == 4 {
 		ip := make(net.IP, net.IPv6len)
-		for _, part := range parts {
-			binary.LittleEndian.PutUint32(ip, part)
+		for i, part := range parts {
+			binary.LittleEndian.PutUint32(ip[4*i:], part)
 		}
 		return ip.String()
 	}
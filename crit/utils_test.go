@@ -1,7 +1,11 @@
 package crit
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+
+	"google.golang.org/protobuf/proto"
 )
 
 func TestFindPs(t *testing.T) {
@@ -71,7 +75,9 @@ func TestProcessIP(t *testing.T) {
 		{[]uint32{0}, "0.0.0.0"},
 		{[]uint32{16777343}, "127.0.0.1"},
 		{[]uint32{0, 0, 0, 0}, "::"},
-		{[]uint32{0, 0, 4294901760, 16777343}, "7f00:1::"},
+		{[]uint32{0, 0, 0, 16777216}, "::1"},
+		{[]uint32{0, 0, 4294901760, 16777343}, "127.0.0.1"},
+		{[]uint32{288, 0, 0, 16777216}, "2001::1"},
 	}
 
 	for _, test := range tests {
@@ -81,3 +87,22 @@ func TestProcessIP(t *testing.T) {
 		}
 	}
 }
+
+// writeTestImg is a helper to create an image file with
+// the given magic and entries in a test checkpoint directory
+func writeTestImg(t *testing.T, dir, name, magic string, entries ...proto.Message) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img := &CriuImage{Magic: magic}
+	for _, entry := range entries {
+		img.Entries = append(img.Entries, &CriuEntry{Message: entry})
+	}
+	if err := encodeImg(img, f); err != nil {
+		t.Fatal(err)
+	}
+}
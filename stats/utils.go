@@ -3,31 +3,45 @@ package stats
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 
 	"google.golang.org/protobuf/proto"
 )
 
+// Helper to add the name of the statistics file and the
+// offset of the invalid data to err, like crit.DecodeError
+func statsError(fileName string, offset int, err error) error {
+	return fmt.Errorf("%s: offset %d: %w", fileName, offset, err)
+}
+
 func readStatisticsFile(imgDir *os.File, fileName string) (*StatsEntry, error) {
 	buf, err := os.ReadFile(filepath.Join(imgDir.Name(), fileName))
 	if err != nil {
 		return nil, err
 	}
 
+	if len(buf) < PayloadOffset {
+		return nil, statsError(fileName, len(buf), errors.New("statistics file too short"))
+	}
+
 	if binary.LittleEndian.Uint32(buf[PrimaryMagicOffset:SecondaryMagicOffset]) != ImgServiceMagic {
-		return nil, errors.New("primary magic not found")
+		return nil, statsError(fileName, PrimaryMagicOffset, errors.New("primary magic not found"))
 	}
 
 	if binary.LittleEndian.Uint32(buf[SecondaryMagicOffset:SizeOffset]) != StatsMagic {
-		return nil, errors.New("secondary magic not found")
+		return nil, statsError(fileName, SecondaryMagicOffset, errors.New("secondary magic not found"))
 	}
 
 	payloadSize := binary.LittleEndian.Uint32(buf[SizeOffset:PayloadOffset])
+	if uint64(payloadSize) > uint64(len(buf)-PayloadOffset) {
+		return nil, statsError(fileName, SizeOffset, fmt.Errorf("statistics file truncated: payload of %d bytes, %d bytes left", payloadSize, len(buf)-PayloadOffset))
+	}
 
 	st := &StatsEntry{}
 	if err := proto.Unmarshal(buf[PayloadOffset:PayloadOffset+payloadSize], st); err != nil {
-		return nil, err
+		return nil, statsError(fileName, PayloadOffset, err)
 	}
 
 	return st, nil
@@ -0,0 +1,68 @@
+package stats
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// writeStatsFile is a helper to write a statistics file
+// with the given payload, which is cut to size bytes
+func writeStatsFile(t *testing.T, dir string, payload []byte, size int) {
+	t.Helper()
+	buf := binary.LittleEndian.AppendUint32(nil, ImgServiceMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, StatsMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	if err := os.WriteFile(filepath.Join(dir, StatsDump), buf[:size], 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadStatisticsFile(t *testing.T) {
+	dir := t.TempDir()
+	imgDir, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imgDir.Close()
+
+	payload, err := proto.Marshal(&StatsEntry{Dump: &DumpStatsEntry{
+		FreezingTime:       proto.Uint32(1),
+		FrozenTime:         proto.Uint32(2),
+		MemdumpTime:        proto.Uint32(3),
+		MemwriteTime:       proto.Uint32(4),
+		PagesScanned:       proto.Uint64(5),
+		PagesSkippedParent: proto.Uint64(0),
+		PagesWritten:       proto.Uint64(6),
+		PagesLazy:          proto.Uint64(0),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeStatsFile(t, dir, payload, PayloadOffset+len(payload))
+	dump, err := CriuGetDumpStats(imgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.GetPagesWritten() != 6 {
+		t.Errorf("unexpected statistics %v", dump)
+	}
+
+	for _, test := range []struct {
+		size int
+		want string
+	}{
+		{PayloadOffset - 1, "stats-dump: offset 11: statistics file too short"},
+		{PayloadOffset + len(payload) - 1, "stats-dump: offset 8: statistics file truncated"},
+	} {
+		writeStatsFile(t, dir, payload, test.size)
+		if _, err := CriuGetDumpStats(imgDir); err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("unexpected error for %d bytes: %v", test.size, err)
+		}
+	}
+}